@@ -0,0 +1,189 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fault holds the scripted faults and call recording shared by the
+// fakes in kv/fake and storage/fake.
+package fault
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule is the part of a fault every fake understands.
+// Fakes embed it in their own fault type, next to options specific to them.
+type Rule struct {
+	// Method is the method the rule matches, or empty to match every method.
+	Method string
+	// Prefix only matches calls for keys starting with it.
+	Prefix string
+	// After lets the first After matching calls through.
+	After int
+	// Times stops the rule after it triggered Times times, if set.
+	Times int
+	// Latency delays triggered calls.
+	Latency time.Duration
+	// Err is the error triggered calls fail with, if set.
+	Err error
+
+	// matched is the number of calls the rule matched.
+	matched int
+	// triggered is the number of calls the rule failed or delayed.
+	triggered int
+}
+
+// Wait delays for the latency of the rule, or until ctx is cancelled.
+func (r *Rule) Wait(ctx context.Context) error {
+	if r.Latency <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(r.Latency)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// matches returns whether the rule matches a call to method for keys.
+// A call matches a prefix if any of its keys does.
+func (r *Rule) matches(method string, keys []string) bool {
+	if r.Method != "" && r.Method != method {
+		return false
+	}
+	if r.Prefix == "" {
+		return true
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, r.Prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type recorded[C any] struct {
+	method string
+	call   C
+}
+
+// Script holds the faults of a fake, of type F, and the calls it recorded, of type C.
+// Script is safe for concurrent use.
+type Script[F any, C any] struct {
+	rule func(F) *Rule
+
+	lock   sync.Mutex
+	faults []F
+	calls  []recorded[C]
+}
+
+// NewScript returns an empty script, rule returns the Rule embedded in a fault.
+func NewScript[F any, C any](rule func(F) *Rule) *Script[F, C] {
+	return &Script[F, C]{
+		rule: rule,
+	}
+}
+
+// Inject adds a fault.
+// If several faults match a call, the one injected first is used.
+func (s *Script[F, C]) Inject(fault F) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.faults = append(s.faults, fault)
+}
+
+// Triggered returns how many times the fault triggered.
+func (s *Script[F, C]) Triggered(fault F) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.rule(fault).triggered
+}
+
+// ClearFaults removes all faults, recorded calls are kept.
+func (s *Script[F, C]) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.faults = nil
+}
+
+// Match returns the fault that triggers for a call to method for keys, if any.
+func (s *Script[F, C]) Match(method string, keys ...string) (F, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, fault := range s.faults {
+		rule := s.rule(fault)
+		if !rule.matches(method, keys) {
+			continue
+		}
+		if rule.Times > 0 && rule.triggered >= rule.Times {
+			continue
+		}
+
+		rule.matched++
+		if rule.matched <= rule.After {
+			continue
+		}
+		rule.triggered++
+		return fault, true
+	}
+
+	var none F
+	return none, false
+}
+
+// Record records a call to method.
+func (s *Script[F, C]) Record(method string, call C) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calls = append(s.calls, recorded[C]{method: method, call: call})
+}
+
+// Calls returns the recorded calls, in the order they were recorded.
+func (s *Script[F, C]) Calls() []C {
+	return s.CallsTo("")
+}
+
+// CallsTo returns the recorded calls to method, or all calls if method is empty.
+func (s *Script[F, C]) CallsTo(method string) []C {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var calls []C
+	for _, r := range s.calls {
+		if method == "" || r.method == method {
+			calls = append(calls, r.call)
+		}
+	}
+
+	return calls
+}
+
+// ResetCalls forgets the recorded calls.
+func (s *Script[F, C]) ResetCalls() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calls = nil
+}
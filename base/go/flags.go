@@ -42,6 +42,15 @@ const (
 	EnvVarStorageRegion                EnvVar = "STORAGE_REGION"
 	EnvVarStorageSecure                EnvVar = "STORAGE_SECURE"
 	EnvVarStoragePathStyle             EnvVar = "STORAGE_PATH_STYLE"
+	EnvVarStorageSigningURL            EnvVar = "STORAGE_SIGNING_URL"
+	EnvVarStorageSigningKey            EnvVar = "STORAGE_SIGNING_KEY"
+	EnvVarStorageCacheDir              EnvVar = "STORAGE_CACHE_DIR"
+	EnvVarStorageCacheSizeMB           EnvVar = "STORAGE_CACHE_SIZE_MB"
+	EnvVarStorageMirrorConnStrings     EnvVar = "STORAGE_MIRROR_CONNECTION_STRINGS"
+	EnvVarStorageMirrorConsistency     EnvVar = "STORAGE_MIRROR_CONSISTENCY"
+	EnvVarStorageBackends              EnvVar = "STORAGE_BACKENDS"
+	EnvVarKVConnectionString           EnvVar = "KV_CONNECTION_STRING"
+	EnvVarKVPageTokenKey               EnvVar = "KV_PAGE_TOKEN_KEY"
 )
 
 func WithDatabaseFlags(appName string) []cli.Flag {
@@ -229,6 +238,60 @@ func WithStorageFlags() []cli.Flag {
 			EnvVars: []string{string(EnvVarStoragePathStyle)},
 			Value:   false,
 		},
+		&cli.StringFlag{
+			Name:    "storage-signing-url",
+			Usage:   "base URL of the storage handler, used to sign URLs for file and memory storage",
+			EnvVars: []string{string(EnvVarStorageSigningURL)},
+		},
+		&cli.StringFlag{
+			Name:    "storage-signing-key",
+			Usage:   "key used to sign URLs for file and memory storage",
+			EnvVars: []string{string(EnvVarStorageSigningKey)},
+		},
+		&cli.StringFlag{
+			Name:    "storage-cache-dir",
+			Usage:   "directory to cache downloaded objects in, caching is disabled if empty",
+			EnvVars: []string{string(EnvVarStorageCacheDir)},
+		},
+		&cli.Int64Flag{
+			Name:    "storage-cache-size-mb",
+			Usage:   "maximum size of the storage cache in megabytes",
+			EnvVars: []string{string(EnvVarStorageCacheSizeMB)},
+			Value:   10240,
+		},
+		&cli.StringSliceFlag{
+			Name:    "storage-mirror-connection-strings",
+			Usage:   "storage connection strings to mirror writes to",
+			EnvVars: []string{string(EnvVarStorageMirrorConnStrings)},
+		},
+		&cli.StringFlag{
+			Name:    "storage-mirror-consistency",
+			Usage:   "when mirrored writes return (all or primary)",
+			EnvVars: []string{string(EnvVarStorageMirrorConsistency)},
+			Value:   "all",
+		},
+		&cli.StringSliceFlag{
+			Name:    "storage-backends",
+			Usage:   "additional named storage backends (name=connection-string)",
+			EnvVars: []string{string(EnvVarStorageBackends)},
+		},
+	}
+}
+
+// WithKVFlags adds the kv flags to the app.
+// The connection string selects the backend, see kv_detector.New for the supported schemes.
+func WithKVFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "kv-connection-string",
+			Usage:   "kv connection string (dynamodb://, bolt://, postgres:// or memory://), bolt files shared by several processes need bolt://path?shared=true",
+			EnvVars: []string{string(EnvVarKVConnectionString)},
+		},
+		&cli.StringFlag{
+			Name:    "kv-page-token-key",
+			Usage:   "key used to sign kv page tokens, must be the same on every replica",
+			EnvVars: []string{string(EnvVarKVPageTokenKey)},
+		},
 	}
 }
 
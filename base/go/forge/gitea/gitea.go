@@ -0,0 +1,239 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitea_forge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	transport_http "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"go.resf.org/peridot/base/go/forge"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Forge is a Gitea (or Forgejo) forge.
+// The namespace can be an organization or a user.
+type Forge struct {
+	host                 string
+	namespace            string
+	token                string
+	authorName           string
+	authorEmail          string
+	shouldMakeRepoPublic bool
+}
+
+type user struct {
+	Login    string `json:"login"`
+	FullName string `json:"full_name"`
+	Email    string `json:"email"`
+}
+
+// New returns a Gitea forge authenticating with an access token.
+// If authorName or authorEmail is empty, the name or email of the token owner is used.
+func New(host string, namespace string, token string, authorName string, authorEmail string, shouldMakeRepoPublic bool) *Forge {
+	return &Forge{
+		host:                 host,
+		namespace:            namespace,
+		token:                token,
+		authorName:           authorName,
+		authorEmail:          authorEmail,
+		shouldMakeRepoPublic: shouldMakeRepoPublic,
+	}
+}
+
+// do sends a request to the Gitea API, with body encoded as JSON if it isn't nil.
+func (f *Forge) do(method string, path string, token string, body any) (*http.Response, error) {
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("https://%s/api/v1/%s", f.host, path), reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "token "+token)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	return client.Do(req)
+}
+
+// getUser returns the owner of the token.
+func (f *Forge) getUser(token string) (*user, error) {
+	resp, err := f.do("GET", "user", token, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to get user: got status code %d", resp.StatusCode)
+	}
+
+	var u user
+	err = json.NewDecoder(resp.Body).Decode(&u)
+	if err != nil {
+		return nil, err
+	}
+	if u.Login == "" {
+		return nil, fmt.Errorf("login not found in response")
+	}
+
+	return &u, nil
+}
+
+func (f *Forge) GetAuthenticator() (*forge.Authenticator, error) {
+	// Also verifies that the token is valid
+	u, err := f.getUser(f.token)
+	if err != nil {
+		return nil, err
+	}
+
+	authorName := f.authorName
+	if authorName == "" {
+		authorName = u.FullName
+	}
+	if authorName == "" {
+		authorName = u.Login
+	}
+	authorEmail := f.authorEmail
+	if authorEmail == "" {
+		authorEmail = u.Email
+	}
+
+	// Gitea accepts access tokens as the password over HTTP
+	transporter := &transport_http.BasicAuth{
+		Username: u.Login,
+		Password: f.token,
+	}
+
+	// We're assuming never expiring tokens for now
+	// Set it to 100 years from now
+	expires := time.Now().AddDate(100, 0, 0)
+
+	return &forge.Authenticator{
+		AuthMethod:  transporter,
+		AuthorName:  authorName,
+		AuthorEmail: authorEmail,
+		Expires:     expires,
+	}, nil
+}
+
+func (f *Forge) GetRemote(repo string) string {
+	return fmt.Sprintf("https://%s/%s/%s", f.host, f.namespace, repo)
+}
+
+func (f *Forge) GetCommitViewerURL(repo string, commit string) string {
+	return fmt.Sprintf(
+		"https://%s/%s/%s/commit/%s",
+		f.host,
+		f.namespace,
+		repo,
+		commit,
+	)
+}
+
+func (f *Forge) EnsureRepositoryExists(auth *forge.Authenticator, repo string) error {
+	// Cast AuthMethod to BasicAuth
+	basicAuth := auth.AuthMethod.(*transport_http.BasicAuth)
+	token := basicAuth.Password
+
+	// First let's check if the repo exists
+	resp, err := f.do("GET", fmt.Sprintf("repos/%s/%s", url.PathEscape(f.namespace), url.PathEscape(repo)), token, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		// Repo exists, we're done
+		return nil
+	}
+	if resp.StatusCode != 404 {
+		return fmt.Errorf("failed to get repo %s: got status code %d", repo, resp.StatusCode)
+	}
+
+	// Repos are created differently in organizations and user namespaces
+	endpoint, err := f.createEndpoint(token, basicAuth.Username)
+	if err != nil {
+		return err
+	}
+
+	mapBody := map[string]any{
+		"name":    repo,
+		"private": !f.shouldMakeRepoPublic,
+	}
+	resp, err = f.do("POST", endpoint, token, mapBody)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Conflict means the repo was created in the meantime
+	if resp.StatusCode != 201 && resp.StatusCode != 409 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to create repo %s: %s", repo, string(body))
+	}
+
+	return nil
+}
+
+// createEndpoint returns the API path to create a repo in the namespace.
+func (f *Forge) createEndpoint(token string, login string) (string, error) {
+	namespace := url.PathEscape(f.namespace)
+
+	resp, err := f.do("GET", "orgs/"+namespace, token, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return fmt.Sprintf("orgs/%s/repos", namespace), nil
+	case 404:
+		// Not an organization, so it's a user
+	default:
+		return "", fmt.Errorf("failed to get organization %s: got status code %d", f.namespace, resp.StatusCode)
+	}
+
+	// Usernames are case-insensitive
+	if strings.EqualFold(login, f.namespace) {
+		return "user/repos", nil
+	}
+
+	// Creating repos for other users requires an admin token
+	return fmt.Sprintf("admin/users/%s/repos", namespace), nil
+}
+
+func (f *Forge) WithNamespace(namespace string) forge.Forge {
+	newF := *f
+	newF.namespace = namespace
+	return &newF
+}
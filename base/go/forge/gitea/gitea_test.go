@@ -0,0 +1,264 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitea_forge
+
+import (
+	"encoding/json"
+	transport_http "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func registerUser(login string) {
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/user",
+		func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Authorization") != "token test_token" {
+				return httpmock.NewJsonResponse(401, map[string]interface{}{
+					"message": "token is required",
+				})
+			}
+			return httpmock.NewJsonResponse(200, map[string]interface{}{
+				"id":        1,
+				"login":     login,
+				"full_name": "Test Bot",
+				"email":     login + "@noreply.git.example.com",
+			})
+		})
+}
+
+func TestNew(t *testing.T) {
+	forge := New("git.example.com", "test-org", "test_token", "", "", false)
+
+	require.Equal(t, "git.example.com", forge.host)
+	require.Equal(t, "test-org", forge.namespace)
+	require.Equal(t, "test_token", forge.token)
+	require.False(t, forge.shouldMakeRepoPublic)
+}
+
+func TestGetRemote(t *testing.T) {
+	forge := New("git.example.com", "test-org", "test_token", "", "", false)
+
+	remote := forge.GetRemote("test")
+	require.Equal(t, "https://git.example.com/test-org/test", remote)
+}
+
+func TestGetCommitViewerURL(t *testing.T) {
+	forge := New("git.example.com", "test-org", "test_token", "", "", false)
+
+	url := forge.GetCommitViewerURL("test", "123456")
+	require.Equal(t, "https://git.example.com/test-org/test/commit/123456", url)
+}
+
+func TestWithNamespace(t *testing.T) {
+	forge := New("git.example.com", "test-org", "test_token", "", "", false)
+
+	other := forge.WithNamespace("other-org")
+	require.Equal(t, "https://git.example.com/other-org/test", other.GetRemote("test"))
+	// The original forge is unchanged
+	require.Equal(t, "https://git.example.com/test-org/test", forge.GetRemote("test"))
+}
+
+func TestGetAuthenticator(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	forge := New("git.example.com", "test-org", "test_token", "", "", false)
+	registerUser("test-bot")
+
+	auth, err := forge.GetAuthenticator()
+	require.Nil(t, err)
+	require.Equal(t, "Test Bot", auth.AuthorName)
+	require.Equal(t, "test-bot@noreply.git.example.com", auth.AuthorEmail)
+	require.True(t, auth.Expires.After(time.Now().AddDate(1, 0, 0)))
+
+	// Cast AuthMethod to BasicAuth
+	basic := auth.AuthMethod.(*transport_http.BasicAuth)
+	require.Equal(t, "test-bot", basic.Username)
+	require.Equal(t, "test_token", basic.Password)
+}
+
+func TestGetAuthenticator_Author(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	forge := New("git.example.com", "test-org", "test_token", "Release Engineering", "releng@example.com", false)
+	registerUser("test-bot")
+
+	auth, err := forge.GetAuthenticator()
+	require.Nil(t, err)
+	require.Equal(t, "Release Engineering", auth.AuthorName)
+	require.Equal(t, "releng@example.com", auth.AuthorEmail)
+}
+
+func TestGetAuthenticatorError(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	forge := New("git.example.com", "test-org", "invalid_token", "", "", false)
+	registerUser("test-bot")
+
+	auth, err := forge.GetAuthenticator()
+	require.NotNil(t, err)
+	require.Nil(t, auth)
+	require.Equal(t, "failed to get user: got status code 401", err.Error())
+}
+
+func TestEnsureRepositoryExists_AlreadyExists(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	forge := New("git.example.com", "test-org", "test_token", "", "", false)
+	registerUser("test-bot")
+
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/repos/test-org/test",
+		httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+			"name": "test",
+		}))
+
+	auth, err := forge.GetAuthenticator()
+	require.Nil(t, err)
+
+	err = forge.EnsureRepositoryExists(auth, "test")
+	require.Nil(t, err)
+
+	info := httpmock.GetCallCountInfo()
+	require.Equal(t, 0, info["GET https://git.example.com/api/v1/orgs/test-org"])
+}
+
+func TestEnsureRepositoryExists_Organization(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	forge := New("git.example.com", "test-org", "test_token", "", "", true)
+	registerUser("test-bot")
+
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/repos/test-org/test",
+		httpmock.NewJsonResponderOrPanic(404, map[string]interface{}{
+			"message": "Not Found",
+		}))
+
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/orgs/test-org",
+		httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+			"username": "test-org",
+		}))
+
+	var body map[string]interface{}
+	httpmock.RegisterResponder("POST", "https://git.example.com/api/v1/orgs/test-org/repos",
+		func(req *http.Request) (*http.Response, error) {
+			require.Nil(t, json.NewDecoder(req.Body).Decode(&body))
+			return httpmock.NewJsonResponse(201, map[string]interface{}{
+				"name": "test",
+			})
+		})
+
+	auth, err := forge.GetAuthenticator()
+	require.Nil(t, err)
+
+	err = forge.EnsureRepositoryExists(auth, "test")
+	require.Nil(t, err)
+	require.Equal(t, "test", body["name"])
+	require.Equal(t, false, body["private"])
+
+	info := httpmock.GetCallCountInfo()
+	require.Equal(t, 1, info["POST https://git.example.com/api/v1/orgs/test-org/repos"])
+}
+
+func TestEnsureRepositoryExists_User(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	forge := New("git.example.com", "test-bot", "test_token", "", "", false)
+	registerUser("test-bot")
+
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/repos/test-bot/test",
+		httpmock.NewJsonResponderOrPanic(404, map[string]interface{}{
+			"message": "Not Found",
+		}))
+
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/orgs/test-bot",
+		httpmock.NewJsonResponderOrPanic(404, map[string]interface{}{
+			"message": "Not Found",
+		}))
+
+	httpmock.RegisterResponder("POST", "https://git.example.com/api/v1/user/repos",
+		httpmock.NewJsonResponderOrPanic(201, map[string]interface{}{
+			"name": "test",
+		}))
+
+	auth, err := forge.GetAuthenticator()
+	require.Nil(t, err)
+
+	err = forge.EnsureRepositoryExists(auth, "test")
+	require.Nil(t, err)
+
+	info := httpmock.GetCallCountInfo()
+	require.Equal(t, 1, info["POST https://git.example.com/api/v1/user/repos"])
+}
+
+func TestEnsureRepositoryExists_OtherUser(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	forge := New("git.example.com", "test-user", "test_token", "", "", false)
+	registerUser("test-bot")
+
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/repos/test-user/test",
+		httpmock.NewJsonResponderOrPanic(404, map[string]interface{}{
+			"message": "Not Found",
+		}))
+
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/orgs/test-user",
+		httpmock.NewJsonResponderOrPanic(404, map[string]interface{}{
+			"message": "Not Found",
+		}))
+
+	httpmock.RegisterResponder("POST", "https://git.example.com/api/v1/admin/users/test-user/repos",
+		httpmock.NewJsonResponderOrPanic(403, map[string]interface{}{
+			"message": "Must be an administrator",
+		}))
+
+	auth, err := forge.GetAuthenticator()
+	require.Nil(t, err)
+
+	err = forge.EnsureRepositoryExists(auth, "test")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Must be an administrator")
+}
+
+func TestEnsureRepositoryExists_Error(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	forge := New("git.example.com", "test-org", "test_token", "", "", false)
+	registerUser("test-bot")
+
+	httpmock.RegisterResponder("GET", "https://git.example.com/api/v1/repos/test-org/test",
+		httpmock.NewJsonResponderOrPanic(500, map[string]interface{}{
+			"message": "test error",
+		}))
+
+	auth, err := forge.GetAuthenticator()
+	require.Nil(t, err)
+
+	err = forge.EnsureRepositoryExists(auth, "test")
+	require.NotNil(t, err)
+	require.Equal(t, "failed to get repo test: got status code 500", err.Error())
+
+	info := httpmock.GetCallCountInfo()
+	require.Equal(t, 0, info["POST https://git.example.com/api/v1/orgs/test-org/repos"])
+}
@@ -49,6 +49,8 @@ type GRPCServer struct {
 	gatewayPort        int
 	noGrpcGateway      bool
 	noMetrics          bool
+	// httpHandlers are served next to the gRPC-gateway, by pattern.
+	httpHandlers map[string]http.Handler
 
 	// ServeMuxOptions
 	additionalHeaders map[string]bool
@@ -141,6 +143,17 @@ func WithNoMetrics() GRPCServerOption {
 	}
 }
 
+// WithHTTPHandler serves a plain HTTP handler on the gateway port, next to the gRPC-gateway.
+// Patterns are http.ServeMux patterns, for example "/_storage/".
+func WithHTTPHandler(pattern string, handler http.Handler) GRPCServerOption {
+	return func(opts *GRPCServer) {
+		if opts.httpHandlers == nil {
+			opts.httpHandlers = make(map[string]http.Handler)
+		}
+		opts.httpHandlers[pattern] = handler
+	}
+}
+
 // WithServeMuxAdditionalHeaders sets additional headers for the gRPC-gateway. (incoming)
 func WithServeMuxAdditionalHeaders(headers ...string) GRPCServerOption {
 	return func(opts *GRPCServer) {
@@ -190,6 +203,7 @@ func DefaultServeMuxOptions(s ...GRPCServer) []runtime.ServeMuxOption {
 
 			return s, false
 		}),
+		runtime.WithForwardResponseOption(redirectResponseOption),
 		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
 			MarshalOptions: protojson.MarshalOptions{
 				EmitUnpopulated: false,
@@ -316,8 +330,18 @@ func (g *GRPCServer) Start() error {
 		go func(wg *sync.WaitGroup) {
 			defer wg.Done()
 
+			var handler http.Handler = g.gatewayMux
+			if len(g.httpHandlers) > 0 {
+				mux := http.NewServeMux()
+				for pattern, h := range g.httpHandlers {
+					mux.Handle(pattern, h)
+				}
+				mux.Handle("/", g.gatewayMux)
+				handler = mux
+			}
+
 			LogInfof("gRPC-gateway listening on port " + strconv.Itoa(g.gatewayPort))
-			err := http.ListenAndServe(":"+strconv.Itoa(g.gatewayPort), g.gatewayMux)
+			err := http.ListenAndServe(":"+strconv.Itoa(g.gatewayPort), handler)
 			if err != nil {
 				LogFatalf("gRPC-gateway failed to serve: %v", err.Error())
 			}
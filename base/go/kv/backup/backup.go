@@ -0,0 +1,429 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backup exports kv data to a storage.Storage, and imports it back.
+//
+// A backup is a set of objects under a common name:
+//   - name/manifest.json describes the backup, and records progress so an interrupted export can be resumed
+//   - name/part-000000.jsonl (or .binpb) and onwards contain the pairs, in key order
+//
+// Backups don't depend on the backend, so they can also be used to copy data between backends.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/kv"
+	"go.resf.org/peridot/base/go/storage"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// defaultPartSize is the number of pairs in a part.
+	defaultPartSize = 10000
+	// pageSize is the page size used to list the pairs, the maximum every backend supports.
+	pageSize = 100
+)
+
+var (
+	ErrIncomplete = errors.New("backup is incomplete")
+	ErrMismatch   = errors.New("existing backup has a different prefix or format")
+)
+
+// Manifest describes a backup.
+type Manifest struct {
+	// Prefix is the prefix (or namespace) that was exported.
+	Prefix string  `json:"prefix"`
+	Format Format  `json:"format"`
+	Parts  []*Part `json:"parts"`
+	// NextToken continues the export after the last part.
+	NextToken string    `json:"next_token,omitempty"`
+	Complete  bool      `json:"complete"`
+	StartedAt time.Time `json:"started_at"`
+	// CompletedAt is only set once the export is complete.
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// Part is a single object of a backup.
+type Part struct {
+	Object string `json:"object"`
+	Pairs  int    `json:"pairs"`
+	// LastKey is the last key in the part.
+	LastKey string `json:"last_key"`
+}
+
+// Pairs returns the number of pairs in the backup.
+func (m *Manifest) Pairs() int {
+	var pairs int
+	for _, part := range m.Parts {
+		pairs += part.Pairs
+	}
+
+	return pairs
+}
+
+// ManifestObject returns the object the manifest of a backup is stored at.
+func ManifestObject(name string) string {
+	return path.Join(name, "manifest.json")
+}
+
+// ReadManifest reads the manifest of a backup.
+// Returns storage.ErrNotFound if the backup doesn't exist.
+func ReadManifest(st storage.Storage, name string) (*Manifest, error) {
+	data, err := st.Get(ManifestObject(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse manifest")
+	}
+
+	return &m, nil
+}
+
+func writeManifest(st storage.Storage, name string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = st.PutBytes(ManifestObject(name), data)
+	return err
+}
+
+type ExportOptions struct {
+	Format Format
+	// PartSize is the number of pairs after which a new part is started.
+	// Parts end at a page boundary, so they may contain a few more pairs.
+	PartSize int
+}
+
+type ExportOption func(*ExportOptions)
+
+// WithFormat sets the format of a new backup, defaults to FormatJSONL.
+func WithFormat(format Format) ExportOption {
+	return func(o *ExportOptions) {
+		o.Format = format
+	}
+}
+
+// WithPartSize sets the number of pairs in a part.
+// The manifest is updated after every part, so this is also how much work
+// is redone when resuming an interrupted export.
+func WithPartSize(partSize int) ExportOption {
+	return func(o *ExportOptions) {
+		o.PartSize = partSize
+	}
+}
+
+// Export writes every pair under prefix to the backup called name.
+// The prefix can be a namespace ("/kernels/") or any prefix within one.
+// If an incomplete backup with the same name exists, the export is resumed.
+// Exporting to a complete backup does nothing and returns its manifest.
+// Expired pairs are not exported, and pairs keep their expiry.
+func Export(ctx context.Context, store kv.KV, st storage.Storage, prefix string, name string, opts ...ExportOption) (*Manifest, error) {
+	o := &ExportOptions{
+		Format:   FormatJSONL,
+		PartSize: defaultPartSize,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	ext, err := o.Format.extension()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := ReadManifest(st, name)
+	if err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+	if m == nil {
+		m = &Manifest{
+			Prefix:    prefix,
+			Format:    o.Format,
+			StartedAt: time.Now(),
+		}
+	} else if m.Prefix != prefix || m.Format != o.Format {
+		return nil, ErrMismatch
+	}
+	if m.Complete {
+		return m, nil
+	}
+
+	// Pairs up to and including skipThrough have already been exported.
+	// Only used if the page token of an interrupted export can't be used anymore.
+	var skipThrough string
+	token := m.NextToken
+	if len(m.Parts) > 0 && token == "" {
+		skipThrough = m.Parts[len(m.Parts)-1].LastKey
+	}
+
+	for {
+		object := path.Join(name, fmt.Sprintf("part-%06d.%s", len(m.Parts), ext))
+		part, nextToken, err := exportPart(ctx, store, st, o, prefix, object, token, skipThrough)
+		if err == kv.ErrPageTokenNotFound && token != "" {
+			// Page tokens are signed with a per-process key unless one is configured,
+			// so fall back to listing from the start and skipping what has been exported.
+			base.LogInfof("page token of interrupted export rejected, skipping already exported pairs")
+			token = ""
+			skipThrough = m.Parts[len(m.Parts)-1].LastKey
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part != nil {
+			m.Parts = append(m.Parts, part)
+			skipThrough = ""
+		}
+		token = nextToken
+		m.NextToken = nextToken
+		if nextToken == "" {
+			now := time.Now()
+			m.Complete = true
+			m.CompletedAt = &now
+		}
+
+		err = writeManifest(st, name, m)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to write manifest")
+		}
+		if m.Complete {
+			return m, nil
+		}
+	}
+}
+
+// exportPart exports the next part of a backup, and returns the token to continue with.
+// Returns a nil part if there were no pairs left to export.
+func exportPart(ctx context.Context, store kv.KV, st storage.Storage, o *ExportOptions, prefix string, object string, token string, skipThrough string) (*Part, string, error) {
+	f, err := os.CreateTemp("", "kvbackup-*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	enc, err := newEncoder(o.Format, f)
+	if err != nil {
+		return nil, "", err
+	}
+
+	part := &Part{
+		Object: object,
+	}
+	for part.Pairs < o.PartSize {
+		err := ctx.Err()
+		if err != nil {
+			return nil, "", err
+		}
+
+		query, err := store.RangePrefix(ctx, prefix, pageSize, token)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, pair := range query.Pairs {
+			if skipThrough != "" && pair.Key <= skipThrough {
+				continue
+			}
+
+			err := enc.Encode(pair)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "failed to encode pair")
+			}
+			part.Pairs++
+			part.LastKey = pair.Key
+		}
+
+		token = query.NextToken
+		if token == "" {
+			break
+		}
+	}
+	if part.Pairs == 0 {
+		return nil, token, nil
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		return nil, "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = st.Put(object, f.Name())
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to upload %s", object)
+	}
+
+	return part, token, nil
+}
+
+// ImportMode decides what happens to keys that already exist.
+type ImportMode int
+
+const (
+	// ImportOverwrite overwrites existing keys with the value from the backup.
+	ImportOverwrite ImportMode = iota
+	// ImportSkipExisting leaves existing keys untouched.
+	ImportSkipExisting
+)
+
+type ImportOptions struct {
+	Mode ImportMode
+	// FromPart is the index of the first part to import.
+	FromPart int
+}
+
+type ImportOption func(*ImportOptions)
+
+// WithMode sets the import mode, defaults to ImportOverwrite.
+func WithMode(mode ImportMode) ImportOption {
+	return func(o *ImportOptions) {
+		o.Mode = mode
+	}
+}
+
+// WithFromPart skips the parts before the given index.
+// Importing is idempotent, so an interrupted import can simply be run again,
+// but this avoids rewriting the parts that were already imported.
+func WithFromPart(part int) ImportOption {
+	return func(o *ImportOptions) {
+		o.FromPart = part
+	}
+}
+
+// ImportStats is the result of an import.
+type ImportStats struct {
+	// Parts is the number of parts imported.
+	Parts   int
+	Written int
+	// Skipped is the number of existing keys left untouched.
+	Skipped int
+	// Expired is the number of pairs that expired since the backup was taken.
+	Expired int
+}
+
+// Import restores the backup called name into store.
+// Pairs keep their remaining TTL, pairs that have expired since the export are skipped.
+// Revisions are not restored, imported pairs get a new revision from the store.
+func Import(ctx context.Context, store kv.KV, st storage.Storage, name string, opts ...ImportOption) (*ImportStats, error) {
+	o := &ImportOptions{
+		Mode: ImportOverwrite,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	m, err := ReadManifest(st, name)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Complete {
+		return nil, ErrIncomplete
+	}
+
+	stats := &ImportStats{}
+	for i := o.FromPart; i < len(m.Parts); i++ {
+		err := importPart(ctx, store, st, m.Format, m.Parts[i].Object, o.Mode, stats)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to import part %d", i)
+		}
+
+		stats.Parts++
+		base.LogInfof("imported part %d of %d", i+1, len(m.Parts))
+	}
+
+	return stats, nil
+}
+
+func importPart(ctx context.Context, store kv.KV, st storage.Storage, format Format, object string, mode ImportMode, stats *ImportStats) error {
+	dir, err := os.MkdirTemp("", "kvbackup-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// Download replaces the file, so it is only opened afterwards.
+	partPath := filepath.Join(dir, "part")
+	err = st.Download(object, partPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to download %s", object)
+	}
+	f, err := os.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec, err := newDecoder(format, f)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		pair, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var setOpts []kv.SetOption
+		if !pair.ExpiresAt.IsZero() {
+			ttl := time.Until(pair.ExpiresAt)
+			if ttl <= 0 {
+				stats.Expired++
+				continue
+			}
+			setOpts = append(setOpts, kv.WithTTL(ttl))
+		}
+
+		switch mode {
+		case ImportSkipExisting:
+			_, err = store.Create(ctx, pair.Key, pair.Value, setOpts...)
+			if err == kv.ErrConflict {
+				stats.Skipped++
+				continue
+			}
+		default:
+			err = store.Set(ctx, pair.Key, pair.Value, setOpts...)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to write %s", pair.Key)
+		}
+		stats.Written++
+	}
+}
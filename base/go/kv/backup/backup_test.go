@@ -0,0 +1,165 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	kv_memory "go.resf.org/peridot/base/go/kv/memory"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"testing"
+	"time"
+)
+
+func newStore(t *testing.T, count int) kv.KV {
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+
+	for i := 0; i < count; i++ {
+		require.Nil(t, store.Set(context.Background(), fmt.Sprintf("/test/items/%03d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.Nil(t, store.Set(context.Background(), "/test/other", []byte("other")))
+	require.Nil(t, store.Set(context.Background(), "/test/items/ttl", []byte("ttl"), kv.WithTTL(time.Hour)))
+
+	return store
+}
+
+func requireSameItems(t *testing.T, expected kv.KV, actual kv.KV) {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("/test/items/%03d", i)
+		expectedPair, err := expected.Get(context.Background(), key)
+		if err == kv.ErrNotFound {
+			return
+		}
+		require.Nil(t, err)
+
+		actualPair, err := actual.Get(context.Background(), key)
+		require.Nil(t, err, key)
+		require.Equal(t, expectedPair.Value, actualPair.Value, key)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []Format{FormatJSONL, FormatProto} {
+		t.Run(string(format), func(t *testing.T) {
+			ctx := context.Background()
+			src := newStore(t, 250)
+			st := storage_memory.New(osfs.New("/"))
+
+			m, err := Export(ctx, src, st, "/test/items/", "backups/test", WithFormat(format), WithPartSize(100))
+			require.Nil(t, err)
+			require.True(t, m.Complete)
+			require.Equal(t, 251, m.Pairs())
+			require.Len(t, m.Parts, 3)
+			require.Equal(t, "backups/test/part-000000."+map[Format]string{FormatJSONL: "jsonl", FormatProto: "binpb"}[format], m.Parts[0].Object)
+
+			dst, err := kv_memory.New()
+			require.Nil(t, err)
+			stats, err := Import(ctx, dst, st, "backups/test")
+			require.Nil(t, err)
+			require.Equal(t, 3, stats.Parts)
+			require.Equal(t, 251, stats.Written)
+			requireSameItems(t, src, dst)
+
+			// The TTL is kept, and only the prefix is exported.
+			pair, err := dst.Get(ctx, "/test/items/ttl")
+			require.Nil(t, err)
+			require.WithinDuration(t, time.Now().Add(time.Hour), pair.ExpiresAt, time.Minute)
+			_, err = dst.Get(ctx, "/test/other")
+			require.ErrorIs(t, err, kv.ErrNotFound)
+		})
+	}
+}
+
+func TestImport_Modes(t *testing.T) {
+	ctx := context.Background()
+	src := newStore(t, 10)
+	st := storage_memory.New(osfs.New("/"))
+
+	_, err := Export(ctx, src, st, "/test/items/", "backup")
+	require.Nil(t, err)
+
+	dst, err := kv_memory.New()
+	require.Nil(t, err)
+	require.Nil(t, dst.Set(ctx, "/test/items/000", []byte("changed")))
+
+	stats, err := Import(ctx, dst, st, "backup", WithMode(ImportSkipExisting))
+	require.Nil(t, err)
+	require.Equal(t, 1, stats.Skipped)
+	require.Equal(t, 10, stats.Written)
+	pair, err := dst.Get(ctx, "/test/items/000")
+	require.Nil(t, err)
+	require.Equal(t, []byte("changed"), pair.Value)
+
+	stats, err = Import(ctx, dst, st, "backup", WithMode(ImportOverwrite))
+	require.Nil(t, err)
+	require.Equal(t, 11, stats.Written)
+	pair, err = dst.Get(ctx, "/test/items/000")
+	require.Nil(t, err)
+	require.Equal(t, []byte("value-0"), pair.Value)
+}
+
+func TestExport_Resume(t *testing.T) {
+	ctx := context.Background()
+	src := newStore(t, 250)
+	st := storage_memory.New(osfs.New("/"))
+
+	m, err := Export(ctx, src, st, "/test/items/", "backup", WithPartSize(100))
+	require.Nil(t, err)
+
+	// Pretend the export was interrupted after the first part, by a process
+	// with a different page token key.
+	m.Parts = m.Parts[:1]
+	m.NextToken = "v2.stale"
+	m.Complete = false
+	m.CompletedAt = nil
+	require.Nil(t, writeManifest(st, "backup", m))
+
+	_, err = Import(ctx, src, st, "backup")
+	require.ErrorIs(t, err, ErrIncomplete)
+
+	m, err = Export(ctx, src, st, "/test/items/", "backup", WithPartSize(100))
+	require.Nil(t, err)
+	require.True(t, m.Complete)
+	require.Equal(t, 251, m.Pairs())
+
+	dst, err := kv_memory.New()
+	require.Nil(t, err)
+	_, err = Import(ctx, dst, st, "backup")
+	require.Nil(t, err)
+	requireSameItems(t, src, dst)
+
+	// Resuming with different settings is refused.
+	_, err = Export(ctx, src, st, "/test/other/", "backup")
+	require.ErrorIs(t, err, ErrMismatch)
+}
+
+func TestExport_Empty(t *testing.T) {
+	ctx := context.Background()
+	src := newStore(t, 0)
+	st := storage_memory.New(osfs.New("/"))
+
+	m, err := Export(ctx, src, st, "/test/missing/", "backup")
+	require.Nil(t, err)
+	require.True(t, m.Complete)
+	require.Empty(t, m.Parts)
+
+	stats, err := Import(ctx, src, st, "backup")
+	require.Nil(t, err)
+	require.Equal(t, 0, stats.Written)
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"go.resf.org/peridot/base/go/kv"
+	basepb "go.resf.org/peridot/base/go/pb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"time"
+)
+
+// Format is the encoding of the pairs in a backup.
+type Format string
+
+const (
+	// FormatJSONL writes one JSON object per line, with the value base64 encoded.
+	FormatJSONL Format = "jsonl"
+	// FormatProto writes length-delimited basepb.KvBackupPair messages.
+	FormatProto Format = "proto"
+)
+
+var ErrUnknownFormat = errors.New("unknown backup format")
+
+// extension returns the file extension of parts in this format.
+func (f Format) extension() (string, error) {
+	switch f {
+	case FormatJSONL:
+		return "jsonl", nil
+	case FormatProto:
+		return "binpb", nil
+	default:
+		return "", ErrUnknownFormat
+	}
+}
+
+type encoder interface {
+	Encode(pair *kv.Pair) error
+	// Flush writes any buffered pairs.
+	Flush() error
+}
+
+type decoder interface {
+	// Decode returns the next pair, or io.EOF after the last one.
+	Decode() (*kv.Pair, error)
+}
+
+func newEncoder(format Format, w io.Writer) (encoder, error) {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case FormatJSONL:
+		return &jsonEncoder{w: bw, enc: json.NewEncoder(bw)}, nil
+	case FormatProto:
+		return &protoEncoder{w: bw}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+func newDecoder(format Format, r io.Reader) (decoder, error) {
+	br := bufio.NewReader(r)
+	switch format {
+	case FormatJSONL:
+		return &jsonDecoder{dec: json.NewDecoder(br)}, nil
+	case FormatProto:
+		return &protoDecoder{r: br}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// jsonPair is a single line of a JSONL backup.
+type jsonPair struct {
+	Key       string     `json:"key"`
+	Value     []byte     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type jsonEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *jsonEncoder) Encode(pair *kv.Pair) error {
+	jp := &jsonPair{
+		Key:   pair.Key,
+		Value: pair.Value,
+	}
+	if !pair.ExpiresAt.IsZero() {
+		jp.ExpiresAt = &pair.ExpiresAt
+	}
+
+	// json.Encoder terminates every value with a newline.
+	return e.enc.Encode(jp)
+}
+
+func (e *jsonEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d *jsonDecoder) Decode() (*kv.Pair, error) {
+	var jp jsonPair
+	err := d.dec.Decode(&jp)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.Wrap(err, "failed to decode pair")
+	}
+
+	pair := &kv.Pair{
+		Key:   jp.Key,
+		Value: jp.Value,
+	}
+	if jp.ExpiresAt != nil {
+		pair.ExpiresAt = *jp.ExpiresAt
+	}
+
+	return pair, nil
+}
+
+type protoEncoder struct {
+	w *bufio.Writer
+}
+
+func (e *protoEncoder) Encode(pair *kv.Pair) error {
+	pb := &basepb.KvBackupPair{
+		Key:   pair.Key,
+		Value: pair.Value,
+	}
+	if !pair.ExpiresAt.IsZero() {
+		pb.ExpiresAt = timestamppb.New(pair.ExpiresAt)
+	}
+
+	data, err := proto.Marshal(pb)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(protowire.AppendVarint(nil, uint64(len(data))))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *protoEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+type protoDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *protoDecoder) Decode() (*kv.Pair, error) {
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.Wrap(err, "failed to read pair size")
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(d.r, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pair")
+	}
+
+	var pb basepb.KvBackupPair
+	err = proto.Unmarshal(data, &pb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode pair")
+	}
+
+	pair := &kv.Pair{
+		Key:   pb.Key,
+		Value: pb.Value,
+	}
+	if pb.ExpiresAt != nil {
+		pair.ExpiresAt = pb.ExpiresAt.AsTime()
+	}
+
+	return pair, nil
+}
@@ -0,0 +1,687 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go.etcd.io/bbolt"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/kv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bolt is a kv.KV implementation backed by a local bbolt database file.
+// Every namespace is a bucket in the namespaces bucket, and the rest of the
+// key is the key within that bucket.
+// Bolt is safe for concurrent use. By default the file is locked by a single
+// process while it is open, use WithShared to use it from several processes.
+type Bolt struct {
+	// db is only kept open if the database isn't shared.
+	db     *bbolt.DB
+	path   string
+	shared bool
+	// lock serializes opening the shared database within the process,
+	// file locks are per open file so they don't do that.
+	lock sync.RWMutex
+	// closed is set by Close, so the shared database isn't opened (and created) again.
+	closed bool
+
+	// changed is closed and replaced after every write, to wake up watchers.
+	changedLock sync.Mutex
+	changed     chan struct{}
+
+	// stopReaper stops the background removal of expired keys.
+	stopReaper chan struct{}
+	reaperDone chan struct{}
+
+	pageTokens   *kv.PageTokenSigner
+	pageTokenKey []byte
+}
+
+type Option func(*Bolt)
+
+// WithShared only opens (and locks) the database file for the duration of every
+// transaction, so several processes can use the same file at the same time.
+// For example kernelmanager_server and kernelmanager_worker during development.
+// This is slower, as every transaction opens the file, and watchers poll for
+// changes made by other processes.
+func WithShared() Option {
+	return func(b *Bolt) {
+		b.shared = true
+	}
+}
+
+// WithPageTokenKey sets the key used to sign page tokens.
+// If not set, a random key is generated when opening the database,
+// so page tokens don't survive a restart.
+func WithPageTokenKey(key []byte) Option {
+	return func(b *Bolt) {
+		b.pageTokenKey = key
+	}
+}
+
+const (
+	// namespacesBucket holds a bucket for every namespace, so namespaces
+	// can't collide with the internal buckets.
+	namespacesBucket = "namespaces"
+	// internalsBucket holds the store-wide revision counter as its sequence,
+	// and the compacted revision of the change log.
+	internalsBucket = "internals"
+	// changesBucket is the change log used by Watch.
+	// Keys are the revision (8 bytes, big endian) followed by the changed key,
+	// values are the event type (1 byte) followed by the value.
+	changesBucket = "changes"
+	// changesRetention is the number of revisions kept in the change log.
+	changesRetention = 10000
+	// reapInterval is how often expired keys are removed.
+	reapInterval = time.Minute
+	// lockTimeout is how long to wait for another process to release the file lock.
+	// Shared databases are only locked for a single transaction, so this is plenty.
+	lockTimeout = 30 * time.Second
+)
+
+var compactedRevisionKey = []byte("compacted_revision")
+
+// New opens (or creates) a bbolt database at the given path.
+func New(path string, opts ...Option) (*Bolt, error) {
+	b := &Bolt{
+		path:       path,
+		changed:    make(chan struct{}),
+		stopReaper: make(chan struct{}),
+		reaperDone: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	pageTokens, err := kv.NewPageTokenSigner(b.pageTokenKey)
+	if err != nil {
+		return nil, err
+	}
+	b.pageTokens = pageTokens
+
+	db, err := b.open(false)
+	if err != nil {
+		return nil, err
+	}
+	if b.shared {
+		// The file now exists, so it can be opened read-only.
+		err = db.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		b.db = db
+	}
+	go b.reaper()
+
+	return b, nil
+}
+
+func (b *Bolt) open(readOnly bool) (*bbolt.DB, error) {
+	return bbolt.Open(b.path, 0600, &bbolt.Options{
+		// Don't block forever if another process holds the file lock.
+		Timeout:  lockTimeout,
+		ReadOnly: readOnly,
+	})
+}
+
+// Close stops the reaper, and closes the underlying database file.
+func (b *Bolt) Close() error {
+	close(b.stopReaper)
+	<-b.reaperDone
+
+	if b.db == nil {
+		// Wait for transactions in progress, watchers may still be polling.
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.closed = true
+		return nil
+	}
+	return b.db.Close()
+}
+
+// view runs a read-only transaction.
+func (b *Bolt) view(fn func(tx *bbolt.Tx) error) error {
+	if !b.shared {
+		return b.db.View(fn)
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.closed {
+		return bbolt.ErrDatabaseNotOpen
+	}
+
+	db, err := b.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
+func (b *Bolt) Get(ctx context.Context, key string) (*kv.Pair, error) {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var pair *kv.Pair
+	err = b.view(func(tx *bbolt.Tx) error {
+		e := getEntry(tx, ns, path)
+		if e == nil {
+			return kv.ErrNotFound
+		}
+
+		pair = e.toPair(ns, []byte(path))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+func (b *Bolt) Set(ctx context.Context, key string, value []byte, opts ...kv.SetOption) error {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	expiresAt := kv.NewSetOptions(opts...).ExpiresAt()
+
+	return b.update(func(tx *bbolt.Tx) error {
+		_, err := put(tx, ns, path, value, expiresAt)
+		return err
+	})
+}
+
+func (b *Bolt) Delete(ctx context.Context, key string) error {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return err
+	}
+
+	return b.update(func(tx *bbolt.Tx) error {
+		bucket := namespaceBucket(tx, ns)
+		if bucket == nil || bucket.Get([]byte(path)) == nil {
+			return nil
+		}
+
+		revision, err := nextRevision(tx)
+		if err != nil {
+			return err
+		}
+
+		return deleteAt(tx, ns, path, revision)
+	})
+}
+
+func (b *Bolt) RangePrefix(ctx context.Context, prefix string, pageSize int32, pageToken string) (*kv.Query, error) {
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	if pageSize > 100 {
+		pageSize = 100
+	}
+
+	// Page tokens are signed, so they don't need to be stored.
+	var fromPath []byte
+	if pageToken != "" {
+		pt, err := b.pageTokens.ParsePageToken(pageToken, prefix, pageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		fromPath = []byte(pt.LastPath)
+	}
+
+	ns, path, err := kv.SplitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs []*kv.Pair
+	var hasMore bool
+	err = b.view(func(tx *bbolt.Tx) error {
+		bucket := namespaceBucket(tx, ns)
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		var k, v []byte
+		if fromPath != nil {
+			k, v = c.Seek(fromPath)
+			// Continue after the last visible result.
+			if k != nil && bytes.Equal(k, fromPath) {
+				k, v = c.Next()
+			}
+		} else {
+			k, v = c.Seek([]byte(path))
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, []byte(path)); k, v = c.Next() {
+			e := decodeEntry(v)
+			if e.expired() {
+				continue
+			}
+
+			if len(pairs) >= int(pageSize) {
+				hasMore = true
+				break
+			}
+
+			pairs = append(pairs, e.toPair(ns, k))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var nextToken string
+	if hasMore {
+		// Continue from the last visible result.
+		lastPath := strings.TrimPrefix(pairs[len(pairs)-1].Key, fmt.Sprintf("/%s/", ns))
+		nextToken, err = b.pageTokens.NewPageToken(ns, lastPath, prefix, pageSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &kv.Query{
+		Prefix:    prefix,
+		Pairs:     pairs,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (b *Bolt) Create(ctx context.Context, key string, value []byte, opts ...kv.SetOption) (int64, error) {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return 0, err
+	}
+	expiresAt := kv.NewSetOptions(opts...).ExpiresAt()
+
+	var revision int64
+	err = b.update(func(tx *bbolt.Tx) error {
+		if getEntry(tx, ns, path) != nil {
+			return kv.ErrConflict
+		}
+
+		revision, err = put(tx, ns, path, value, expiresAt)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, nil
+}
+
+func (b *Bolt) SetIfRevision(ctx context.Context, key string, value []byte, revision int64, opts ...kv.SetOption) (int64, error) {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return 0, err
+	}
+	expiresAt := kv.NewSetOptions(opts...).ExpiresAt()
+
+	var newRevision int64
+	err = b.update(func(tx *bbolt.Tx) error {
+		if err := checkRevision(tx, ns, path, revision); err != nil {
+			return err
+		}
+
+		newRevision, err = put(tx, ns, path, value, expiresAt)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newRevision, nil
+}
+
+func (b *Bolt) DeleteIfRevision(ctx context.Context, key string, revision int64) error {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return err
+	}
+
+	return b.update(func(tx *bbolt.Tx) error {
+		if err := checkRevision(tx, ns, path, revision); err != nil {
+			return err
+		}
+
+		newRevision, err := nextRevision(tx)
+		if err != nil {
+			return err
+		}
+
+		return deleteAt(tx, ns, path, newRevision)
+	})
+}
+
+func (b *Bolt) Txn(ctx context.Context, ops ...*kv.Op) (int64, error) {
+	err := kv.ValidateTxn(ops)
+	if err != nil {
+		return 0, err
+	}
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	// Returning an error from the update function rolls back every operation.
+	var revision int64
+	err = b.update(func(tx *bbolt.Tx) error {
+		revision, err = nextRevision(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, op := range ops {
+			err := applyOp(tx, op, revision)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, nil
+}
+
+// reaper periodically removes expired keys until the database is closed.
+// Expired keys are already hidden from reads, removing them frees up the
+// space and lets watchers know with a delete event.
+func (b *Bolt) reaper() {
+	defer close(b.reaperDone)
+
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := b.reap()
+			if err != nil {
+				base.LogErrorf("failed to remove expired keys: %v", err)
+			}
+		case <-b.stopReaper:
+			return
+		}
+	}
+}
+
+func (b *Bolt) reap() error {
+	type expiredKey struct {
+		ns   string
+		path string
+	}
+
+	// Collect first, deleting while iterating can skip keys.
+	var expired []expiredKey
+	err := b.view(func(tx *bbolt.Tx) error {
+		namespaces := tx.Bucket([]byte(namespacesBucket))
+		if namespaces == nil {
+			return nil
+		}
+
+		return namespaces.ForEach(func(name []byte, _ []byte) error {
+			bucket := namespaces.Bucket(name)
+			if bucket == nil {
+				return nil
+			}
+
+			return bucket.ForEach(func(k []byte, v []byte) error {
+				if decodeEntry(v).expired() {
+					expired = append(expired, expiredKey{ns: string(name), path: string(k)})
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	return b.update(func(tx *bbolt.Tx) error {
+		revision, err := nextRevision(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			// Skip keys that have been written again since.
+			bucket := namespaceBucket(tx, key.ns)
+			if bucket == nil {
+				continue
+			}
+			v := bucket.Get([]byte(key.path))
+			if v == nil || !decodeEntry(v).expired() {
+				continue
+			}
+
+			err := deleteAt(tx, key.ns, key.path, revision)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// applyOp applies a single transaction operation at the given revision.
+func applyOp(tx *bbolt.Tx, op *kv.Op, revision int64) error {
+	ns, path, err := kv.SplitKey(op.Key)
+	if err != nil {
+		return err
+	}
+
+	switch op.Type {
+	case kv.OpSet:
+		return putAt(tx, ns, path, op.Value, op.ExpiresAt(), revision)
+	case kv.OpCreate:
+		if getEntry(tx, ns, path) != nil {
+			return kv.ErrConflict
+		}
+		return putAt(tx, ns, path, op.Value, op.ExpiresAt(), revision)
+	case kv.OpSetIfRevision:
+		if err := checkRevision(tx, ns, path, op.Revision); err != nil {
+			return err
+		}
+		return putAt(tx, ns, path, op.Value, op.ExpiresAt(), revision)
+	case kv.OpDelete:
+		bucket := namespaceBucket(tx, ns)
+		if bucket == nil || bucket.Get([]byte(path)) == nil {
+			return nil
+		}
+		return deleteAt(tx, ns, path, revision)
+	case kv.OpDeleteIfRevision:
+		if err := checkRevision(tx, ns, path, op.Revision); err != nil {
+			return err
+		}
+		return deleteAt(tx, ns, path, revision)
+	case kv.OpCheckRevision:
+		return checkRevision(tx, ns, path, op.Revision)
+	default:
+		return fmt.Errorf("unknown op type %d", op.Type)
+	}
+}
+
+// put writes the value at the next store-wide revision.
+func put(tx *bbolt.Tx, ns string, path string, value []byte, expiresAt time.Time) (int64, error) {
+	revision, err := nextRevision(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, putAt(tx, ns, path, value, expiresAt, revision)
+}
+
+// nextRevision increments the store-wide revision counter and returns the new revision.
+func nextRevision(tx *bbolt.Tx) (int64, error) {
+	internals, err := tx.CreateBucketIfNotExists([]byte(internalsBucket))
+	if err != nil {
+		return 0, err
+	}
+	seq, err := internals.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(seq), nil
+}
+
+func putAt(tx *bbolt.Tx, ns string, path string, value []byte, expiresAt time.Time, revision int64) error {
+	namespaces, err := tx.CreateBucketIfNotExists([]byte(namespacesBucket))
+	if err != nil {
+		return err
+	}
+	bucket, err := namespaces.CreateBucketIfNotExists([]byte(ns))
+	if err != nil {
+		return err
+	}
+
+	err = bucket.Put([]byte(path), encodeEntry(&entry{
+		revision:  revision,
+		expiresAt: expiresAt,
+		value:     value,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return logChange(tx, kv.EventPut, ns, path, value, revision)
+}
+
+func deleteAt(tx *bbolt.Tx, ns string, path string, revision int64) error {
+	err := namespaceBucket(tx, ns).Delete([]byte(path))
+	if err != nil {
+		return err
+	}
+
+	return logChange(tx, kv.EventDelete, ns, path, nil, revision)
+}
+
+// checkRevision returns kv.ErrConflict unless the key exists at the given revision.
+func checkRevision(tx *bbolt.Tx, ns string, path string, revision int64) error {
+	e := getEntry(tx, ns, path)
+	if e == nil || e.revision != revision {
+		return kv.ErrConflict
+	}
+
+	return nil
+}
+
+// namespaceBucket returns the bucket of a namespace, or nil if nothing has been written to it.
+func namespaceBucket(tx *bbolt.Tx, ns string) *bbolt.Bucket {
+	namespaces := tx.Bucket([]byte(namespacesBucket))
+	if namespaces == nil {
+		return nil
+	}
+
+	return namespaces.Bucket([]byte(ns))
+}
+
+// entry is a value together with its metadata, as it is stored.
+type entry struct {
+	revision  int64
+	expiresAt time.Time
+	value     []byte
+}
+
+// getEntry returns the entry of a key, or nil if it doesn't exist or has expired.
+func getEntry(tx *bbolt.Tx, ns string, path string) *entry {
+	bucket := namespaceBucket(tx, ns)
+	if bucket == nil {
+		return nil
+	}
+
+	v := bucket.Get([]byte(path))
+	if v == nil {
+		return nil
+	}
+
+	e := decodeEntry(v)
+	if e.expired() {
+		return nil
+	}
+
+	return e
+}
+
+// encodeEntry encodes an entry for storage.
+// The first 8 bytes are the revision, the next 8 bytes are the expiry
+// in unix nanoseconds (0 if it doesn't expire), both big endian,
+// followed by the value.
+func encodeEntry(e *entry) []byte {
+	data := make([]byte, 16+len(e.value))
+	binary.BigEndian.PutUint64(data, uint64(e.revision))
+	if !e.expiresAt.IsZero() {
+		binary.BigEndian.PutUint64(data[8:], uint64(e.expiresAt.UnixNano()))
+	}
+	copy(data[16:], e.value)
+
+	return data
+}
+
+func decodeEntry(data []byte) *entry {
+	if len(data) < 16 {
+		return &entry{}
+	}
+
+	e := &entry{
+		revision: int64(binary.BigEndian.Uint64(data)),
+		value:    data[16:],
+	}
+	if expiresAt := int64(binary.BigEndian.Uint64(data[8:])); expiresAt != 0 {
+		e.expiresAt = time.Unix(0, expiresAt)
+	}
+
+	return e
+}
+
+func (e *entry) expired() bool {
+	return !e.expiresAt.IsZero() && !e.expiresAt.After(time.Now())
+}
+
+// toPair converts an entry into a pair.
+// Values are only valid for the lifetime of the transaction, so they are copied.
+func (e *entry) toPair(ns string, path []byte) *kv.Pair {
+	return &kv.Pair{
+		Key:       fmt.Sprintf("/%s/%s", ns, path),
+		Value:     bytes.Clone(e.value),
+		Revision:  e.revision,
+		ExpiresAt: e.expiresAt,
+	}
+}
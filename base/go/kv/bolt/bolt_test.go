@@ -0,0 +1,179 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bolt
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+	"go.resf.org/peridot/base/go/kv"
+	"go.resf.org/peridot/base/go/kv/kvtest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newBolt(t *testing.T, path string, opts ...Option) *Bolt {
+	b, err := New(path, opts...)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, b.Close())
+	})
+	return b
+}
+
+func TestConformance(t *testing.T) {
+	kvtest.RunConformance(t, func(t *testing.T) kv.KV {
+		return newBolt(t, filepath.Join(t.TempDir(), "kv.db"))
+	})
+}
+
+func TestConformance_Shared(t *testing.T) {
+	kvtest.RunConformance(t, func(t *testing.T) kv.KV {
+		return newBolt(t, filepath.Join(t.TempDir(), "kv.db"), WithShared())
+	})
+}
+
+func TestShared_MultipleOpeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "kv.db")
+	key := []byte("page-token-key")
+	server := newBolt(t, path, WithShared(), WithPageTokenKey(key))
+	worker := newBolt(t, path, WithShared(), WithPageTokenKey(key))
+
+	ch, err := server.Watch(ctx, "/tasks/")
+	require.Nil(t, err)
+
+	revision, err := worker.Create(ctx, "/tasks/1", []byte("queued"))
+	require.Nil(t, err)
+
+	pair, err := server.Get(ctx, "/tasks/1")
+	require.Nil(t, err)
+	require.Equal(t, []byte("queued"), pair.Value)
+	require.Equal(t, revision, pair.Revision)
+
+	// Watchers poll for changes made by other openers.
+	select {
+	case event := <-ch:
+		require.Equal(t, kv.EventPut, event.Type)
+		require.Equal(t, "/tasks/1", event.Pair.Key)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a change made by another opener")
+	}
+
+	// Revisions are shared, so conditional writes work across openers.
+	_, err = server.SetIfRevision(ctx, "/tasks/1", []byte("running"), revision)
+	require.Nil(t, err)
+	_, err = worker.SetIfRevision(ctx, "/tasks/1", []byte("done"), revision)
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+	// Page tokens signed with the same key work on both.
+	_, err = worker.Create(ctx, "/tasks/2", []byte("queued"))
+	require.Nil(t, err)
+	query, err := server.RangePrefix(ctx, "/tasks/", 1, "")
+	require.Nil(t, err)
+	require.NotEmpty(t, query.NextToken)
+	query, err = worker.RangePrefix(ctx, "/tasks/", 1, query.NextToken)
+	require.Nil(t, err)
+	require.Len(t, query.Pairs, 1)
+	require.Equal(t, "/tasks/2", query.Pairs[0].Key)
+}
+
+func TestInternalNamespaces(t *testing.T) {
+	ctx := context.Background()
+	b := newBolt(t, filepath.Join(t.TempDir(), "kv.db"))
+
+	// Namespaces named like the internal buckets don't touch the revision counter or change log.
+	for _, ns := range []string{namespacesBucket, internalsBucket, changesBucket, "_internals", "_changes"} {
+		key := "/" + ns + "/key"
+		revision, err := b.Create(ctx, key, []byte("value"))
+		require.Nil(t, err)
+
+		pair, err := b.Get(ctx, key)
+		require.Nil(t, err)
+		require.Equal(t, revision, pair.Revision)
+
+		query, err := b.RangePrefix(ctx, "/"+ns+"/", 0, "")
+		require.Nil(t, err)
+		require.Len(t, query.Pairs, 1)
+	}
+
+	next, err := b.Create(ctx, "/test/key", []byte("value"))
+	require.Nil(t, err)
+	require.Equal(t, int64(6), next)
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "kv.db")
+
+	b, err := New(path)
+	require.Nil(t, err)
+	revision, err := b.Create(ctx, "/test/key", []byte("value"))
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	b = newBolt(t, path)
+	pair, err := b.Get(ctx, "/test/key")
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), pair.Value)
+	require.Equal(t, revision, pair.Revision)
+
+	// The revision counter is persisted too.
+	require.Nil(t, b.Set(ctx, "/test/other", []byte("value")))
+	pair, err = b.Get(ctx, "/test/other")
+	require.Nil(t, err)
+	require.Greater(t, pair.Revision, revision)
+}
+
+func TestReap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := newBolt(t, filepath.Join(t.TempDir(), "kv.db"))
+
+	start, err := b.Create(ctx, "/test/start", []byte("start"))
+	require.Nil(t, err)
+	require.Nil(t, b.Set(ctx, "/test/expiring", []byte("value"), kv.WithTTL(time.Millisecond)))
+	require.Nil(t, b.Set(ctx, "/test/kept", []byte("value"), kv.WithTTL(time.Hour)))
+
+	ch, err := b.Watch(ctx, "/test/", kv.WithFromRevision(start))
+	require.Nil(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	require.Nil(t, b.reap())
+
+	var events []*kv.Event
+	for len(events) < 3 {
+		select {
+		case event := <-ch:
+			events = append(events, event)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the reaper's delete event")
+		}
+	}
+	require.Equal(t, kv.EventDelete, events[2].Type)
+	require.Equal(t, "/test/expiring", events[2].Pair.Key)
+
+	err = b.view(func(tx *bbolt.Tx) error {
+		bucket := namespaceBucket(tx, "test")
+		require.Nil(t, bucket.Get([]byte("expiring")))
+		require.NotNil(t, bucket.Get([]byte("kept")))
+		return nil
+	})
+	require.Nil(t, err)
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"go.resf.org/peridot/base/go/kv"
+	"strings"
+	"time"
+)
+
+const (
+	// watchBatchSize is the maximum number of changes read from the change log at once.
+	watchBatchSize = 100
+	// watchPollInterval is how often watchers of a shared database check for
+	// changes made by other processes.
+	watchPollInterval = time.Second
+)
+
+func (b *Bolt) Watch(ctx context.Context, prefix string, opts ...kv.WatchOption) (<-chan *kv.Event, error) {
+	ns, path, err := kv.SplitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	o := kv.NewWatchOptions(opts...)
+
+	fromRevision := o.FromRevision
+	err = b.view(func(tx *bbolt.Tx) error {
+		internals := tx.Bucket([]byte(internalsBucket))
+		if internals == nil {
+			return nil
+		}
+
+		// Without a revision to resume from, start at the current revision.
+		if fromRevision == 0 {
+			fromRevision = int64(internals.Sequence())
+			return nil
+		}
+
+		if fromRevision < compactedRevision(internals) {
+			return kv.ErrCompacted
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *kv.Event)
+	go b.watch(ctx, ch, fmt.Sprintf("%s/%s", ns, path), fromRevision)
+
+	return ch, nil
+}
+
+func (b *Bolt) watch(ctx context.Context, ch chan<- *kv.Event, prefix string, fromRevision int64) {
+	defer close(ch)
+
+	// Transactions log several changes at the same revision, so continue
+	// from the last change read rather than the last revision.
+	lastKey := encodeRevision(fromRevision + 1)
+
+	for {
+		// Get the channel before reading, so writes committed while reading still wake us up.
+		changed := b.changedChan()
+
+		var events []*kv.Event
+		var scanned int
+		err := b.view(func(tx *bbolt.Tx) error {
+			internals := tx.Bucket([]byte(internalsBucket))
+			if internals != nil && fromRevision < compactedRevision(internals) {
+				// The watcher fell too far behind.
+				return kv.ErrCompacted
+			}
+
+			changes := tx.Bucket([]byte(changesBucket))
+			if changes == nil {
+				return nil
+			}
+
+			c := changes.Cursor()
+			k, v := c.Seek(lastKey)
+			if k != nil && bytes.Equal(k, lastKey) {
+				k, v = c.Next()
+			}
+			for ; k != nil && scanned < watchBatchSize; k, v = c.Next() {
+				scanned++
+				lastKey = bytes.Clone(k)
+				revision := int64(binary.BigEndian.Uint64(k[:8]))
+				key := string(k[8:])
+				fromRevision = revision
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+
+				event := &kv.Event{
+					Type: kv.EventType(v[0]),
+					Pair: &kv.Pair{
+						Key:      "/" + key,
+						Revision: revision,
+					},
+				}
+				if event.Type == kv.EventPut {
+					event.Pair.Value = bytes.Clone(v[1:])
+				}
+				events = append(events, event)
+			}
+
+			return nil
+		})
+		if err != nil {
+			select {
+			case ch <- &kv.Event{Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		for _, event := range events {
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// There may be more changes, so don't wait.
+		if scanned >= watchBatchSize {
+			continue
+		}
+
+		// Other processes can't wake us up, so poll shared databases.
+		var poll <-chan time.Time
+		if b.shared {
+			poll = time.After(watchPollInterval)
+		}
+
+		select {
+		case <-changed:
+		case <-poll:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// update runs a write transaction and wakes up watchers if it succeeds.
+func (b *Bolt) update(fn func(tx *bbolt.Tx) error) error {
+	err := b.updateDB(fn)
+	if err != nil {
+		return err
+	}
+
+	b.changedLock.Lock()
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.changedLock.Unlock()
+
+	return nil
+}
+
+// updateDB runs a write transaction, opening a shared database for just that transaction.
+func (b *Bolt) updateDB(fn func(tx *bbolt.Tx) error) error {
+	if !b.shared {
+		return b.db.Update(fn)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return bbolt.ErrDatabaseNotOpen
+	}
+
+	db, err := b.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+func (b *Bolt) changedChan() <-chan struct{} {
+	b.changedLock.Lock()
+	defer b.changedLock.Unlock()
+
+	return b.changed
+}
+
+// logChange appends a change to the change log, and compacts
+// changes that are older than the retention.
+func logChange(tx *bbolt.Tx, eventType kv.EventType, ns string, path string, value []byte, revision int64) error {
+	changes, err := tx.CreateBucketIfNotExists([]byte(changesBucket))
+	if err != nil {
+		return err
+	}
+
+	key := append(encodeRevision(revision), fmt.Sprintf("%s/%s", ns, path)...)
+	err = changes.Put(key, append([]byte{byte(eventType)}, value...))
+	if err != nil {
+		return err
+	}
+
+	compactBefore := revision - changesRetention
+	if compactBefore <= 0 {
+		return nil
+	}
+
+	// Deleting while iterating with a cursor can skip keys, so collect them first.
+	var compacted [][]byte
+	c := changes.Cursor()
+	for k, _ := c.First(); k != nil && int64(binary.BigEndian.Uint64(k[:8])) < compactBefore; k, _ = c.Next() {
+		compacted = append(compacted, bytes.Clone(k))
+	}
+	if len(compacted) == 0 {
+		return nil
+	}
+	for _, k := range compacted {
+		err := changes.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	internals, err := tx.CreateBucketIfNotExists([]byte(internalsBucket))
+	if err != nil {
+		return err
+	}
+
+	// Resuming needs every change after the resume revision, so everything
+	// before the oldest remaining change can't be resumed from anymore.
+	return internals.Put(compactedRevisionKey, encodeRevision(compactBefore-1))
+}
+
+// compactedRevision returns the oldest revision that can still be resumed from.
+func compactedRevision(internals *bbolt.Bucket) int64 {
+	v := internals.Get(compactedRevisionKey)
+	if len(v) != 8 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func encodeRevision(revision int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(revision))
+	return b
+}
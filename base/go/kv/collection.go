@@ -0,0 +1,554 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	base "go.resf.org/peridot/base/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Collection stores protobuf resources of a single type, keyed by their
+// AIP-122 resource name (the "name" field of the message).
+// A resource named "kernels/123" in a collection with the prefix "/kernels/entries/"
+// is stored at "/kernels/entries/kernels/123".
+//
+// Every method returns gRPC status errors, so they can be returned from RPC handlers as is.
+//
+// Secondary indexes (see WithIndex) are stored next to the collection, and are
+// written in the same transaction as the resource, so they are always consistent.
+//
+// If T has a string "etag" field, it is set to the revision of the resource when it is
+// read or written, and Update only replaces a resource whose revision matches a
+// non-empty etag (AIP-154). The etag is not stored.
+type Collection[T proto.Message] struct {
+	kv     KV
+	prefix string
+	// indexPrefix is where index entries are stored, outside the prefix so List doesn't return them.
+	indexPrefix string
+	indexes     map[string]func(T) []string
+	// resource is the singular resource name used in error messages, e.g. "kernel".
+	resource  string
+	nameField protoreflect.FieldDescriptor
+	// etagField is nil if T has no etag field.
+	etagField protoreflect.FieldDescriptor
+}
+
+type CollectionOption[T proto.Message] func(*Collection[T])
+
+// WithIndex adds a secondary index to the collection.
+// values returns the values a resource is indexed under, a resource can have any
+// number of values, and empty values are ignored.
+// Index entries are listed ordered by value and then name, so to list
+// "updates of a kernel ordered by finish time", index on the kernel name followed
+// by a sortable (fixed width) finish time, and query with the kernel name as prefix.
+//
+// Every index entry contains a copy of the resource, so queries don't need
+// to read the resources separately.
+// Resources written before the index was added are not indexed until Reindex is called.
+func WithIndex[T proto.Message](name string, values func(T) []string) CollectionOption[T] {
+	return func(c *Collection[T]) {
+		c.indexes[name] = values
+	}
+}
+
+// NewCollection creates a collection storing resources under prefix.
+// Prefix must have a namespace, and T must have a string "name" field.
+// Index entries are stored under "/<namespace>/_indexes/<rest of prefix>", so collections
+// with indexes can't be stored directly at the root of a namespace.
+func NewCollection[T proto.Message](kv KV, prefix string, opts ...CollectionOption[T]) (*Collection[T], error) {
+	ns, path, err := SplitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var zero T
+	desc := zero.ProtoReflect().Descriptor()
+	nameField := desc.Fields().ByName("name")
+	if nameField == nil || nameField.Kind() != protoreflect.StringKind || nameField.IsList() {
+		return nil, fmt.Errorf("%s has no string name field", desc.FullName())
+	}
+
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if path != "" && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	c := &Collection[T]{
+		kv:          kv,
+		prefix:      prefix,
+		indexPrefix: fmt.Sprintf("/%s/_indexes/%s", ns, path),
+		indexes:     map[string]func(T) []string{},
+		resource:    resourceName(string(desc.Name())),
+		nameField:   nameField,
+	}
+	etagField := desc.Fields().ByName("etag")
+	if etagField != nil && etagField.Kind() == protoreflect.StringKind && !etagField.IsList() {
+		c.etagField = etagField
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	for name := range c.indexes {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid index name %q", name)
+		}
+	}
+	if len(c.indexes) > 0 && path == "" {
+		// List would return the index entries.
+		return nil, errors.New("collections with indexes must be below the namespace root")
+	}
+
+	return c, nil
+}
+
+// Key returns the key a resource is stored at.
+// Returns an InvalidArgument error if the name is not a valid resource name.
+func (c *Collection[T]) Key(name string) (string, error) {
+	if name == "" {
+		return "", status.Errorf(codes.InvalidArgument, "%s name must be provided", c.resource)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", status.Errorf(codes.InvalidArgument, "invalid %s name %q", c.resource, name)
+		}
+	}
+
+	return c.prefix + name, nil
+}
+
+// Name returns the resource name of a message.
+func (c *Collection[T]) Name(msg T) string {
+	return msg.ProtoReflect().Get(c.nameField).String()
+}
+
+// SetEtag sets the etag of a message to a revision, for example to the revision returned
+// by a transaction containing CreateOps. Does nothing if T has no etag field.
+func (c *Collection[T]) SetEtag(msg T, revision int64) {
+	if c.etagField == nil {
+		return
+	}
+
+	msg.ProtoReflect().Set(c.etagField, protoreflect.ValueOfString(strconv.FormatInt(revision, 10)))
+}
+
+// etag returns the etag of a message, empty if it has none.
+func (c *Collection[T]) etag(msg T) string {
+	if c.etagField == nil {
+		return ""
+	}
+
+	return msg.ProtoReflect().Get(c.etagField).String()
+}
+
+func (c *Collection[T]) Get(ctx context.Context, name string) (T, error) {
+	var zero T
+
+	msg, _, err := c.get(ctx, name)
+	if err != nil {
+		return zero, c.status(err, "get")
+	}
+
+	return msg, nil
+}
+
+// Create stores a new resource.
+// Returns an AlreadyExists error if a resource with the same name exists.
+func (c *Collection[T]) Create(ctx context.Context, msg T, opts ...SetOption) (T, error) {
+	var zero T
+
+	ops, err := c.CreateOps(msg, opts...)
+	if err != nil {
+		return zero, err
+	}
+
+	revision, err := c.kv.Txn(ctx, ops...)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return zero, status.Errorf(codes.AlreadyExists, "%s already exists", c.resource)
+		}
+		return zero, c.status(err, "create")
+	}
+	c.SetEtag(msg, revision)
+
+	return msg, nil
+}
+
+// CreateOps returns the transaction operations creating the resource and its
+// index entries, to create it together with other keys.
+func (c *Collection[T]) CreateOps(msg T, opts ...SetOption) ([]*Op, error) {
+	key, err := c.Key(c.Name(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := c.marshal(msg)
+	if err != nil {
+		return nil, c.status(err, "marshal")
+	}
+
+	ops := []*Op{CreateOp(key, value, opts...)}
+	for _, indexKey := range c.indexKeys(msg) {
+		ops = append(ops, SetOp(indexKey, value, opts...))
+	}
+
+	return ops, nil
+}
+
+// Update replaces an existing resource.
+// Returns a NotFound error if the resource doesn't exist, and an Aborted error
+// if it was modified concurrently, in which case the caller should retry.
+// If the message has an etag, Update also returns an Aborted error if the resource
+// has been modified since the etag was read, in which case the caller should read
+// the resource again before retrying.
+func (c *Collection[T]) Update(ctx context.Context, msg T, opts ...SetOption) (T, error) {
+	var zero T
+
+	name := c.Name(msg)
+	old, revision, err := c.get(ctx, name)
+	if err != nil {
+		return zero, c.status(err, "get")
+	}
+
+	if etag := c.etag(msg); etag != "" {
+		expected, err := strconv.ParseInt(etag, 10, 64)
+		if err != nil {
+			return zero, status.Errorf(codes.InvalidArgument, "invalid %s etag %q", c.resource, etag)
+		}
+		if expected != revision {
+			return zero, status.Errorf(codes.Aborted, "%s has been modified since etag %s was read", c.resource, etag)
+		}
+	}
+
+	value, err := c.marshal(msg)
+	if err != nil {
+		return zero, c.status(err, "marshal")
+	}
+
+	// Only write if nobody else has modified the resource in the meantime,
+	// otherwise the index entries of the old resource could be out of date.
+	ops := []*Op{SetIfRevisionOp(c.prefix+name, value, revision, opts...)}
+	newKeys := c.indexKeys(msg)
+	for _, indexKey := range newKeys {
+		ops = append(ops, SetOp(indexKey, value, opts...))
+	}
+	for _, indexKey := range c.indexKeys(old) {
+		if !contains(newKeys, indexKey) {
+			ops = append(ops, DeleteOp(indexKey))
+		}
+	}
+
+	revision, err = c.kv.Txn(ctx, ops...)
+	if err != nil {
+		return zero, c.status(err, "update")
+	}
+	c.SetEtag(msg, revision)
+
+	return msg, nil
+}
+
+// Delete deletes a resource.
+// Returns a NotFound error if the resource doesn't exist.
+func (c *Collection[T]) Delete(ctx context.Context, name string) error {
+	old, revision, err := c.get(ctx, name)
+	if err != nil {
+		return c.status(err, "get")
+	}
+
+	ops := []*Op{DeleteIfRevisionOp(c.prefix+name, revision)}
+	for _, indexKey := range c.indexKeys(old) {
+		ops = append(ops, DeleteOp(indexKey))
+	}
+
+	_, err = c.kv.Txn(ctx, ops...)
+	if err != nil {
+		return c.status(err, "delete")
+	}
+
+	return nil
+}
+
+// List returns a page of resources ordered by name, and the token for the next page.
+// The token is empty on the last page.
+func (c *Collection[T]) List(ctx context.Context, pageSize int32, pageToken string) ([]T, string, error) {
+	query, err := c.kv.RangePrefix(ctx, c.prefix, pageSize, pageToken)
+	if err != nil {
+		return nil, "", c.status(err, "list")
+	}
+
+	msgs := make([]T, 0, len(query.Pairs))
+	for _, pair := range query.Pairs {
+		msg, err := c.unmarshal(pair.Value)
+		if err != nil {
+			return nil, "", c.status(err, "unmarshal")
+		}
+		c.SetEtag(msg, pair.Revision)
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, query.NextToken, nil
+}
+
+// Query returns a page of resources from an index, with a value starting with valuePrefix.
+// Resources are ordered by index value, and then by name. A resource with several
+// matching values is returned once for every value.
+// Use an empty prefix to list the whole index, and end the prefix with "/" to only
+// match values in the same "directory".
+// Index entries are copies, so resources returned by Query have no etag.
+func (c *Collection[T]) Query(ctx context.Context, index string, valuePrefix string, pageSize int32, pageToken string) ([]T, string, error) {
+	if c.indexes[index] == nil {
+		return nil, "", status.Errorf(codes.InvalidArgument, "unknown index %q", index)
+	}
+
+	query, err := c.kv.RangePrefix(ctx, c.indexPrefix+index+"/"+valuePrefix, pageSize, pageToken)
+	if err != nil {
+		return nil, "", c.status(err, "query")
+	}
+
+	msgs := make([]T, 0, len(query.Pairs))
+	for _, pair := range query.Pairs {
+		msg, err := c.unmarshal(pair.Value)
+		if err != nil {
+			return nil, "", c.status(err, "unmarshal")
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, query.NextToken, nil
+}
+
+// Reindex rebuilds an index, adding entries for resources written before the index
+// was added and removing entries that are no longer valid.
+// Writes made while reindexing maintain the index as usual, so it is safe to run
+// while the collection is in use.
+func (c *Collection[T]) Reindex(ctx context.Context, index string) error {
+	if c.indexes[index] == nil {
+		return status.Errorf(codes.InvalidArgument, "unknown index %q", index)
+	}
+
+	// Add missing entries.
+	err := c.forEach(ctx, c.prefix, func(pair *Pair) error {
+		msg, err := c.unmarshal(pair.Value)
+		if err != nil {
+			return err
+		}
+
+		ops := []*Op{CheckRevisionOp(pair.Key, pair.Revision)}
+		for _, indexKey := range c.indexKeysFor(index, msg) {
+			ops = append(ops, SetOp(indexKey, pair.Value, WithTTL(ttlFromExpiry(pair.ExpiresAt))))
+		}
+
+		// A conflict means the resource has been written since, which updated the index.
+		_, err = c.kv.Txn(ctx, ops...)
+		if err != nil && !errors.Is(err, ErrConflict) && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return c.status(err, "reindex")
+	}
+
+	// Remove entries of resources that have been deleted or no longer have the value.
+	err = c.forEach(ctx, c.indexPrefix+index+"/", func(pair *Pair) error {
+		entry, err := c.unmarshal(pair.Value)
+		if err != nil {
+			return err
+		}
+
+		msg, _, err := c.get(ctx, c.Name(entry))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil && contains(c.indexKeysFor(index, msg), pair.Key) {
+			return nil
+		}
+
+		err = c.kv.DeleteIfRevision(ctx, pair.Key, pair.Revision)
+		if err != nil && !errors.Is(err, ErrConflict) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return c.status(err, "reindex")
+	}
+
+	return nil
+}
+
+// forEach calls fn for every pair under the prefix.
+func (c *Collection[T]) forEach(ctx context.Context, prefix string, fn func(pair *Pair) error) error {
+	var token string
+	for {
+		query, err := c.kv.RangePrefix(ctx, prefix, 100, token)
+		if err != nil {
+			return err
+		}
+
+		for _, pair := range query.Pairs {
+			err := fn(pair)
+			if err != nil {
+				return err
+			}
+		}
+
+		token = query.NextToken
+		if token == "" {
+			return nil
+		}
+	}
+}
+
+// indexKeys returns the keys of every index entry of a resource, sorted.
+func (c *Collection[T]) indexKeys(msg T) []string {
+	var keys []string
+	for index := range c.indexes {
+		keys = append(keys, c.indexKeysFor(index, msg)...)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// indexKeysFor returns the keys of the entries of a resource in a single index.
+func (c *Collection[T]) indexKeysFor(index string, msg T) []string {
+	var keys []string
+	for _, value := range c.indexes[index](msg) {
+		if value == "" {
+			continue
+		}
+
+		key := fmt.Sprintf("%s%s/%s/%s", c.indexPrefix, index, value, c.Name(msg))
+		// A transaction can only contain a key once.
+		if !contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// get returns a resource together with its revision.
+func (c *Collection[T]) get(ctx context.Context, name string) (T, int64, error) {
+	var zero T
+
+	key, err := c.Key(name)
+	if err != nil {
+		return zero, 0, err
+	}
+
+	pair, err := c.kv.Get(ctx, key)
+	if err != nil {
+		return zero, 0, err
+	}
+
+	msg, err := c.unmarshal(pair.Value)
+	if err != nil {
+		return zero, 0, err
+	}
+	c.SetEtag(msg, pair.Revision)
+
+	return msg, pair.Revision, nil
+}
+
+// marshal marshals a resource without its etag.
+func (c *Collection[T]) marshal(msg T) ([]byte, error) {
+	if c.etag(msg) != "" {
+		msg = proto.Clone(msg).(T)
+		msg.ProtoReflect().Clear(c.etagField)
+	}
+
+	return proto.Marshal(msg)
+}
+
+func (c *Collection[T]) unmarshal(value []byte) (T, error) {
+	var zero T
+
+	msg := zero.ProtoReflect().Type().New().Interface().(T)
+	err := proto.Unmarshal(value, msg)
+	if err != nil {
+		return zero, fmt.Errorf("failed to unmarshal %s: %w", c.resource, err)
+	}
+
+	return msg, nil
+}
+
+// status converts an error from action into a gRPC status error.
+// Unexpected errors are logged, and returned as Internal errors without details.
+func (c *Collection[T]) status(err error, action string) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Errorf(codes.NotFound, "%s not found", c.resource)
+	case errors.Is(err, ErrConflict):
+		return status.Errorf(codes.Aborted, "%s was modified concurrently, retry", c.resource)
+	case errors.Is(err, ErrPageTokenNotFound):
+		return status.Error(codes.InvalidArgument, "invalid page token")
+	case errors.Is(err, ErrNoNamespace):
+		return status.Errorf(codes.InvalidArgument, "invalid %s name", c.resource)
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	base.LogErrorf("failed to %s %s: %v", action, c.resource, err)
+	return status.Errorf(codes.Internal, "failed to %s %s", action, c.resource)
+}
+
+// ttlFromExpiry returns the remaining TTL of a key expiring at expiresAt, zero if it doesn't expire.
+func ttlFromExpiry(expiresAt time.Time) time.Duration {
+	if expiresAt.IsZero() {
+		return 0
+	}
+
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		// Already expired, expire the index entry as soon as possible.
+		return time.Nanosecond
+	}
+
+	return ttl
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resourceName converts a message name to a resource name for error messages,
+// for example "KernelUpdate" becomes "kernel update".
+func resourceName(messageName string) string {
+	var b strings.Builder
+	for i, r := range messageName {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteRune(' ')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
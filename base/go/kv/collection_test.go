@@ -0,0 +1,265 @@
+package kv_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	kv_memory "go.resf.org/peridot/base/go/kv/memory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/apipb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"testing"
+)
+
+func newCollection(t *testing.T) (*kv.Collection[*apipb.Api], kv.KV) {
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+
+	c, err := kv.NewCollection[*apipb.Api](store, "/apis/entries")
+	require.Nil(t, err)
+
+	return c, store
+}
+
+func requireCode(t *testing.T, code codes.Code, err error) {
+	t.Helper()
+	require.Equal(t, code, status.Code(err), "%v", err)
+}
+
+func TestNewCollection_NoNameField(t *testing.T) {
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+
+	_, err = kv.NewCollection[*emptypb.Empty](store, "/empty/")
+	require.NotNil(t, err)
+
+	_, err = kv.NewCollection[*apipb.Api](store, "/")
+	require.ErrorIs(t, err, kv.ErrNoNamespace)
+}
+
+func TestCollection_CRUD(t *testing.T) {
+	ctx := context.Background()
+	c, store := newCollection(t)
+
+	_, err := c.Get(ctx, "apis/1")
+	requireCode(t, codes.NotFound, err)
+
+	created, err := c.Create(ctx, &apipb.Api{Name: "apis/1", Version: "v1"})
+	require.Nil(t, err)
+	require.Equal(t, "apis/1", created.Name)
+
+	_, err = c.Create(ctx, &apipb.Api{Name: "apis/1"})
+	requireCode(t, codes.AlreadyExists, err)
+
+	// Resources are stored under the prefix, by name.
+	pair, err := store.Get(ctx, "/apis/entries/apis/1")
+	require.Nil(t, err)
+	stored := &apipb.Api{}
+	require.Nil(t, proto.Unmarshal(pair.Value, stored))
+	require.Equal(t, "v1", stored.Version)
+
+	api, err := c.Get(ctx, "apis/1")
+	require.Nil(t, err)
+	require.True(t, proto.Equal(created, api))
+
+	_, err = c.Update(ctx, &apipb.Api{Name: "apis/1", Version: "v2"})
+	require.Nil(t, err)
+	api, err = c.Get(ctx, "apis/1")
+	require.Nil(t, err)
+	require.Equal(t, "v2", api.Version)
+
+	_, err = c.Update(ctx, &apipb.Api{Name: "apis/2"})
+	requireCode(t, codes.NotFound, err)
+
+	require.Nil(t, c.Delete(ctx, "apis/1"))
+	requireCode(t, codes.NotFound, c.Delete(ctx, "apis/1"))
+	_, err = c.Get(ctx, "apis/1")
+	requireCode(t, codes.NotFound, err)
+}
+
+func TestCollection_InvalidNames(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newCollection(t)
+
+	for _, name := range []string{"", "/apis/1", "apis/", "apis//1", "apis/../1"} {
+		_, err := c.Get(ctx, name)
+		requireCode(t, codes.InvalidArgument, err)
+
+		_, err = c.Create(ctx, &apipb.Api{Name: name})
+		requireCode(t, codes.InvalidArgument, err)
+	}
+}
+
+func TestCollection_List(t *testing.T) {
+	ctx := context.Background()
+	c, store := newCollection(t)
+
+	for i := 0; i < 25; i++ {
+		_, err := c.Create(ctx, &apipb.Api{Name: fmt.Sprintf("apis/%02d", i)})
+		require.Nil(t, err)
+	}
+	// Keys outside the prefix are not listed.
+	require.Nil(t, store.Set(ctx, "/apis/other", []byte("other")))
+
+	apis, token, err := c.List(ctx, 20, "")
+	require.Nil(t, err)
+	require.Len(t, apis, 20)
+	require.Equal(t, "apis/00", apis[0].Name)
+	require.NotEmpty(t, token)
+
+	apis, token, err = c.List(ctx, 20, token)
+	require.Nil(t, err)
+	require.Len(t, apis, 5)
+	require.Equal(t, "apis/20", apis[0].Name)
+	require.Empty(t, token)
+
+	_, _, err = c.List(ctx, 20, "invalid")
+	requireCode(t, codes.InvalidArgument, err)
+}
+
+func TestCollection_CreateOps(t *testing.T) {
+	ctx := context.Background()
+	c, store := newCollection(t)
+
+	ops, err := c.CreateOps(&apipb.Api{Name: "apis/1"})
+	require.Nil(t, err)
+
+	_, err = store.Txn(ctx, append(ops, kv.CreateOp("/apis/names/1", []byte("apis/1")))...)
+	require.Nil(t, err)
+
+	_, err = c.Get(ctx, "apis/1")
+	require.Nil(t, err)
+}
+
+func newIndexedCollection(t *testing.T, store kv.KV) *kv.Collection[*apipb.Api] {
+	c, err := kv.NewCollection[*apipb.Api](
+		store,
+		"/apis/entries",
+		kv.WithIndex("version", func(api *apipb.Api) []string {
+			return []string{api.Version}
+		}),
+		kv.WithIndex("method", func(api *apipb.Api) []string {
+			var values []string
+			for _, method := range api.Methods {
+				values = append(values, method.Name)
+			}
+			return values
+		}),
+	)
+	require.Nil(t, err)
+
+	return c
+}
+
+func queryNames(t *testing.T, c *kv.Collection[*apipb.Api], index string, prefix string) []string {
+	apis, _, err := c.Query(context.Background(), index, prefix, 100, "")
+	require.Nil(t, err)
+
+	var names []string
+	for _, api := range apis {
+		names = append(names, api.Name)
+	}
+	return names
+}
+
+func TestCollection_Index(t *testing.T) {
+	ctx := context.Background()
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+	c := newIndexedCollection(t, store)
+
+	_, err = c.Create(ctx, &apipb.Api{Name: "apis/1", Version: "v1", Methods: []*apipb.Method{{Name: "Get"}, {Name: "List"}}})
+	require.Nil(t, err)
+	_, err = c.Create(ctx, &apipb.Api{Name: "apis/2", Version: "v2", Methods: []*apipb.Method{{Name: "Get"}}})
+	require.Nil(t, err)
+	_, err = c.Create(ctx, &apipb.Api{Name: "apis/3", Version: "v1"})
+	require.Nil(t, err)
+
+	require.Equal(t, []string{"apis/1", "apis/3"}, queryNames(t, c, "version", "v1/"))
+	require.Equal(t, []string{"apis/1", "apis/3", "apis/2"}, queryNames(t, c, "version", ""))
+	require.Equal(t, []string{"apis/1", "apis/2"}, queryNames(t, c, "method", "Get/"))
+
+	// Index entries are not listed with the resources.
+	apis, _, err := c.List(ctx, 100, "")
+	require.Nil(t, err)
+	require.Len(t, apis, 3)
+
+	// Updates move the entries, and queries return the updated resource.
+	_, err = c.Update(ctx, &apipb.Api{Name: "apis/1", Version: "v2", Methods: []*apipb.Method{{Name: "List"}}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"apis/3"}, queryNames(t, c, "version", "v1/"))
+	require.Equal(t, []string{"apis/1", "apis/2"}, queryNames(t, c, "version", "v2/"))
+	require.Equal(t, []string{"apis/2"}, queryNames(t, c, "method", "Get/"))
+	apis, _, err = c.Query(ctx, "method", "List/", 100, "")
+	require.Nil(t, err)
+	require.Equal(t, "v2", apis[0].Version)
+
+	require.Nil(t, c.Delete(ctx, "apis/2"))
+	require.Equal(t, []string{"apis/1"}, queryNames(t, c, "version", "v2/"))
+	require.Empty(t, queryNames(t, c, "method", "Get/"))
+
+	_, _, err = c.Query(ctx, "missing", "", 100, "")
+	requireCode(t, codes.InvalidArgument, err)
+}
+
+func TestCollection_QueryPages(t *testing.T) {
+	ctx := context.Background()
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+	c := newIndexedCollection(t, store)
+
+	for i := 0; i < 25; i++ {
+		_, err := c.Create(ctx, &apipb.Api{Name: fmt.Sprintf("apis/%02d", i), Version: "v1"})
+		require.Nil(t, err)
+	}
+
+	apis, token, err := c.Query(ctx, "version", "v1/", 20, "")
+	require.Nil(t, err)
+	require.Len(t, apis, 20)
+	require.NotEmpty(t, token)
+
+	apis, token, err = c.Query(ctx, "version", "v1/", 20, token)
+	require.Nil(t, err)
+	require.Len(t, apis, 5)
+	require.Equal(t, "apis/20", apis[0].Name)
+	require.Empty(t, token)
+}
+
+func TestCollection_Reindex(t *testing.T) {
+	ctx := context.Background()
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+
+	// Resources created before the index existed.
+	c, _ := kv.NewCollection[*apipb.Api](store, "/apis/entries")
+	_, err = c.Create(ctx, &apipb.Api{Name: "apis/1", Version: "v1"})
+	require.Nil(t, err)
+	_, err = c.Create(ctx, &apipb.Api{Name: "apis/2", Version: "v1"})
+	require.Nil(t, err)
+
+	indexed := newIndexedCollection(t, store)
+	require.Empty(t, queryNames(t, indexed, "version", "v1/"))
+	require.Nil(t, indexed.Reindex(ctx, "version"))
+	require.Equal(t, []string{"apis/1", "apis/2"}, queryNames(t, indexed, "version", "v1/"))
+
+	// Changes made without the index leave stale entries until reindexed.
+	_, err = c.Update(ctx, &apipb.Api{Name: "apis/1", Version: "v2"})
+	require.Nil(t, err)
+	require.Nil(t, c.Delete(ctx, "apis/2"))
+	require.Nil(t, indexed.Reindex(ctx, "version"))
+	require.Empty(t, queryNames(t, indexed, "version", "v1/"))
+	require.Equal(t, []string{"apis/1"}, queryNames(t, indexed, "version", "v2/"))
+}
+
+func TestNewCollection_IndexAtNamespaceRoot(t *testing.T) {
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+
+	_, err = kv.NewCollection[*apipb.Api](store, "/apis/", kv.WithIndex("version", func(api *apipb.Api) []string {
+		return []string{api.Version}
+	}))
+	require.NotNil(t, err)
+}
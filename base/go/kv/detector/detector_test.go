@@ -0,0 +1,213 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv_detector
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/kv"
+	"go.resf.org/peridot/base/go/kv/bolt"
+	"go.resf.org/peridot/base/go/kv/dynamodb"
+	"go.resf.org/peridot/base/go/kv/dynamodb/dynamodbtest"
+	kv_memory "go.resf.org/peridot/base/go/kv/memory"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	// The fake doesn't check credentials, but the client needs some to sign requests.
+	t.Setenv("AWS_ACCESS_KEY_ID", "kvtest")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "kvtest")
+	server := dynamodbtest.NewServer()
+	defer server.Close()
+
+	dir := t.TempDir()
+
+	tests := []struct {
+		name             string
+		connectionString string
+		want             kv.KV
+		err              bool
+	}{
+		{
+			name:             "memory",
+			connectionString: "memory://",
+			want:             &kv_memory.Memory{},
+		},
+		{
+			name:             "bolt",
+			connectionString: "bolt://" + filepath.Join(dir, "kv.db"),
+			want:             &bolt.Bolt{},
+		},
+		{
+			name:             "bolt relative path",
+			connectionString: "bolt://kv.db",
+			want:             &bolt.Bolt{},
+		},
+		{
+			name:             "bolt shared",
+			connectionString: "bolt://" + filepath.Join(dir, "shared.db") + "?shared=true",
+			want:             &bolt.Bolt{},
+		},
+		{
+			name:             "bolt not shared",
+			connectionString: "bolt://" + filepath.Join(dir, "unshared.db") + "?shared=false",
+			want:             &bolt.Bolt{},
+		},
+		{
+			name:             "bolt invalid shared",
+			connectionString: "bolt://" + filepath.Join(dir, "invalid.db") + "?shared=maybe",
+			err:              true,
+		},
+		{
+			name:             "bolt missing path",
+			connectionString: "bolt://",
+			err:              true,
+		},
+		{
+			name:             "dynamodb",
+			connectionString: "dynamodb://detector?endpoint=" + server.URL,
+			want:             &dynamodb.DynamoDB{},
+		},
+		{
+			name:             "dynamodb missing table",
+			connectionString: "dynamodb://?endpoint=" + server.URL,
+			err:              true,
+		},
+		{
+			name:             "postgres unreachable",
+			connectionString: "postgres://kv:kv@127.0.0.1:1/kv?sslmode=disable&table=detector",
+			err:              true,
+		},
+		{
+			name:             "unknown scheme",
+			connectionString: "etcd://localhost:2379",
+			err:              true,
+		},
+		{
+			name:             "no scheme",
+			connectionString: "kv.db",
+			err:              true,
+		},
+		{
+			name:             "invalid",
+			connectionString: "://",
+			err:              true,
+		},
+		{
+			name: "empty",
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			// Relative bolt paths are relative to the working directory.
+			wd, err := os.Getwd()
+			require.Nil(t, err)
+			require.Nil(t, os.Chdir(t.TempDir()))
+			defer func() {
+				require.Nil(t, os.Chdir(wd))
+			}()
+
+			store, err := New(test.connectionString, []byte("page-token-key"))
+			if test.err {
+				require.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			if closer, ok := store.(io.Closer); ok {
+				defer closer.Close()
+			}
+			require.IsType(t, test.want, store)
+
+			// Every backend is usable right away.
+			ctx := context.Background()
+			require.Nil(t, store.Set(ctx, "/test/key", []byte("value")))
+			pair, err := store.Get(ctx, "/test/key")
+			require.Nil(t, err)
+			require.Equal(t, []byte("value"), pair.Value)
+		})
+	}
+}
+
+func TestApplyLegacyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantSet bool
+		err     bool
+	}{
+		{
+			name: "nothing set",
+		},
+		{
+			name:    "table",
+			env:     map[string]string{envDynamoDBTable: "legacy"},
+			want:    "dynamodb://legacy",
+			wantSet: true,
+		},
+		{
+			name:    "endpoint",
+			env:     map[string]string{envDynamoDBEndpoint: "http://localhost:4566"},
+			want:    "dynamodb://kernelmanager?endpoint=http%3A%2F%2Flocalhost%3A4566",
+			wantSet: true,
+		},
+		{
+			name:    "table and endpoint",
+			env:     map[string]string{envDynamoDBTable: "legacy", envDynamoDBEndpoint: "http://localhost:4566"},
+			want:    "dynamodb://legacy?endpoint=http%3A%2F%2Flocalhost%3A4566",
+			wantSet: true,
+		},
+		{
+			name: "connection string set as well",
+			env: map[string]string{
+				envDynamoDBTable:                      "legacy",
+				string(base.EnvVarKVConnectionString): "memory://",
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{envDynamoDBTable, envDynamoDBEndpoint, string(base.EnvVarKVConnectionString)} {
+				// Setenv restores the variable afterwards, so it can be unset safely.
+				t.Setenv(name, "")
+				require.Nil(t, os.Unsetenv(name))
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			err := ApplyLegacyEnv("kernelmanager")
+			if test.err {
+				require.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+
+			connectionString, ok := os.LookupEnv(string(base.EnvVarKVConnectionString))
+			require.Equal(t, test.wantSet, ok)
+			require.Equal(t, test.want, connectionString)
+		})
+	}
+}
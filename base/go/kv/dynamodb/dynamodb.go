@@ -2,27 +2,62 @@ package dynamodb
 
 import (
 	"context"
-	"crypto/rand"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
 	"go.resf.org/peridot/base/go/awsutils"
 	"go.resf.org/peridot/base/go/kv"
-	basepb "go.resf.org/peridot/base/go/pb"
-	"google.golang.org/protobuf/proto"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// maxWriteAttempts is how many times a write retries with a revision after the one it observed.
+// Each retry moves past the revision of the write that got in between, so this is only
+// reached if the key is under constant concurrent writes.
+const maxWriteAttempts = 100
+
 type DynamoDB struct {
-	db        *dynamodb.DynamoDB
-	tableName string
+	db         *dynamodb.DynamoDB
+	streams    *dynamodbstreams.DynamoDBStreams
+	tableName  string
+	pageTokens *kv.PageTokenSigner
+	revisions  *revisionClock
+
+	pageTokenKey []byte
+}
+
+type Option func(*DynamoDB)
+
+// WithPageTokenKey sets the key used to sign page tokens.
+// All replicas must use the same key, otherwise page tokens from one replica
+// are rejected by the others. If not set, a random key is generated on startup.
+func WithPageTokenKey(key []byte) Option {
+	return func(d *DynamoDB) {
+		d.pageTokenKey = key
+	}
 }
 
 // New creates a new DynamoDB storage backend.
-func New(endpoint string, tableName string) (*DynamoDB, error) {
+func New(endpoint string, tableName string, opts ...Option) (*DynamoDB, error) {
+	d := &DynamoDB{
+		tableName: tableName,
+		revisions: &revisionClock{now: time.Now},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	pageTokens, err := kv.NewPageTokenSigner(d.pageTokenKey)
+	if err != nil {
+		return nil, err
+	}
+	d.pageTokens = pageTokens
+
 	awsCfg := &aws.Config{}
 	awsutils.FillOutConfig(awsCfg)
 
@@ -37,12 +72,30 @@ func New(endpoint string, tableName string) (*DynamoDB, error) {
 
 	svc := dynamodb.New(sess)
 
+	// Streams are used for Watch, and contain both the new and old item,
+	// so deletes still know the revision of the deleted value.
+	streamSpec := &dynamodb.StreamSpecification{
+		StreamEnabled:  aws.Bool(true),
+		StreamViewType: aws.String(dynamodb.StreamViewTypeNewAndOldImages),
+	}
+
 	// Create the table if it doesn't exist.
 	// First check if the table exists.
-	_, err = svc.DescribeTable(&dynamodb.DescribeTableInput{
+	table, err := svc.DescribeTable(&dynamodb.DescribeTableInput{
 		TableName: aws.String(tableName),
 	})
-	if err != nil {
+	if err == nil {
+		// Enable streams on tables created before Watch was supported.
+		if table.Table.StreamSpecification == nil || !aws.BoolValue(table.Table.StreamSpecification.StreamEnabled) {
+			_, err = svc.UpdateTable(&dynamodb.UpdateTableInput{
+				TableName:           aws.String(tableName),
+				StreamSpecification: streamSpec,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
 		_, err = svc.CreateTable(&dynamodb.CreateTableInput{
 			TableName: aws.String(tableName),
 			AttributeDefinitions: []*dynamodb.AttributeDefinition{
@@ -69,34 +122,62 @@ func New(endpoint string, tableName string) (*DynamoDB, error) {
 				ReadCapacityUnits:  aws.Int64(5),
 				WriteCapacityUnits: aws.Int64(5),
 			},
+			StreamSpecification: streamSpec,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// TTL can only be enabled once the table is active.
+		err = svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+			TableName: aws.String(tableName),
 		})
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return &DynamoDB{
-		db:        svc,
-		tableName: tableName,
-	}, nil
+	// Expired items are deleted by DynamoDB eventually (usually within a few days),
+	// reads filter out expired items until then.
+	ttl, err := svc.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ttl.TimeToLiveDescription == nil || aws.StringValue(ttl.TimeToLiveDescription.TimeToLiveStatus) == dynamodb.TimeToLiveStatusDisabled {
+		_, err = svc.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String(tableName),
+			TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+				AttributeName: aws.String("ExpiresAt"),
+				Enabled:       aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.db = svc
+	d.streams = dynamodbstreams.New(sess)
+
+	return d, nil
 }
 
 func (d *DynamoDB) Get(ctx context.Context, key string) (*kv.Pair, error) {
-	trimmed := strings.TrimPrefix(key, "/")
-	parts := strings.Split(trimmed, "/")
-	if len(parts) < 2 {
-		return nil, kv.ErrNoNamespace
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return nil, err
 	}
-	ns := parts[0]
 
-	result, err := d.db.GetItem(&dynamodb.GetItemInput{
+	result, err := d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(d.tableName),
 		Key: map[string]*dynamodb.AttributeValue{
 			"Key": {
 				S: aws.String(ns),
 			},
 			"Path": {
-				S: aws.String(strings.Join(parts[1:], "/")),
+				S: aws.String(path),
 			},
 		},
 	})
@@ -104,57 +185,69 @@ func (d *DynamoDB) Get(ctx context.Context, key string) (*kv.Pair, error) {
 		return nil, err
 	}
 
-	if result.Item == nil {
+	// Expired items may not have been deleted yet.
+	if result.Item == nil || isExpired(result.Item) {
 		return nil, kv.ErrNotFound
 	}
 
-	return &kv.Pair{
-		Key:   *result.Item["Key"].S,
-		Value: result.Item["Value"].B,
-	}, nil
+	return pairFromItem(result.Item), nil
 }
 
-func (d *DynamoDB) Set(ctx context.Context, key string, value []byte) error {
-	trimmed := strings.TrimPrefix(key, "/")
-	parts := strings.Split(trimmed, "/")
-	if len(parts) < 2 {
-		return kv.ErrNoNamespace
+func (d *DynamoDB) Set(ctx context.Context, key string, value []byte, opts ...kv.SetOption) error {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return err
 	}
-	ns := parts[0]
 
-	_, err := d.db.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(d.tableName),
-		Item: map[string]*dynamodb.AttributeValue{
-			"Key": {
-				S: aws.String(ns),
-			},
-			"Path": {
-				S: aws.String(strings.Join(parts[1:], "/")),
-			},
-			"Value": {
-				B: value,
-			},
-		},
-	})
-	return err
+	expiresAt := kv.NewSetOptions(opts...).ExpiresAt()
+
+	// Writers with a clock behind the key's revision retry with a revision after it,
+	// so revisions of a key always increase. Every failed attempt means another write
+	// landed in between, so concurrent writers always make progress.
+	var observed int64
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		revision := d.revisions.next(observed)
+		condition, names, values := newerRevisionCondition(revision)
+		_, err := d.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:                           aws.String(d.tableName),
+			Item:                                newItem(ns, path, value, revision, expiresAt),
+			ConditionExpression:                 condition,
+			ExpressionAttributeNames:            names,
+			ExpressionAttributeValues:           values,
+			ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+		})
+		if err == nil {
+			return nil
+		}
+
+		var failed *dynamodb.ConditionalCheckFailedException
+		if !errors.As(err, &failed) {
+			return err
+		}
+		item, err := d.conflictingItem(ctx, ns, path, failed.Item)
+		if err != nil {
+			return err
+		}
+		observed = revisionFromItem(item)
+	}
+
+	return tooManyAttempts(key)
 }
 
 func (d *DynamoDB) Delete(ctx context.Context, key string) error {
-	trimmed := strings.TrimPrefix(key, "/")
-	parts := strings.Split(trimmed, "/")
-	if len(parts) < 2 {
-		return kv.ErrNoNamespace
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return err
 	}
-	ns := parts[0]
 
-	_, err := d.db.DeleteItem(&dynamodb.DeleteItemInput{
+	_, err = d.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(d.tableName),
 		Key: map[string]*dynamodb.AttributeValue{
 			"Key": {
 				S: aws.String(ns),
 			},
 			"Path": {
-				S: aws.String(strings.Join(parts[1:], "/")),
+				S: aws.String(path),
 			},
 		},
 	})
@@ -170,21 +263,11 @@ func (d *DynamoDB) RangePrefix(ctx context.Context, prefix string, pageSize int3
 	}
 
 	// Check if there is a page token.
+	// Page tokens are signed, so they don't need to be stored.
 	var fromKey string
 	var fromPath string
 	if pageToken != "" {
-		// Get the page token from the database.
-		res, err := d.Get(ctx, fmt.Sprintf("/_internals/page_tokens/%s", pageToken))
-		if err != nil {
-			if errors.Is(err, kv.ErrNotFound) {
-				return nil, kv.ErrPageTokenNotFound
-			}
-			return nil, err
-		}
-
-		// Parse the page token.
-		pt := &basepb.DynamoDbPageToken{}
-		err = proto.Unmarshal(res.Value, pt)
+		pt, err := d.pageTokens.ParsePageToken(pageToken, prefix, pageSize)
 		if err != nil {
 			return nil, err
 		}
@@ -193,32 +276,29 @@ func (d *DynamoDB) RangePrefix(ctx context.Context, prefix string, pageSize int3
 		fromPath = pt.LastPath
 	}
 
-	trimmed := strings.TrimPrefix(prefix, "/")
-	parts := strings.Split(trimmed, "/")
-	if len(parts) < 2 {
-		return nil, kv.ErrNoNamespace
+	ns, path, err := kv.SplitKey(prefix)
+	if err != nil {
+		return nil, err
 	}
-	ns := parts[0]
 
+	// Expired items may not have been deleted yet, so filter them out.
 	queryInput := &dynamodb.QueryInput{
-		TableName: aws.String(d.tableName),
-		KeyConditions: map[string]*dynamodb.Condition{
-			"Key": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(ns),
-					},
-				},
+		TableName:              aws.String(d.tableName),
+		KeyConditionExpression: aws.String("#key = :ns AND begins_with(#path, :path)"),
+		FilterExpression:       aws.String(notExpiredCondition),
+		ExpressionAttributeNames: map[string]*string{
+			"#key":  aws.String("Key"),
+			"#path": aws.String("Path"),
+			"#exp":  aws.String("ExpiresAt"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":ns": {
+				S: aws.String(ns),
 			},
-			"Path": {
-				ComparisonOperator: aws.String("BEGINS_WITH"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(strings.Join(parts[1:], "/")),
-					},
-				},
+			":path": {
+				S: aws.String(path),
 			},
+			":now": nowValue(),
 		},
 		Limit: aws.Int64(int64(pageSize + 1)),
 	}
@@ -232,7 +312,7 @@ func (d *DynamoDB) RangePrefix(ctx context.Context, prefix string, pageSize int3
 			},
 		}
 	}
-	result, err := d.db.Query(queryInput)
+	result, err := d.db.QueryWithContext(ctx, queryInput)
 	if err != nil {
 		return nil, err
 	}
@@ -243,10 +323,7 @@ func (d *DynamoDB) RangePrefix(ctx context.Context, prefix string, pageSize int3
 		if len(pairs) >= int(pageSize) {
 			break
 		}
-		pairs = append(pairs, &kv.Pair{
-			Key:   *item["Key"].S,
-			Value: item["Value"].B,
-		})
+		pairs = append(pairs, pairFromItem(item))
 	}
 
 	var nextToken string
@@ -266,63 +343,495 @@ func (d *DynamoDB) RangePrefix(ctx context.Context, prefix string, pageSize int3
 	}
 
 	if lastEvalKey != "" && lastEvalPath != "" {
-		// Add page token to the database.
-		ptKey, err := generatePageToken()
+		nextToken, err = d.pageTokens.NewPageToken(lastEvalKey, lastEvalPath, prefix, pageSize)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		ptBytes, err := proto.Marshal(&basepb.DynamoDbPageToken{
-			LastKey:  lastEvalKey,
-			LastPath: lastEvalPath,
+	return &kv.Query{
+		Prefix:    prefix,
+		Pairs:     pairs,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (d *DynamoDB) Create(ctx context.Context, key string, value []byte, opts ...kv.SetOption) (int64, error) {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// An expired item is only replaced at a higher revision, so a key that is created again
+	// after expiring, like a lease that is taken over, never goes back in revision.
+	// Writers with a clock behind retry with a revision after the expired item.
+	expiresAt := kv.NewSetOptions(opts...).ExpiresAt()
+	var observed int64
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		revision := d.revisions.next(observed)
+		condition, names, values := createCondition(revision)
+		_, err = d.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:                           aws.String(d.tableName),
+			Item:                                newItem(ns, path, value, revision, expiresAt),
+			ConditionExpression:                 condition,
+			ExpressionAttributeNames:            names,
+			ExpressionAttributeValues:           values,
+			ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
 		})
+		if err == nil {
+			return revision, nil
+		}
+
+		var failed *dynamodb.ConditionalCheckFailedException
+		if !errors.As(err, &failed) {
+			return 0, err
+		}
+		item, err := d.conflictingItem(ctx, ns, path, failed.Item)
+		if err != nil {
+			return 0, err
+		}
+		if item != nil && !isExpired(item) {
+			return 0, kv.ErrConflict
+		}
+		observed = revisionFromItem(item)
+	}
+
+	return 0, tooManyAttempts(key)
+}
+
+func (d *DynamoDB) SetIfRevision(ctx context.Context, key string, value []byte, revision int64, opts ...kv.SetOption) (int64, error) {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	newRevision := d.revisions.next(revision)
+	condition, names, values := revisionCondition(revision)
+	_, err = d.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(d.tableName),
+		Item:                      newItem(ns, path, value, newRevision, kv.NewSetOptions(opts...).ExpiresAt()),
+		ConditionExpression:       condition,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return 0, kv.ErrConflict
+		}
+		return 0, err
+	}
+
+	return newRevision, nil
+}
+
+func (d *DynamoDB) DeleteIfRevision(ctx context.Context, key string, revision int64) error {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return err
+	}
+
+	condition, names, values := revisionCondition(revision)
+	_, err = d.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {
+				S: aws.String(ns),
+			},
+			"Path": {
+				S: aws.String(path),
+			},
+		},
+		ConditionExpression:       condition,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return kv.ErrConflict
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (d *DynamoDB) Txn(ctx context.Context, ops ...*kv.Op) (int64, error) {
+	err := kv.ValidateTxn(ops)
+	if err != nil {
+		return 0, err
+	}
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	// The new revision has to be after every revision the transaction checks.
+	var observed int64
+	for _, op := range ops {
+		if op.Revision > observed {
+			observed = op.Revision
+		}
+	}
+
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		revision := d.revisions.next(observed)
+		items, err := d.txnItems(ops, revision)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = d.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: items,
+		})
+		if err == nil {
+			return revision, nil
+		}
+
+		var canceled *dynamodb.TransactionCanceledException
+		if !errors.As(err, &canceled) {
+			return 0, err
+		}
+
+		// Only retry if the sole failed conditions are the revision guards of plain sets,
+		// or creates of expired keys.
+		retry := false
+		for i, reason := range canceled.CancellationReasons {
+			if aws.StringValue(reason.Code) != "ConditionalCheckFailed" {
+				continue
+			}
+			if i >= len(ops) || (ops[i].Type != kv.OpSet && ops[i].Type != kv.OpCreate) {
+				return 0, kv.ErrConflict
+			}
+
+			ns, path, err := kv.SplitKey(ops[i].Key)
+			if err != nil {
+				return 0, err
+			}
+			item, err := d.conflictingItem(ctx, ns, path, reason.Item)
+			if err != nil {
+				return 0, err
+			}
+			if ops[i].Type == kv.OpCreate && item != nil && !isExpired(item) {
+				return 0, kv.ErrConflict
+			}
+
+			retry = true
+			if itemRevision := revisionFromItem(item); itemRevision > observed {
+				observed = itemRevision
+			}
+		}
+		if !retry {
+			return 0, err
+		}
+	}
+
+	return 0, tooManyAttempts("transaction")
+}
+
+// conflictingItem returns the item a conditional write failed on, or nil if it doesn't exist.
+// Emulators like older LocalStack versions ignore ReturnValuesOnConditionCheckFailure,
+// so without a returned item, it is read again.
+func (d *DynamoDB) conflictingItem(ctx context.Context, ns string, path string, item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	if item != nil {
+		return item, nil
+	}
+
+	result, err := d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"Key": {
+				S: aws.String(ns),
+			},
+			"Path": {
+				S: aws.String(path),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Item, nil
+}
+
+// tooManyAttempts is returned when a write keeps failing to move past newer revisions.
+func tooManyAttempts(key string) error {
+	return fmt.Errorf("failed to write %s after %d attempts, concurrent writers kept moving it to newer revisions", key, maxWriteAttempts)
+}
+
+// txnItems converts transaction operations to DynamoDB transaction items that write at the given revision.
+func (d *DynamoDB) txnItems(ops []*kv.Op, revision int64) ([]*dynamodb.TransactWriteItem, error) {
+	items := make([]*dynamodb.TransactWriteItem, 0, len(ops))
+	for _, op := range ops {
+		ns, path, err := kv.SplitKey(op.Key)
 		if err != nil {
 			return nil, err
 		}
 
-		// Create the page token in the database, and it should expire in 2 days.
-		_, err = d.db.PutItem(&dynamodb.PutItemInput{
-			TableName: aws.String(d.tableName),
-			Item: map[string]*dynamodb.AttributeValue{
-				"Key": {
-					S: aws.String("_internals"),
+		key := map[string]*dynamodb.AttributeValue{
+			"Key": {
+				S: aws.String(ns),
+			},
+			"Path": {
+				S: aws.String(path),
+			},
+		}
+		item := newItem(ns, path, op.Value, revision, op.ExpiresAt())
+
+		switch op.Type {
+		case kv.OpSet:
+			condition, names, values := newerRevisionCondition(revision)
+			items = append(items, &dynamodb.TransactWriteItem{
+				Put: &dynamodb.Put{
+					TableName:                           aws.String(d.tableName),
+					Item:                                item,
+					ConditionExpression:                 condition,
+					ExpressionAttributeNames:            names,
+					ExpressionAttributeValues:           values,
+					ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
 				},
-				"Path": {
-					S: aws.String(fmt.Sprintf("page_tokens/%s", ptKey)),
+			})
+		case kv.OpCreate:
+			condition, names, values := createCondition(revision)
+			items = append(items, &dynamodb.TransactWriteItem{
+				Put: &dynamodb.Put{
+					TableName:                           aws.String(d.tableName),
+					Item:                                item,
+					ConditionExpression:                 condition,
+					ExpressionAttributeNames:            names,
+					ExpressionAttributeValues:           values,
+					ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
 				},
-				"Value": {
-					B: ptBytes,
+			})
+		case kv.OpSetIfRevision:
+			condition, names, values := revisionCondition(op.Revision)
+			items = append(items, &dynamodb.TransactWriteItem{
+				Put: &dynamodb.Put{
+					TableName:                 aws.String(d.tableName),
+					Item:                      item,
+					ConditionExpression:       condition,
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
 				},
-				"ExpiresAt": {
-					N: aws.String(fmt.Sprintf("%d", time.Now().Add(48*time.Hour).Unix())),
+			})
+		case kv.OpDelete:
+			items = append(items, &dynamodb.TransactWriteItem{
+				Delete: &dynamodb.Delete{
+					TableName: aws.String(d.tableName),
+					Key:       key,
 				},
-			},
-		})
-		if err != nil {
-			return nil, err
+			})
+		case kv.OpDeleteIfRevision:
+			condition, names, values := revisionCondition(op.Revision)
+			items = append(items, &dynamodb.TransactWriteItem{
+				Delete: &dynamodb.Delete{
+					TableName:                 aws.String(d.tableName),
+					Key:                       key,
+					ConditionExpression:       condition,
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
+				},
+			})
+		case kv.OpCheckRevision:
+			condition, names, values := revisionCondition(op.Revision)
+			items = append(items, &dynamodb.TransactWriteItem{
+				ConditionCheck: &dynamodb.ConditionCheck{
+					TableName:                 aws.String(d.tableName),
+					Key:                       key,
+					ConditionExpression:       condition,
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
+				},
+			})
+		default:
+			return nil, fmt.Errorf("unknown op type %d", op.Type)
+		}
+	}
+
+	return items, nil
+}
+
+// revisionClock issues revisions without a shared counter, which would cost a round trip
+// per write and be a hot key. Revisions are hybrid logical clock timestamps:
+// microseconds since the epoch, moved past every revision issued or observed before.
+// Writes to the same key always get increasing revisions, as conditional writes observe
+// the revision they replace, and plain sets and creates retry past newer revisions,
+// including those of expired items. A deleted key has no revision left to move past,
+// so keys whose revisions must keep increasing are written with kv.WithExpired instead.
+// Across keys, revisions are only ordered as well as the writers' clocks are synchronized.
+type revisionClock struct {
+	lock sync.Mutex
+	now  func() time.Time
+	last int64
+}
+
+// next returns a new revision after both the previous one and observed.
+func (c *revisionClock) next(observed int64) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if observed > c.last {
+		c.last = observed
+	}
+	revision := c.now().UnixMicro()
+	if revision <= c.last {
+		revision = c.last + 1
+	}
+	c.last = revision
+
+	return revision
+}
+
+// notExpiredCondition matches items that don't expire or haven't expired yet.
+// Requires the #exp name and :now value.
+const notExpiredCondition = "(attribute_not_exists(#exp) OR #exp > :now)"
+
+// createCondition returns a condition expression that only matches if the item doesn't exist,
+// or has expired at an older revision than the given one.
+func createCondition(revision int64) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	names := map[string]*string{
+		"#path": aws.String("Path"),
+		"#exp":  aws.String("ExpiresAt"),
+		"#rev":  aws.String("Revision"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":now": nowValue(),
+		":rev": {
+			N: aws.String(strconv.FormatInt(revision, 10)),
+		},
+	}
+
+	return aws.String("attribute_not_exists(#path) OR (#exp <= :now AND (attribute_not_exists(#rev) OR #rev < :rev))"), names, values
+}
+
+// newerRevisionCondition returns a condition expression that only matches if the item
+// doesn't exist, or is at an older revision than the given one.
+func newerRevisionCondition(revision int64) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	names := map[string]*string{
+		"#rev": aws.String("Revision"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":rev": {
+			N: aws.String(strconv.FormatInt(revision, 10)),
+		},
+	}
+
+	return aws.String("attribute_not_exists(#rev) OR #rev < :rev"), names, values
+}
+
+// revisionCondition returns a condition expression that only matches an existing, unexpired item at the given revision.
+// Items written before revisions were introduced don't have a revision attribute and match revision 0.
+func revisionCondition(revision int64) (*string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	names := map[string]*string{
+		"#path": aws.String("Path"),
+		"#rev":  aws.String("Revision"),
+		"#exp":  aws.String("ExpiresAt"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":now": nowValue(),
+	}
+	if revision == 0 {
+		return aws.String("attribute_exists(#path) AND attribute_not_exists(#rev) AND " + notExpiredCondition), names, values
+	}
+
+	values[":rev"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(revision, 10)),
+	}
+	return aws.String("attribute_exists(#path) AND #rev = :rev AND " + notExpiredCondition), names, values
+}
+
+// newItem returns the item for a key, expiresAt is only set if it isn't zero.
+// DynamoDB TTL expects ExpiresAt to be in unix seconds, so it is rounded up
+// to make sure keys never expire early.
+func newItem(ns string, path string, value []byte, revision int64, expiresAt time.Time) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"Key": {
+			S: aws.String(ns),
+		},
+		"Path": {
+			S: aws.String(path),
+		},
+		"Value": {
+			B: value,
+		},
+		"Revision": {
+			N: aws.String(strconv.FormatInt(revision, 10)),
+		},
+	}
+	if !expiresAt.IsZero() {
+		item["ExpiresAt"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(expiresAtSeconds(expiresAt), 10)),
 		}
+	}
 
-		nextToken = ptKey
+	return item
+}
+
+// expiresAtSeconds rounds expiresAt up to whole unix seconds.
+func expiresAtSeconds(expiresAt time.Time) int64 {
+	seconds := expiresAt.Unix()
+	if expiresAt.After(time.Unix(seconds, 0)) {
+		seconds++
 	}
 
-	return &kv.Query{
-		Prefix:    prefix,
-		Pairs:     pairs,
-		NextToken: nextToken,
-	}, nil
+	return seconds
+}
+
+func pairFromItem(item map[string]*dynamodb.AttributeValue) *kv.Pair {
+	pair := &kv.Pair{
+		Key:      fmt.Sprintf("/%s/%s", aws.StringValue(item["Key"].S), aws.StringValue(item["Path"].S)),
+		Value:    item["Value"].B,
+		Revision: revisionFromItem(item),
+	}
+	if expiresAt := expiresAtFromItem(item); expiresAt != 0 {
+		pair.ExpiresAt = time.Unix(expiresAt, 0)
+	}
+
+	return pair
 }
 
-func generatePageToken() (string, error) {
-	possible := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
-	token := make([]byte, 48)
-	_, err := rand.Read(token)
+func nowValue() *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+	}
+}
+
+func isExpired(item map[string]*dynamodb.AttributeValue) bool {
+	expiresAt := expiresAtFromItem(item)
+	return expiresAt != 0 && expiresAt <= time.Now().Unix()
+}
+
+func expiresAtFromItem(item map[string]*dynamodb.AttributeValue) int64 {
+	attr, ok := item["ExpiresAt"]
+	if !ok || attr.N == nil {
+		return 0
+	}
+
+	expiresAt, err := strconv.ParseInt(*attr.N, 10, 64)
 	if err != nil {
-		return "", err
+		return 0
 	}
 
-	for i := 0; i < len(token); i++ {
-		token[i] = possible[token[i]%byte(len(possible))]
+	return expiresAt
+}
+
+func revisionFromItem(item map[string]*dynamodb.AttributeValue) int64 {
+	attr, ok := item["Revision"]
+	if !ok || attr.N == nil {
+		return 0
+	}
+
+	revision, err := strconv.ParseInt(*attr.N, 10, 64)
+	if err != nil {
+		return 0
 	}
 
-	return "v1." + string(token), nil
+	return revision
+}
+
+func isConditionalCheckFailed(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
 }
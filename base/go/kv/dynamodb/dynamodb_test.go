@@ -0,0 +1,240 @@
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	"go.resf.org/peridot/base/go/kv/dynamodb/dynamodbtest"
+	"go.resf.org/peridot/base/go/kv/kvtest"
+	"go.resf.org/peridot/base/go/kv/lease"
+	"os"
+	"testing"
+	"time"
+)
+
+// testEndpoint returns KVTEST_DYNAMODB_ENDPOINT if set, so the tests can run against
+// DynamoDB or an emulator like LocalStack, and starts an in-process fake otherwise.
+func testEndpoint(t *testing.T) string {
+	if endpoint := os.Getenv("KVTEST_DYNAMODB_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+
+	return testServer(t)
+}
+
+// testServer starts an in-process fake and returns its endpoint.
+func testServer(t *testing.T, opts ...dynamodbtest.Option) string {
+	// The fake doesn't check credentials, but the client needs some to sign requests.
+	t.Setenv("AWS_ACCESS_KEY_ID", "kvtest")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "kvtest")
+
+	server := dynamodbtest.NewServer(opts...)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// newTestDynamoDB creates a DynamoDB backend with its own table, which is deleted afterwards.
+func newTestDynamoDB(t *testing.T, endpoint string, opts ...Option) *DynamoDB {
+	d, err := New(endpoint, fmt.Sprintf("kvtest_%d", time.Now().UnixNano()), opts...)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		_, err := d.db.DeleteTable(&dynamodb.DeleteTableInput{
+			TableName: aws.String(d.tableName),
+		})
+		require.Nil(t, err)
+	})
+	return d
+}
+
+func TestConformance(t *testing.T) {
+	endpoint := testEndpoint(t)
+
+	kvtest.RunConformance(t, func(t *testing.T) kv.KV {
+		return newTestDynamoDB(t, endpoint)
+	})
+}
+
+// newSkewedReplicas returns two replicas on the same table, one with a clock an hour
+// ahead and one with a clock an hour behind.
+func newSkewedReplicas(t *testing.T, endpoint string) (*DynamoDB, *DynamoDB) {
+	ahead := newTestDynamoDB(t, endpoint)
+	ahead.revisions.now = func() time.Time { return time.Now().Add(time.Hour) }
+
+	behind, err := New(endpoint, ahead.tableName)
+	require.Nil(t, err)
+	behind.revisions.now = func() time.Time { return time.Now().Add(-time.Hour) }
+
+	return ahead, behind
+}
+
+func TestRevisions_SkewedClocks(t *testing.T) {
+	testSkewedClocks(t, testEndpoint(t))
+}
+
+// Older emulators don't return the current item of a failed condition,
+// writes read it again instead of retrying blindly.
+func TestRevisions_SkewedClocks_NoReturnValues(t *testing.T) {
+	testSkewedClocks(t, testServer(t, dynamodbtest.WithoutReturnValues()))
+}
+
+func testSkewedClocks(t *testing.T, endpoint string) {
+	ctx := context.Background()
+	ahead, behind := newSkewedReplicas(t, endpoint)
+
+	revision, err := ahead.Create(ctx, "/test/key", []byte("ahead"))
+	require.Nil(t, err)
+
+	// Plain sets from the replica that is behind still move the revision forward.
+	require.Nil(t, behind.Set(ctx, "/test/key", []byte("behind")))
+	pair, err := ahead.Get(ctx, "/test/key")
+	require.Nil(t, err)
+	require.Equal(t, []byte("behind"), pair.Value)
+	require.Greater(t, pair.Revision, revision)
+
+	// So do conditional writes and transactions.
+	next, err := behind.SetIfRevision(ctx, "/test/key", []byte("conditional"), pair.Revision)
+	require.Nil(t, err)
+	require.Greater(t, next, pair.Revision)
+
+	_, err = ahead.Create(ctx, "/test/other", []byte("ahead"))
+	require.Nil(t, err)
+	txnRevision, err := behind.Txn(ctx, kv.SetOp("/test/key", []byte("txn")), kv.SetOp("/test/other", []byte("txn")))
+	require.Nil(t, err)
+	require.Greater(t, txnRevision, next)
+	pair, err = ahead.Get(ctx, "/test/other")
+	require.Nil(t, err)
+	require.Equal(t, txnRevision, pair.Revision)
+
+	// Stale revisions still conflict.
+	_, err = behind.SetIfRevision(ctx, "/test/key", []byte("stale"), next)
+	require.ErrorIs(t, err, kv.ErrConflict)
+	_, err = behind.Txn(ctx, kv.SetOp("/test/other", []byte("stale")), kv.CheckRevisionOp("/test/key", next))
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+}
+
+func TestRevisions_SkewedClocks_Create(t *testing.T) {
+	testSkewedCreate(t, testEndpoint(t))
+}
+
+func TestRevisions_SkewedClocks_Create_NoReturnValues(t *testing.T) {
+	testSkewedCreate(t, testServer(t, dynamodbtest.WithoutReturnValues()))
+}
+
+// expire writes a key as expired and returns the revision of the expired item.
+func expire(t *testing.T, d *DynamoDB, key string) int64 {
+	ctx := context.Background()
+
+	revision, err := d.Create(ctx, key, []byte("expiring"))
+	require.Nil(t, err)
+	expired, err := d.SetIfRevision(ctx, key, []byte("expired"), revision, kv.WithExpired())
+	require.Nil(t, err)
+	_, err = d.Get(ctx, key)
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	return expired
+}
+
+func testSkewedCreate(t *testing.T, endpoint string) {
+	ctx := context.Background()
+	ahead, behind := newSkewedReplicas(t, endpoint)
+
+	// Creating a key over an expired item moves past the expired revision.
+	expired := expire(t, ahead, "/test/key")
+	created, err := behind.Create(ctx, "/test/key", []byte("behind"))
+	require.Nil(t, err)
+	require.Greater(t, created, expired)
+
+	// Live keys still conflict.
+	_, err = behind.Create(ctx, "/test/key", []byte("behind"))
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+	// So does a create in a transaction, the clock ahead moves further so the
+	// replica behind hasn't seen the expired revision yet.
+	ahead.revisions.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	expired = expire(t, ahead, "/test/txn")
+	txnRevision, err := behind.Txn(ctx, kv.CreateOp("/test/txn", []byte("txn")))
+	require.Nil(t, err)
+	require.Greater(t, txnRevision, expired)
+
+	_, err = behind.Txn(ctx, kv.CreateOp("/test/txn", []byte("txn")))
+	require.ErrorIs(t, err, kv.ErrConflict)
+}
+
+// Leases use revisions as fencing tokens, so they must increase across holders
+// even when a replica with a clock behind takes over.
+func TestLease_SkewedClocks(t *testing.T) {
+	ctx := context.Background()
+	ahead, behind := newSkewedReplicas(t, testEndpoint(t))
+
+	// Taking over an expired lease.
+	first, err := lease.TryAcquire(ctx, ahead, "/leases/skewed", lease.WithTTL(time.Hour))
+	require.Nil(t, err)
+	pair, err := ahead.Get(ctx, "/leases/skewed")
+	require.Nil(t, err)
+	_, err = ahead.SetIfRevision(ctx, "/leases/skewed", pair.Value, pair.Revision, kv.WithExpired())
+	require.Nil(t, err)
+	second, err := lease.TryAcquire(ctx, behind, "/leases/skewed", lease.WithTTL(time.Hour))
+	require.Nil(t, err)
+	require.Greater(t, second.Token(), first.Token())
+	require.ErrorIs(t, first.Release(ctx), lease.ErrLost)
+
+	// Acquiring a released lease.
+	require.Nil(t, second.Release(ctx))
+	third, err := lease.TryAcquire(ctx, ahead, "/leases/skewed", lease.WithTTL(time.Hour))
+	require.Nil(t, err)
+	require.Nil(t, third.Release(ctx))
+	fourth, err := lease.TryAcquire(ctx, behind, "/leases/skewed", lease.WithTTL(time.Hour))
+	require.Nil(t, err)
+	require.Greater(t, fourth.Token(), third.Token())
+	require.Nil(t, fourth.Release(ctx))
+}
+
+func TestRevisions_NoInternalItems(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDynamoDB(t, testEndpoint(t))
+
+	_, err := d.Create(ctx, "/test/key", []byte("value"))
+	require.Nil(t, err)
+	require.Nil(t, d.Set(ctx, "/test/key", []byte("value")))
+
+	// Revisions don't need a counter item.
+	query, err := d.RangePrefix(ctx, "/_internals/", 0, "")
+	require.Nil(t, err)
+	require.Empty(t, query.Pairs)
+}
+
+func TestRevisionClock(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := &revisionClock{now: func() time.Time { return now }}
+
+	first := c.next(0)
+	require.Equal(t, now.UnixMicro(), first)
+
+	// The clock doesn't move, revisions still increase.
+	second := c.next(0)
+	require.Equal(t, first+1, second)
+
+	// Revisions from writers with a clock ahead are skipped past.
+	ahead := now.Add(time.Hour).UnixMicro()
+	require.Equal(t, ahead+1, c.next(ahead))
+	require.Equal(t, ahead+2, c.next(0))
+
+	// Once the clock catches up, it is used again.
+	now = now.Add(2 * time.Hour)
+	require.Equal(t, now.UnixMicro(), c.next(first))
+}
+
+func TestExpiresAtSeconds(t *testing.T) {
+	whole := time.Unix(1700000000, 0)
+	require.Equal(t, int64(1700000000), expiresAtSeconds(whole))
+	require.Equal(t, int64(1700000001), expiresAtSeconds(whole.Add(time.Millisecond)))
+	require.Equal(t, int64(1700000001), expiresAtSeconds(whole.Add(999*time.Millisecond)))
+
+	// Sub-second TTLs don't expire immediately.
+	item := newItem("test", "key", []byte("value"), 1, time.Now().Add(100*time.Millisecond))
+	require.False(t, isExpired(item))
+}
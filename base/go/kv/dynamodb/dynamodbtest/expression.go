@@ -0,0 +1,296 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodbtest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"math/big"
+	"strings"
+	"unicode"
+)
+
+// expression is a parsed condition, filter or key condition expression.
+// Only the subset used by the kv backend is supported: comparisons, AND, OR, NOT,
+// parentheses, attribute_exists, attribute_not_exists and begins_with.
+type expression struct {
+	tokens []string
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+// evaluate returns whether the item matches the expression.
+// An empty expression matches every item.
+func evaluate(expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if aws.StringValue(expr) == "" {
+		return true, nil
+	}
+
+	tokens, err := tokenize(*expr)
+	if err != nil {
+		return false, err
+	}
+	e := &expression{
+		tokens: tokens,
+		names:  names,
+		values: values,
+	}
+
+	matches, err := e.or(item)
+	if err != nil {
+		return false, err
+	}
+	if e.pos != len(e.tokens) {
+		return false, fmt.Errorf("unexpected %q in expression", e.tokens[e.pos])
+	}
+
+	return matches, nil
+}
+
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),=", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '<' || c == '>':
+			// <, <=, <>, > and >=
+			if i+1 < len(expr) && (expr[i+1] == '=' || (c == '<' && expr[i+1] == '>')) {
+				tokens = append(tokens, expr[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, string(c))
+				i++
+			}
+		case c == '#' || c == ':' || c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			start := i
+			i++
+			for i < len(expr) && (expr[i] == '_' || unicode.IsLetter(rune(expr[i])) || unicode.IsDigit(rune(expr[i]))) {
+				i++
+			}
+			tokens = append(tokens, expr[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected %q in expression", c)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (e *expression) peek() string {
+	if e.pos >= len(e.tokens) {
+		return ""
+	}
+	return e.tokens[e.pos]
+}
+
+func (e *expression) expect(token string) error {
+	if e.peek() != token {
+		return fmt.Errorf("expected %q in expression, got %q", token, e.peek())
+	}
+	e.pos++
+	return nil
+}
+
+func (e *expression) or(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	matches, err := e.and(item)
+	if err != nil {
+		return false, err
+	}
+	for strings.EqualFold(e.peek(), "OR") {
+		e.pos++
+		right, err := e.and(item)
+		if err != nil {
+			return false, err
+		}
+		matches = matches || right
+	}
+
+	return matches, nil
+}
+
+func (e *expression) and(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	matches, err := e.not(item)
+	if err != nil {
+		return false, err
+	}
+	for strings.EqualFold(e.peek(), "AND") {
+		e.pos++
+		right, err := e.not(item)
+		if err != nil {
+			return false, err
+		}
+		matches = matches && right
+	}
+
+	return matches, nil
+}
+
+func (e *expression) not(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	if strings.EqualFold(e.peek(), "NOT") {
+		e.pos++
+		matches, err := e.not(item)
+		return !matches, err
+	}
+
+	return e.primary(item)
+}
+
+func (e *expression) primary(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	token := e.peek()
+	switch {
+	case token == "(":
+		e.pos++
+		matches, err := e.or(item)
+		if err != nil {
+			return false, err
+		}
+		return matches, e.expect(")")
+	case token == "attribute_exists" || token == "attribute_not_exists":
+		e.pos++
+		args, err := e.args(item, 1)
+		if err != nil {
+			return false, err
+		}
+		exists := args[0] != nil
+		return exists == (token == "attribute_exists"), nil
+	case token == "begins_with":
+		e.pos++
+		args, err := e.args(item, 2)
+		if err != nil {
+			return false, err
+		}
+		if args[0] == nil || args[1] == nil {
+			return false, nil
+		}
+		if args[0].S != nil && args[1].S != nil {
+			return strings.HasPrefix(*args[0].S, *args[1].S), nil
+		}
+		return args[0].B != nil && args[1].B != nil && bytes.HasPrefix(args[0].B, args[1].B), nil
+	}
+
+	left, err := e.operand(item)
+	if err != nil {
+		return false, err
+	}
+	op := e.peek()
+	e.pos++
+	right, err := e.operand(item)
+	if err != nil {
+		return false, err
+	}
+
+	// Comparisons with missing attributes never match.
+	if left == nil || right == nil {
+		return false, nil
+	}
+	cmp, ok := compare(left, right)
+	if !ok {
+		return false, nil
+	}
+
+	switch op {
+	case "=":
+		return cmp == 0, nil
+	case "<>":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	default:
+		return false, fmt.Errorf("unsupported operator %q in expression", op)
+	}
+}
+
+// args parses the arguments of a function call.
+func (e *expression) args(item map[string]*dynamodb.AttributeValue, n int) ([]*dynamodb.AttributeValue, error) {
+	err := e.expect("(")
+	if err != nil {
+		return nil, err
+	}
+
+	var args []*dynamodb.AttributeValue
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			err := e.expect(",")
+			if err != nil {
+				return nil, err
+			}
+		}
+		arg, err := e.operand(item)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, e.expect(")")
+}
+
+// operand returns the value of an attribute or placeholder, nil if the attribute doesn't exist.
+func (e *expression) operand(item map[string]*dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	token := e.peek()
+	e.pos++
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case strings.HasPrefix(token, ":"):
+		value, ok := e.values[token]
+		if !ok {
+			return nil, fmt.Errorf("undefined expression attribute value %s", token)
+		}
+		return value, nil
+	case strings.HasPrefix(token, "#"):
+		name, ok := e.names[token]
+		if !ok {
+			return nil, fmt.Errorf("undefined expression attribute name %s", token)
+		}
+		return item[*name], nil
+	default:
+		return item[token], nil
+	}
+}
+
+// compare compares two values of the same type, ok is false if they can't be compared.
+func compare(a *dynamodb.AttributeValue, b *dynamodb.AttributeValue) (int, bool) {
+	switch {
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), true
+	case a.N != nil && b.N != nil:
+		x, okX := new(big.Rat).SetString(*a.N)
+		y, okY := new(big.Rat).SetString(*b.N)
+		if !okX || !okY {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case a.B != nil && b.B != nil:
+		return bytes.Compare(a.B, b.B), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,727 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dynamodbtest is an in-process fake of the DynamoDB and DynamoDB Streams
+// APIs, so the DynamoDB kv backend can be tested without AWS or an emulator.
+// Only the calls and expressions the backend uses are implemented, and expired
+// items are never deleted, like DynamoDB may take days to delete them.
+package dynamodbtest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// shardId is the only shard of every stream.
+	shardId = "shardId-00000000000000000001"
+	// maxRecords is the maximum number of stream records returned at once.
+	maxRecords = 1000
+)
+
+// Server is a fake DynamoDB endpoint, use URL as the endpoint of the client.
+// All state is kept in memory and lost once the server is closed.
+type Server struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	tables   map[string]*table
+	sequence int64
+
+	ignoreReturnValues bool
+}
+
+type Option func(*Server)
+
+// WithoutReturnValues ignores ReturnValuesOnConditionCheckFailure, so failed conditions
+// never return the current item, like older LocalStack versions.
+func WithoutReturnValues() Option {
+	return func(s *Server) {
+		s.ignoreReturnValues = true
+	}
+}
+
+type table struct {
+	description *dynamodb.TableDescription
+	ttl         *dynamodb.TimeToLiveDescription
+	hashKey     string
+	rangeKey    string
+	// items are keyed by the hash key, then the range key.
+	items   map[string]map[string]map[string]*dynamodb.AttributeValue
+	records []*dynamodbstreams.Record
+}
+
+// apiError is returned to the client as a typed exception.
+type apiError struct {
+	code      string
+	exception interface{}
+}
+
+// errorMessage is the body of exceptions without any other fields.
+type errorMessage struct {
+	_ struct{} `type:"structure"`
+
+	Message *string `locationName:"message" type:"string"`
+}
+
+func newError(code string, format string, args ...interface{}) *apiError {
+	return &apiError{
+		code:      code,
+		exception: &errorMessage{Message: aws.String(fmt.Sprintf(format, args...))},
+	}
+}
+
+// NewServer starts a fake DynamoDB server.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		tables: map[string]*table{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Targets look like DynamoDB_20120810.GetItem or DynamoDBStreams_20120810.GetRecords.
+	_, operation, _ := strings.Cut(r.Header.Get("X-Amz-Target"), ".")
+
+	s.lock.Lock()
+	output, apiErr := s.call(operation, body)
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if apiErr != nil {
+		exception, err := jsonutil.BuildJSON(apiErr.exception)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, `{"__type":"com.amazonaws.dynamodb.v20120810#%s"`, apiErr.code)
+		if len(exception) > 2 {
+			_, _ = w.Write([]byte(","))
+		}
+		_, _ = w.Write(exception[1:])
+		return
+	}
+
+	res, err := jsonutil.BuildJSON(output)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(res)
+}
+
+// call decodes the input of an operation, and runs it.
+func (s *Server) call(operation string, body []byte) (interface{}, *apiError) {
+	decode := func(input interface{}) *apiError {
+		err := jsonutil.UnmarshalJSON(input, bytes.NewReader(body))
+		if err != nil {
+			return newError("ValidationException", "invalid input: %v", err)
+		}
+		return nil
+	}
+
+	switch operation {
+	case "CreateTable":
+		input := &dynamodb.CreateTableInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.createTable(input)
+	case "DescribeTable":
+		input := &dynamodb.DescribeTableInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		t, err := s.table(input.TableName)
+		if err != nil {
+			return nil, err
+		}
+		return &dynamodb.DescribeTableOutput{Table: t.description}, nil
+	case "UpdateTable":
+		input := &dynamodb.UpdateTableInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.updateTable(input)
+	case "DeleteTable":
+		input := &dynamodb.DeleteTableInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		t, err := s.table(input.TableName)
+		if err != nil {
+			return nil, err
+		}
+		delete(s.tables, aws.StringValue(input.TableName))
+		return &dynamodb.DeleteTableOutput{TableDescription: t.description}, nil
+	case "DescribeTimeToLive":
+		input := &dynamodb.DescribeTimeToLiveInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		t, err := s.table(input.TableName)
+		if err != nil {
+			return nil, err
+		}
+		return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: t.ttl}, nil
+	case "UpdateTimeToLive":
+		input := &dynamodb.UpdateTimeToLiveInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		t, err := s.table(input.TableName)
+		if err != nil {
+			return nil, err
+		}
+		status := dynamodb.TimeToLiveStatusDisabled
+		if aws.BoolValue(input.TimeToLiveSpecification.Enabled) {
+			status = dynamodb.TimeToLiveStatusEnabled
+		}
+		t.ttl = &dynamodb.TimeToLiveDescription{
+			AttributeName:    input.TimeToLiveSpecification.AttributeName,
+			TimeToLiveStatus: aws.String(status),
+		}
+		return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: input.TimeToLiveSpecification}, nil
+	case "GetItem":
+		input := &dynamodb.GetItemInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		t, err := s.table(input.TableName)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.validateKey(input.Key); err != nil {
+			return nil, err
+		}
+		return &dynamodb.GetItemOutput{Item: t.get(input.Key)}, nil
+	case "PutItem":
+		input := &dynamodb.PutItemInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.putItem(input)
+	case "DeleteItem":
+		input := &dynamodb.DeleteItemInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.deleteItem(input)
+	case "Query":
+		input := &dynamodb.QueryInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.query(input)
+	case "TransactWriteItems":
+		input := &dynamodb.TransactWriteItemsInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.transactWriteItems(input)
+	case "DescribeStream":
+		input := &dynamodbstreams.DescribeStreamInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.describeStream(input)
+	case "GetShardIterator":
+		input := &dynamodbstreams.GetShardIteratorInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.getShardIterator(input)
+	case "GetRecords":
+		input := &dynamodbstreams.GetRecordsInput{}
+		if err := decode(input); err != nil {
+			return nil, err
+		}
+		return s.getRecords(input)
+	default:
+		return nil, newError("UnknownOperationException", "unsupported operation %q", operation)
+	}
+}
+
+func (s *Server) table(name *string) (*table, *apiError) {
+	t, ok := s.tables[aws.StringValue(name)]
+	if !ok {
+		return nil, newError("ResourceNotFoundException", "table %s not found", aws.StringValue(name))
+	}
+	return t, nil
+}
+
+func (s *Server) createTable(input *dynamodb.CreateTableInput) (interface{}, *apiError) {
+	name := aws.StringValue(input.TableName)
+	if _, ok := s.tables[name]; ok {
+		return nil, newError("ResourceInUseException", "table %s already exists", name)
+	}
+
+	t := &table{
+		description: &dynamodb.TableDescription{
+			TableName:             input.TableName,
+			TableStatus:           aws.String(dynamodb.TableStatusActive),
+			KeySchema:             input.KeySchema,
+			AttributeDefinitions:  input.AttributeDefinitions,
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{},
+		},
+		ttl: &dynamodb.TimeToLiveDescription{
+			TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusDisabled),
+		},
+		items: map[string]map[string]map[string]*dynamodb.AttributeValue{},
+	}
+	for _, key := range input.KeySchema {
+		if aws.StringValue(key.KeyType) == dynamodb.KeyTypeHash {
+			t.hashKey = aws.StringValue(key.AttributeName)
+		} else {
+			t.rangeKey = aws.StringValue(key.AttributeName)
+		}
+	}
+	s.tables[name] = t
+	t.setStream(input.StreamSpecification)
+
+	return &dynamodb.CreateTableOutput{TableDescription: t.description}, nil
+}
+
+func (s *Server) updateTable(input *dynamodb.UpdateTableInput) (interface{}, *apiError) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if input.StreamSpecification != nil {
+		t.setStream(input.StreamSpecification)
+	}
+
+	return &dynamodb.UpdateTableOutput{TableDescription: t.description}, nil
+}
+
+func (t *table) setStream(spec *dynamodb.StreamSpecification) {
+	t.description.StreamSpecification = spec
+	t.description.LatestStreamArn = nil
+	if spec != nil && aws.BoolValue(spec.StreamEnabled) {
+		t.description.LatestStreamArn = aws.String(fmt.Sprintf("arn:aws:dynamodb:us-east-2:000000000000:table/%s/stream/1", aws.StringValue(t.description.TableName)))
+	}
+}
+
+// keyOf returns the hash and range key of an item or key.
+func (t *table) keyOf(item map[string]*dynamodb.AttributeValue) (string, string) {
+	return attributeString(item[t.hashKey]), attributeString(item[t.rangeKey])
+}
+
+func attributeString(value *dynamodb.AttributeValue) string {
+	if value == nil {
+		return ""
+	}
+	if value.N != nil {
+		return *value.N
+	}
+	if value.B != nil {
+		return string(value.B)
+	}
+	return aws.StringValue(value.S)
+}
+
+// validateKey rejects missing and empty key attributes, like DynamoDB does.
+func (t *table) validateKey(key map[string]*dynamodb.AttributeValue) *apiError {
+	for _, name := range []string{t.hashKey, t.rangeKey} {
+		if attributeString(key[name]) == "" {
+			return newError("ValidationException", "key attribute %s is missing or empty", name)
+		}
+	}
+	return nil
+}
+
+// get returns the item with the key, or nil if it doesn't exist.
+func (t *table) get(key map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	hash, rangeKey := t.keyOf(key)
+	return t.items[hash][rangeKey]
+}
+
+// set writes or, if item is nil, deletes the item with the key and records the change in the stream.
+func (s *Server) set(t *table, key map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) {
+	hash, rangeKey := t.keyOf(key)
+	old := t.items[hash][rangeKey]
+
+	var eventName string
+	switch {
+	case item != nil && old == nil:
+		eventName = dynamodbstreams.OperationTypeInsert
+	case item != nil:
+		eventName = dynamodbstreams.OperationTypeModify
+	case old != nil:
+		eventName = dynamodbstreams.OperationTypeRemove
+	default:
+		// Deleting an item that doesn't exist isn't a change.
+		return
+	}
+
+	if item == nil {
+		delete(t.items[hash], rangeKey)
+	} else {
+		if t.items[hash] == nil {
+			t.items[hash] = map[string]map[string]*dynamodb.AttributeValue{}
+		}
+		t.items[hash][rangeKey] = item
+	}
+
+	if t.description.LatestStreamArn == nil {
+		return
+	}
+	s.sequence++
+	keys := map[string]*dynamodb.AttributeValue{
+		t.hashKey:  key[t.hashKey],
+		t.rangeKey: key[t.rangeKey],
+	}
+	t.records = append(t.records, &dynamodbstreams.Record{
+		EventName: aws.String(eventName),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			Keys:           keys,
+			NewImage:       item,
+			OldImage:       old,
+			SequenceNumber: aws.String(fmt.Sprintf("%021d", s.sequence)),
+			StreamViewType: aws.String(dynamodbstreams.StreamViewTypeNewAndOldImages),
+		},
+	})
+}
+
+// check evaluates a condition against the current item with the key.
+func (t *table) check(key map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (bool, *apiError) {
+	if err := t.validateKey(key); err != nil {
+		return false, err
+	}
+
+	current := t.get(key)
+	if current == nil {
+		current = map[string]*dynamodb.AttributeValue{}
+	}
+
+	matches, err := evaluate(condition, names, values, current)
+	if err != nil {
+		return false, newError("ValidationException", "%v", err)
+	}
+	return matches, nil
+}
+
+// returnValues returns the ReturnValuesOnConditionCheckFailure of a request, or nil if they are ignored.
+func (s *Server) returnValues(returnValues *string) *string {
+	if s.ignoreReturnValues {
+		return nil
+	}
+
+	return returnValues
+}
+
+// conditionFailed returns a ConditionalCheckFailedException, with the current item if requested.
+func (t *table) conditionFailed(key map[string]*dynamodb.AttributeValue, returnValues *string) *apiError {
+	exception := &dynamodb.ConditionalCheckFailedException{
+		Message_: aws.String("The conditional request failed"),
+	}
+	if aws.StringValue(returnValues) == dynamodb.ReturnValuesOnConditionCheckFailureAllOld {
+		exception.Item = t.get(key)
+	}
+
+	return &apiError{
+		code:      "ConditionalCheckFailedException",
+		exception: exception,
+	}
+}
+
+func (s *Server) putItem(input *dynamodb.PutItemInput) (interface{}, *apiError) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := t.check(input.Item, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, t.conditionFailed(input.Item, s.returnValues(input.ReturnValuesOnConditionCheckFailure))
+	}
+	s.set(t, input.Item, input.Item)
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (s *Server) deleteItem(input *dynamodb.DeleteItemInput) (interface{}, *apiError) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := t.check(input.Key, input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, t.conditionFailed(input.Key, s.returnValues(input.ReturnValuesOnConditionCheckFailure))
+	}
+	s.set(t, input.Key, nil)
+
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// query evaluates at most Limit items matching the key condition in key order,
+// then filters them, like DynamoDB does.
+func (s *Server) query(input *dynamodb.QueryInput) (interface{}, *apiError) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	type itemKey struct {
+		hash     string
+		rangeKey string
+	}
+	var keys []itemKey
+	for hash, items := range t.items {
+		for rangeKey := range items {
+			keys = append(keys, itemKey{hash: hash, rangeKey: rangeKey})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hash != keys[j].hash {
+			return keys[i].hash < keys[j].hash
+		}
+		return keys[i].rangeKey < keys[j].rangeKey
+	})
+
+	var startHash, startRange string
+	if input.ExclusiveStartKey != nil {
+		startHash, startRange = t.keyOf(input.ExclusiveStartKey)
+	}
+
+	output := &dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{},
+	}
+	var scanned int64
+	for _, key := range keys {
+		if input.ExclusiveStartKey != nil && (key.hash < startHash || (key.hash == startHash && key.rangeKey <= startRange)) {
+			continue
+		}
+
+		item := t.items[key.hash][key.rangeKey]
+		matches, err := evaluate(input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, item)
+		if err != nil {
+			return nil, newError("ValidationException", "%v", err)
+		}
+		if !matches {
+			continue
+		}
+
+		scanned++
+		matches, err = evaluate(input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, item)
+		if err != nil {
+			return nil, newError("ValidationException", "%v", err)
+		}
+		if matches {
+			output.Items = append(output.Items, item)
+		}
+
+		if input.Limit != nil && scanned >= *input.Limit {
+			output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{
+				t.hashKey:  item[t.hashKey],
+				t.rangeKey: item[t.rangeKey],
+			}
+			break
+		}
+	}
+	output.Count = aws.Int64(int64(len(output.Items)))
+	output.ScannedCount = aws.Int64(scanned)
+
+	return output, nil
+}
+
+// transactWriteItems checks every condition first, and only applies the writes if all of them pass.
+func (s *Server) transactWriteItems(input *dynamodb.TransactWriteItemsInput) (interface{}, *apiError) {
+	type write struct {
+		t    *table
+		key  map[string]*dynamodb.AttributeValue
+		item map[string]*dynamodb.AttributeValue
+	}
+
+	var writes []write
+	var reasons []*dynamodb.CancellationReason
+	var codes []string
+	failed := false
+	for _, transactItem := range input.TransactItems {
+		var tableName *string
+		var key map[string]*dynamodb.AttributeValue
+		var item map[string]*dynamodb.AttributeValue
+		var condition *string
+		var names map[string]*string
+		var values map[string]*dynamodb.AttributeValue
+		var returnValues *string
+
+		switch {
+		case transactItem.Put != nil:
+			put := transactItem.Put
+			tableName, key, item = put.TableName, put.Item, put.Item
+			condition, names, values, returnValues = put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues, put.ReturnValuesOnConditionCheckFailure
+		case transactItem.Delete != nil:
+			del := transactItem.Delete
+			tableName, key = del.TableName, del.Key
+			condition, names, values, returnValues = del.ConditionExpression, del.ExpressionAttributeNames, del.ExpressionAttributeValues, del.ReturnValuesOnConditionCheckFailure
+		case transactItem.ConditionCheck != nil:
+			check := transactItem.ConditionCheck
+			tableName, key = check.TableName, check.Key
+			condition, names, values, returnValues = check.ConditionExpression, check.ExpressionAttributeNames, check.ExpressionAttributeValues, check.ReturnValuesOnConditionCheckFailure
+		default:
+			return nil, newError("ValidationException", "unsupported transaction item")
+		}
+
+		t, err := s.table(tableName)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := t.check(key, condition, names, values)
+		if err != nil {
+			return nil, err
+		}
+
+		reason := &dynamodb.CancellationReason{Code: aws.String("None")}
+		if !ok {
+			failed = true
+			reason.Code = aws.String("ConditionalCheckFailed")
+			reason.Message = aws.String("The conditional request failed")
+			if aws.StringValue(s.returnValues(returnValues)) == dynamodb.ReturnValuesOnConditionCheckFailureAllOld {
+				reason.Item = t.get(key)
+			}
+		}
+		reasons = append(reasons, reason)
+		codes = append(codes, aws.StringValue(reason.Code))
+
+		if transactItem.ConditionCheck == nil {
+			writes = append(writes, write{t: t, key: key, item: item})
+		}
+	}
+
+	if failed {
+		return nil, &apiError{
+			code: "TransactionCanceledException",
+			exception: &dynamodb.TransactionCanceledException{
+				Message_:            aws.String(fmt.Sprintf("Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", "))),
+				CancellationReasons: reasons,
+			},
+		}
+	}
+
+	for _, w := range writes {
+		s.set(w.t, w.key, w.item)
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (s *Server) streamTable(arn *string) (*table, *apiError) {
+	for _, t := range s.tables {
+		if t.description.LatestStreamArn != nil && *t.description.LatestStreamArn == aws.StringValue(arn) {
+			return t, nil
+		}
+	}
+	return nil, newError("ResourceNotFoundException", "stream %s not found", aws.StringValue(arn))
+}
+
+func (s *Server) describeStream(input *dynamodbstreams.DescribeStreamInput) (interface{}, *apiError) {
+	t, err := s.streamTable(input.StreamArn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodbstreams.DescribeStreamOutput{
+		StreamDescription: &dynamodbstreams.StreamDescription{
+			StreamArn:      input.StreamArn,
+			StreamStatus:   aws.String(dynamodbstreams.StreamStatusEnabled),
+			StreamViewType: aws.String(dynamodbstreams.StreamViewTypeNewAndOldImages),
+			TableName:      t.description.TableName,
+			Shards: []*dynamodbstreams.Shard{
+				{
+					ShardId: aws.String(shardId),
+					SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{
+						StartingSequenceNumber: aws.String(fmt.Sprintf("%021d", 0)),
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// Shard iterators are the stream ARN and the index of the next record.
+func (s *Server) getShardIterator(input *dynamodbstreams.GetShardIteratorInput) (interface{}, *apiError) {
+	t, err := s.streamTable(input.StreamArn)
+	if err != nil {
+		return nil, err
+	}
+
+	var position int
+	switch aws.StringValue(input.ShardIteratorType) {
+	case dynamodbstreams.ShardIteratorTypeTrimHorizon:
+		position = 0
+	case dynamodbstreams.ShardIteratorTypeLatest:
+		position = len(t.records)
+	default:
+		return nil, newError("ValidationException", "unsupported shard iterator type %s", aws.StringValue(input.ShardIteratorType))
+	}
+
+	return &dynamodbstreams.GetShardIteratorOutput{
+		ShardIterator: aws.String(fmt.Sprintf("%s|%d", aws.StringValue(input.StreamArn), position)),
+	}, nil
+}
+
+func (s *Server) getRecords(input *dynamodbstreams.GetRecordsInput) (interface{}, *apiError) {
+	arn, rawPosition, _ := strings.Cut(aws.StringValue(input.ShardIterator), "|")
+	t, err := s.streamTable(aws.String(arn))
+	if err != nil {
+		return nil, err
+	}
+	position, convErr := strconv.Atoi(rawPosition)
+	if convErr != nil || position < 0 || position > len(t.records) {
+		return nil, newError("ValidationException", "invalid shard iterator")
+	}
+
+	end := len(t.records)
+	if end > position+maxRecords {
+		end = position + maxRecords
+	}
+
+	// The shard never closes, so there is always a next iterator.
+	return &dynamodbstreams.GetRecordsOutput{
+		Records:           t.records[position:end],
+		NextShardIterator: aws.String(fmt.Sprintf("%s|%d", arn, end)),
+	}, nil
+}
@@ -0,0 +1,257 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"go.resf.org/peridot/base/go/kv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchInterval is how often empty shards are polled, and new shards are discovered.
+const watchInterval = time.Second
+
+// Watch reads changes from the table's DynamoDB stream.
+// Streams only retain changes for 24 hours, so resuming from an older revision
+// silently misses changes.
+// Every shard of the stream is read concurrently, so only changes to the same key
+// are guaranteed to be in revision order.
+func (d *DynamoDB) Watch(ctx context.Context, prefix string, opts ...kv.WatchOption) (<-chan *kv.Event, error) {
+	ns, path, err := kv.SplitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	o := kv.NewWatchOptions(opts...)
+
+	table, err := d.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(d.tableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if table.Table.LatestStreamArn == nil {
+		return nil, errors.New("streams are not enabled on the table")
+	}
+
+	ch := make(chan *kv.Event)
+	go d.watch(ctx, ch, *table.Table.LatestStreamArn, ns, path, o.FromRevision)
+
+	return ch, nil
+}
+
+func (d *DynamoDB) watch(ctx context.Context, ch chan<- *kv.Event, streamArn string, ns string, path string, fromRevision int64) {
+	// Deferred in reverse, so shard readers are stopped before the channel is closed.
+	defer close(ch)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	doneCh := make(chan string)
+	started := map[string]bool{}
+	finished := map[string]bool{}
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	// Without a revision to resume from, only new changes in the shards open
+	// right now are read. Shards created later are always read from the start.
+	latest := fromRevision == 0
+	for {
+		shards, err := d.listShards(ctx, streamArn)
+		if err != nil {
+			if ctx.Err() == nil {
+				select {
+				case ch <- &kv.Event{Err: err}:
+				case <-ctx.Done():
+				}
+			}
+			return
+		}
+
+		listed := map[string]bool{}
+		for _, shard := range shards {
+			listed[aws.StringValue(shard.ShardId)] = true
+		}
+
+		for _, shard := range shards {
+			shardId := aws.StringValue(shard.ShardId)
+			if started[shardId] {
+				continue
+			}
+
+			// Children are read after their parent, so changes to a key stay in order.
+			// Parents that are no longer listed have been trimmed.
+			if parent := aws.StringValue(shard.ParentShardId); (listed[parent] || started[parent]) && !finished[parent] {
+				continue
+			}
+
+			started[shardId] = true
+			iteratorType := dynamodbstreams.ShardIteratorTypeTrimHorizon
+			if latest {
+				// Closed shards don't get new changes.
+				if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+					finished[shardId] = true
+					continue
+				}
+				iteratorType = dynamodbstreams.ShardIteratorTypeLatest
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := d.readShard(ctx, ch, streamArn, shardId, iteratorType, ns, path, fromRevision)
+				if err != nil {
+					select {
+					case errCh <- err:
+					default:
+					}
+					return
+				}
+
+				select {
+				case doneCh <- shardId:
+				case <-ctx.Done():
+				}
+			}()
+		}
+		latest = false
+
+		select {
+		case <-ticker.C:
+		case shardId := <-doneCh:
+			finished[shardId] = true
+		case err := <-errCh:
+			select {
+			case ch <- &kv.Event{Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readShard reads changes from a shard until it is closed.
+func (d *DynamoDB) readShard(ctx context.Context, ch chan<- *kv.Event, streamArn string, shardId string, iteratorType string, ns string, path string, fromRevision int64) error {
+	iteratorOutput, err := d.streams.GetShardIteratorWithContext(ctx, &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(streamArn),
+		ShardId:           aws.String(shardId),
+		ShardIteratorType: aws.String(iteratorType),
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	iterator := iteratorOutput.ShardIterator
+	for iterator != nil {
+		records, err := d.streams.GetRecordsWithContext(ctx, &dynamodbstreams.GetRecordsInput{
+			ShardIterator: iterator,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		for _, record := range records.Records {
+			event := eventFromRecord(record, ns, path, fromRevision)
+			if event == nil {
+				continue
+			}
+
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		// Open shards always return a next iterator, so wait before polling again.
+		iterator = records.NextShardIterator
+		if len(records.Records) == 0 && iterator != nil {
+			select {
+			case <-time.After(watchInterval):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *DynamoDB) listShards(ctx context.Context, streamArn string) ([]*dynamodbstreams.Shard, error) {
+	var shards []*dynamodbstreams.Shard
+	var lastShardId *string
+	for {
+		res, err := d.streams.DescribeStreamWithContext(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(streamArn),
+			ExclusiveStartShardId: lastShardId,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		shards = append(shards, res.StreamDescription.Shards...)
+		lastShardId = res.StreamDescription.LastEvaluatedShardId
+		if lastShardId == nil {
+			return shards, nil
+		}
+	}
+}
+
+// eventFromRecord converts a stream record to an event.
+// Returns nil if the record is outside the prefix, or before the revision to resume from.
+func eventFromRecord(record *dynamodbstreams.Record, ns string, path string, fromRevision int64) *kv.Event {
+	if record.Dynamodb == nil || record.Dynamodb.Keys == nil {
+		return nil
+	}
+
+	recordNs := aws.StringValue(record.Dynamodb.Keys["Key"].S)
+	recordPath := aws.StringValue(record.Dynamodb.Keys["Path"].S)
+	if recordNs != ns || !strings.HasPrefix(recordPath, path) {
+		return nil
+	}
+
+	pair := &kv.Pair{
+		Key: fmt.Sprintf("/%s/%s", recordNs, recordPath),
+	}
+	switch aws.StringValue(record.EventName) {
+	case dynamodbstreams.OperationTypeInsert, dynamodbstreams.OperationTypeModify:
+		if value, ok := record.Dynamodb.NewImage["Value"]; ok {
+			pair.Value = value.B
+		}
+		pair.Revision = revisionFromItem(record.Dynamodb.NewImage)
+		if pair.Revision <= fromRevision {
+			return nil
+		}
+
+		return &kv.Event{
+			Type: kv.EventPut,
+			Pair: pair,
+		}
+	case dynamodbstreams.OperationTypeRemove:
+		// Deletes don't have a revision, so they can't be filtered when resuming.
+		pair.Revision = revisionFromItem(record.Dynamodb.OldImage)
+
+		return &kv.Event{
+			Type: kv.EventDelete,
+			Pair: pair,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,432 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encrypted is a kv.KV wrapper that encrypts values before they reach the backend.
+//
+// Values are encrypted with AES-256-GCM using data keys, which are wrapped by a key
+// encryption key from a KeyProvider and stored next to every value (envelope encryption).
+// A data key is reused for a while, so the provider isn't called on every write.
+// Keys are not encrypted, so prefix scans, transactions and watches work as usual.
+package encrypted
+
+import (
+	"context"
+	"crypto/cipher"
+	"github.com/pkg/errors"
+	"go.resf.org/peridot/base/go/kv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDataKeyLifetime = time.Hour
+	// defaultMaxDataKeyUses stays well below the 2^32 messages AES-GCM allows per key with random nonces.
+	defaultMaxDataKeyUses = 1 << 24
+	// maxCachedDataKeys limits the decrypted data keys kept in memory.
+	maxCachedDataKeys = 1000
+	// reencryptPageSize is the page size used to list the values to re-encrypt.
+	reencryptPageSize = 100
+)
+
+var (
+	ErrNotEncrypted = errors.New("value is not encrypted")
+	ErrDecrypt      = errors.New("failed to decrypt value")
+)
+
+// Encrypted wraps a kv.KV, encrypting values on write and decrypting them on read.
+// Every value is bound to its key, so an encrypted value copied to another key fails to decrypt.
+// Encrypted is safe for concurrent use.
+type Encrypted struct {
+	kv   kv.KV
+	keys KeyProvider
+
+	lock sync.Mutex
+	// current is the data key new values are encrypted with.
+	current *dataKey
+	// decrypted caches unwrapped data keys by their wrapped form.
+	decrypted map[string]cipher.AEAD
+
+	dataKeyLifetime time.Duration
+	maxDataKeyUses  int64
+	allowPlaintext  bool
+}
+
+type dataKey struct {
+	keyID     string
+	wrapped   []byte
+	aead      cipher.AEAD
+	createdAt time.Time
+	uses      int64
+}
+
+type Option func(*Encrypted)
+
+// WithDataKeyLifetime sets how long a data key is used for new values.
+func WithDataKeyLifetime(lifetime time.Duration) Option {
+	return func(e *Encrypted) {
+		e.dataKeyLifetime = lifetime
+	}
+}
+
+// WithMaxDataKeyUses sets how many values are encrypted with a data key before a new one is generated.
+func WithMaxDataKeyUses(uses int64) Option {
+	return func(e *Encrypted) {
+		e.maxDataKeyUses = uses
+	}
+}
+
+// WithAllowPlaintext returns values that are not encrypted as is, instead of failing with ErrNotEncrypted.
+// Used to migrate an existing store, together with Reencrypt.
+func WithAllowPlaintext() Option {
+	return func(e *Encrypted) {
+		e.allowPlaintext = true
+	}
+}
+
+// New wraps store, encrypting values with data keys from keys.
+func New(store kv.KV, keys KeyProvider, opts ...Option) (*Encrypted, error) {
+	if keys == nil {
+		return nil, errors.New("key provider is required")
+	}
+
+	e := &Encrypted{
+		kv:              store,
+		keys:            keys,
+		decrypted:       map[string]cipher.AEAD{},
+		dataKeyLifetime: defaultDataKeyLifetime,
+		maxDataKeyUses:  defaultMaxDataKeyUses,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e, nil
+}
+
+// currentKey returns the data key to encrypt a new value with, generating a new one if needed.
+func (e *Encrypted) currentKey(ctx context.Context) (*dataKey, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.current == nil || e.current.uses >= e.maxDataKeyUses || time.Since(e.current.createdAt) >= e.dataKeyLifetime {
+		generated, err := e.keys.GenerateDataKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := newAEAD(generated.Plaintext)
+		if err != nil {
+			return nil, err
+		}
+		e.current = &dataKey{
+			keyID:     generated.KeyID,
+			wrapped:   generated.Wrapped,
+			aead:      aead,
+			createdAt: time.Now(),
+		}
+	}
+	e.current.uses++
+
+	return e.current, nil
+}
+
+// decryptKey returns the unwrapped data key of an envelope.
+func (e *Encrypted) decryptKey(ctx context.Context, env *envelope) (cipher.AEAD, error) {
+	cacheKey := env.keyID + "\x00" + string(env.wrapped)
+
+	e.lock.Lock()
+	aead := e.decrypted[cacheKey]
+	e.lock.Unlock()
+	if aead != nil {
+		return aead, nil
+	}
+
+	plaintext, err := e.keys.DecryptDataKey(ctx, env.keyID, env.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err = newAEAD(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	e.lock.Lock()
+	if len(e.decrypted) >= maxCachedDataKeys {
+		e.decrypted = map[string]cipher.AEAD{}
+	}
+	e.decrypted[cacheKey] = aead
+	e.lock.Unlock()
+
+	return aead, nil
+}
+
+// additionalData binds a value to its key.
+// Keys are normalized, as "/a/b" and "a/b" are the same key.
+func additionalData(key string) ([]byte, error) {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(ns + "/" + path), nil
+}
+
+func (e *Encrypted) encrypt(ctx context.Context, key string, value []byte) ([]byte, error) {
+	ad, err := additionalData(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dk, err := e.currentKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(dk.aead, value, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &envelope{
+		keyID:      dk.keyID,
+		wrapped:    dk.wrapped,
+		ciphertext: ciphertext,
+	}
+	return env.marshal(), nil
+}
+
+func (e *Encrypted) decrypt(ctx context.Context, key string, value []byte) ([]byte, error) {
+	if e.allowPlaintext && !isEnvelope(value) {
+		return value, nil
+	}
+
+	env, err := unmarshalEnvelope(value)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := additionalData(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := e.decryptKey(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(aead, env.ciphertext, ad)
+}
+
+// decryptPair returns a copy of pair with the value decrypted.
+func (e *Encrypted) decryptPair(ctx context.Context, pair *kv.Pair) (*kv.Pair, error) {
+	value, err := e.decrypt(ctx, pair.Key, pair.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := *pair
+	decrypted.Value = value
+	return &decrypted, nil
+}
+
+func (e *Encrypted) Get(ctx context.Context, key string) (*kv.Pair, error) {
+	pair, err := e.kv.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.decryptPair(ctx, pair)
+}
+
+func (e *Encrypted) Set(ctx context.Context, key string, value []byte, opts ...kv.SetOption) error {
+	encrypted, err := e.encrypt(ctx, key, value)
+	if err != nil {
+		return err
+	}
+
+	return e.kv.Set(ctx, key, encrypted, opts...)
+}
+
+func (e *Encrypted) Delete(ctx context.Context, key string) error {
+	return e.kv.Delete(ctx, key)
+}
+
+func (e *Encrypted) RangePrefix(ctx context.Context, prefix string, pageSize int32, pageToken string) (*kv.Query, error) {
+	query, err := e.kv.RangePrefix(ctx, prefix, pageSize, pageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]*kv.Pair, 0, len(query.Pairs))
+	for _, pair := range query.Pairs {
+		decrypted, err := e.decryptPair(ctx, pair)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, decrypted)
+	}
+
+	return &kv.Query{
+		Prefix:    query.Prefix,
+		Pairs:     pairs,
+		NextToken: query.NextToken,
+	}, nil
+}
+
+func (e *Encrypted) Create(ctx context.Context, key string, value []byte, opts ...kv.SetOption) (int64, error) {
+	encrypted, err := e.encrypt(ctx, key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return e.kv.Create(ctx, key, encrypted, opts...)
+}
+
+func (e *Encrypted) SetIfRevision(ctx context.Context, key string, value []byte, revision int64, opts ...kv.SetOption) (int64, error) {
+	encrypted, err := e.encrypt(ctx, key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return e.kv.SetIfRevision(ctx, key, encrypted, revision, opts...)
+}
+
+func (e *Encrypted) DeleteIfRevision(ctx context.Context, key string, revision int64) error {
+	return e.kv.DeleteIfRevision(ctx, key, revision)
+}
+
+// Txn encrypts the values of every write. Encryption adds an overhead of about
+// 100 bytes plus the size of the wrapped data key to every value, which counts
+// towards kv.MaxTxnSize.
+func (e *Encrypted) Txn(ctx context.Context, ops ...*kv.Op) (int64, error) {
+	encryptedOps := make([]*kv.Op, 0, len(ops))
+	for _, op := range ops {
+		switch op.Type {
+		case kv.OpSet, kv.OpCreate, kv.OpSetIfRevision:
+			encrypted, err := e.encrypt(ctx, op.Key, op.Value)
+			if err != nil {
+				return 0, err
+			}
+
+			encryptedOp := *op
+			encryptedOp.Value = encrypted
+			encryptedOps = append(encryptedOps, &encryptedOp)
+		default:
+			encryptedOps = append(encryptedOps, op)
+		}
+	}
+
+	return e.kv.Txn(ctx, encryptedOps...)
+}
+
+// Watch decrypts the value of every event.
+// If a value can't be decrypted, the watch fails with an event carrying the error.
+func (e *Encrypted) Watch(ctx context.Context, prefix string, opts ...kv.WatchOption) (<-chan *kv.Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	events, err := e.kv.Watch(ctx, prefix, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ch := make(chan *kv.Event)
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		for event := range events {
+			if event.Err == nil && event.Type == kv.EventPut {
+				pair, err := e.decryptPair(ctx, event.Pair)
+				if err != nil {
+					event = &kv.Event{Err: err}
+				} else {
+					event = &kv.Event{Type: event.Type, Pair: pair}
+				}
+			}
+
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+			if event.Err != nil {
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// Reencrypt rewrites every value under prefix that isn't encrypted with the current
+// key encryption key, and returns the number of values rewritten.
+// Run it after rotating the key encryption key, before the old key is removed.
+// With WithAllowPlaintext, values that are not encrypted yet are encrypted as well.
+// Values keep their TTL, and values written concurrently are skipped, as they
+// have been encrypted with the current key already.
+func (e *Encrypted) Reencrypt(ctx context.Context, prefix string) (int, error) {
+	dk, err := e.currentKey(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var rewritten int
+	var token string
+	for {
+		query, err := e.kv.RangePrefix(ctx, prefix, reencryptPageSize, token)
+		if err != nil {
+			return rewritten, err
+		}
+
+		for _, pair := range query.Pairs {
+			if isEnvelope(pair.Value) {
+				env, err := unmarshalEnvelope(pair.Value)
+				if err != nil {
+					return rewritten, err
+				}
+				if env.keyID == dk.keyID {
+					continue
+				}
+			}
+
+			value, err := e.decrypt(ctx, pair.Key, pair.Value)
+			if err != nil {
+				return rewritten, err
+			}
+
+			var opts []kv.SetOption
+			if !pair.ExpiresAt.IsZero() {
+				ttl := time.Until(pair.ExpiresAt)
+				if ttl <= 0 {
+					continue
+				}
+				opts = append(opts, kv.WithTTL(ttl))
+			}
+
+			_, err = e.SetIfRevision(ctx, pair.Key, value, pair.Revision, opts...)
+			if errors.Is(err, kv.ErrConflict) {
+				continue
+			}
+			if err != nil {
+				return rewritten, err
+			}
+			rewritten++
+		}
+
+		token = query.NextToken
+		if token == "" {
+			return rewritten, nil
+		}
+	}
+}
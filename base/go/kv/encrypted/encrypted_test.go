@@ -0,0 +1,210 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	"go.resf.org/peridot/base/go/kv/kvtest"
+	kv_memory "go.resf.org/peridot/base/go/kv/memory"
+	"os"
+	"testing"
+	"time"
+)
+
+func staticKeys(t *testing.T, current string, ids ...string) *StaticKeyProvider {
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id[:1]), dataKeySize)
+	}
+
+	p, err := NewStaticKeyProvider(current, keys)
+	require.Nil(t, err)
+	return p
+}
+
+func newEncrypted(t *testing.T, keys KeyProvider, opts ...Option) (*Encrypted, kv.KV) {
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+
+	e, err := New(store, keys, opts...)
+	require.Nil(t, err)
+	return e, store
+}
+
+func TestConformance(t *testing.T) {
+	kvtest.RunConformance(t, func(t *testing.T) kv.KV {
+		e, _ := newEncrypted(t, staticKeys(t, "a", "a"))
+		return e
+	})
+}
+
+func TestEncrypted_StoresCiphertext(t *testing.T) {
+	ctx := context.Background()
+	e, store := newEncrypted(t, staticKeys(t, "a", "a"))
+
+	require.Nil(t, e.Set(ctx, "/secrets/forge", []byte("hunter2")))
+
+	pair, err := store.Get(ctx, "/secrets/forge")
+	require.Nil(t, err)
+	require.NotContains(t, string(pair.Value), "hunter2")
+
+	pair, err = e.Get(ctx, "/secrets/forge")
+	require.Nil(t, err)
+	require.Equal(t, []byte("hunter2"), pair.Value)
+
+	// Values are bound to their key.
+	encrypted, err := store.Get(ctx, "/secrets/forge")
+	require.Nil(t, err)
+	require.Nil(t, store.Set(ctx, "/secrets/copy", encrypted.Value))
+	_, err = e.Get(ctx, "/secrets/copy")
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	// Tampered values fail to decrypt.
+	encrypted.Value[len(encrypted.Value)-1] ^= 1
+	require.Nil(t, store.Set(ctx, "/secrets/forge", encrypted.Value))
+	_, err = e.Get(ctx, "/secrets/forge")
+	require.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestEncrypted_Plaintext(t *testing.T) {
+	ctx := context.Background()
+	e, store := newEncrypted(t, staticKeys(t, "a", "a"))
+	require.Nil(t, store.Set(ctx, "/secrets/old", []byte("plaintext")))
+
+	_, err := e.Get(ctx, "/secrets/old")
+	require.ErrorIs(t, err, ErrNotEncrypted)
+
+	migrating, err := New(store, staticKeys(t, "a", "a"), WithAllowPlaintext())
+	require.Nil(t, err)
+	pair, err := migrating.Get(ctx, "/secrets/old")
+	require.Nil(t, err)
+	require.Equal(t, []byte("plaintext"), pair.Value)
+
+	rewritten, err := migrating.Reencrypt(ctx, "/secrets/")
+	require.Nil(t, err)
+	require.Equal(t, 1, rewritten)
+
+	pair, err = e.Get(ctx, "/secrets/old")
+	require.Nil(t, err)
+	require.Equal(t, []byte("plaintext"), pair.Value)
+}
+
+func TestEncrypted_Rotation(t *testing.T) {
+	ctx := context.Background()
+	e, store := newEncrypted(t, staticKeys(t, "a", "a"))
+
+	for i := 0; i < 150; i++ {
+		require.Nil(t, e.Set(ctx, fmt.Sprintf("/secrets/%03d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.Nil(t, e.Set(ctx, "/secrets/ttl", []byte("ttl"), kv.WithTTL(time.Hour)))
+
+	// Rotate to b, a is still needed to read existing values.
+	rotated, err := New(store, staticKeys(t, "b", "a", "b"))
+	require.Nil(t, err)
+	pair, err := rotated.Get(ctx, "/secrets/000")
+	require.Nil(t, err)
+	require.Equal(t, []byte("value-0"), pair.Value)
+
+	rewritten, err := rotated.Reencrypt(ctx, "/secrets/")
+	require.Nil(t, err)
+	require.Equal(t, 151, rewritten)
+
+	// Everything is encrypted with b now, so a can be removed.
+	onlyB, err := New(store, staticKeys(t, "b", "b"))
+	require.Nil(t, err)
+	pair, err = onlyB.Get(ctx, "/secrets/149")
+	require.Nil(t, err)
+	require.Equal(t, []byte("value-149"), pair.Value)
+	pair, err = onlyB.Get(ctx, "/secrets/ttl")
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), pair.ExpiresAt, time.Minute)
+
+	rewritten, err = onlyB.Reencrypt(ctx, "/secrets/")
+	require.Nil(t, err)
+	require.Equal(t, 0, rewritten)
+
+	// Without a, old values can't be read.
+	require.Nil(t, e.Set(ctx, "/secrets/000", []byte("value-0")))
+	_, err = onlyB.Get(ctx, "/secrets/000")
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestEncrypted_DataKeyReuse(t *testing.T) {
+	ctx := context.Background()
+	e, store := newEncrypted(t, staticKeys(t, "a", "a"), WithMaxDataKeyUses(2))
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, e.Set(ctx, fmt.Sprintf("/secrets/%d", i), []byte("value")))
+	}
+
+	var wrapped [][]byte
+	for i := 0; i < 3; i++ {
+		pair, err := store.Get(ctx, fmt.Sprintf("/secrets/%d", i))
+		require.Nil(t, err)
+		env, err := unmarshalEnvelope(pair.Value)
+		require.Nil(t, err)
+		wrapped = append(wrapped, env.wrapped)
+	}
+	require.Equal(t, wrapped[0], wrapped[1])
+	require.NotEqual(t, wrapped[1], wrapped[2])
+}
+
+// TestKMS needs KMS (or a local emulator like LocalStack), so it only runs if
+// KVTEST_KMS_ENDPOINT is set. A new key is created for the test and scheduled for deletion afterwards.
+func TestKMS(t *testing.T) {
+	endpoint := os.Getenv("KVTEST_KMS_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("KVTEST_KMS_ENDPOINT not set")
+	}
+
+	newKey := func() string {
+		p, err := NewKMSKeyProvider(endpoint, "")
+		require.Nil(t, err)
+		out, err := p.kms.CreateKey(&kms.CreateKeyInput{})
+		require.Nil(t, err)
+		t.Cleanup(func() {
+			_, err := p.kms.ScheduleKeyDeletion(&kms.ScheduleKeyDeletionInput{
+				KeyId:               out.KeyMetadata.KeyId,
+				PendingWindowInDays: aws.Int64(7),
+			})
+			require.Nil(t, err)
+		})
+		return aws.StringValue(out.KeyMetadata.Arn)
+	}
+
+	ctx := context.Background()
+	first, err := NewKMSKeyProvider(endpoint, newKey())
+	require.Nil(t, err)
+	e, store := newEncrypted(t, first)
+	require.Nil(t, e.Set(ctx, "/secrets/forge", []byte("hunter2")))
+
+	second, err := NewKMSKeyProvider(endpoint, newKey())
+	require.Nil(t, err)
+	rotated, err := New(store, second)
+	require.Nil(t, err)
+	rewritten, err := rotated.Reencrypt(ctx, "/secrets/")
+	require.Nil(t, err)
+	require.Equal(t, 1, rewritten)
+
+	pair, err := rotated.Get(ctx, "/secrets/forge")
+	require.Nil(t, err)
+	require.Equal(t, []byte("hunter2"), pair.Value)
+}
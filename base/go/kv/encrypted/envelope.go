@@ -0,0 +1,89 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypted
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// magic starts every encrypted value, followed by the envelope version.
+var magic = []byte("\x00kve")
+
+const envelopeVersion = 1
+
+// envelope is an encrypted value. It is stored as:
+//
+//	magic | version | uvarint len(keyID) | keyID | uvarint len(wrapped) | wrapped | nonce | ciphertext
+type envelope struct {
+	keyID   string
+	wrapped []byte
+	// ciphertext is the nonce followed by the ciphertext, see seal.
+	ciphertext []byte
+}
+
+func isEnvelope(value []byte) bool {
+	return bytes.HasPrefix(value, magic)
+}
+
+func (e *envelope) marshal() []byte {
+	buf := make([]byte, 0, len(magic)+1+2*binary.MaxVarintLen64+len(e.keyID)+len(e.wrapped)+len(e.ciphertext))
+	buf = append(buf, magic...)
+	buf = append(buf, envelopeVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(e.keyID)))
+	buf = append(buf, e.keyID...)
+	buf = binary.AppendUvarint(buf, uint64(len(e.wrapped)))
+	buf = append(buf, e.wrapped...)
+	buf = append(buf, e.ciphertext...)
+
+	return buf
+}
+
+func unmarshalEnvelope(value []byte) (*envelope, error) {
+	if !isEnvelope(value) {
+		return nil, ErrNotEncrypted
+	}
+	rest := value[len(magic):]
+	if len(rest) == 0 || rest[0] != envelopeVersion {
+		return nil, ErrDecrypt
+	}
+	rest = rest[1:]
+
+	keyID, rest, ok := readBytes(rest)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	wrapped, rest, ok := readBytes(rest)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+
+	return &envelope{
+		keyID:      string(keyID),
+		wrapped:    wrapped,
+		ciphertext: rest,
+	}, nil
+}
+
+// readBytes reads a length-prefixed byte slice, and returns the rest of buf.
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, nil, false
+	}
+	buf = buf[n:]
+
+	return buf[:size], buf[size:], true
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypted
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// dataKeySize is the size of data keys, AES-256.
+const dataKeySize = 32
+
+var ErrUnknownKey = errors.New("unknown key encryption key")
+
+// DataKey is a data key, both in plaintext and wrapped by a key encryption key.
+type DataKey struct {
+	// KeyID identifies the key encryption key that wrapped the data key.
+	KeyID     string
+	Plaintext []byte
+	Wrapped   []byte
+}
+
+// KeyProvider wraps data keys with a key encryption key that never leaves the provider.
+type KeyProvider interface {
+	// GenerateDataKey returns a new random data key wrapped by the current key encryption key.
+	GenerateDataKey(ctx context.Context) (*DataKey, error)
+	// DecryptDataKey unwraps a data key wrapped by the key encryption key with the given ID.
+	// Keys that are no longer current must still be decryptable until every value
+	// has been re-encrypted, see Encrypted.Reencrypt.
+	DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// StaticKeyProvider wraps data keys with local AES-256 keys.
+// Meant for development and deployments without a KMS.
+type StaticKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewStaticKeyProvider creates a key provider from 32 byte keys by ID.
+// New data keys are wrapped by the key with the ID current, the other keys are
+// only used to decrypt. To rotate, add a new key, make it current and re-encrypt.
+func NewStaticKeyProvider(current string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	if keys[current] == nil {
+		return nil, errors.Wrapf(ErrUnknownKey, "current key %q", current)
+	}
+
+	p := &StaticKeyProvider{
+		current: current,
+		keys:    map[string]cipher.AEAD{},
+	}
+	for id, key := range keys {
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("key %q must be %d bytes, got %d", id, dataKeySize, len(key))
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		p.keys[id] = aead
+	}
+
+	return p, nil
+}
+
+func (p *StaticKeyProvider) GenerateDataKey(ctx context.Context) (*DataKey, error) {
+	plaintext := make([]byte, dataKeySize)
+	_, err := io.ReadFull(rand.Reader, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := seal(p.keys[p.current], plaintext, []byte(p.current))
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		KeyID:     p.current,
+		Plaintext: plaintext,
+		Wrapped:   wrapped,
+	}, nil
+}
+
+func (p *StaticKeyProvider) DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead := p.keys[keyID]
+	if aead == nil {
+		return nil, errors.Wrapf(ErrUnknownKey, "key %q", keyID)
+	}
+
+	return open(aead, wrapped, []byte(keyID))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, and returns the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts the output of seal.
+func open(aead cipher.AEAD, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypted
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/pkg/errors"
+	"go.resf.org/peridot/base/go/awsutils"
+)
+
+// KMSKeyProvider wraps data keys with an AWS KMS key.
+type KMSKeyProvider struct {
+	kms   *kms.KMS
+	keyID string
+}
+
+// NewKMSKeyProvider creates a key provider using the KMS key keyID,
+// which can be a key ID, ARN or alias ("alias/kernelmanager").
+// Endpoint is optional, and can point at a local emulator like LocalStack.
+//
+// To rotate, either enable automatic rotation in KMS, which needs no re-encryption,
+// or point keyID at a new key and re-encrypt. The old key must stay enabled until then.
+func NewKMSKeyProvider(endpoint string, keyID string) (*KMSKeyProvider, error) {
+	awsCfg := &aws.Config{}
+	awsutils.FillOutConfig(awsCfg)
+
+	if endpoint != "" {
+		awsCfg.Endpoint = aws.String(endpoint)
+	}
+
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KMSKeyProvider{
+		kms:   kms.New(sess),
+		keyID: keyID,
+	}, nil
+}
+
+func (p *KMSKeyProvider) GenerateDataKey(ctx context.Context) (*DataKey, error) {
+	out, err := p.kms.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(p.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate data key")
+	}
+
+	// KeyId is always the ARN of the key, even if keyID is an alias,
+	// so re-encryption can tell which key a value was encrypted with.
+	return &DataKey{
+		KeyID:     aws.StringValue(out.KeyId),
+		Plaintext: out.Plaintext,
+		Wrapped:   out.CiphertextBlob,
+	}, nil
+}
+
+func (p *KMSKeyProvider) DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	out, err := p.kms.DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt data key")
+	}
+
+	return out.Plaintext, nil
+}
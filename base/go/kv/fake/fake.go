@@ -0,0 +1,328 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fake is a kv.KV for tests, that records every call and can be scripted to fail.
+//
+//	store, _ := fake.New()
+//	store.Inject("Txn", fake.WithConflict(), fake.WithTimes(1))
+//
+// makes the first transaction fail with kv.ErrConflict, after which transactions work as usual.
+// Calls that don't fail are passed to a real store, in memory by default.
+package fake
+
+import (
+	"context"
+	"go.resf.org/peridot/base/go/fault"
+	"go.resf.org/peridot/base/go/kv"
+	kv_memory "go.resf.org/peridot/base/go/kv/memory"
+	"time"
+)
+
+// Call is a recorded call to the fake.
+type Call struct {
+	Method string
+	// Key is the key or prefix of the call, empty for Txn.
+	Key string
+	// Value is the value written, only set for writes.
+	Value []byte
+	// Ops are the operations of a Txn.
+	Ops []*kv.Op
+	// Err is the error the call returned.
+	Err error
+}
+
+// Fault is a scripted failure, see Fake.Inject.
+type Fault struct {
+	rule    fault.Rule
+	applied bool
+}
+
+type FaultOption func(*Fault)
+
+// WithError makes matching calls return err.
+func WithError(err error) FaultOption {
+	return func(f *Fault) {
+		f.rule.Err = err
+	}
+}
+
+// WithNotFound makes matching calls return kv.ErrNotFound.
+func WithNotFound() FaultOption {
+	return WithError(kv.ErrNotFound)
+}
+
+// WithConflict makes matching calls return kv.ErrConflict, as if another writer got there first.
+func WithConflict() FaultOption {
+	return WithError(kv.ErrConflict)
+}
+
+// WithLatency delays matching calls, or until the context of the call is cancelled.
+// Without an error, delayed calls succeed.
+func WithLatency(latency time.Duration) FaultOption {
+	return func(f *Fault) {
+		f.rule.Latency = latency
+	}
+}
+
+// WithAfter lets the first n matching calls through, the fault triggers from the next one.
+func WithAfter(n int) FaultOption {
+	return func(f *Fault) {
+		f.rule.After = n
+	}
+}
+
+// WithTimes stops the fault after it triggered n times.
+// By default it keeps triggering.
+func WithTimes(n int) FaultOption {
+	return func(f *Fault) {
+		f.rule.Times = n
+	}
+}
+
+// WithKeyPrefix only matches calls for keys starting with prefix.
+// Transactions match if any of their operations does.
+func WithKeyPrefix(prefix string) FaultOption {
+	return func(f *Fault) {
+		f.rule.Prefix = prefix
+	}
+}
+
+// WithApplied passes matching calls to the store before returning the error,
+// like a write that was committed but timed out before the response arrived.
+func WithApplied() FaultOption {
+	return func(f *Fault) {
+		f.applied = true
+	}
+}
+
+// Fake is a kv.KV that records every call and fails as scripted.
+// Fake is safe for concurrent use.
+type Fake struct {
+	kv kv.KV
+
+	script *fault.Script[*Fault, *Call]
+}
+
+// New returns a fake backed by an in-memory store.
+func New() (*Fake, error) {
+	store, err := kv_memory.New()
+	if err != nil {
+		return nil, err
+	}
+
+	return Wrap(store), nil
+}
+
+// Wrap returns a fake that passes calls to store.
+func Wrap(store kv.KV) *Fake {
+	return &Fake{
+		kv: store,
+		script: fault.NewScript[*Fault, *Call](func(f *Fault) *fault.Rule {
+			return &f.rule
+		}),
+	}
+}
+
+// Inject adds a fault for calls to method, which is the name of a kv.KV
+// method ("Get", "Txn" etc.), or empty to match every method.
+// If several faults match a call, the one injected first is used.
+func (f *Fake) Inject(method string, opts ...FaultOption) *Fault {
+	fault := &Fault{}
+	fault.rule.Method = method
+	for _, opt := range opts {
+		opt(fault)
+	}
+	f.script.Inject(fault)
+
+	return fault
+}
+
+// Triggered returns how many times the fault triggered.
+func (f *Fake) Triggered(fault *Fault) int {
+	return f.script.Triggered(fault)
+}
+
+// ClearFaults removes all faults, recorded calls are kept.
+func (f *Fake) ClearFaults() {
+	f.script.ClearFaults()
+}
+
+// Calls returns the recorded calls, in the order they returned.
+func (f *Fake) Calls() []*Call {
+	return f.script.Calls()
+}
+
+// CallsTo returns the recorded calls to method.
+func (f *Fake) CallsTo(method string) []*Call {
+	return f.script.CallsTo(method)
+}
+
+// CallCount returns the number of recorded calls to method.
+func (f *Fake) CallCount(method string) int {
+	return len(f.CallsTo(method))
+}
+
+// ResetCalls forgets the recorded calls.
+func (f *Fake) ResetCalls() {
+	f.script.ResetCalls()
+}
+
+// call runs fn unless a fault fails the call first, and records it.
+func (f *Fake) call(ctx context.Context, record *Call, keys []string, fn func() error) error {
+	err := f.apply(ctx, record.Method, keys, fn)
+	record.Err = err
+	f.script.Record(record.Method, record)
+
+	return err
+}
+
+func (f *Fake) apply(ctx context.Context, method string, keys []string, fn func() error) error {
+	fault, ok := f.script.Match(method, keys...)
+	if !ok {
+		return fn()
+	}
+
+	err := fault.rule.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if fault.rule.Err == nil {
+		return fn()
+	}
+	if fault.applied {
+		_ = fn()
+	}
+
+	return fault.rule.Err
+}
+
+// copyValue copies a value, so the recorded call isn't changed if the caller reuses the slice.
+func copyValue(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+
+	return append([]byte{}, value...)
+}
+
+// copyOps copies the operations of a Txn, see copyValue.
+func copyOps(ops []*kv.Op) []*kv.Op {
+	if ops == nil {
+		return nil
+	}
+
+	copied := make([]*kv.Op, 0, len(ops))
+	for _, op := range ops {
+		op := *op
+		op.Value = copyValue(op.Value)
+		copied = append(copied, &op)
+	}
+
+	return copied
+}
+
+func (f *Fake) Get(ctx context.Context, key string) (pair *kv.Pair, err error) {
+	err = f.call(ctx, &Call{Method: "Get", Key: key}, []string{key}, func() error {
+		pair, err = f.kv.Get(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+func (f *Fake) Set(ctx context.Context, key string, value []byte, opts ...kv.SetOption) error {
+	return f.call(ctx, &Call{Method: "Set", Key: key, Value: copyValue(value)}, []string{key}, func() error {
+		return f.kv.Set(ctx, key, value, opts...)
+	})
+}
+
+func (f *Fake) Delete(ctx context.Context, key string) error {
+	return f.call(ctx, &Call{Method: "Delete", Key: key}, []string{key}, func() error {
+		return f.kv.Delete(ctx, key)
+	})
+}
+
+func (f *Fake) RangePrefix(ctx context.Context, prefix string, pageSize int32, pageToken string) (query *kv.Query, err error) {
+	err = f.call(ctx, &Call{Method: "RangePrefix", Key: prefix}, []string{prefix}, func() error {
+		query, err = f.kv.RangePrefix(ctx, prefix, pageSize, pageToken)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+func (f *Fake) Create(ctx context.Context, key string, value []byte, opts ...kv.SetOption) (revision int64, err error) {
+	err = f.call(ctx, &Call{Method: "Create", Key: key, Value: copyValue(value)}, []string{key}, func() error {
+		revision, err = f.kv.Create(ctx, key, value, opts...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, nil
+}
+
+func (f *Fake) SetIfRevision(ctx context.Context, key string, value []byte, revision int64, opts ...kv.SetOption) (newRevision int64, err error) {
+	err = f.call(ctx, &Call{Method: "SetIfRevision", Key: key, Value: copyValue(value)}, []string{key}, func() error {
+		newRevision, err = f.kv.SetIfRevision(ctx, key, value, revision, opts...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newRevision, nil
+}
+
+func (f *Fake) DeleteIfRevision(ctx context.Context, key string, revision int64) error {
+	return f.call(ctx, &Call{Method: "DeleteIfRevision", Key: key}, []string{key}, func() error {
+		return f.kv.DeleteIfRevision(ctx, key, revision)
+	})
+}
+
+func (f *Fake) Txn(ctx context.Context, ops ...*kv.Op) (revision int64, err error) {
+	keys := make([]string, 0, len(ops))
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+
+	err = f.call(ctx, &Call{Method: "Txn", Ops: copyOps(ops)}, keys, func() error {
+		revision, err = f.kv.Txn(ctx, ops...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, nil
+}
+
+func (f *Fake) Watch(ctx context.Context, prefix string, opts ...kv.WatchOption) (ch <-chan *kv.Event, err error) {
+	err = f.call(ctx, &Call{Method: "Watch", Key: prefix}, []string{prefix}, func() error {
+		ch, err = f.kv.Watch(ctx, prefix, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	"go.resf.org/peridot/base/go/kv/kvtest"
+	"testing"
+	"time"
+)
+
+func newFake(t *testing.T) *Fake {
+	f, err := New()
+	require.Nil(t, err)
+	return f
+}
+
+// Without faults, the fake behaves like the store it wraps.
+func TestConformance(t *testing.T) {
+	kvtest.RunConformance(t, func(t *testing.T) kv.KV {
+		return newFake(t)
+	})
+}
+
+func TestFake_RecordsCalls(t *testing.T) {
+	ctx := context.Background()
+	f := newFake(t)
+
+	value := []byte("foo")
+	require.Nil(t, f.Set(ctx, "/test/foo", value))
+	_, err := f.Get(ctx, "/test/missing")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+	ops := []*kv.Op{kv.DeleteOp("/test/foo")}
+	_, err = f.Txn(ctx, ops...)
+	require.Nil(t, err)
+
+	// Calls are recorded as they were made, even if the caller reuses its buffers.
+	copy(value, "bar")
+	ops[0].Key = "/test/bar"
+
+	calls := f.Calls()
+	require.Len(t, calls, 3)
+	require.Equal(t, &Call{Method: "Set", Key: "/test/foo", Value: []byte("foo")}, calls[0])
+	require.Equal(t, &Call{Method: "Get", Key: "/test/missing", Err: kv.ErrNotFound}, calls[1])
+	require.Equal(t, []*kv.Op{kv.DeleteOp("/test/foo")}, calls[2].Ops)
+	require.Equal(t, 1, f.CallCount("Txn"))
+
+	f.ResetCalls()
+	require.Empty(t, f.Calls())
+}
+
+func TestFake_ErrorAfterCalls(t *testing.T) {
+	ctx := context.Background()
+	f := newFake(t)
+	unavailable := errors.New("unavailable")
+	fault := f.Inject("Set", WithError(unavailable), WithAfter(1), WithTimes(2))
+
+	for i, expected := range []error{nil, unavailable, unavailable, nil} {
+		require.Equal(t, expected, f.Set(ctx, "/test/foo", []byte{byte(i)}), i)
+	}
+	require.Equal(t, 2, f.Triggered(fault))
+
+	pair, err := f.Get(ctx, "/test/foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte{3}, pair.Value)
+}
+
+func TestFake_KeyPrefix(t *testing.T) {
+	ctx := context.Background()
+	f := newFake(t)
+	f.Inject("", WithConflict(), WithKeyPrefix("/locked/"))
+
+	_, err := f.Txn(ctx, kv.SetOp("/test/foo", nil), kv.SetOp("/locked/foo", nil))
+	require.ErrorIs(t, err, kv.ErrConflict)
+	_, err = f.Get(ctx, "/test/foo")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	_, err = f.Create(ctx, "/test/foo", nil)
+	require.Nil(t, err)
+
+	f.ClearFaults()
+	_, err = f.Create(ctx, "/locked/foo", nil)
+	require.Nil(t, err)
+}
+
+func TestFake_Applied(t *testing.T) {
+	ctx := context.Background()
+	f := newFake(t)
+	timeout := errors.New("timeout")
+	f.Inject("Create", WithError(timeout), WithApplied(), WithTimes(1))
+
+	// The first attempt is committed even though it fails, so a retry conflicts.
+	_, err := f.Create(ctx, "/test/foo", []byte("foo"))
+	require.ErrorIs(t, err, timeout)
+	_, err = f.Create(ctx, "/test/foo", []byte("foo"))
+	require.ErrorIs(t, err, kv.ErrConflict)
+}
+
+func TestFake_Latency(t *testing.T) {
+	f := newFake(t)
+	f.Inject("Get", WithLatency(time.Hour), WithNotFound())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := f.Get(ctx, "/test/foo")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, context.DeadlineExceeded, f.CallsTo("Get")[0].Err)
+}
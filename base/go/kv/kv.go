@@ -3,17 +3,28 @@ package kv
 import (
 	"context"
 	"errors"
+	"strings"
+	"time"
 )
 
 var (
 	ErrNotFound          = errors.New("key not found")
 	ErrPageTokenNotFound = errors.New("page token not found")
 	ErrNoNamespace       = errors.New("no namespace")
+	ErrConflict          = errors.New("revision conflict")
 )
 
 type Pair struct {
 	Key   string
 	Value []byte
+	// Revision is the revision the key was last written at.
+	// Revisions are store-wide and increase with every write, so a later
+	// write always has a higher revision than an earlier one.
+	// On DynamoDB, revisions are timestamps, so writes to different keys by
+	// different processes are only ordered as well as their clocks are synchronized.
+	Revision int64
+	// ExpiresAt is when the key expires, zero if it doesn't expire.
+	ExpiresAt time.Time
 }
 
 type Query struct {
@@ -26,8 +37,102 @@ type KV interface {
 	// Get returns the contents of a file from the storage backend.
 	// Key must have a namespace prefix.
 	// Example: /kernels/entries/123, where kernels is the namespace and the rest is the range key.
+	// Expired keys are never returned, even if the backend hasn't removed them yet.
 	Get(ctx context.Context, key string) (*Pair, error)
-	Set(ctx context.Context, key string, value []byte) error
+	Set(ctx context.Context, key string, value []byte, opts ...SetOption) error
 	Delete(ctx context.Context, key string) error
 	RangePrefix(ctx context.Context, prefix string, pageSize int32, pageToken string) (*Query, error)
+
+	// Create sets the value of a key only if it doesn't exist yet.
+	// Returns the new revision, or ErrConflict if the key already exists.
+	// Expired keys don't count as existing.
+	Create(ctx context.Context, key string, value []byte, opts ...SetOption) (int64, error)
+
+	// SetIfRevision sets the value of a key only if it is still at the given revision.
+	// Returns the new revision, or ErrConflict if the key has been modified or deleted since.
+	SetIfRevision(ctx context.Context, key string, value []byte, revision int64, opts ...SetOption) (int64, error)
+
+	// DeleteIfRevision deletes a key only if it is still at the given revision.
+	// Returns ErrConflict if the key has been modified or deleted since.
+	DeleteIfRevision(ctx context.Context, key string, revision int64) error
+
+	// Txn atomically applies a set of operations, either all of them are applied or none are.
+	// Operations may span namespaces. All writes in a transaction share the same revision, which is returned.
+	// Returns ErrConflict if any condition fails, ErrTxnTooLarge if the transaction exceeds
+	// MaxTxnOps or MaxTxnSize and ErrTxnDuplicateKey if a key appears more than once.
+	Txn(ctx context.Context, ops ...*Op) (int64, error)
+
+	// Watch returns a stream of changes to keys under the prefix, ordered by revision.
+	// Prefix must have a namespace. The channel is closed when the context is cancelled.
+	// Events are delivered at least once, so resuming with WithFromRevision may replay
+	// some events. Resuming from a revision that is no longer retained fails with ErrCompacted,
+	// except on DynamoDB where streams silently drop changes older than 24 hours.
+	// On DynamoDB, deletes don't have a revision of their own, so resuming replays
+	// every delete still in the stream that may have happened after the revision.
+	Watch(ctx context.Context, prefix string, opts ...WatchOption) (<-chan *Event, error)
+}
+
+type SetOptions struct {
+	// TTL is how long the key lives before it expires.
+	// Zero means the key never expires.
+	TTL time.Duration
+	// Expired writes the key as already expired, see WithExpired.
+	Expired bool
+}
+
+type SetOption func(*SetOptions)
+
+// WithTTL makes the key expire after the given duration.
+// Expired keys are removed by the backend eventually, and are hidden from reads until then.
+// The key doesn't expire if the write is later overwritten without a TTL.
+func WithTTL(ttl time.Duration) SetOption {
+	return func(o *SetOptions) {
+		o.TTL = ttl
+	}
+}
+
+// WithExpired writes the key as already expired, so it is hidden from reads right away.
+// Unlike a delete, the key keeps its revision until the backend removes it, so a
+// later Create of the key gets a higher revision. Use it instead of deleting keys whose
+// revisions must keep increasing, like fencing tokens.
+func WithExpired() SetOption {
+	return func(o *SetOptions) {
+		o.Expired = true
+	}
+}
+
+// NewSetOptions applies the given options, backends use this to read the options passed to a write.
+func NewSetOptions(opts ...SetOption) *SetOptions {
+	o := &SetOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// ExpiresAt returns when a key written now with these options expires, zero if it doesn't.
+func (o *SetOptions) ExpiresAt() time.Time {
+	if o.Expired {
+		// A whole second in the past, so backends that round up to seconds still see it as expired.
+		return time.Unix(time.Now().Unix()-1, 0)
+	}
+	if o.TTL <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(o.TTL)
+}
+
+// SplitKey splits a key into its namespace and the path within that namespace.
+// Example: /kernels/entries/123 returns "kernels" and "entries/123".
+// Returns ErrNoNamespace if the key does not have a namespace prefix.
+func SplitKey(key string) (string, string, error) {
+	trimmed := strings.TrimPrefix(key, "/")
+	parts := strings.SplitN(trimmed, "/", 2)
+	if len(parts) < 2 || parts[0] == "" {
+		return "", "", ErrNoNamespace
+	}
+
+	return parts[0], parts[1], nil
 }
@@ -0,0 +1,53 @@
+package kv_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	"testing"
+	"time"
+)
+
+func TestSetOptions_ExpiresAt(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []kv.SetOption
+		expires bool
+	}{
+		{
+			name: "no ttl",
+		},
+		{
+			name: "zero ttl",
+			opts: []kv.SetOption{kv.WithTTL(0)},
+		},
+		{
+			name: "negative ttl",
+			opts: []kv.SetOption{kv.WithTTL(-time.Minute)},
+		},
+		{
+			name:    "ttl",
+			opts:    []kv.SetOption{kv.WithTTL(time.Hour)},
+			expires: true,
+		},
+		{
+			name:    "last ttl wins",
+			opts:    []kv.SetOption{kv.WithTTL(time.Minute), kv.WithTTL(time.Hour)},
+			expires: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			expiresAt := kv.NewSetOptions(test.opts...).ExpiresAt()
+			opExpiresAt := kv.SetOp("/test/key", nil, test.opts...).ExpiresAt()
+			if !test.expires {
+				require.True(t, expiresAt.IsZero())
+				require.True(t, opExpiresAt.IsZero())
+				return
+			}
+			require.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+			require.WithinDuration(t, time.Now().Add(time.Hour), opExpiresAt, time.Minute)
+		})
+	}
+}
@@ -0,0 +1,873 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kvtest contains a conformance suite for kv.KV implementations.
+// Every backend should pass it, so code written against kv.KV behaves the
+// same regardless of the backend it runs on.
+package kvtest
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// watchTimeout is how long to wait for a watch event.
+// DynamoDB streams are polled, so events can take a few seconds to arrive.
+const watchTimeout = 30 * time.Second
+
+// Factory returns an empty store.
+// It is called once per test, and must clean up after itself using t.Cleanup.
+type Factory func(t *testing.T) kv.KV
+
+// RunConformance runs the conformance suite against the stores returned by factory.
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store kv.KV)
+	}{
+		{"NamespaceErrors", testNamespaceErrors},
+		{"NotFound", testNotFound},
+		{"SetGet", testSetGet},
+		{"EmptyValues", testEmptyValues},
+		{"Delete", testDelete},
+		{"RangePrefix", testRangePrefix},
+		{"RangePrefixPages", testRangePrefixPages},
+		{"PageSizeClamping", testPageSizeClamping},
+		{"PageTokenReuse", testPageTokenReuse},
+		{"InvalidPageTokens", testInvalidPageTokens},
+		{"LargeValues", testLargeValues},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"ConditionalWrites", testConditionalWrites},
+		{"ConcurrentIncrements", testConcurrentIncrements},
+		{"Txn", testTxn},
+		{"TxnLimits", testTxnLimits},
+		{"TTL", testTTL},
+		{"TxnTTL", testTxnTTL},
+		{"Expired", testExpired},
+		{"Watch", testWatch},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, factory(t))
+		})
+	}
+}
+
+func testNamespaceErrors(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	for _, key := range []string{"", "/", "foo", "/foo", "//foo"} {
+		_, err := store.Get(ctx, key)
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "Get %q", key)
+
+		err = store.Set(ctx, key, []byte("value"))
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "Set %q", key)
+
+		err = store.Delete(ctx, key)
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "Delete %q", key)
+
+		_, err = store.RangePrefix(ctx, key, 0, "")
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "RangePrefix %q", key)
+
+		_, err = store.Create(ctx, key, []byte("value"))
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "Create %q", key)
+
+		_, err = store.SetIfRevision(ctx, key, []byte("value"), 1)
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "SetIfRevision %q", key)
+
+		err = store.DeleteIfRevision(ctx, key, 1)
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "DeleteIfRevision %q", key)
+
+		_, err = store.Txn(ctx, kv.SetOp(key, []byte("value")))
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "Txn %q", key)
+
+		_, err = store.Watch(ctx, key)
+		require.ErrorIs(t, err, kv.ErrNoNamespace, "Watch %q", key)
+	}
+}
+
+func testNotFound(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	_, err := store.Get(ctx, "/test/missing")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	// Deleting a missing key is not an error.
+	require.Nil(t, store.Delete(ctx, "/test/missing"))
+
+	// Conditional writes on a missing key conflict.
+	_, err = store.SetIfRevision(ctx, "/test/missing", []byte("value"), 1)
+	require.ErrorIs(t, err, kv.ErrConflict)
+	err = store.DeleteIfRevision(ctx, "/test/missing", 1)
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+	// Listing an empty prefix is not an error.
+	query, err := store.RangePrefix(ctx, "/test/missing", 0, "")
+	require.Nil(t, err)
+	require.Empty(t, query.Pairs)
+	require.Empty(t, query.NextToken)
+
+	// The key must not be created as a side effect.
+	_, err = store.Get(ctx, "/test/missing")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+}
+
+func testSetGet(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	require.Nil(t, store.Set(ctx, "/test/foo", []byte("bar")))
+
+	pair, err := store.Get(ctx, "/test/foo")
+	require.Nil(t, err)
+	require.Equal(t, "/test/foo", pair.Key)
+	require.Equal(t, []byte("bar"), pair.Value)
+	require.Greater(t, pair.Revision, int64(0))
+	require.True(t, pair.ExpiresAt.IsZero())
+
+	// The leading slash is optional.
+	pair2, err := store.Get(ctx, "test/foo")
+	require.Nil(t, err)
+	require.Equal(t, pair.Value, pair2.Value)
+
+	// Keys are separated by namespace.
+	_, err = store.Get(ctx, "/other/foo")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	// Overwriting increases the revision.
+	require.Nil(t, store.Set(ctx, "/test/foo", []byte("baz")))
+	pair3, err := store.Get(ctx, "/test/foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("baz"), pair3.Value)
+	require.Greater(t, pair3.Revision, pair.Revision)
+
+	// Nested paths are just keys.
+	require.Nil(t, store.Set(ctx, "/test/a/b/c", []byte("nested")))
+	pair4, err := store.Get(ctx, "/test/a/b/c")
+	require.Nil(t, err)
+	require.Equal(t, "/test/a/b/c", pair4.Key)
+	require.Equal(t, []byte("nested"), pair4.Value)
+}
+
+func testEmptyValues(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	// Nil and empty values are both stored as empty values.
+	require.Nil(t, store.Set(ctx, "/test/nil", nil))
+	pair, err := store.Get(ctx, "/test/nil")
+	require.Nil(t, err)
+	require.Empty(t, pair.Value)
+
+	revision, err := store.Create(ctx, "/test/created", nil)
+	require.Nil(t, err)
+	revision, err = store.SetIfRevision(ctx, "/test/created", []byte{}, revision)
+	require.Nil(t, err)
+	pair, err = store.Get(ctx, "/test/created")
+	require.Nil(t, err)
+	require.Empty(t, pair.Value)
+	require.Equal(t, revision, pair.Revision)
+
+	_, err = store.Txn(ctx, kv.SetOp("/test/txn", nil), kv.CreateOp("/test/txn-created", nil))
+	require.Nil(t, err)
+	query, err := store.RangePrefix(ctx, "/test/", 0, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/test/created", "/test/nil", "/test/txn", "/test/txn-created"}, pairKeys(query.Pairs))
+	for _, pair := range query.Pairs {
+		require.Empty(t, pair.Value)
+	}
+}
+
+func testDelete(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	require.Nil(t, store.Set(ctx, "/test/foo", []byte("bar")))
+	require.Nil(t, store.Set(ctx, "/test/foo2", []byte("bar")))
+	require.Nil(t, store.Delete(ctx, "/test/foo"))
+
+	_, err := store.Get(ctx, "/test/foo")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	// Deleting a key doesn't affect keys it is a prefix of.
+	_, err = store.Get(ctx, "/test/foo2")
+	require.Nil(t, err)
+
+	// A deleted key can be created again.
+	_, err = store.Create(ctx, "/test/foo", []byte("again"))
+	require.Nil(t, err)
+}
+
+func testRangePrefix(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	keys := []string{"/test/items/b", "/test/items/a", "/test/items/c/d", "/test/itemsx", "/test/other/a", "/other/items/a"}
+	for _, key := range keys {
+		require.Nil(t, store.Set(ctx, key, []byte(key)))
+	}
+
+	query, err := store.RangePrefix(ctx, "/test/items/", 0, "")
+	require.Nil(t, err)
+	require.Equal(t, "/test/items/", query.Prefix)
+	require.Empty(t, query.NextToken)
+	require.Equal(t, []string{"/test/items/a", "/test/items/b", "/test/items/c/d"}, pairKeys(query.Pairs))
+	for _, pair := range query.Pairs {
+		require.Equal(t, []byte(pair.Key), pair.Value)
+		require.Greater(t, pair.Revision, int64(0))
+	}
+
+	// The prefix doesn't have to end at a path separator.
+	query, err = store.RangePrefix(ctx, "/test/items", 0, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/test/items/a", "/test/items/b", "/test/items/c/d", "/test/itemsx"}, pairKeys(query.Pairs))
+
+	// An empty path lists the whole namespace.
+	query, err = store.RangePrefix(ctx, "/test/", 0, "")
+	require.Nil(t, err)
+	require.Len(t, query.Pairs, 5)
+}
+
+func testRangePrefixPages(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	var expected []string
+	for i := 0; i < 45; i++ {
+		key := fmt.Sprintf("/test/items/%03d", i)
+		expected = append(expected, key)
+		require.Nil(t, store.Set(ctx, key, []byte("value")))
+	}
+	// Keys around the prefix must not leak into the pages.
+	require.Nil(t, store.Set(ctx, "/test/item", []byte("value")))
+	require.Nil(t, store.Set(ctx, "/test/itemz", []byte("value")))
+	require.Nil(t, store.Set(ctx, "/other/items/000", []byte("value")))
+
+	keys, pages := listAll(t, store, "/test/items/", 20)
+	require.Equal(t, expected, keys)
+	require.Equal(t, []int{20, 20, 5}, pages)
+
+	// Page boundaries exactly at the end of the results don't return an empty page.
+	keys, pages = listAll(t, store, "/test/items/", 15)
+	require.Equal(t, expected, keys)
+	require.Equal(t, 45, sum(pages))
+	require.NotContains(t, pages, 0)
+
+	keys, pages = listAll(t, store, "/test/items/", 1)
+	require.Equal(t, expected, keys)
+	require.Len(t, pages, 45)
+}
+
+func testPageSizeClamping(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	// Write in transactions, so this doesn't take forever on remote backends.
+	for i := 0; i < 150; i += kv.MaxTxnOps / 2 {
+		var ops []*kv.Op
+		for j := i; j < i+kv.MaxTxnOps/2 && j < 150; j++ {
+			ops = append(ops, kv.SetOp(fmt.Sprintf("/test/items/%03d", j), []byte("value")))
+		}
+		_, err := store.Txn(ctx, ops...)
+		require.Nil(t, err)
+	}
+
+	for _, tc := range []struct {
+		pageSize int32
+		expected int
+	}{
+		{0, 20},
+		{-1, 20},
+		{10, 10},
+		{100, 100},
+		{101, 100},
+		{1000, 100},
+	} {
+		query, err := store.RangePrefix(ctx, "/test/items/", tc.pageSize, "")
+		require.Nil(t, err, "page size %d", tc.pageSize)
+		require.Len(t, query.Pairs, tc.expected, "page size %d", tc.pageSize)
+		require.NotEmpty(t, query.NextToken, "page size %d", tc.pageSize)
+
+		// The token continues with the same (clamped) page size.
+		remaining := 150 - tc.expected
+		if remaining > tc.expected {
+			remaining = tc.expected
+		}
+		next, err := store.RangePrefix(ctx, "/test/items/", tc.pageSize, query.NextToken)
+		require.Nil(t, err, "page size %d", tc.pageSize)
+		require.Len(t, next.Pairs, remaining, "page size %d", tc.pageSize)
+		require.Greater(t, next.Pairs[0].Key, query.Pairs[len(query.Pairs)-1].Key)
+	}
+}
+
+func testPageTokenReuse(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	for i := 0; i < 30; i++ {
+		require.Nil(t, store.Set(ctx, fmt.Sprintf("/test/items/%03d", i), []byte("value")))
+	}
+
+	first, err := store.RangePrefix(ctx, "/test/items/", 10, "")
+	require.Nil(t, err)
+	require.NotEmpty(t, first.NextToken)
+
+	// Tokens can be used more than once, and always continue from the same place.
+	second, err := store.RangePrefix(ctx, "/test/items/", 10, first.NextToken)
+	require.Nil(t, err)
+	again, err := store.RangePrefix(ctx, "/test/items/", 10, first.NextToken)
+	require.Nil(t, err)
+	require.Equal(t, pairKeys(second.Pairs), pairKeys(again.Pairs))
+	require.Equal(t, "/test/items/010", second.Pairs[0].Key)
+
+	// The same listing returns the same first page.
+	firstAgain, err := store.RangePrefix(ctx, "/test/items/", 10, "")
+	require.Nil(t, err)
+	require.Equal(t, pairKeys(first.Pairs), pairKeys(firstAgain.Pairs))
+
+	// Tokens stay valid while the store is modified, and see the changes.
+	require.Nil(t, store.Delete(ctx, "/test/items/010"))
+	require.Nil(t, store.Set(ctx, "/test/items/0055", []byte("value")))
+	afterWrite, err := store.RangePrefix(ctx, "/test/items/", 10, first.NextToken)
+	require.Nil(t, err)
+	require.Equal(t, "/test/items/011", afterWrite.Pairs[0].Key)
+}
+
+func testInvalidPageTokens(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	for i := 0; i < 30; i++ {
+		require.Nil(t, store.Set(ctx, fmt.Sprintf("/test/items/%03d", i), []byte("value")))
+	}
+
+	query, err := store.RangePrefix(ctx, "/test/items/", 10, "")
+	require.Nil(t, err)
+	token := query.NextToken
+	require.NotEmpty(t, token)
+
+	// Tokens are tied to the request that returned them.
+	_, err = store.RangePrefix(ctx, "/test/other/", 10, token)
+	require.ErrorIs(t, err, kv.ErrPageTokenNotFound)
+	_, err = store.RangePrefix(ctx, "/test/items/", 11, token)
+	require.ErrorIs(t, err, kv.ErrPageTokenNotFound)
+
+	// Modified and made up tokens are rejected.
+	tampered := []byte(token)
+	tampered[len(tampered)/2] ^= 1
+	for _, invalid := range []string{"garbage", "v2.", "v2.garbage", string(tampered), token[:len(token)-1], token + "A"} {
+		_, err = store.RangePrefix(ctx, "/test/items/", 10, invalid)
+		require.ErrorIs(t, err, kv.ErrPageTokenNotFound, "token %q", invalid)
+	}
+}
+
+func testLargeValues(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	// DynamoDB limits items to 400KB.
+	value := make([]byte, 350*1024)
+	_, err := rand.Read(value)
+	require.Nil(t, err)
+
+	require.Nil(t, store.Set(ctx, "/test/large", value))
+
+	pair, err := store.Get(ctx, "/test/large")
+	require.Nil(t, err)
+	require.Equal(t, value, pair.Value)
+
+	query, err := store.RangePrefix(ctx, "/test/large", 0, "")
+	require.Nil(t, err)
+	require.Len(t, query.Pairs, 1)
+	require.Equal(t, value, query.Pairs[0].Value)
+
+	// Empty values are values too.
+	require.Nil(t, store.Set(ctx, "/test/empty", []byte{}))
+	pair, err = store.Get(ctx, "/test/empty")
+	require.Nil(t, err)
+	require.Empty(t, pair.Value)
+}
+
+func testConcurrentWriters(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	const writers = 10
+	const keysPerWriter = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*keysPerWriter*2)
+	for w := 0; w < writers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				// Every writer writes its own keys, and a key shared with the others.
+				errs <- store.Set(ctx, fmt.Sprintf("/test/writers/%02d/%02d", w, i), []byte(fmt.Sprintf("%d-%d", w, i)))
+				errs <- store.Set(ctx, "/test/shared", []byte(fmt.Sprintf("%d", w)))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	keys, _ := listAll(t, store, "/test/writers/", 100)
+	require.Len(t, keys, writers*keysPerWriter)
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keysPerWriter; i++ {
+			pair, err := store.Get(ctx, fmt.Sprintf("/test/writers/%02d/%02d", w, i))
+			require.Nil(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("%d-%d", w, i)), pair.Value)
+		}
+	}
+
+	// The shared key has one of the written values.
+	pair, err := store.Get(ctx, "/test/shared")
+	require.Nil(t, err)
+	require.Len(t, pair.Value, 1)
+}
+
+func testConditionalWrites(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	revision, err := store.Create(ctx, "/test/foo", []byte("v1"))
+	require.Nil(t, err)
+	require.Greater(t, revision, int64(0))
+
+	_, err = store.Create(ctx, "/test/foo", []byte("v2"))
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+	pair, err := store.Get(ctx, "/test/foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), pair.Value)
+	require.Equal(t, revision, pair.Revision)
+
+	revision2, err := store.SetIfRevision(ctx, "/test/foo", []byte("v2"), revision)
+	require.Nil(t, err)
+	require.Greater(t, revision2, revision)
+
+	// The old revision is stale now.
+	_, err = store.SetIfRevision(ctx, "/test/foo", []byte("v3"), revision)
+	require.ErrorIs(t, err, kv.ErrConflict)
+	err = store.DeleteIfRevision(ctx, "/test/foo", revision)
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+	pair, err = store.Get(ctx, "/test/foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("v2"), pair.Value)
+	require.Equal(t, revision2, pair.Revision)
+
+	// Unconditional writes bump the revision too.
+	require.Nil(t, store.Set(ctx, "/test/foo", []byte("v3")))
+	_, err = store.SetIfRevision(ctx, "/test/foo", []byte("v4"), revision2)
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+	pair, err = store.Get(ctx, "/test/foo")
+	require.Nil(t, err)
+	require.Nil(t, store.DeleteIfRevision(ctx, "/test/foo", pair.Revision))
+	_, err = store.Get(ctx, "/test/foo")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	// Revisions are store-wide.
+	revisionA, err := store.Create(ctx, "/test/a", []byte("a"))
+	require.Nil(t, err)
+	revisionB, err := store.Create(ctx, "/other/b", []byte("b"))
+	require.Nil(t, err)
+	require.Greater(t, revisionB, revisionA)
+}
+
+func testConcurrentIncrements(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	const workers = 5
+	const increments = 5
+
+	_, err := store.Create(ctx, "/test/counter", []byte("0"))
+	require.Nil(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*increments)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				errs <- increment(ctx, store, "/test/counter")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	pair, err := store.Get(ctx, "/test/counter")
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("%d", workers*increments), string(pair.Value))
+}
+
+// increment increments a counter with optimistic concurrency, retrying on conflicts.
+func increment(ctx context.Context, store kv.KV, key string) error {
+	for {
+		pair, err := store.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		var n int
+		_, err = fmt.Sscanf(string(pair.Value), "%d", &n)
+		if err != nil {
+			return err
+		}
+
+		_, err = store.SetIfRevision(ctx, key, []byte(fmt.Sprintf("%d", n+1)), pair.Revision)
+		if errors.Is(err, kv.ErrConflict) {
+			continue
+		}
+		return err
+	}
+}
+
+func testTxn(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	revision, err := store.Txn(
+		ctx,
+		kv.CreateOp("/test/a", []byte("a")),
+		kv.SetOp("/test/b", []byte("b")),
+		kv.SetOp("/other/c", []byte("c")),
+	)
+	require.Nil(t, err)
+	require.Greater(t, revision, int64(0))
+
+	// Every write in a transaction shares the revision.
+	for _, key := range []string{"/test/a", "/test/b", "/other/c"} {
+		pair, err := store.Get(ctx, key)
+		require.Nil(t, err)
+		require.Equal(t, revision, pair.Revision, key)
+	}
+
+	// A failed condition rolls back the whole transaction.
+	_, err = store.Txn(
+		ctx,
+		kv.SetOp("/test/b", []byte("b2")),
+		kv.DeleteOp("/other/c"),
+		kv.CreateOp("/test/new", []byte("new")),
+		kv.CreateOp("/test/a", []byte("a2")),
+	)
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+	pair, err := store.Get(ctx, "/test/b")
+	require.Nil(t, err)
+	require.Equal(t, []byte("b"), pair.Value)
+	_, err = store.Get(ctx, "/other/c")
+	require.Nil(t, err)
+	_, err = store.Get(ctx, "/test/new")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	// Checks don't write, but fail the transaction.
+	_, err = store.Txn(
+		ctx,
+		kv.CheckRevisionOp("/test/a", revision-1),
+		kv.SetOp("/test/b", []byte("b2")),
+	)
+	require.ErrorIs(t, err, kv.ErrConflict)
+
+	revision2, err := store.Txn(
+		ctx,
+		kv.CheckRevisionOp("/test/a", revision),
+		kv.SetIfRevisionOp("/test/b", []byte("b2"), revision),
+		kv.DeleteIfRevisionOp("/other/c", revision),
+		kv.DeleteOp("/test/missing"),
+	)
+	require.Nil(t, err)
+	require.Greater(t, revision2, revision)
+
+	pair, err = store.Get(ctx, "/test/a")
+	require.Nil(t, err)
+	require.Equal(t, revision, pair.Revision)
+	pair, err = store.Get(ctx, "/test/b")
+	require.Nil(t, err)
+	require.Equal(t, []byte("b2"), pair.Value)
+	require.Equal(t, revision2, pair.Revision)
+	_, err = store.Get(ctx, "/other/c")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	// An empty transaction does nothing.
+	_, err = store.Txn(ctx)
+	require.Nil(t, err)
+}
+
+func testTxnLimits(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	var ops []*kv.Op
+	for i := 0; i <= kv.MaxTxnOps; i++ {
+		ops = append(ops, kv.SetOp(fmt.Sprintf("/test/items/%03d", i), []byte("value")))
+	}
+	_, err := store.Txn(ctx, ops...)
+	require.ErrorIs(t, err, kv.ErrTxnTooLarge)
+
+	// Exactly at the limit is fine.
+	_, err = store.Txn(ctx, ops[:kv.MaxTxnOps]...)
+	require.Nil(t, err)
+
+	large := make([]byte, kv.MaxTxnSize/4)
+	_, err = store.Txn(
+		ctx,
+		kv.SetOp("/test/large/1", large),
+		kv.SetOp("/test/large/2", large),
+		kv.SetOp("/test/large/3", large),
+		kv.SetOp("/test/large/4", large),
+	)
+	require.ErrorIs(t, err, kv.ErrTxnTooLarge)
+
+	_, err = store.Txn(
+		ctx,
+		kv.SetOp("/test/dup", []byte("1")),
+		kv.SetOp("test/dup", []byte("2")),
+	)
+	require.ErrorIs(t, err, kv.ErrTxnDuplicateKey)
+	_, err = store.Get(ctx, "/test/dup")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+}
+
+func testTTL(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	require.Nil(t, store.Set(ctx, "/test/short", []byte("value"), kv.WithTTL(time.Second)))
+	require.Nil(t, store.Set(ctx, "/test/long", []byte("value"), kv.WithTTL(time.Hour)))
+	require.Nil(t, store.Set(ctx, "/test/forever", []byte("value")))
+
+	pair, err := store.Get(ctx, "/test/long")
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), pair.ExpiresAt, time.Minute)
+
+	pair, err = store.Get(ctx, "/test/short")
+	require.Nil(t, err)
+	require.False(t, pair.ExpiresAt.IsZero())
+
+	// DynamoDB stores expiry with second precision.
+	time.Sleep(2 * time.Second)
+
+	_, err = store.Get(ctx, "/test/short")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	query, err := store.RangePrefix(ctx, "/test/", 0, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/test/forever", "/test/long"}, pairKeys(query.Pairs))
+
+	// Expired keys don't exist, so they can be created again.
+	_, err = store.Create(ctx, "/test/short", []byte("again"))
+	require.Nil(t, err)
+	pair, err = store.Get(ctx, "/test/short")
+	require.Nil(t, err)
+	require.Equal(t, []byte("again"), pair.Value)
+	require.True(t, pair.ExpiresAt.IsZero())
+
+	// Overwriting without a TTL removes it.
+	require.Nil(t, store.Set(ctx, "/test/long", []byte("value")))
+	pair, err = store.Get(ctx, "/test/long")
+	require.Nil(t, err)
+	require.True(t, pair.ExpiresAt.IsZero())
+}
+
+func testExpired(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	revision, err := store.Create(ctx, "/test/key", []byte("value"))
+	require.Nil(t, err)
+	expired, err := store.SetIfRevision(ctx, "/test/key", []byte("value"), revision, kv.WithExpired())
+	require.Nil(t, err)
+	require.Greater(t, expired, revision)
+
+	// Expired writes are hidden right away.
+	_, err = store.Get(ctx, "/test/key")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+	query, err := store.RangePrefix(ctx, "/test/", 0, "")
+	require.Nil(t, err)
+	require.Empty(t, query.Pairs)
+
+	// Creating the key again moves past the revision of the expired write.
+	created, err := store.Create(ctx, "/test/key", []byte("again"))
+	require.Nil(t, err)
+	require.Greater(t, created, expired)
+
+	_, err = store.Txn(ctx, kv.SetOp("/test/txn", []byte("value"), kv.WithExpired()))
+	require.Nil(t, err)
+	_, err = store.Get(ctx, "/test/txn")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+}
+
+func testTxnTTL(t *testing.T, store kv.KV) {
+	ctx := context.Background()
+
+	revision, err := store.Create(ctx, "/test/conditional", []byte("v1"))
+	require.Nil(t, err)
+
+	txnRevision, err := store.Txn(
+		ctx,
+		kv.SetOp("/test/short", []byte("value"), kv.WithTTL(time.Second)),
+		kv.CreateOp("/test/long", []byte("value"), kv.WithTTL(time.Hour)),
+		kv.SetIfRevisionOp("/test/conditional", []byte("v2"), revision, kv.WithTTL(time.Second)),
+		kv.SetOp("/test/forever", []byte("value")),
+	)
+	require.Nil(t, err)
+
+	pair, err := store.Get(ctx, "/test/long")
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), pair.ExpiresAt, time.Minute)
+
+	// DynamoDB stores expiry with second precision.
+	time.Sleep(2 * time.Second)
+
+	_, err = store.Get(ctx, "/test/short")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+	_, err = store.Get(ctx, "/test/conditional")
+	require.ErrorIs(t, err, kv.ErrNotFound)
+
+	query, err := store.RangePrefix(ctx, "/test/", 0, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/test/forever", "/test/long"}, pairKeys(query.Pairs))
+
+	// Expired keys can't be written conditionally, but can be created again.
+	_, err = store.Txn(ctx, kv.SetIfRevisionOp("/test/short", []byte("again"), txnRevision))
+	require.ErrorIs(t, err, kv.ErrConflict)
+	_, err = store.Txn(ctx, kv.CreateOp("/test/conditional", []byte("again")))
+	require.Nil(t, err)
+}
+
+func testWatch(t *testing.T, store kv.KV) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Resume from a known revision, so no changes are missed while the watch starts.
+	start, err := store.Create(ctx, "/test/start", []byte("start"))
+	require.Nil(t, err)
+
+	ch, err := store.Watch(ctx, "/test/watched/", kv.WithFromRevision(start))
+	require.Nil(t, err)
+
+	require.Nil(t, store.Set(ctx, "/test/unwatched", []byte("other")))
+	require.Nil(t, store.Set(ctx, "/other/watched/foo", []byte("other")))
+	revision1, err := store.Create(ctx, "/test/watched/foo", []byte("v1"))
+	require.Nil(t, err)
+	revision2, err := store.SetIfRevision(ctx, "/test/watched/foo", []byte("v2"), revision1)
+	require.Nil(t, err)
+	require.Nil(t, store.DeleteIfRevision(ctx, "/test/watched/foo", revision2))
+
+	event := nextEvent(t, ch)
+	require.Equal(t, kv.EventPut, event.Type)
+	require.Equal(t, "/test/watched/foo", event.Pair.Key)
+	require.Equal(t, []byte("v1"), event.Pair.Value)
+	require.Equal(t, revision1, event.Pair.Revision)
+
+	event = nextEvent(t, ch)
+	require.Equal(t, kv.EventPut, event.Type)
+	require.Equal(t, []byte("v2"), event.Pair.Value)
+	require.Equal(t, revision2, event.Pair.Revision)
+
+	event = nextEvent(t, ch)
+	require.Equal(t, kv.EventDelete, event.Type)
+	require.Equal(t, "/test/watched/foo", event.Pair.Key)
+	require.GreaterOrEqual(t, event.Pair.Revision, revision2)
+
+	// Resuming replays the changes after the revision.
+	resumed, err := store.Watch(ctx, "/test/watched/", kv.WithFromRevision(revision1))
+	require.Nil(t, err)
+	event = nextEvent(t, resumed)
+	require.Equal(t, kv.EventPut, event.Type)
+	require.Equal(t, []byte("v2"), event.Pair.Value)
+
+	// Cancelling the context closes the channel.
+	cancel()
+	deadline := time.After(watchTimeout)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("watch channel not closed after cancel")
+		}
+	}
+}
+
+// nextEvent returns the next event from a watch, failing the test on errors.
+func nextEvent(t *testing.T, ch <-chan *kv.Event) *kv.Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-ch:
+		require.True(t, ok, "watch channel closed")
+		require.Nil(t, event.Err)
+		return event
+	case <-time.After(watchTimeout):
+		t.Fatal("timed out waiting for watch event")
+		return nil
+	}
+}
+
+// listAll lists every key under the prefix, and returns the keys and the size of every page.
+func listAll(t *testing.T, store kv.KV, prefix string, pageSize int32) ([]string, []int) {
+	t.Helper()
+
+	var keys []string
+	var pages []int
+	var token string
+	for {
+		query, err := store.RangePrefix(context.Background(), prefix, pageSize, token)
+		require.Nil(t, err)
+		require.LessOrEqual(t, len(query.Pairs), int(pageSize))
+
+		for _, pair := range query.Pairs {
+			require.True(t, strings.HasPrefix(pair.Key, prefix), "key %q outside of prefix %q", pair.Key, prefix)
+		}
+		keys = append(keys, pairKeys(query.Pairs)...)
+		pages = append(pages, len(query.Pairs))
+
+		if query.NextToken == "" {
+			break
+		}
+		token = query.NextToken
+	}
+
+	require.True(t, sort.StringsAreSorted(keys), "keys are not sorted")
+	return keys, pages
+}
+
+func pairKeys(pairs []*kv.Pair) []string {
+	var keys []string
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key)
+	}
+
+	return keys
+}
+
+func sum(values []int) int {
+	var total int
+	for _, v := range values {
+		total += v
+	}
+
+	return total
+}
@@ -0,0 +1,397 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lease provides distributed leases (locks with a TTL) on top of kv.KV.
+//
+// A lease is a key created with kv.KV.Create and a TTL, renewed with kv.KV.SetIfRevision,
+// and released by writing it as expired (kv.WithExpired), so it only relies on conditional
+// writes and works on every backend.
+// If the holder stops renewing, for example because it crashed, the key expires
+// and the lease can be acquired by someone else.
+//
+// The lease context is cancelled shortly before the TTL runs out since the last successful
+// renewal, even if the store can't be reached to find out whether the lease expired.
+// Because that can't account for pauses and clock drift, work guarded by a lease should
+// also pass the fencing token (Lease.Token) to the systems it writes to, so they can
+// reject writes from a previous holder.
+package lease
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/kv"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTTL           = 15 * time.Second
+	defaultRetryInterval = time.Second
+	// expiryMarginDivisor gives the part of the TTL before expiry at which a lease that
+	// couldn't be renewed is considered lost, so work stops before someone else can take over.
+	expiryMarginDivisor = 10
+)
+
+var (
+	// ErrHeld is returned when the lease is held by someone else.
+	ErrHeld = errors.New("lease is held by another holder")
+	// ErrLost is returned, and is the cause of the lease context, when the lease expired
+	// or was taken over before it could be renewed.
+	ErrLost = errors.New("lease lost")
+	// ErrReleased is the cause of the lease context after Release.
+	ErrReleased = errors.New("lease released")
+)
+
+// record is the value of a lease key.
+type record struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+type Options struct {
+	TTL time.Duration
+	// Holder identifies the holder, defaults to the hostname followed by a random suffix.
+	Holder        string
+	RetryInterval time.Duration
+}
+
+type Option func(*Options)
+
+// WithTTL sets how long the lease lives without being renewed, defaults to 15 seconds.
+// Leases are renewed automatically every third of the TTL.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *Options) {
+		o.TTL = ttl
+	}
+}
+
+// WithHolder sets the holder name stored in the lease, see Holder.
+func WithHolder(holder string) Option {
+	return func(o *Options) {
+		o.Holder = holder
+	}
+}
+
+// WithRetryInterval sets how often Acquire retries while the lease is held, defaults to one second.
+func WithRetryInterval(interval time.Duration) Option {
+	return func(o *Options) {
+		o.RetryInterval = interval
+	}
+}
+
+func newOptions(opts []Option) (*Options, error) {
+	o := &Options{
+		TTL:           defaultTTL,
+		RetryInterval: defaultRetryInterval,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.Holder == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		suffix := make([]byte, 4)
+		_, err = rand.Read(suffix)
+		if err != nil {
+			return nil, err
+		}
+		o.Holder = fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(suffix))
+	}
+
+	return o, nil
+}
+
+// Lease is a held lease. It is renewed in the background until it is released,
+// lost, or the context passed to Acquire is cancelled.
+type Lease struct {
+	store  kv.KV
+	key    string
+	holder string
+	ttl    time.Duration
+	token  int64
+	// acquiredAt is when the lease was acquired, kept in the record across renewals.
+	acquiredAt time.Time
+
+	lock sync.Mutex
+	// revision is the revision of the last write to the lease key, used to renew and release.
+	revision int64
+	// expiry cancels the lease context with ErrLost shortly before the lease expires,
+	// it is pushed back after every successful renewal.
+	expiry *time.Timer
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// TryAcquire acquires the lease at key, or returns ErrHeld if it is held by someone else.
+// The lease is renewed until ctx is cancelled, after which it is released.
+func TryAcquire(ctx context.Context, store kv.KV, key string, opts ...Option) (*Lease, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return tryAcquire(ctx, store, key, o)
+}
+
+// Acquire acquires the lease at key, waiting until it is available or ctx is cancelled.
+// The lease is renewed until ctx is cancelled, after which it is released.
+func Acquire(ctx context.Context, store kv.KV, key string, opts ...Option) (*Lease, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		l, err := tryAcquire(ctx, store, key, o)
+		if !errors.Is(err, ErrHeld) {
+			return l, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(o.RetryInterval):
+		}
+	}
+}
+
+func tryAcquire(ctx context.Context, store kv.KV, key string, o *Options) (*Lease, error) {
+	now := time.Now()
+	value, err := json.Marshal(&record{
+		Holder:     o.Holder,
+		AcquiredAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Expired leases don't count as existing, so this also takes over expired leases.
+	revision, err := store.Create(ctx, key, value, kv.WithTTL(o.TTL))
+	if err != nil {
+		if errors.Is(err, kv.ErrConflict) {
+			return nil, ErrHeld
+		}
+		return nil, err
+	}
+
+	leaseCtx, cancel := context.WithCancelCause(ctx)
+	l := &Lease{
+		store:      store,
+		key:        key,
+		holder:     o.Holder,
+		ttl:        o.TTL,
+		token:      revision,
+		acquiredAt: now,
+		revision:   revision,
+		ctx:        leaseCtx,
+		cancel:     cancel,
+	}
+	l.expiry = time.AfterFunc(time.Until(l.lostAt(now)), func() {
+		l.cancel(ErrLost)
+	})
+	go l.renewLoop()
+
+	return l, nil
+}
+
+// Token returns the fencing token of the lease.
+// Revisions of a key only increase, and released leases leave an expired key behind
+// instead of deleting it, so every new lease on a key gets a higher token than the
+// leases before it, even on backends whose revisions are not store-wide.
+func (l *Lease) Token() int64 {
+	return l.token
+}
+
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+// Context returns a context that is cancelled when the lease is lost or released.
+// context.Cause returns ErrLost or ErrReleased, or the error of the context passed to Acquire.
+// Work guarded by the lease should use this context.
+func (l *Lease) Context() context.Context {
+	return l.ctx
+}
+
+// Renew extends the lease by its TTL.
+// Renewing happens automatically, this is only needed to extend the lease right away.
+// Returns ErrLost if the lease expired or was taken over.
+func (l *Lease) Renew(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.ctx.Err() != nil {
+		return context.Cause(l.ctx)
+	}
+
+	value, err := l.value()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	revision, err := l.store.SetIfRevision(ctx, l.key, value, l.revision, kv.WithTTL(l.ttl))
+	if err != nil {
+		if errors.Is(err, kv.ErrConflict) {
+			l.cancel(ErrLost)
+			return ErrLost
+		}
+		return err
+	}
+	l.revision = revision
+	// The TTL started before the write, so count from then.
+	l.expiry.Reset(time.Until(l.lostAt(now)))
+
+	return nil
+}
+
+// value returns the record of the lease.
+func (l *Lease) value() ([]byte, error) {
+	return json.Marshal(&record{
+		Holder:     l.holder,
+		AcquiredAt: l.acquiredAt,
+	})
+}
+
+// release writes the lease key as expired, so it can be acquired right away.
+// The key isn't deleted, so the next Create of it moves past its revision.
+func (l *Lease) release(ctx context.Context) error {
+	value, err := l.value()
+	if err != nil {
+		return err
+	}
+
+	_, err = l.store.SetIfRevision(ctx, l.key, value, l.revision, kv.WithExpired())
+	return err
+}
+
+// lostAt returns when a lease written at writtenAt is considered lost if it isn't renewed.
+func (l *Lease) lostAt(writtenAt time.Time) time.Time {
+	return writtenAt.Add(l.ttl - l.ttl/expiryMarginDivisor)
+}
+
+// Release releases the lease, so it can be acquired right away, and cancels the lease context.
+// Returns ErrLost if the lease was lost before it was released.
+// Releasing a released lease does nothing.
+func (l *Lease) Release(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.ctx.Err() != nil {
+		cause := context.Cause(l.ctx)
+		if errors.Is(cause, ErrLost) {
+			return ErrLost
+		}
+		// Cancelled by the parent context, the renew loop releases the lease.
+		return nil
+	}
+	defer l.cancel(ErrReleased)
+
+	err := l.release(ctx)
+	if err != nil {
+		if errors.Is(err, kv.ErrConflict) {
+			return ErrLost
+		}
+		return err
+	}
+
+	return nil
+}
+
+// renewLoop renews the lease every third of the TTL, until it is lost or released.
+// If renewing keeps failing, the expiry timer cancels the lease before the TTL has passed.
+func (l *Lease) renewLoop() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	defer l.expiry.Stop()
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			cause := context.Cause(l.ctx)
+			if !errors.Is(cause, ErrLost) && !errors.Is(cause, ErrReleased) {
+				l.releaseAfterCancel()
+			}
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(l.ctx, l.ttl/3)
+		err := l.Renew(ctx)
+		cancel()
+		if err == nil || errors.Is(err, ErrLost) || errors.Is(err, ErrReleased) || l.ctx.Err() != nil {
+			continue
+		}
+
+		base.LogErrorf("failed to renew lease %s: %v", l.key, err)
+	}
+}
+
+// releaseAfterCancel releases the lease after the context passed to Acquire is cancelled.
+func (l *Lease) releaseAfterCancel() {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+	defer cancel()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.release(ctx)
+	if err != nil && !errors.Is(err, kv.ErrConflict) {
+		base.LogErrorf("failed to release lease %s: %v", l.key, err)
+	}
+}
+
+// Run acquires the lease at key, waiting until it is available, and runs fn with the lease context.
+// The lease is released when fn returns. If the lease is lost while fn runs, its context
+// is cancelled and Run returns ErrLost unless fn returned an error of its own.
+func Run(ctx context.Context, store kv.KV, key string, fn func(ctx context.Context, l *Lease) error, opts ...Option) error {
+	l, err := Acquire(ctx, store, key, opts...)
+	if err != nil {
+		return err
+	}
+
+	fnErr := fn(l.Context(), l)
+	releaseErr := l.Release(context.Background())
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return releaseErr
+}
+
+// Holder returns the holder of the lease at key, or kv.ErrNotFound if it isn't held.
+func Holder(ctx context.Context, store kv.KV, key string) (string, error) {
+	pair, err := store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	var r record
+	err = json.Unmarshal(pair.Value, &r)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse lease")
+	}
+
+	return r.Holder, nil
+}
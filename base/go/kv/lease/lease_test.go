@@ -0,0 +1,212 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	kv_fake "go.resf.org/peridot/base/go/kv/fake"
+	kv_memory "go.resf.org/peridot/base/go/kv/memory"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStore(t *testing.T) kv.KV {
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+	return store
+}
+
+func TestTryAcquire(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	l, err := TryAcquire(ctx, store, "/leases/repack/1", WithHolder("a"))
+	require.Nil(t, err)
+	require.Equal(t, "a", l.Holder())
+
+	_, err = TryAcquire(ctx, store, "/leases/repack/1", WithHolder("b"))
+	require.ErrorIs(t, err, ErrHeld)
+
+	holder, err := Holder(ctx, store, "/leases/repack/1")
+	require.Nil(t, err)
+	require.Equal(t, "a", holder)
+
+	// Other keys are independent.
+	other, err := TryAcquire(ctx, store, "/leases/repack/2")
+	require.Nil(t, err)
+	require.Nil(t, other.Release(ctx))
+
+	require.Nil(t, l.Release(ctx))
+	require.ErrorIs(t, context.Cause(l.Context()), ErrReleased)
+	require.Nil(t, l.Release(ctx))
+
+	// Every new lease has a higher fencing token.
+	next, err := TryAcquire(ctx, store, "/leases/repack/1", WithHolder("b"))
+	require.Nil(t, err)
+	require.Greater(t, next.Token(), l.Token())
+	require.Nil(t, next.Release(ctx))
+}
+
+func TestLease_Renewed(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	l, err := TryAcquire(ctx, store, "/leases/scheduler", WithTTL(300*time.Millisecond))
+	require.Nil(t, err)
+	token := l.Token()
+
+	time.Sleep(time.Second)
+	require.Nil(t, l.Context().Err())
+	require.Equal(t, token, l.Token())
+	_, err = TryAcquire(ctx, store, "/leases/scheduler")
+	require.ErrorIs(t, err, ErrHeld)
+
+	require.Nil(t, l.Release(ctx))
+}
+
+func TestLease_Lost(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	l, err := TryAcquire(ctx, store, "/leases/scheduler", WithTTL(300*time.Millisecond))
+	require.Nil(t, err)
+
+	// Someone else takes over, for example after the lease expired during a pause.
+	require.Nil(t, store.Delete(ctx, "/leases/scheduler"))
+	other, err := TryAcquire(ctx, store, "/leases/scheduler", WithTTL(time.Minute))
+	require.Nil(t, err)
+
+	select {
+	case <-l.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease context not cancelled")
+	}
+	require.ErrorIs(t, context.Cause(l.Context()), ErrLost)
+	require.ErrorIs(t, l.Renew(ctx), ErrLost)
+	require.ErrorIs(t, l.Release(ctx), ErrLost)
+
+	// Releasing the lost lease must not release the new holder's lease.
+	holder, err := Holder(ctx, store, "/leases/scheduler")
+	require.Nil(t, err)
+	require.Equal(t, other.Holder(), holder)
+	require.Nil(t, other.Release(ctx))
+}
+
+func TestLease_LostBeforeExpiry(t *testing.T) {
+	ctx := context.Background()
+	store, err := kv_fake.New()
+	require.Nil(t, err)
+
+	l, err := TryAcquire(ctx, store, "/leases/scheduler", WithTTL(time.Second))
+	require.Nil(t, err)
+
+	// The store can't be reached, so the lease can't be renewed.
+	store.Inject("SetIfRevision", kv_fake.WithError(errors.New("unreachable")))
+
+	select {
+	case <-l.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease context not cancelled")
+	}
+	require.ErrorIs(t, context.Cause(l.Context()), ErrLost)
+	require.GreaterOrEqual(t, store.CallCount("SetIfRevision"), 1)
+
+	// The holder stops before the lease expires and someone else can take over.
+	_, err = TryAcquire(ctx, store, "/leases/scheduler")
+	require.ErrorIs(t, err, ErrHeld)
+}
+
+func TestLease_ParentCancelled(t *testing.T) {
+	store := newStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := TryAcquire(ctx, store, "/leases/scheduler")
+	require.Nil(t, err)
+	cancel()
+
+	<-l.Context().Done()
+	require.Eventually(t, func() bool {
+		_, err := store.Get(context.Background(), "/leases/scheduler")
+		return err == kv.ErrNotFound
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAcquire_Waits(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	l, err := TryAcquire(ctx, store, "/leases/scheduler")
+	require.Nil(t, err)
+
+	acquired := make(chan *Lease)
+	go func() {
+		next, err := Acquire(ctx, store, "/leases/scheduler", WithRetryInterval(10*time.Millisecond))
+		require.Nil(t, err)
+		acquired <- next
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired a held lease")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.Nil(t, l.Release(ctx))
+	next := <-acquired
+	require.Nil(t, next.Release(ctx))
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	l, err = TryAcquire(ctx, store, "/leases/scheduler")
+	require.Nil(t, err)
+	_, err = Acquire(timeout, store, "/leases/scheduler", WithRetryInterval(10*time.Millisecond))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Nil(t, l.Release(ctx))
+}
+
+func TestRun_MutualExclusion(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := Run(ctx, store, "/leases/repack/1", func(ctx context.Context, l *Lease) error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					current := atomic.LoadInt32(&maxRunning)
+					if n <= current || atomic.CompareAndSwapInt32(&maxRunning, current, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			}, WithRetryInterval(5*time.Millisecond))
+			require.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), maxRunning)
+}
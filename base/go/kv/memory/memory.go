@@ -0,0 +1,316 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.resf.org/peridot/base/go/kv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// changesRetention is the number of revisions kept in the change log.
+	changesRetention = 10000
+	// reapInterval is how often expired keys are removed.
+	// Expired keys are removed during writes, so an idle store keeps them until the next write.
+	reapInterval = time.Minute
+	// watchBatchSize is the maximum number of changes read from the change log at once.
+	watchBatchSize = 100
+)
+
+// Memory is an in-memory kv.KV implementation.
+// It behaves like the other backends, but nothing is persisted, so it is
+// meant for tests and local development.
+// Memory is safe for concurrent use.
+type Memory struct {
+	lock     sync.Mutex
+	entries  map[string]*entry
+	revision int64
+	lastReap time.Time
+
+	// changes is the change log used by Watch, ordered by revision.
+	// firstChange is the index of changes[0] since the store was created,
+	// so watchers can keep their position while the log is compacted.
+	changes     []*change
+	firstChange int64
+	compacted   int64
+	// changed is closed and replaced after every write, to wake up watchers.
+	changed chan struct{}
+
+	pageTokens   *kv.PageTokenSigner
+	pageTokenKey []byte
+}
+
+type Option func(*Memory)
+
+// WithPageTokenKey sets the key used to sign page tokens.
+// If not set, a random key is generated.
+func WithPageTokenKey(key []byte) Option {
+	return func(m *Memory) {
+		m.pageTokenKey = key
+	}
+}
+
+// entry is a value together with its metadata.
+type entry struct {
+	value     []byte
+	revision  int64
+	expiresAt time.Time
+}
+
+type change struct {
+	eventType kv.EventType
+	key       string
+	value     []byte
+	revision  int64
+}
+
+// New creates a new empty in-memory store.
+func New(opts ...Option) (*Memory, error) {
+	m := &Memory{
+		entries:  map[string]*entry{},
+		lastReap: time.Now(),
+		changed:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	pageTokens, err := kv.NewPageTokenSigner(m.pageTokenKey)
+	if err != nil {
+		return nil, err
+	}
+	m.pageTokens = pageTokens
+
+	return m, nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (*kv.Pair, error) {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e := m.getEntry(ns, path)
+	if e == nil {
+		return nil, kv.ErrNotFound
+	}
+
+	return e.toPair(ns, path), nil
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value []byte, opts ...kv.SetOption) error {
+	_, err := m.Txn(ctx, kv.SetOp(key, value, opts...))
+	return err
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	_, err := m.Txn(ctx, kv.DeleteOp(key))
+	return err
+}
+
+func (m *Memory) RangePrefix(ctx context.Context, prefix string, pageSize int32, pageToken string) (*kv.Query, error) {
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	if pageSize > 100 {
+		pageSize = 100
+	}
+
+	// Page tokens are signed, so they don't need to be stored.
+	var fromPath string
+	if pageToken != "" {
+		pt, err := m.pageTokens.ParsePageToken(pageToken, prefix, pageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		fromPath = pt.LastPath
+	}
+
+	ns, path, err := kv.SplitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var paths []string
+	for k, e := range m.entries {
+		entryNs, entryPath, _ := kv.SplitKey(k)
+		if entryNs != ns || !strings.HasPrefix(entryPath, path) || e.expired() {
+			continue
+		}
+		if pageToken != "" && entryPath <= fromPath {
+			continue
+		}
+
+		paths = append(paths, entryPath)
+	}
+	sort.Strings(paths)
+
+	var nextToken string
+	if len(paths) > int(pageSize) {
+		paths = paths[:pageSize]
+		nextToken, err = m.pageTokens.NewPageToken(ns, paths[len(paths)-1], prefix, pageSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pairs := make([]*kv.Pair, 0, len(paths))
+	for _, p := range paths {
+		pairs = append(pairs, m.entries[ns+"/"+p].toPair(ns, p))
+	}
+
+	return &kv.Query{
+		Prefix:    prefix,
+		Pairs:     pairs,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (m *Memory) Create(ctx context.Context, key string, value []byte, opts ...kv.SetOption) (int64, error) {
+	return m.Txn(ctx, kv.CreateOp(key, value, opts...))
+}
+
+func (m *Memory) SetIfRevision(ctx context.Context, key string, value []byte, revision int64, opts ...kv.SetOption) (int64, error) {
+	return m.Txn(ctx, kv.SetIfRevisionOp(key, value, revision, opts...))
+}
+
+func (m *Memory) DeleteIfRevision(ctx context.Context, key string, revision int64) error {
+	_, err := m.Txn(ctx, kv.DeleteIfRevisionOp(key, revision))
+	return err
+}
+
+func (m *Memory) Txn(ctx context.Context, ops ...*kv.Op) (int64, error) {
+	err := kv.ValidateTxn(ops)
+	if err != nil {
+		return 0, err
+	}
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Check every condition first, so nothing is written if one fails.
+	for _, op := range ops {
+		ns, path, _ := kv.SplitKey(op.Key)
+		e := m.getEntry(ns, path)
+
+		switch op.Type {
+		case kv.OpCreate:
+			if e != nil {
+				return 0, kv.ErrConflict
+			}
+		case kv.OpSetIfRevision, kv.OpDeleteIfRevision, kv.OpCheckRevision:
+			if e == nil || e.revision != op.Revision {
+				return 0, kv.ErrConflict
+			}
+		case kv.OpSet, kv.OpDelete:
+		default:
+			return 0, fmt.Errorf("unknown op type %d", op.Type)
+		}
+	}
+
+	m.revision++
+	revision := m.revision
+	for _, op := range ops {
+		ns, path, _ := kv.SplitKey(op.Key)
+		key := ns + "/" + path
+
+		switch op.Type {
+		case kv.OpSet, kv.OpCreate, kv.OpSetIfRevision:
+			m.entries[key] = &entry{
+				value:     bytes.Clone(op.Value),
+				revision:  revision,
+				expiresAt: op.ExpiresAt(),
+			}
+			m.logChange(kv.EventPut, key, op.Value, revision)
+		case kv.OpDelete, kv.OpDeleteIfRevision:
+			if _, ok := m.entries[key]; !ok {
+				continue
+			}
+			delete(m.entries, key)
+			m.logChange(kv.EventDelete, key, nil, revision)
+		}
+	}
+	m.reap()
+	m.notify()
+
+	return revision, nil
+}
+
+// reap removes expired keys, at most once per reapInterval.
+// Expired keys are already hidden from reads, removing them frees up the
+// memory and lets watchers know with a delete event.
+// Must be called with the lock held.
+func (m *Memory) reap() {
+	if time.Since(m.lastReap) < reapInterval {
+		return
+	}
+	m.lastReap = time.Now()
+
+	var revision int64
+	for key, e := range m.entries {
+		if !e.expired() {
+			continue
+		}
+
+		if revision == 0 {
+			m.revision++
+			revision = m.revision
+		}
+		delete(m.entries, key)
+		m.logChange(kv.EventDelete, key, nil, revision)
+	}
+}
+
+// getEntry returns the entry of a key, or nil if it doesn't exist or has expired.
+// Must be called with the lock held.
+func (m *Memory) getEntry(ns string, path string) *entry {
+	e := m.entries[ns+"/"+path]
+	if e == nil || e.expired() {
+		return nil
+	}
+
+	return e
+}
+
+func (e *entry) expired() bool {
+	return !e.expiresAt.IsZero() && !e.expiresAt.After(time.Now())
+}
+
+// toPair converts an entry into a pair.
+// Values are copied, so callers can't modify the stored value.
+func (e *entry) toPair(ns string, path string) *kv.Pair {
+	return &kv.Pair{
+		Key:       fmt.Sprintf("/%s/%s", ns, path),
+		Value:     bytes.Clone(e.value),
+		Revision:  e.revision,
+		ExpiresAt: e.expiresAt,
+	}
+}
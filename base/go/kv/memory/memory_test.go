@@ -0,0 +1,72 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	"go.resf.org/peridot/base/go/kv/kvtest"
+	"testing"
+	"time"
+)
+
+func TestConformance(t *testing.T) {
+	kvtest.RunConformance(t, func(t *testing.T) kv.KV {
+		m, err := New()
+		require.Nil(t, err)
+		return m
+	})
+}
+
+func TestReap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := New()
+	require.Nil(t, err)
+
+	start, err := m.Create(ctx, "/test/start", []byte("start"))
+	require.Nil(t, err)
+	require.Nil(t, m.Set(ctx, "/test/expiring", []byte("value"), kv.WithTTL(time.Millisecond)))
+	require.Nil(t, m.Set(ctx, "/test/kept", []byte("value"), kv.WithTTL(time.Hour)))
+
+	ch, err := m.Watch(ctx, "/test/", kv.WithFromRevision(start))
+	require.Nil(t, err)
+
+	// Expired keys are removed by the next write after reapInterval.
+	time.Sleep(10 * time.Millisecond)
+	m.lock.Lock()
+	m.lastReap = time.Now().Add(-reapInterval)
+	m.lock.Unlock()
+	require.Nil(t, m.Set(ctx, "/other/key", []byte("value")))
+
+	var events []*kv.Event
+	for len(events) < 3 {
+		select {
+		case event := <-ch:
+			events = append(events, event)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the reaper's delete event")
+		}
+	}
+	require.Equal(t, kv.EventDelete, events[2].Type)
+	require.Equal(t, "/test/expiring", events[2].Pair.Key)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	require.Nil(t, m.entries["test/expiring"])
+	require.NotNil(t, m.entries["test/kept"])
+}
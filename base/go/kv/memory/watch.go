@@ -0,0 +1,148 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+	"context"
+	"go.resf.org/peridot/base/go/kv"
+	"sort"
+	"strings"
+)
+
+func (m *Memory) Watch(ctx context.Context, prefix string, opts ...kv.WatchOption) (<-chan *kv.Event, error) {
+	ns, path, err := kv.SplitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	o := kv.NewWatchOptions(opts...)
+
+	m.lock.Lock()
+	// Without a revision to resume from, start at the current revision.
+	fromRevision := o.FromRevision
+	if fromRevision == 0 {
+		fromRevision = m.revision
+	} else if fromRevision < m.compacted {
+		m.lock.Unlock()
+		return nil, kv.ErrCompacted
+	}
+
+	// Start at the first change after the revision.
+	next := m.firstChange + int64(sort.Search(len(m.changes), func(i int) bool {
+		return m.changes[i].revision > fromRevision
+	}))
+	m.lock.Unlock()
+
+	ch := make(chan *kv.Event)
+	go m.watch(ctx, ch, ns+"/"+path, next)
+
+	return ch, nil
+}
+
+// watch sends changes under the prefix, starting at the change with index next.
+func (m *Memory) watch(ctx context.Context, ch chan<- *kv.Event, prefix string, next int64) {
+	defer close(ch)
+
+	for {
+		var events []*kv.Event
+		var scanned int
+
+		m.lock.Lock()
+		changed := m.changed
+		if next < m.firstChange {
+			// The watcher fell too far behind.
+			m.lock.Unlock()
+			select {
+			case ch <- &kv.Event{Err: kv.ErrCompacted}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		for i := next - m.firstChange; i < int64(len(m.changes)) && scanned < watchBatchSize; i++ {
+			scanned++
+			next++
+
+			c := m.changes[i]
+			if !strings.HasPrefix(c.key, prefix) {
+				continue
+			}
+
+			events = append(events, &kv.Event{
+				Type: c.eventType,
+				Pair: &kv.Pair{
+					Key:      "/" + c.key,
+					Value:    bytes.Clone(c.value),
+					Revision: c.revision,
+				},
+			})
+		}
+		m.lock.Unlock()
+
+		for _, event := range events {
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// There may be more changes, so don't wait.
+		if scanned >= watchBatchSize {
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logChange appends a change to the change log, and compacts
+// changes that are older than the retention.
+// Must be called with the lock held.
+func (m *Memory) logChange(eventType kv.EventType, key string, value []byte, revision int64) {
+	m.changes = append(m.changes, &change{
+		eventType: eventType,
+		key:       key,
+		value:     bytes.Clone(value),
+		revision:  revision,
+	})
+
+	compactBefore := revision - changesRetention
+	if compactBefore <= 0 {
+		return
+	}
+
+	n := sort.Search(len(m.changes), func(i int) bool {
+		return m.changes[i].revision >= compactBefore
+	})
+	if n == 0 {
+		return
+	}
+
+	// The compacted changes are garbage collected once append reallocates the slice.
+	m.changes = m.changes[n:]
+	m.firstChange += int64(n)
+	m.compacted = compactBefore - 1
+}
+
+// notify wakes up watchers.
+// Must be called with the lock held.
+func (m *Memory) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
@@ -0,0 +1,104 @@
+package kv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	basepb "go.resf.org/peridot/base/go/pb"
+	"google.golang.org/protobuf/proto"
+	"strings"
+)
+
+// PageTokenSigner signs page tokens with HMAC-SHA256, so listing can be resumed
+// without storing the tokens anywhere.
+// Tokens are only valid for backends using the same key.
+type PageTokenSigner struct {
+	key []byte
+}
+
+// NewPageTokenSigner creates a new signer with the given key.
+// If key is empty, a random key is generated. Tokens are then only valid
+// for this process, so they can't be used after a restart or on another replica.
+func NewPageTokenSigner(key []byte) (*PageTokenSigner, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &PageTokenSigner{
+		key: key,
+	}, nil
+}
+
+// NewPageToken returns a signed page token continuing after lastKey and lastPath.
+// The prefix and page size of the request are included, so the token can't be used for another listing.
+func (s *PageTokenSigner) NewPageToken(lastKey string, lastPath string, prefix string, pageSize int32) (string, error) {
+	payload, err := proto.Marshal(&basepb.DynamoDbPageToken{
+		LastKey:  lastKey,
+		LastPath: lastPath,
+		Prefix:   prefix,
+		PageSize: pageSize,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return s.sign(payload), nil
+}
+
+// ParsePageToken verifies and parses a page token.
+// As required by AIP-158, the prefix and page size must match the request that returned the token.
+// Returns ErrPageTokenNotFound if the token is invalid, has been tampered with or doesn't match.
+func (s *PageTokenSigner) ParsePageToken(token string, prefix string, pageSize int32) (*basepb.DynamoDbPageToken, error) {
+	payload, err := s.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	pt := &basepb.DynamoDbPageToken{}
+	err = proto.Unmarshal(payload, pt)
+	if err != nil {
+		return nil, ErrPageTokenNotFound
+	}
+	if pt.Prefix != prefix || pt.PageSize != pageSize {
+		return nil, ErrPageTokenNotFound
+	}
+
+	return pt, nil
+}
+
+// sign returns a page token containing the payload.
+// The payload is signed, not encrypted, so it shouldn't contain secrets.
+func (s *PageTokenSigner) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+
+	return "v2." + base64.RawURLEncoding.EncodeToString(append(bytes.Clone(payload), mac.Sum(nil)...))
+}
+
+// verify returns the payload of a page token.
+// Returns ErrPageTokenNotFound if the token is malformed or has been tampered with.
+func (s *PageTokenSigner) verify(token string) ([]byte, error) {
+	if !strings.HasPrefix(token, "v2.") {
+		return nil, ErrPageTokenNotFound
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, "v2."))
+	if err != nil || len(data) < sha256.Size {
+		return nil, ErrPageTokenNotFound
+	}
+
+	payload := data[:len(data)-sha256.Size]
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), data[len(data)-sha256.Size:]) {
+		return nil, ErrPageTokenNotFound
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,116 @@
+package kv_test
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	"strings"
+	"testing"
+)
+
+func TestPageTokenSigner(t *testing.T) {
+	signer, err := kv.NewPageTokenSigner([]byte("key"))
+	require.Nil(t, err)
+	otherSigner, err := kv.NewPageTokenSigner([]byte("other-key"))
+	require.Nil(t, err)
+	randomSigner, err := kv.NewPageTokenSigner(nil)
+	require.Nil(t, err)
+
+	token, err := signer.NewPageToken("last-key", "last-path", "/test/", 10)
+	require.Nil(t, err)
+
+	pt, err := signer.ParsePageToken(token, "/test/", 10)
+	require.Nil(t, err)
+	require.Equal(t, "last-key", pt.LastKey)
+	require.Equal(t, "last-path", pt.LastPath)
+
+	// Signers with the same key accept each other's tokens.
+	sameSigner, err := kv.NewPageTokenSigner([]byte("key"))
+	require.Nil(t, err)
+	_, err = sameSigner.ParsePageToken(token, "/test/", 10)
+	require.Nil(t, err)
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, "v2."))
+	require.Nil(t, err)
+	data[0] ^= 0xff
+	tampered := "v2." + base64.RawURLEncoding.EncodeToString(data)
+
+	tests := []struct {
+		name     string
+		signer   *kv.PageTokenSigner
+		token    string
+		prefix   string
+		pageSize int32
+	}{
+		{
+			name:     "tampered",
+			signer:   signer,
+			token:    tampered,
+			prefix:   "/test/",
+			pageSize: 10,
+		},
+		{
+			name:     "truncated",
+			signer:   signer,
+			token:    token[:len(token)-4],
+			prefix:   "/test/",
+			pageSize: 10,
+		},
+		{
+			name:     "other key",
+			signer:   otherSigner,
+			token:    token,
+			prefix:   "/test/",
+			pageSize: 10,
+		},
+		{
+			name:     "random key",
+			signer:   randomSigner,
+			token:    token,
+			prefix:   "/test/",
+			pageSize: 10,
+		},
+		{
+			name:     "other prefix",
+			signer:   signer,
+			token:    token,
+			prefix:   "/other/",
+			pageSize: 10,
+		},
+		{
+			name:     "other page size",
+			signer:   signer,
+			token:    token,
+			prefix:   "/test/",
+			pageSize: 20,
+		},
+		{
+			name:     "unknown version",
+			signer:   signer,
+			token:    "v1." + strings.TrimPrefix(token, "v2."),
+			prefix:   "/test/",
+			pageSize: 10,
+		},
+		{
+			name:     "not base64",
+			signer:   signer,
+			token:    "v2.!!!",
+			prefix:   "/test/",
+			pageSize: 10,
+		},
+		{
+			name:     "empty",
+			signer:   signer,
+			prefix:   "/test/",
+			pageSize: 10,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.signer.ParsePageToken(test.token, test.prefix, test.pageSize)
+			require.ErrorIs(t, err, kv.ErrPageTokenNotFound)
+		})
+	}
+}
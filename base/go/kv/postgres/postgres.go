@@ -0,0 +1,482 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/kv"
+	"sort"
+	"time"
+)
+
+// Postgres is a kv.KV implementation on top of a PostgreSQL table.
+// The table mirrors the DynamoDB layout, the namespace is the partition
+// and the rest of the key is the path within that partition.
+type Postgres struct {
+	db           *base.DB
+	rawTableName string
+	tableName    string
+	sequenceName string
+	changesName  string
+	// compactedName holds the newest compacted revision of the change log.
+	compactedName string
+	pageTokens    *kv.PageTokenSigner
+	stopReaper    chan struct{}
+	reaperDone    chan struct{}
+
+	pageTokenKey []byte
+}
+
+type Option func(*Postgres)
+
+// reapInterval is how often expired keys are removed and old changes compacted.
+const reapInterval = time.Minute
+
+// WithPageTokenKey sets the key used to sign page tokens.
+// All replicas must use the same key, otherwise page tokens from one replica
+// are rejected by the others. If not set, a random key is generated on startup.
+func WithPageTokenKey(key []byte) Option {
+	return func(p *Postgres) {
+		p.pageTokenKey = key
+	}
+}
+
+type row struct {
+	Namespace string     `db:"namespace"`
+	Path      string     `db:"path"`
+	Value     []byte     `db:"value"`
+	Revision  int64      `db:"revision"`
+	ExpiresAt *time.Time `db:"expires_at"`
+}
+
+func (r *row) toPair() *kv.Pair {
+	pair := &kv.Pair{
+		Key:      fmt.Sprintf("/%s/%s", r.Namespace, r.Path),
+		Value:    r.Value,
+		Revision: r.Revision,
+	}
+	if r.ExpiresAt != nil {
+		pair.ExpiresAt = *r.ExpiresAt
+	}
+
+	return pair
+}
+
+// New creates a new PostgreSQL kv backend.
+// The table (and its indexes) is created if it doesn't exist.
+// Expired keys are removed in the background until Close is called.
+func New(db *base.DB, tableName string, opts ...Option) (*Postgres, error) {
+	p := &Postgres{
+		db:            db,
+		rawTableName:  tableName,
+		tableName:     pq.QuoteIdentifier(tableName),
+		sequenceName:  pq.QuoteIdentifier(tableName + "_revision_seq"),
+		changesName:   pq.QuoteIdentifier(tableName + "_changes"),
+		compactedName: pq.QuoteIdentifier(tableName + "_changes_compacted"),
+		stopReaper:    make(chan struct{}),
+		reaperDone:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	pageTokens, err := kv.NewPageTokenSigner(p.pageTokenKey)
+	if err != nil {
+		return nil, err
+	}
+	p.pageTokens = pageTokens
+
+	// Paths use the C collation so ordering is byte-wise, same as DynamoDB
+	// range keys.
+	// Revisions are allocated from a sequence, so they are store-wide.
+	// The changes table is the change log used by Watch, and the compacted
+	// table has a single row with the newest revision removed from it.
+	_, err = db.DB().Exec(fmt.Sprintf(`
+		create sequence if not exists %[3]s;
+		create table if not exists %[1]s (
+			namespace text not null,
+			path text collate "C" not null,
+			value bytea not null,
+			expires_at timestamptz,
+			primary key (namespace, path)
+		);
+		alter table %[1]s add column if not exists revision bigint not null default 0;
+		create index if not exists %[2]s on %[1]s (expires_at) where expires_at is not null;
+		create table if not exists %[4]s (
+			revision bigint not null,
+			namespace text not null,
+			path text collate "C" not null,
+			type smallint not null,
+			value bytea,
+			created_at timestamptz not null default now(),
+			primary key (revision, namespace, path)
+		);
+		create index if not exists %[5]s on %[4]s (created_at);
+		create table if not exists %[6]s (
+			id boolean primary key default true check (id),
+			revision bigint not null
+		);
+	`, p.tableName, pq.QuoteIdentifier(tableName+"_expires_at_idx"), p.sequenceName, p.changesName, pq.QuoteIdentifier(tableName+"_changes_created_at_idx"), p.compactedName))
+	if err != nil {
+		return nil, err
+	}
+	go p.reaper()
+
+	return p, nil
+}
+
+// Close stops removing expired keys. The database is owned by the caller, so it is left open.
+func (p *Postgres) Close() error {
+	close(p.stopReaper)
+	<-p.reaperDone
+
+	return nil
+}
+
+func (p *Postgres) Get(ctx context.Context, key string) (*kv.Pair, error) {
+	ns, path, err := kv.SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var r row
+	err = p.db.DB().GetContext(
+		ctx,
+		&r,
+		fmt.Sprintf("select namespace, path, value, revision, expires_at from %s where namespace = $1 and path = $2 and (expires_at is null or expires_at > now())", p.tableName),
+		ns,
+		path,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, kv.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return r.toPair(), nil
+}
+
+func (p *Postgres) Set(ctx context.Context, key string, value []byte, opts ...kv.SetOption) error {
+	_, err := p.Txn(ctx, kv.SetOp(key, value, opts...))
+	return err
+}
+
+func (p *Postgres) Delete(ctx context.Context, key string) error {
+	_, err := p.Txn(ctx, kv.DeleteOp(key))
+	return err
+}
+
+func (p *Postgres) RangePrefix(ctx context.Context, prefix string, pageSize int32, pageToken string) (*kv.Query, error) {
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	if pageSize > 100 {
+		pageSize = 100
+	}
+
+	// Check if there is a page token.
+	// Page tokens are signed, so they don't need to be stored.
+	var fromPath string
+	if pageToken != "" {
+		pt, err := p.pageTokens.ParsePageToken(pageToken, prefix, pageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		fromPath = pt.LastPath
+	}
+
+	ns, path, err := kv.SplitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("select namespace, path, value, revision, expires_at from %s where namespace = $1 and starts_with(path, $2) and (expires_at is null or expires_at > now())", p.tableName)
+	args := []any{ns, path}
+	if fromPath != "" {
+		query += " and path > $3"
+		args = append(args, fromPath)
+	}
+	// Fetch pageSize+1, so we know if there is a next page.
+	query += fmt.Sprintf(" order by path limit %d", pageSize+1)
+
+	var rows []*row
+	err = p.db.DB().SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]*kv.Pair, 0, len(rows))
+	for _, r := range rows {
+		if len(pairs) >= int(pageSize) {
+			break
+		}
+		pairs = append(pairs, r.toPair())
+	}
+
+	var nextToken string
+	if len(rows) > int(pageSize) {
+		// Continue from the last visible result.
+		nextToken, err = p.pageTokens.NewPageToken(ns, rows[len(pairs)-1].Path, prefix, pageSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &kv.Query{
+		Prefix:    prefix,
+		Pairs:     pairs,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (p *Postgres) Create(ctx context.Context, key string, value []byte, opts ...kv.SetOption) (int64, error) {
+	return p.Txn(ctx, kv.CreateOp(key, value, opts...))
+}
+
+func (p *Postgres) SetIfRevision(ctx context.Context, key string, value []byte, revision int64, opts ...kv.SetOption) (int64, error) {
+	return p.Txn(ctx, kv.SetIfRevisionOp(key, value, revision, opts...))
+}
+
+func (p *Postgres) DeleteIfRevision(ctx context.Context, key string, revision int64) error {
+	_, err := p.Txn(ctx, kv.DeleteIfRevisionOp(key, revision))
+	return err
+}
+
+func (p *Postgres) Txn(ctx context.Context, ops ...*kv.Op) (int64, error) {
+	err := kv.ValidateTxn(ops)
+	if err != nil {
+		return 0, err
+	}
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	namespaces := make([]string, 0, len(ops))
+	for _, op := range ops {
+		ns, _, err := kv.SplitKey(op.Key)
+		if err != nil {
+			return 0, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+
+	var revision int64
+	err = p.writeTxn(ctx, namespaces, func(tx *sqlx.Tx, rev int64) error {
+		revision = rev
+		for _, op := range ops {
+			err := p.applyOp(ctx, tx, op, revision)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, nil
+}
+
+// writeTxn runs fn in a transaction that writes to the given namespaces at a new revision.
+// Writes to a namespace are serialized until commit, so its revisions are committed in order.
+// Otherwise a watcher could see a revision before an earlier one is committed and skip it.
+// Watchers only see a single namespace, so writes to different namespaces don't wait for each other.
+func (p *Postgres) writeTxn(ctx context.Context, namespaces []string, fn func(tx *sqlx.Tx, revision int64) error) error {
+	tx, err := p.db.DB().BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op after a successful commit.
+	defer tx.Rollback()
+
+	// Lock in a consistent order, so transactions spanning namespaces can't deadlock.
+	sort.Strings(namespaces)
+	for i, ns := range namespaces {
+		if i > 0 && ns == namespaces[i-1] {
+			continue
+		}
+		err = p.lockNamespace(ctx, tx, ns)
+		if err != nil {
+			return err
+		}
+	}
+
+	var revision int64
+	err = tx.GetContext(ctx, &revision, fmt.Sprintf("select nextval(%s)", pq.QuoteLiteral(p.sequenceName)))
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx, revision)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockNamespace waits for writes to a namespace to commit, and holds them off until tx ends.
+func (p *Postgres) lockNamespace(ctx context.Context, tx *sqlx.Tx, ns string) error {
+	_, err := tx.ExecContext(ctx, "select pg_advisory_xact_lock(hashtext($1), hashtext($2))", p.rawTableName, ns)
+	return err
+}
+
+// reaper periodically removes expired keys and compacts the change log until
+// Close is called. Expired keys are already hidden from reads, removing them
+// frees up the space and lets watchers know with a delete event.
+func (p *Postgres) reaper() {
+	defer close(p.reaperDone)
+
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx := context.Background()
+			err := p.reap(ctx)
+			if err != nil {
+				base.LogErrorf("failed to remove expired keys: %v", err)
+			}
+			err = p.compactChanges(ctx)
+			if err != nil {
+				base.LogErrorf("failed to compact changes: %v", err)
+			}
+		case <-p.stopReaper:
+			return
+		}
+	}
+}
+
+// reap deletes expired keys, and logs a delete event for each of them.
+func (p *Postgres) reap(ctx context.Context) error {
+	var namespaces []string
+	err := p.db.DB().SelectContext(ctx, &namespaces, fmt.Sprintf("select distinct namespace from %s where expires_at <= now()", p.tableName))
+	if err != nil {
+		return err
+	}
+	if len(namespaces) == 0 {
+		return nil
+	}
+
+	return p.writeTxn(ctx, namespaces, func(tx *sqlx.Tx, revision int64) error {
+		// Only the locked namespaces, keys in others may have expired since.
+		_, err := tx.ExecContext(
+			ctx,
+			fmt.Sprintf(`
+				with expired as (
+					delete from %s where namespace = any($1) and expires_at <= now() returning namespace, path
+				)
+				insert into %s (revision, namespace, path, type, value)
+				select $2, namespace, path, $3, null from expired
+			`, p.tableName, p.changesName),
+			pq.Array(namespaces),
+			revision,
+			int(kv.EventDelete),
+		)
+		return err
+	})
+}
+
+// applyOp applies a single transaction operation at the given revision.
+// Returns kv.ErrConflict if the condition of the operation fails.
+func (p *Postgres) applyOp(ctx context.Context, tx *sqlx.Tx, op *kv.Op, revision int64) error {
+	ns, path, err := kv.SplitKey(op.Key)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt *time.Time
+	if t := op.ExpiresAt(); !t.IsZero() {
+		expiresAt = &t
+	}
+	// Nil is stored as null, which the value column doesn't allow.
+	value := op.Value
+	if value == nil {
+		value = []byte{}
+	}
+
+	var query string
+	var args []any
+	switch op.Type {
+	case kv.OpSet:
+		query = `
+			insert into %s (namespace, path, value, expires_at, revision) values ($1, $2, $3, $4, $5)
+			on conflict (namespace, path) do update set value = excluded.value, expires_at = excluded.expires_at, revision = excluded.revision
+		`
+		args = []any{ns, path, value, expiresAt, revision}
+	case kv.OpCreate:
+		// Expired rows that haven't been cleaned up yet don't count as existing.
+		query = `
+			insert into %[1]s (namespace, path, value, expires_at, revision) values ($1, $2, $3, $4, $5)
+			on conflict (namespace, path) do update set value = excluded.value, expires_at = excluded.expires_at, revision = excluded.revision
+			where %[1]s.expires_at is not null and %[1]s.expires_at <= now()
+		`
+		args = []any{ns, path, value, expiresAt, revision}
+	case kv.OpSetIfRevision:
+		query = `
+			update %s set value = $3, expires_at = $4, revision = $5
+			where namespace = $1 and path = $2 and revision = $6 and (expires_at is null or expires_at > now())
+		`
+		args = []any{ns, path, value, expiresAt, revision, op.Revision}
+	case kv.OpDelete:
+		query = "delete from %s where namespace = $1 and path = $2"
+		args = []any{ns, path}
+	case kv.OpDeleteIfRevision:
+		query = "delete from %s where namespace = $1 and path = $2 and revision = $3 and (expires_at is null or expires_at > now())"
+		args = []any{ns, path, op.Revision}
+	case kv.OpCheckRevision:
+		// Lock the row, so it can't change until the transaction commits.
+		query = "select 1 from %s where namespace = $1 and path = $2 and revision = $3 and (expires_at is null or expires_at > now()) for update"
+		args = []any{ns, path, op.Revision}
+	default:
+		return fmt.Errorf("unknown op type %d", op.Type)
+	}
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf(query, p.tableName), args...)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		// Unconditional deletes of missing keys succeed, but there is nothing to log.
+		if op.Type == kv.OpDelete {
+			return nil
+		}
+		return kv.ErrConflict
+	}
+
+	switch op.Type {
+	case kv.OpSet, kv.OpCreate, kv.OpSetIfRevision:
+		return p.logChange(ctx, tx, kv.EventPut, ns, path, value, revision)
+	case kv.OpDelete, kv.OpDeleteIfRevision:
+		return p.logChange(ctx, tx, kv.EventDelete, ns, path, nil, revision)
+	}
+
+	return nil
+}
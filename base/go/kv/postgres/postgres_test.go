@@ -0,0 +1,220 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"fmt"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/kv"
+	"go.resf.org/peridot/base/go/kv/kvtest"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDatabaseURL returns KVTEST_DATABASE_URL if set, and starts an embedded
+// PostgreSQL server otherwise. The embedded server's binaries are downloaded
+// on first use and cached in ~/.embedded-postgres-go.
+func testDatabaseURL(t *testing.T) string {
+	if databaseURL := os.Getenv("KVTEST_DATABASE_URL"); databaseURL != "" {
+		return databaseURL
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.Nil(t, listener.Close())
+
+	dir := t.TempDir()
+	config := embeddedpostgres.DefaultConfig().
+		Port(uint32(port)).
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		Logger(io.Discard)
+	server := embeddedpostgres.NewDatabase(config)
+	err = server.Start()
+	if err != nil && strings.Contains(err.Error(), "unable to connect to") {
+		t.Skipf("embedded postgres binaries can't be downloaded, set KVTEST_DATABASE_URL instead: %v", err)
+	}
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, server.Stop())
+	})
+
+	return config.GetConnectionURL() + "?sslmode=disable"
+}
+
+// newTestPostgres creates a Postgres backend with its own tables, which are dropped afterwards.
+func newTestPostgres(t *testing.T, db *base.DB, opts ...Option) *Postgres {
+	tableName := fmt.Sprintf("kvtest_%d", time.Now().UnixNano())
+	p, err := New(db, tableName, opts...)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, p.Close())
+		_, err := db.DB().Exec(fmt.Sprintf("drop table %s, %s, %s; drop sequence %s", p.tableName, p.changesName, p.compactedName, p.sequenceName))
+		require.Nil(t, err)
+	})
+	return p
+}
+
+func TestConformance(t *testing.T) {
+	db, err := base.NewDB(testDatabaseURL(t))
+	require.Nil(t, err)
+
+	kvtest.RunConformance(t, func(t *testing.T) kv.KV {
+		return newTestPostgres(t, db)
+	})
+}
+
+func TestReap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := base.NewDB(testDatabaseURL(t))
+	require.Nil(t, err)
+	p := newTestPostgres(t, db)
+
+	start, err := p.Create(ctx, "/test/start", []byte("start"))
+	require.Nil(t, err)
+	require.Nil(t, p.Set(ctx, "/test/expiring", []byte("value"), kv.WithTTL(time.Millisecond)))
+	require.Nil(t, p.Set(ctx, "/test/kept", []byte("value"), kv.WithTTL(time.Hour)))
+	require.Nil(t, p.Set(ctx, "/other/expiring", []byte("value"), kv.WithTTL(time.Millisecond)))
+
+	ch, err := p.Watch(ctx, "/test/", kv.WithFromRevision(start))
+	require.Nil(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	require.Nil(t, p.reap(ctx))
+
+	var events []*kv.Event
+	for len(events) < 3 {
+		select {
+		case event := <-ch:
+			events = append(events, event)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the reaper's delete event")
+		}
+	}
+	require.Equal(t, kv.EventDelete, events[2].Type)
+	require.Equal(t, "/test/expiring", events[2].Pair.Key)
+
+	var paths []string
+	err = db.DB().Select(&paths, fmt.Sprintf("select namespace || '/' || path from %s order by 1", p.tableName))
+	require.Nil(t, err)
+	require.Equal(t, []string{"test/kept", "test/start"}, paths)
+}
+
+func TestCompactChanges(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := base.NewDB(testDatabaseURL(t))
+	require.Nil(t, err)
+	p := newTestPostgres(t, db)
+
+	old, err := p.Create(ctx, "/test/old", []byte("value"))
+	require.Nil(t, err)
+	recent, err := p.Create(ctx, "/test/recent", []byte("value"))
+	require.Nil(t, err)
+
+	_, err = db.DB().Exec(fmt.Sprintf("update %s set created_at = $1 where revision = $2", p.changesName), time.Now().Add(-2*changesRetention), old)
+	require.Nil(t, err)
+	require.Nil(t, p.compactChanges(ctx))
+
+	_, err = p.Watch(ctx, "/test/", kv.WithFromRevision(old-1))
+	require.ErrorIs(t, err, kv.ErrCompacted)
+	_, err = p.Watch(ctx, "/test/", kv.WithFromRevision(recent))
+	require.Nil(t, err)
+
+	// The compacted revision isn't stored under a user namespace.
+	query, err := p.RangePrefix(ctx, "/_internals/", 100, "")
+	require.Nil(t, err)
+	require.Empty(t, query.Pairs)
+}
+
+// Revisions are allocated before commit, so a write to another namespace can commit
+// a newer revision while a write to the watched namespace is still in progress.
+// Watching from now must still see that write if it commits after Watch returns.
+func TestWatch_WriteInProgress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := base.NewDB(testDatabaseURL(t))
+	require.Nil(t, err)
+	p := newTestPostgres(t, db)
+
+	allocated := make(chan struct{})
+	commit := make(chan struct{})
+	written := make(chan error, 1)
+	go func() {
+		written <- p.writeTxn(ctx, []string{"test"}, func(tx *sqlx.Tx, revision int64) error {
+			close(allocated)
+			<-commit
+			return p.applyOp(ctx, tx, kv.SetOp("/test/slow", []byte("value")), revision)
+		})
+	}()
+	<-allocated
+	require.Nil(t, p.Set(ctx, "/other/fast", []byte("value")))
+
+	type watchResult struct {
+		ch  <-chan *kv.Event
+		err error
+	}
+	watched := make(chan watchResult, 1)
+	go func() {
+		ch, err := p.Watch(ctx, "/test/")
+		watched <- watchResult{ch, err}
+	}()
+
+	// Watch may only return before the slow write commits if it will see it.
+	var result watchResult
+	returnedEarly := false
+	select {
+	case result = <-watched:
+		returnedEarly = true
+	case <-time.After(500 * time.Millisecond):
+	}
+	close(commit)
+	require.Nil(t, <-written)
+	if !returnedEarly {
+		result = <-watched
+	}
+	require.Nil(t, result.err)
+
+	require.Nil(t, p.Set(ctx, "/test/after", []byte("value")))
+
+	var keys []string
+	for len(keys) == 0 || keys[len(keys)-1] != "/test/after" {
+		select {
+		case event := <-result.ch:
+			require.Nil(t, event.Err)
+			keys = append(keys, event.Pair.Key)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for events, got %v", keys)
+		}
+	}
+	if returnedEarly {
+		require.Equal(t, []string{"/test/slow", "/test/after"}, keys)
+	} else {
+		require.Equal(t, []string{"/test/after"}, keys)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"go.resf.org/peridot/base/go/kv"
+	"time"
+)
+
+const (
+	// watchInterval is how often watchers poll the changes table.
+	watchInterval = time.Second
+	// watchBatchSize is the maximum number of changes read at once.
+	watchBatchSize = 100
+	// changesRetention is how long changes are kept for watchers to resume from.
+	changesRetention = 7 * 24 * time.Hour
+)
+
+type change struct {
+	Revision  int64  `db:"revision"`
+	Namespace string `db:"namespace"`
+	Path      string `db:"path"`
+	Type      int    `db:"type"`
+	Value     []byte `db:"value"`
+}
+
+func (p *Postgres) Watch(ctx context.Context, prefix string, opts ...kv.WatchOption) (<-chan *kv.Event, error) {
+	ns, path, err := kv.SplitKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	o := kv.NewWatchOptions(opts...)
+
+	fromRevision := o.FromRevision
+	if fromRevision == 0 {
+		// Without a revision to resume from, start at the latest change.
+		fromRevision, err = p.latestRevision(ctx, ns)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = p.checkCompacted(ctx, fromRevision)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ch := make(chan *kv.Event)
+	go p.watch(ctx, ch, ns, path, fromRevision)
+
+	return ch, nil
+}
+
+// latestRevision returns the revision to start watching a namespace from, so that
+// every later write to it is seen.
+// Revisions are allocated before commit, so a write to another namespace can commit
+// a newer revision than one still in progress here. Holding the lock of the namespace
+// waits for writes in progress, and later writes get newer revisions than any logged.
+// Compaction can remove the newest changes of a namespace, so never start before it.
+func (p *Postgres) latestRevision(ctx context.Context, ns string) (int64, error) {
+	tx, err := p.db.DB().BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	// Only used for the lock.
+	defer tx.Rollback()
+
+	err = p.lockNamespace(ctx, tx, ns)
+	if err != nil {
+		return 0, err
+	}
+
+	var revision int64
+	err = tx.GetContext(
+		ctx,
+		&revision,
+		fmt.Sprintf(`
+			select greatest(
+				(select coalesce(max(revision), 0) from %s where namespace = $1),
+				(select coalesce(max(revision), 0) from %s)
+			)
+		`, p.changesName, p.compactedName),
+		ns,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return revision, nil
+}
+
+func (p *Postgres) watch(ctx context.Context, ch chan<- *kv.Event, ns string, path string, fromRevision int64) {
+	defer close(ch)
+
+	// Transactions log several changes at the same revision, so continue
+	// from the last change read rather than the last revision.
+	// Until a change has been read, lastPath is null which skips the whole revision.
+	lastRevision := fromRevision
+	var lastPath *string
+	first := true
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		if !first {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+		first = false
+
+		err := p.checkCompacted(ctx, lastRevision)
+		if err != nil {
+			if ctx.Err() == nil {
+				select {
+				case ch <- &kv.Event{Err: err}:
+				case <-ctx.Done():
+				}
+			}
+			return
+		}
+
+		for {
+			var changes []*change
+			err = p.db.DB().SelectContext(
+				ctx,
+				&changes,
+				fmt.Sprintf(`
+					select revision, namespace, path, type, value from %s
+					where namespace = $1 and starts_with(path, $2) and (revision > $3 or (revision = $3 and path > $4))
+					order by revision, path limit %d
+				`, p.changesName, watchBatchSize),
+				ns,
+				path,
+				lastRevision,
+				lastPath,
+			)
+			if err != nil {
+				if ctx.Err() == nil {
+					select {
+					case ch <- &kv.Event{Err: err}:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+
+			for _, c := range changes {
+				event := &kv.Event{
+					Type: kv.EventType(c.Type),
+					Pair: &kv.Pair{
+						Key:      fmt.Sprintf("/%s/%s", c.Namespace, c.Path),
+						Value:    c.Value,
+						Revision: c.Revision,
+					},
+				}
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+
+				lastRevision = c.Revision
+				lastPath = &c.Path
+			}
+
+			// There may be more changes, so don't wait.
+			if len(changes) < watchBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func (p *Postgres) logChange(ctx context.Context, tx *sqlx.Tx, eventType kv.EventType, ns string, path string, value []byte, revision int64) error {
+	_, err := tx.ExecContext(
+		ctx,
+		fmt.Sprintf("insert into %s (revision, namespace, path, type, value) values ($1, $2, $3, $4, $5)", p.changesName),
+		revision,
+		ns,
+		path,
+		int(eventType),
+		value,
+	)
+	return err
+}
+
+// compactChanges deletes changes older than the retention, and records the
+// newest deleted revision so watchers can't resume from before it.
+func (p *Postgres) compactChanges(ctx context.Context) error {
+	var compacted int64
+	err := p.db.DB().GetContext(
+		ctx,
+		&compacted,
+		fmt.Sprintf(`
+			with deleted as (delete from %s where created_at < $1 returning revision)
+			select coalesce(max(revision), 0) from deleted
+		`, p.changesName),
+		time.Now().Add(-changesRetention),
+	)
+	if err != nil {
+		return err
+	}
+	if compacted == 0 {
+		return nil
+	}
+
+	// Replicas compact concurrently, so never move the compacted revision back.
+	_, err = p.db.DB().ExecContext(
+		ctx,
+		fmt.Sprintf(`
+			insert into %[1]s (revision) values ($1)
+			on conflict (id) do update set revision = greatest(%[1]s.revision, excluded.revision)
+		`, p.compactedName),
+		compacted,
+	)
+	return err
+}
+
+// checkCompacted returns kv.ErrCompacted if changes after the revision have been compacted.
+func (p *Postgres) checkCompacted(ctx context.Context, revision int64) error {
+	var compacted int64
+	err := p.db.DB().GetContext(ctx, &compacted, fmt.Sprintf("select coalesce(max(revision), 0) from %s", p.compactedName))
+	if err != nil {
+		return err
+	}
+	if revision < compacted {
+		return kv.ErrCompacted
+	}
+
+	return nil
+}
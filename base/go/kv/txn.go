@@ -0,0 +1,116 @@
+package kv
+
+import (
+	"errors"
+	"time"
+)
+
+// MaxTxnOps is the maximum number of operations in a single transaction.
+// This matches the DynamoDB TransactWriteItems limit, and is enforced by every
+// backend so transactions behave the same regardless of the backend.
+const MaxTxnOps = 100
+
+// MaxTxnSize is the maximum combined size of all keys and values in a single transaction.
+// This matches the DynamoDB TransactWriteItems limit.
+const MaxTxnSize = 4 * 1024 * 1024
+
+var (
+	ErrTxnTooLarge     = errors.New("transaction too large")
+	ErrTxnDuplicateKey = errors.New("key appears more than once in transaction")
+)
+
+type OpType int
+
+const (
+	// OpSet unconditionally sets the value of a key.
+	OpSet OpType = iota
+	// OpCreate sets the value of a key only if it doesn't exist yet.
+	OpCreate
+	// OpSetIfRevision sets the value of a key only if it is still at the given revision.
+	OpSetIfRevision
+	// OpDelete unconditionally deletes a key.
+	OpDelete
+	// OpDeleteIfRevision deletes a key only if it is still at the given revision.
+	OpDeleteIfRevision
+	// OpCheckRevision doesn't write anything, but fails the transaction
+	// if the key is not at the given revision.
+	OpCheckRevision
+)
+
+// Op is a single operation in a transaction.
+// Use the constructors (SetOp, CreateOp etc.) instead of creating it directly.
+type Op struct {
+	Type     OpType
+	Key      string
+	Value    []byte
+	Revision int64
+	// TTL is only used by writes, see WithTTL.
+	TTL time.Duration
+	// Expired is only used by writes, see WithExpired.
+	Expired bool
+}
+
+func SetOp(key string, value []byte, opts ...SetOption) *Op {
+	o := NewSetOptions(opts...)
+	return &Op{Type: OpSet, Key: key, Value: value, TTL: o.TTL, Expired: o.Expired}
+}
+
+func CreateOp(key string, value []byte, opts ...SetOption) *Op {
+	o := NewSetOptions(opts...)
+	return &Op{Type: OpCreate, Key: key, Value: value, TTL: o.TTL, Expired: o.Expired}
+}
+
+func SetIfRevisionOp(key string, value []byte, revision int64, opts ...SetOption) *Op {
+	o := NewSetOptions(opts...)
+	return &Op{Type: OpSetIfRevision, Key: key, Value: value, Revision: revision, TTL: o.TTL, Expired: o.Expired}
+}
+
+func DeleteOp(key string) *Op {
+	return &Op{Type: OpDelete, Key: key}
+}
+
+func DeleteIfRevisionOp(key string, revision int64) *Op {
+	return &Op{Type: OpDeleteIfRevision, Key: key, Revision: revision}
+}
+
+func CheckRevisionOp(key string, revision int64) *Op {
+	return &Op{Type: OpCheckRevision, Key: key, Revision: revision}
+}
+
+// ExpiresAt returns when the key written by this op expires, zero if it doesn't.
+func (o *Op) ExpiresAt() time.Time {
+	return (&SetOptions{TTL: o.TTL, Expired: o.Expired}).ExpiresAt()
+}
+
+// ValidateTxn checks that a transaction is within the limits every backend supports.
+// Backends call this before applying a transaction.
+// A key may only appear once per transaction, and every key must have a namespace.
+// Keys from different namespaces can be mixed freely in the same transaction.
+func ValidateTxn(ops []*Op) error {
+	if len(ops) > MaxTxnOps {
+		return ErrTxnTooLarge
+	}
+
+	size := 0
+	seen := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		ns, path, err := SplitKey(op.Key)
+		if err != nil {
+			return err
+		}
+
+		// Compare on the split key, so "/a/b" and "a/b" are the same key.
+		normalized := ns + "/" + path
+		if seen[normalized] {
+			return ErrTxnDuplicateKey
+		}
+		seen[normalized] = true
+
+		size += len(op.Key) + len(op.Value)
+		if size > MaxTxnSize {
+			return ErrTxnTooLarge
+		}
+	}
+
+	return nil
+}
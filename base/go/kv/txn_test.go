@@ -0,0 +1,95 @@
+package kv_test
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/kv"
+	"strings"
+	"testing"
+)
+
+func TestValidateTxn(t *testing.T) {
+	var maxOps []*kv.Op
+	for i := 0; i < kv.MaxTxnOps; i++ {
+		maxOps = append(maxOps, kv.SetOp(fmt.Sprintf("/test/%03d", i), []byte("value")))
+	}
+	large := []byte(strings.Repeat("x", kv.MaxTxnSize/2))
+
+	tests := []struct {
+		name string
+		ops  []*kv.Op
+		err  error
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "every op type",
+			ops: []*kv.Op{
+				kv.SetOp("/test/set", []byte("value")),
+				kv.CreateOp("/test/create", []byte("value")),
+				kv.SetIfRevisionOp("/test/set-if-revision", []byte("value"), 1),
+				kv.DeleteOp("/test/delete"),
+				kv.DeleteIfRevisionOp("/test/delete-if-revision", 1),
+				kv.CheckRevisionOp("/test/check", 1),
+			},
+		},
+		{
+			name: "mixed namespaces",
+			ops: []*kv.Op{
+				kv.SetOp("/one/key", []byte("value")),
+				kv.SetOp("/two/key", []byte("value")),
+			},
+		},
+		{
+			name: "at the op limit",
+			ops:  maxOps,
+		},
+		{
+			name: "over the op limit",
+			ops:  append(maxOps[:kv.MaxTxnOps:kv.MaxTxnOps], kv.SetOp("/test/extra", []byte("value"))),
+			err:  kv.ErrTxnTooLarge,
+		},
+		{
+			name: "over the size limit",
+			ops: []*kv.Op{
+				kv.SetOp("/test/1", large),
+				kv.SetOp("/test/2", large),
+			},
+			err: kv.ErrTxnTooLarge,
+		},
+		{
+			name: "duplicate key",
+			ops: []*kv.Op{
+				kv.SetOp("/test/key", []byte("value")),
+				kv.CheckRevisionOp("/test/key", 1),
+			},
+			err: kv.ErrTxnDuplicateKey,
+		},
+		{
+			name: "duplicate key without leading slash",
+			ops: []*kv.Op{
+				kv.SetOp("/test/key", []byte("value")),
+				kv.DeleteOp("test/key"),
+			},
+			err: kv.ErrTxnDuplicateKey,
+		},
+		{
+			name: "no namespace",
+			ops: []*kv.Op{
+				kv.SetOp("/key", []byte("value")),
+			},
+			err: kv.ErrNoNamespace,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := kv.ValidateTxn(test.ops)
+			if test.err == nil {
+				require.Nil(t, err)
+			} else {
+				require.ErrorIs(t, err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package kv
+
+import (
+	"errors"
+)
+
+// ErrCompacted is returned when resuming a watch from a revision that is
+// no longer retained by the backend.
+var ErrCompacted = errors.New("revision has been compacted")
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// Event is a single change to a key under a watched prefix.
+type Event struct {
+	Type EventType
+	// Pair is the key after the change, for deletes Value is nil.
+	// Pair.Revision is the revision of the change, except for DynamoDB deletes
+	// where it is the last revision of the deleted value (see Watch).
+	Pair *Pair
+	// Err is set if the watch failed.
+	// An event with Err set is always the last event before the channel is closed.
+	Err error
+}
+
+type WatchOptions struct {
+	// FromRevision resumes a watch.
+	// Only changes after this revision are returned.
+	// If zero, only changes after the watch started are returned.
+	FromRevision int64
+}
+
+type WatchOption func(*WatchOptions)
+
+// WithFromRevision resumes a watch after the given revision.
+// Pass the revision of the last event received to continue where a previous watch stopped.
+func WithFromRevision(revision int64) WatchOption {
+	return func(o *WatchOptions) {
+		o.FromRevision = revision
+	}
+}
+
+// NewWatchOptions applies the given options, backends use this to read the options passed to Watch.
+func NewWatchOptions(opts ...WatchOption) *WatchOptions {
+	o := &WatchOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
@@ -0,0 +1,525 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache implements a read-through disk cache for a storage.Storage.
+//
+// Full reads of an object are written to the cache directory as they are streamed,
+// and later reads are served from disk. The least recently used objects are
+// evicted once the cache grows beyond its size limit.
+// Cached files are hashed when they are stored, and checked on every full read,
+// so a corrupt cache file is detected and evicted instead of served.
+//
+// Every cache uses its own locked subdirectory of the cache directory, so several
+// processes can share a cache directory without removing each other's files.
+package storage_cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"go.resf.org/peridot/base/go/storage"
+	"golang.org/x/sys/unix"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrCorrupt is returned by the last Read of a cached object that doesn't match its checksum.
+var ErrCorrupt = errors.New("cached object is corrupt")
+
+const (
+	// filePattern is the pattern of cached files.
+	filePattern = "obj-*"
+	// processDirPattern is the pattern of the subdirectory every cache stores its files in.
+	processDirPattern = "proc-*"
+	// lockFile is locked for as long as the cache using its subdirectory is open.
+	lockFile = "lock"
+)
+
+// Cache is a storage.Storage that caches reads on disk.
+// Writes and deletes go straight to the backend, and evict the object from the cache.
+type Cache struct {
+	storage.Storage
+
+	// dir is the subdirectory of this cache, dirLock is the locked lock file in it.
+	dir       string
+	dirLock   *os.File
+	maxBytes  int64
+	immutable bool
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// lru has the most recently used entry at the front.
+	lru  *list.List
+	size int64
+}
+
+type entry struct {
+	object string
+	path   string
+	sha256 string
+	stat   *storage.Stat
+}
+
+type Option func(*Cache)
+
+// WithImmutable assumes objects never change once written, for example
+// objects in a storage_cas.Store. Cache hits are then served without asking the
+// backend whether the object changed.
+func WithImmutable() Option {
+	return func(c *Cache) {
+		c.immutable = true
+	}
+}
+
+// New creates a cache of at most maxBytes in dir, in front of st.
+// The cache index is kept in memory, so files cached by processes that exited are removed.
+// Call Close to remove the files of this cache.
+func New(st storage.Storage, dir string, maxBytes int64, opts ...Option) (*Cache, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("cache size must be positive")
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cache directory")
+	}
+	err = removeStale(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to clean cache directory")
+	}
+
+	processDir, err := os.MkdirTemp(dir, processDirPattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cache directory")
+	}
+	lock, err := lockDir(processDir, true)
+	if err != nil {
+		_ = os.RemoveAll(processDir)
+		return nil, errors.Wrap(err, "failed to lock cache directory")
+	}
+
+	c := &Cache{
+		Storage:  st,
+		dir:      processDir,
+		dirLock:  lock,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// lockDir locks the lock file in a cache subdirectory without waiting,
+// creating it if create is set. The lock is released when the file is closed,
+// or when the process exits.
+func lockDir(processDir string, create bool) (*os.File, error) {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(filepath.Join(processDir, lockFile), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// removeStale removes the subdirectories of caches that are no longer open,
+// because their process exited without closing them.
+func removeStale(dir string) error {
+	processDirs, err := filepath.Glob(filepath.Join(dir, processDirPattern))
+	if err != nil {
+		return err
+	}
+
+	for _, processDir := range processDirs {
+		// Locked by an open cache, or it was just created and isn't locked yet.
+		lock, err := lockDir(processDir, false)
+		if err != nil {
+			continue
+		}
+
+		err = os.RemoveAll(processDir)
+		_ = lock.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close removes the cached files, and releases the cache subdirectory.
+// Reads from the cache after Close go to the backend.
+func (c *Cache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.dirLock == nil {
+		return nil
+	}
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+
+	err := os.RemoveAll(c.dir)
+	_ = c.dirLock.Close()
+	c.dirLock = nil
+
+	return err
+}
+
+// Size returns the number of bytes currently cached.
+func (c *Cache) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.size
+}
+
+// lookup returns the cache entry of an object, and marks it as recently used.
+func (c *Cache) lookup(object string) *entry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[object]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+
+	return el.Value.(*entry)
+}
+
+// add adds an entry and evicts the least recently used entries if the cache is full.
+func (c *Cache) add(e *entry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Closed while the object was read.
+	if c.dirLock == nil {
+		_ = os.Remove(e.path)
+		return
+	}
+
+	if el, ok := c.entries[e.object]; ok {
+		c.remove(el)
+	}
+	c.entries[e.object] = c.lru.PushFront(e)
+	c.size += e.stat.Size
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// evict removes an object from the cache.
+// Only the given entry is removed, unless it is nil, so a newer entry isn't evicted by mistake.
+func (c *Cache) evict(object string, e *entry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[object]
+	if !ok || (e != nil && el.Value.(*entry) != e) {
+		return
+	}
+	c.remove(el)
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.entries, e.object)
+	c.size -= e.stat.Size
+
+	// Readers that still have the file open can finish reading it.
+	_ = os.Remove(e.path)
+}
+
+// Open serves the object from the cache if possible.
+// Full reads of uncached objects are cached, range reads of uncached objects go to the backend.
+func (c *Cache) Open(ctx context.Context, object string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	o := storage.NewOpenOptions(opts...)
+
+	e := c.lookup(object)
+	if e != nil && !c.immutable {
+		stat, err := c.Storage.Stat(ctx, object)
+		if err != nil {
+			if err == storage.ErrNotFound {
+				c.evict(object, e)
+			}
+			return nil, nil, err
+		}
+		if stat.Size != e.stat.Size || stat.ETag != e.stat.ETag {
+			c.evict(object, e)
+			e = nil
+		}
+	}
+	if e != nil {
+		r, err := c.openEntry(e, o)
+		if err == nil || err == storage.ErrInvalidRange {
+			return r, copyStat(e.stat), err
+		}
+		// Evicted since the lookup, read from the backend instead.
+	}
+
+	if o.IsRange() {
+		return c.Storage.Open(ctx, object, opts...)
+	}
+
+	r, stat, err := c.Storage.Open(ctx, object)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat.Size > c.maxBytes {
+		return r, stat, nil
+	}
+
+	// Caching is best effort, the read continues even if the cache can't be written.
+	tmp, err := os.CreateTemp(c.dir, filePattern)
+	if err != nil {
+		return r, stat, nil
+	}
+
+	return &populatingReader{
+		c:      c,
+		object: object,
+		r:      r,
+		stat:   stat,
+		tmp:    tmp,
+		sha256: sha256.New(),
+	}, stat, nil
+}
+
+func (c *Cache) openEntry(e *entry, o *storage.OpenOptions) (io.ReadCloser, error) {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !o.IsRange() {
+		return &verifyingReader{
+			c:      c,
+			e:      e,
+			f:      f,
+			sha256: sha256.New(),
+		}, nil
+	}
+
+	// Match the backends, which reject ranges starting at or after the end.
+	if o.Offset >= e.stat.Size {
+		_ = f.Close()
+		return nil, storage.ErrInvalidRange
+	}
+	_, err = f.Seek(o.Offset, io.SeekStart)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if o.Length <= 0 {
+		return f, nil
+	}
+
+	return &limitedFile{
+		Reader: io.LimitReader(f, o.Length),
+		f:      f,
+	}, nil
+}
+
+func (c *Cache) Get(object string, opts ...storage.GetOption) ([]byte, error) {
+	return storage.ReadAll(context.Background(), c, object, opts...)
+}
+
+func (c *Cache) Download(object string, toPath string, opts ...storage.GetOption) error {
+	return storage.DownloadTo(context.Background(), c, object, toPath, opts...)
+}
+
+func (c *Cache) Create(ctx context.Context, object string, opts ...storage.PutOption) (storage.Writer, error) {
+	c.evict(object, nil)
+
+	w, err := c.Storage.Create(ctx, object, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &evictingWriter{
+		Writer: w,
+		c:      c,
+		object: object,
+	}, nil
+}
+
+func (c *Cache) Put(object string, fromPath string, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	c.evict(object, nil)
+	defer c.evict(object, nil)
+
+	return c.Storage.Put(object, fromPath, opts...)
+}
+
+func (c *Cache) PutBytes(object string, data []byte, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	c.evict(object, nil)
+	defer c.evict(object, nil)
+
+	return c.Storage.PutBytes(object, data, opts...)
+}
+
+func (c *Cache) Delete(object string) error {
+	c.evict(object, nil)
+
+	return c.Storage.Delete(object)
+}
+
+// DeleteVersion evicts the object, deleting the current version changes its contents.
+func (c *Cache) DeleteVersion(ctx context.Context, object string, versionID string) error {
+	c.evict(object, nil)
+
+	return c.Storage.DeleteVersion(ctx, object, versionID)
+}
+
+// SignURL signs URLs with the backend, signed URLs bypass the cache.
+func (c *Cache) SignURL(ctx context.Context, object string, method string, expires time.Duration) (string, error) {
+	return storage.SignURL(ctx, c.Storage, object, method, expires)
+}
+
+func copyStat(stat *storage.Stat) *storage.Stat {
+	s := *stat
+	return &s
+}
+
+// populatingReader writes an object to the cache as it is read.
+// The object is only added to the cache once it has been read completely, and matches its checksum.
+type populatingReader struct {
+	c      *Cache
+	object string
+	r      io.ReadCloser
+	stat   *storage.Stat
+	tmp    *os.File
+	sha256 hash.Hash
+	size   int64
+	// failed is set once writing to the cache failed, the read continues uncached.
+	failed bool
+	done   bool
+}
+
+func (p *populatingReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && !p.failed && !p.done {
+		_, werr := p.tmp.Write(b[:n])
+		if werr != nil {
+			p.failed = true
+		}
+		p.sha256.Write(b[:n])
+		p.size += int64(n)
+	}
+	if err == io.EOF && !p.failed && !p.done {
+		p.done = true
+		p.commit()
+	}
+
+	return n, err
+}
+
+func (p *populatingReader) commit() {
+	err := p.tmp.Close()
+	if err != nil {
+		return
+	}
+
+	sum := hex.EncodeToString(p.sha256.Sum(nil))
+	if p.size != p.stat.Size || (p.stat.SHA256 != "" && p.stat.SHA256 != sum) {
+		return
+	}
+
+	p.c.add(&entry{
+		object: p.object,
+		path:   p.tmp.Name(),
+		sha256: sum,
+		stat:   copyStat(p.stat),
+	})
+	p.tmp = nil
+}
+
+func (p *populatingReader) Close() error {
+	// Not added to the cache, because the read was incomplete or failed.
+	if p.tmp != nil {
+		_ = p.tmp.Close()
+		_ = os.Remove(p.tmp.Name())
+		p.tmp = nil
+	}
+
+	return p.r.Close()
+}
+
+// verifyingReader reads a cached object, and checks its checksum once the end is reached.
+type verifyingReader struct {
+	c      *Cache
+	e      *entry
+	f      *os.File
+	sha256 hash.Hash
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.f.Read(b)
+	v.sha256.Write(b[:n])
+	if err == io.EOF && hex.EncodeToString(v.sha256.Sum(nil)) != v.e.sha256 {
+		v.c.evict(v.e.object, v.e)
+		return n, errors.Wrapf(ErrCorrupt, "cached copy of %s", v.e.object)
+	}
+
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.f.Close()
+}
+
+type limitedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (l *limitedFile) Close() error {
+	return l.f.Close()
+}
+
+// evictingWriter evicts the object again once the upload completes,
+// in case it was cached while the upload was in progress.
+type evictingWriter struct {
+	storage.Writer
+	c      *Cache
+	object string
+}
+
+func (w *evictingWriter) Close() error {
+	defer w.c.evict(w.object, nil)
+
+	return w.Writer.Close()
+}
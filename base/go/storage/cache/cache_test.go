@@ -0,0 +1,256 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_cache
+
+import (
+	"context"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingStorage counts the reads that reach the backend.
+type countingStorage struct {
+	storage.Storage
+	opens int
+}
+
+func (c *countingStorage) Open(ctx context.Context, object string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	c.opens++
+	return c.Storage.Open(ctx, object, opts...)
+}
+
+func newCache(t *testing.T, maxBytes int64, opts ...Option) (*Cache, *countingStorage, string) {
+	backend := &countingStorage{Storage: storage_memory.New(memfs.New())}
+	dir := t.TempDir()
+
+	c, err := New(backend, dir, maxBytes, opts...)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, c.Close())
+	})
+
+	return c, backend, c.dir
+}
+
+func TestCache_ReadThrough(t *testing.T) {
+	c, backend, _ := newCache(t, 1024)
+
+	_, err := c.PutBytes("foo", []byte("bar"))
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		data, err := c.Get("foo")
+		require.Nil(t, err)
+		require.Equal(t, []byte("bar"), data)
+	}
+	require.Equal(t, 1, backend.opens)
+	require.Equal(t, int64(3), c.Size())
+
+	// Range reads are served from the cache too.
+	r, stat, err := c.Open(context.Background(), "foo", storage.WithRange(1, 1))
+	require.Nil(t, err)
+	data, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Nil(t, r.Close())
+	require.Equal(t, []byte("a"), data)
+	require.Equal(t, int64(3), stat.Size)
+	require.Equal(t, 1, backend.opens)
+
+	_, _, err = c.Open(context.Background(), "foo", storage.WithRange(3, 0))
+	require.ErrorIs(t, err, storage.ErrInvalidRange)
+
+	_, err = c.Get("missing")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	c, backend, _ := newCache(t, 1024)
+
+	_, err := c.PutBytes("foo", []byte("bar"))
+	require.Nil(t, err)
+	_, err = c.Get("foo")
+	require.Nil(t, err)
+
+	// Writes through the cache evict the object.
+	_, err = c.PutBytes("foo", []byte("baz"))
+	require.Nil(t, err)
+	data, err := c.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("baz"), data)
+	require.Equal(t, 2, backend.opens)
+
+	// Writes to the backend directly are noticed by the revalidation.
+	_, err = backend.PutBytes("foo", []byte("qux"))
+	require.Nil(t, err)
+	data, err = c.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("qux"), data)
+	require.Equal(t, 3, backend.opens)
+
+	require.Nil(t, c.Delete("foo"))
+	_, err = c.Get("foo")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+	require.Equal(t, int64(0), c.Size())
+}
+
+func TestCache_Immutable(t *testing.T) {
+	c, backend, _ := newCache(t, 1024, WithImmutable())
+
+	_, err := c.PutBytes("foo", []byte("bar"))
+	require.Nil(t, err)
+	_, err = c.Get("foo")
+	require.Nil(t, err)
+
+	// Without revalidation, changes made directly in the backend are not noticed.
+	_, err = backend.PutBytes("foo", []byte("baz"))
+	require.Nil(t, err)
+	data, err := c.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("bar"), data)
+	require.Equal(t, 1, backend.opens)
+}
+
+func TestCache_Evict(t *testing.T) {
+	c, backend, dir := newCache(t, 10)
+
+	for _, object := range []string{"a", "b", "c"} {
+		_, err := c.PutBytes(object, []byte("1234"))
+		require.Nil(t, err)
+	}
+
+	_, err := c.Get("a")
+	require.Nil(t, err)
+	_, err = c.Get("b")
+	require.Nil(t, err)
+	// Uses a, so b is the least recently used.
+	_, err = c.Get("a")
+	require.Nil(t, err)
+	_, err = c.Get("c")
+	require.Nil(t, err)
+	require.Equal(t, int64(8), c.Size())
+	require.Equal(t, 3, backend.opens)
+
+	files, err := filepath.Glob(filepath.Join(dir, filePattern))
+	require.Nil(t, err)
+	require.Len(t, files, 2)
+
+	_, err = c.Get("a")
+	require.Nil(t, err)
+	require.Equal(t, 3, backend.opens)
+	_, err = c.Get("b")
+	require.Nil(t, err)
+	require.Equal(t, 4, backend.opens)
+
+	// Objects larger than the cache are never cached.
+	_, err = c.PutBytes("large", []byte("12345678901"))
+	require.Nil(t, err)
+	_, err = c.Get("large")
+	require.Nil(t, err)
+	require.LessOrEqual(t, c.Size(), int64(10))
+}
+
+func TestCache_Corrupt(t *testing.T) {
+	c, backend, dir := newCache(t, 1024)
+
+	_, err := c.PutBytes("foo", []byte("bar"))
+	require.Nil(t, err)
+	_, err = c.Get("foo")
+	require.Nil(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, filePattern))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	require.Nil(t, os.WriteFile(files[0], []byte("baz"), 0644))
+
+	_, err = c.Get("foo")
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	// The corrupt copy is evicted, and the next read goes to the backend.
+	data, err := c.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("bar"), data)
+	require.Equal(t, 2, backend.opens)
+}
+
+func TestCache_IncompleteRead(t *testing.T) {
+	c, backend, dir := newCache(t, 1024)
+
+	_, err := c.PutBytes("foo", []byte("bar"))
+	require.Nil(t, err)
+
+	r, _, err := c.Open(context.Background(), "foo")
+	require.Nil(t, err)
+	_, err = r.Read(make([]byte, 1))
+	require.Nil(t, err)
+	require.Nil(t, r.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, filePattern))
+	require.Nil(t, err)
+	require.Empty(t, files)
+
+	_, err = c.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, 2, backend.opens)
+}
+
+func TestNew_SharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	// A cache of a process that exited without closing it.
+	stale := filepath.Join(dir, "proc-stale")
+	require.Nil(t, os.Mkdir(stale, 0755))
+	require.Nil(t, os.WriteFile(filepath.Join(stale, lockFile), nil, 0644))
+	require.Nil(t, os.WriteFile(filepath.Join(stale, "obj-stale"), []byte("stale"), 0644))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644))
+
+	backend := storage_memory.New(memfs.New())
+	_, err := backend.PutBytes("foo", []byte("foo"))
+	require.Nil(t, err)
+
+	first, err := New(backend, dir, 1024)
+	require.Nil(t, err)
+	_, err = first.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), first.Size())
+
+	// Opening another cache in the same directory keeps the files of the first one.
+	second, err := New(backend, dir, 1024)
+	require.Nil(t, err)
+	require.NotEqual(t, first.dir, second.dir)
+	files, err := filepath.Glob(filepath.Join(first.dir, filePattern))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	_, err = first.Get("foo")
+	require.Nil(t, err)
+
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "other"))
+	require.Nil(t, err)
+
+	// Closing removes the files of that cache only.
+	require.Nil(t, first.Close())
+	_, err = os.Stat(first.dir)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(second.dir)
+	require.Nil(t, err)
+	require.Nil(t, second.Close())
+}
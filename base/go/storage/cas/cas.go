@@ -0,0 +1,347 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cas stores blobs in a storage.Storage by the hash of their contents.
+//
+// Blobs are stored at <prefix>/sha256/<hex>. If SHA-512 is enabled, blobs can also
+// be looked up by their SHA-512 hash, through a small object at <prefix>/sha512/<hex>
+// containing the SHA-256 hash, so the contents are only stored once.
+//
+// Hashes are verified on write, so a blob is never stored under the wrong digest,
+// and on read, so corruption in the backend is detected.
+package storage_cas
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"go.resf.org/peridot/base/go/storage"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const defaultPrefix = "cas"
+
+// ErrDigestMismatch is returned when the contents of a blob don't match its digest.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// Store is a content-addressable store on top of a storage.Storage.
+type Store struct {
+	st     storage.Storage
+	prefix string
+	sha512 bool
+}
+
+type Option func(*Store)
+
+// WithPrefix sets the prefix blobs are stored under, defaults to "cas".
+func WithPrefix(prefix string) Option {
+	return func(s *Store) {
+		s.prefix = strings.Trim(prefix, "/")
+	}
+}
+
+// WithSHA512 also indexes blobs by their SHA-512 hash.
+// Only blobs stored with this option enabled can be looked up by SHA-512.
+func WithSHA512() Option {
+	return func(s *Store) {
+		s.sha512 = true
+	}
+}
+
+// New creates a content-addressable store on top of st.
+func New(st storage.Storage, opts ...Option) *Store {
+	s := &Store{
+		st:     st,
+		prefix: defaultPrefix,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Blob is the result of storing a blob.
+type Blob struct {
+	Size int64
+	// SHA256 is always set.
+	SHA256 Digest
+	// SHA512 is only set if the store indexes blobs by SHA-512.
+	SHA512 *Digest
+	// Deduplicated is true if the blob was already stored, and nothing was uploaded.
+	Deduplicated bool
+}
+
+// Object returns the name of the object the contents of a blob are stored at.
+// Useful to sign URLs for a blob, only SHA-256 digests address the contents directly.
+func (s *Store) Object(d Digest) (string, error) {
+	err := d.Validate()
+	if err != nil {
+		return "", err
+	}
+	if d.Algorithm != SHA256 {
+		return "", errors.Wrap(ErrInvalidDigest, "only sha256 digests address an object")
+	}
+
+	return s.object(d), nil
+}
+
+func (s *Store) object(d Digest) string {
+	return path.Join(s.prefix, string(d.Algorithm), d.Hex)
+}
+
+// Has returns whether a blob is stored.
+func (s *Store) Has(ctx context.Context, d Digest) (bool, error) {
+	err := d.Validate()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.st.Stat(ctx, s.object(d))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Put stores the contents of r and returns its digests.
+// The contents are spooled to a temporary file while hashing, and only uploaded
+// if the blob isn't stored yet.
+// If expected digests are given, the contents must match all of them,
+// otherwise nothing is stored and ErrDigestMismatch is returned.
+// If the first expected digest is already stored, r is not read at all.
+func (s *Store) Put(ctx context.Context, r io.Reader, expected ...Digest) (*Blob, error) {
+	for _, d := range expected {
+		err := d.Validate()
+		if err != nil {
+			return nil, err
+		}
+		if d.Algorithm == SHA512 && !s.sha512 {
+			return nil, errors.Wrap(ErrInvalidDigest, "sha512 is not enabled")
+		}
+	}
+	if len(expected) > 0 {
+		blob, err := s.stored(ctx, expected[0])
+		if err != nil {
+			return nil, err
+		}
+		if blob != nil {
+			return blob, nil
+		}
+	}
+
+	f, err := os.CreateTemp("", "cas-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hashes := map[Algorithm]hash.Hash{}
+	writers := []io.Writer{f}
+	for _, alg := range s.algorithms() {
+		h, _ := alg.new()
+		hashes[alg] = h
+		writers = append(writers, h)
+	}
+
+	size, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read blob")
+	}
+
+	blob := &Blob{
+		Size:   size,
+		SHA256: Digest{Algorithm: SHA256, Hex: hex.EncodeToString(hashes[SHA256].Sum(nil))},
+	}
+	if s.sha512 {
+		blob.SHA512 = &Digest{Algorithm: SHA512, Hex: hex.EncodeToString(hashes[SHA512].Sum(nil))}
+	}
+	for _, d := range expected {
+		if hex.EncodeToString(hashes[d.Algorithm].Sum(nil)) != d.Hex {
+			return nil, errors.Wrapf(ErrDigestMismatch, "expected %s", d)
+		}
+	}
+
+	exists, err := s.Has(ctx, blob.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		blob.Deduplicated = true
+	} else {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+
+		// The digests are recorded in the metadata, and checked by the backend if it supports it.
+		putOpts := []storage.PutOption{storage.WithSHA256(blob.SHA256.Hex)}
+		if blob.SHA512 != nil {
+			putOpts = append(putOpts, storage.WithSHA512(blob.SHA512.Hex))
+		}
+		_, err = storage.Upload(ctx, s.st, s.object(blob.SHA256), f, putOpts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to upload blob")
+		}
+	}
+
+	// The alias is written after the contents, so it never points to a missing blob.
+	// It is also written for deduplicated blobs, which may have been stored without SHA-512.
+	if blob.SHA512 != nil {
+		_, err = s.st.PutBytes(s.object(*blob.SHA512), []byte(blob.SHA256.Hex))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to upload sha512 alias")
+		}
+	}
+
+	return blob, nil
+}
+
+// PutBytes stores data and returns its digests.
+func (s *Store) PutBytes(ctx context.Context, data []byte, expected ...Digest) (*Blob, error) {
+	return s.Put(ctx, bytes.NewReader(data), expected...)
+}
+
+// stored returns the blob for a digest if it is already stored, or nil.
+func (s *Store) stored(ctx context.Context, d Digest) (*Blob, error) {
+	sha256Digest := d
+	if d.Algorithm == SHA512 {
+		resolved, err := s.resolve(ctx, d)
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sha256Digest = resolved
+	}
+
+	stat, err := s.st.Stat(ctx, s.object(sha256Digest))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	blob := &Blob{
+		Size:         stat.Size,
+		SHA256:       sha256Digest,
+		Deduplicated: true,
+	}
+	if d.Algorithm == SHA512 {
+		blob.SHA512 = &d
+	} else if s.sha512 && stat.Metadata[string(SHA512)] != "" {
+		blob.SHA512 = &Digest{Algorithm: SHA512, Hex: stat.Metadata[string(SHA512)]}
+	}
+
+	return blob, nil
+}
+
+// resolve returns the SHA-256 digest a SHA-512 digest points to.
+func (s *Store) resolve(ctx context.Context, d Digest) (Digest, error) {
+	data, err := storage.ReadAll(ctx, s.st, s.object(d))
+	if err != nil {
+		return Digest{}, err
+	}
+
+	resolved := Digest{Algorithm: SHA256, Hex: string(data)}
+	err = resolved.Validate()
+	if err != nil {
+		return Digest{}, errors.Wrapf(err, "corrupt sha512 alias %s", d.Hex)
+	}
+
+	return resolved, nil
+}
+
+// Open opens a blob for reading.
+// The contents are hashed while reading, and the last Read returns ErrDigestMismatch
+// instead of io.EOF if they don't match the digest.
+// Returns storage.ErrNotFound if the blob isn't stored.
+func (s *Store) Open(ctx context.Context, d Digest) (io.ReadCloser, *storage.Stat, error) {
+	err := d.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	object := s.object(d)
+	if d.Algorithm == SHA512 {
+		resolved, err := s.resolve(ctx, d)
+		if err != nil {
+			return nil, nil, err
+		}
+		object = s.object(resolved)
+	}
+
+	r, stat, err := s.st.Open(ctx, object)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, _ := d.Algorithm.new()
+	return &verifyingReader{
+		r:      r,
+		h:      h,
+		digest: d,
+	}, stat, nil
+}
+
+// Get returns the contents of a blob, after verifying them.
+func (s *Store) Get(ctx context.Context, d Digest) ([]byte, error) {
+	r, _, err := s.Open(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (s *Store) algorithms() []Algorithm {
+	if s.sha512 {
+		return []Algorithm{SHA256, SHA512}
+	}
+	return []Algorithm{SHA256}
+}
+
+// verifyingReader hashes everything read, and checks the digest once the end is reached.
+type verifyingReader struct {
+	r      io.ReadCloser
+	h      hash.Hash
+	digest Digest
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.h.Sum(nil)) != v.digest.Hex {
+		return n, errors.Wrapf(ErrDigestMismatch, "stored blob does not match %s", v.digest)
+	}
+
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
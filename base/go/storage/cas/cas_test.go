@@ -0,0 +1,192 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_cas
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"io"
+	"strings"
+	"testing"
+)
+
+func sha256Digest(data string) Digest {
+	sum := sha256.Sum256([]byte(data))
+	return Digest{Algorithm: SHA256, Hex: hex.EncodeToString(sum[:])}
+}
+
+func sha512Digest(data string) Digest {
+	sum := sha512.Sum512([]byte(data))
+	return Digest{Algorithm: SHA512, Hex: hex.EncodeToString(sum[:])}
+}
+
+func TestParseDigest(t *testing.T) {
+	d := sha256Digest("foo")
+	parsed, err := ParseDigest(d.String())
+	require.Nil(t, err)
+	require.Equal(t, d, parsed)
+
+	for _, s := range []string{
+		"",
+		d.Hex,
+		"md5:acbd18db4cc2f85cedef654fccc4a4d8",
+		"sha256:abc",
+		"sha256:" + strings.ToUpper(d.Hex),
+		"sha256:" + strings.Repeat("z", 64),
+	} {
+		_, err := ParseDigest(s)
+		require.ErrorIs(t, err, ErrInvalidDigest, s)
+	}
+}
+
+func TestStore_PutGet(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New())
+	s := New(st)
+
+	blob, err := s.PutBytes(ctx, []byte("kernel"))
+	require.Nil(t, err)
+	require.Equal(t, sha256Digest("kernel"), blob.SHA256)
+	require.Nil(t, blob.SHA512)
+	require.Equal(t, int64(6), blob.Size)
+	require.False(t, blob.Deduplicated)
+
+	// The contents are stored by hash.
+	object, err := s.Object(blob.SHA256)
+	require.Nil(t, err)
+	require.Equal(t, "cas/sha256/"+blob.SHA256.Hex, object)
+	data, err := st.Get(object)
+	require.Nil(t, err)
+	require.Equal(t, []byte("kernel"), data)
+
+	has, err := s.Has(ctx, blob.SHA256)
+	require.Nil(t, err)
+	require.True(t, has)
+	has, err = s.Has(ctx, sha256Digest("other"))
+	require.Nil(t, err)
+	require.False(t, has)
+
+	data, err = s.Get(ctx, blob.SHA256)
+	require.Nil(t, err)
+	require.Equal(t, []byte("kernel"), data)
+
+	_, err = s.Get(ctx, sha256Digest("other"))
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestStore_Dedupe(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New())
+	s := New(st)
+
+	_, err := s.PutBytes(ctx, []byte("kernel"))
+	require.Nil(t, err)
+	stat, err := st.Stat(ctx, "cas/sha256/"+sha256Digest("kernel").Hex)
+	require.Nil(t, err)
+
+	blob, err := s.PutBytes(ctx, []byte("kernel"))
+	require.Nil(t, err)
+	require.True(t, blob.Deduplicated)
+
+	// Nothing was uploaded the second time.
+	restat, err := st.Stat(ctx, "cas/sha256/"+sha256Digest("kernel").Hex)
+	require.Nil(t, err)
+	require.Equal(t, stat.LastModified, restat.LastModified)
+
+	// With an expected digest that is already stored, the reader isn't used.
+	blob, err = s.Put(ctx, failingReader{}, sha256Digest("kernel"))
+	require.Nil(t, err)
+	require.True(t, blob.Deduplicated)
+	require.Equal(t, int64(6), blob.Size)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestStore_PutMismatch(t *testing.T) {
+	ctx := context.Background()
+	s := New(storage_memory.New(memfs.New()))
+
+	_, err := s.PutBytes(ctx, []byte("kernel"), sha256Digest("other"))
+	require.ErrorIs(t, err, ErrDigestMismatch)
+
+	has, err := s.Has(ctx, sha256Digest("kernel"))
+	require.Nil(t, err)
+	require.False(t, has)
+
+	// SHA-512 digests can only be used if enabled.
+	_, err = s.PutBytes(ctx, []byte("kernel"), sha512Digest("kernel"))
+	require.ErrorIs(t, err, ErrInvalidDigest)
+}
+
+func TestStore_SHA512(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New())
+	s := New(st, WithSHA512(), WithPrefix("/lookaside/"))
+
+	blob, err := s.PutBytes(ctx, []byte("kernel"), sha512Digest("kernel"))
+	require.Nil(t, err)
+	require.Equal(t, sha512Digest("kernel"), *blob.SHA512)
+
+	has, err := s.Has(ctx, sha512Digest("kernel"))
+	require.Nil(t, err)
+	require.True(t, has)
+
+	data, err := s.Get(ctx, sha512Digest("kernel"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("kernel"), data)
+
+	// Only the alias is stored under the SHA-512 hash.
+	alias, err := st.Get("lookaside/sha512/" + sha512Digest("kernel").Hex)
+	require.Nil(t, err)
+	require.Equal(t, []byte(sha256Digest("kernel").Hex), alias)
+
+	// Blobs stored before SHA-512 was enabled get an alias when stored again.
+	_, err = New(st, WithPrefix("lookaside")).PutBytes(ctx, []byte("old"))
+	require.Nil(t, err)
+	has, err = s.Has(ctx, sha512Digest("old"))
+	require.Nil(t, err)
+	require.False(t, has)
+	blob, err = s.PutBytes(ctx, []byte("old"))
+	require.Nil(t, err)
+	require.True(t, blob.Deduplicated)
+	has, err = s.Has(ctx, sha512Digest("old"))
+	require.Nil(t, err)
+	require.True(t, has)
+}
+
+func TestStore_Corrupt(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New())
+	s := New(st)
+
+	blob, err := s.PutBytes(ctx, []byte("kernel"))
+	require.Nil(t, err)
+
+	_, err = st.PutBytes("cas/sha256/"+blob.SHA256.Hex, []byte("corrupt"))
+	require.Nil(t, err)
+
+	_, err = s.Get(ctx, blob.SHA256)
+	require.ErrorIs(t, err, ErrDigestMismatch)
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_cas
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"hash"
+	"strings"
+)
+
+var ErrInvalidDigest = errors.New("invalid digest")
+
+// Algorithm is a hash algorithm blobs can be addressed by.
+type Algorithm string
+
+const (
+	SHA256 Algorithm = "sha256"
+	SHA512 Algorithm = "sha512"
+)
+
+func (a Algorithm) new() (hash.Hash, error) {
+	switch a {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, errors.Wrapf(ErrInvalidDigest, "unsupported algorithm %q", a)
+	}
+}
+
+// Digest addresses a blob by the hash of its contents.
+type Digest struct {
+	Algorithm Algorithm
+	// Hex is the lower case hex encoded hash.
+	Hex string
+}
+
+// ParseDigest parses a digest in the "<algorithm>:<hex>" form, for example "sha256:e3b0c442...".
+func ParseDigest(s string) (Digest, error) {
+	algorithm, hexSum, ok := strings.Cut(s, ":")
+	if !ok {
+		return Digest{}, errors.Wrapf(ErrInvalidDigest, "%q is missing the algorithm", s)
+	}
+
+	d := Digest{
+		Algorithm: Algorithm(algorithm),
+		Hex:       hexSum,
+	}
+	err := d.Validate()
+	if err != nil {
+		return Digest{}, err
+	}
+
+	return d, nil
+}
+
+// Validate checks that the algorithm is supported and the hash has the right length.
+func (d Digest) Validate() error {
+	h, err := d.Algorithm.new()
+	if err != nil {
+		return err
+	}
+	if len(d.Hex) != h.Size()*2 {
+		return errors.Wrapf(ErrInvalidDigest, "%s digest must be %d characters", d.Algorithm, h.Size()*2)
+	}
+	// Only lower case, so every blob has a single object name.
+	if strings.ToLower(d.Hex) != d.Hex {
+		return errors.Wrap(ErrInvalidDigest, "digest must be lower case")
+	}
+	if _, err := hex.DecodeString(d.Hex); err != nil {
+		return errors.Wrap(ErrInvalidDigest, "digest is not hex encoded")
+	}
+
+	return nil
+}
+
+func (d Digest) String() string {
+	return string(d.Algorithm) + ":" + d.Hex
+}
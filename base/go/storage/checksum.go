@@ -0,0 +1,189 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrChecksumMismatch is returned when the contents of an object don't match its expected digests.
+// The returned error is a *ChecksumMismatchError, use errors.Is to check for it.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+const (
+	// MetadataSHA256 is the metadata key the expected SHA-256 digest of an object is recorded under.
+	MetadataSHA256 = "sha256"
+	// MetadataSHA512 is the metadata key the expected SHA-512 digest of an object is recorded under.
+	MetadataSHA512 = "sha512"
+)
+
+// ChecksumMismatchError describes which digest of an object didn't match.
+type ChecksumMismatchError struct {
+	Object    string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch for %s: expected %s, got %s", e.Algorithm, e.Object, e.Expected, e.Actual)
+}
+
+func (e *ChecksumMismatchError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// checksum is a digest that is checked once all data has been hashed.
+type checksum struct {
+	algorithm string
+	expected  string
+	hash      hash.Hash
+}
+
+// newChecksums returns the checksums for the given hex encoded digests, skipping empty ones.
+func newChecksums(sha256Hex string, sha512Hex string) ([]*checksum, error) {
+	var checksums []*checksum
+	if sha256Hex != "" {
+		if !validHex(sha256Hex, sha256.Size) {
+			return nil, fmt.Errorf("invalid sha256 digest: %s", sha256Hex)
+		}
+		checksums = append(checksums, &checksum{algorithm: MetadataSHA256, expected: sha256Hex, hash: sha256.New()})
+	}
+	if sha512Hex != "" {
+		if !validHex(sha512Hex, sha512.Size) {
+			return nil, fmt.Errorf("invalid sha512 digest: %s", sha512Hex)
+		}
+		checksums = append(checksums, &checksum{algorithm: MetadataSHA512, expected: sha512Hex, hash: sha512.New()})
+	}
+
+	return checksums, nil
+}
+
+func validHex(s string, size int) bool {
+	decoded, err := hex.DecodeString(s)
+	return err == nil && len(decoded) == size && hex.EncodeToString(decoded) == s
+}
+
+// checksumReader hashes everything read through it.
+type checksumReader struct {
+	r         io.Reader
+	object    string
+	checksums []*checksum
+}
+
+func newChecksumReader(r io.Reader, object string, checksums []*checksum) *checksumReader {
+	writers := make([]io.Writer, 0, len(checksums))
+	for _, c := range checksums {
+		writers = append(writers, c.hash)
+	}
+
+	return &checksumReader{
+		r:         io.TeeReader(r, io.MultiWriter(writers...)),
+		object:    object,
+		checksums: checksums,
+	}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// verify returns a *ChecksumMismatchError if the data read doesn't match.
+func (c *checksumReader) verify() error {
+	for _, checksum := range c.checksums {
+		actual := hex.EncodeToString(checksum.hash.Sum(nil))
+		if actual != checksum.expected {
+			return &ChecksumMismatchError{
+				Object:    c.object,
+				Algorithm: checksum.algorithm,
+				Expected:  checksum.expected,
+				Actual:    actual,
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifyingReadCloser verifies the contents once the end is reached.
+type verifyingReadCloser struct {
+	*checksumReader
+	closer io.Closer
+}
+
+func (v *verifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := v.checksumReader.Read(p)
+	if err == io.EOF {
+		verifyErr := v.verify()
+		if verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+
+	return n, err
+}
+
+func (v *verifyingReadCloser) Close() error {
+	return v.closer.Close()
+}
+
+// ExpectedChecksums returns the hex encoded digests an object is expected to have.
+// The digests recorded when the object was uploaded are preferred over the one reported by the backend.
+// Empty if unknown.
+func ExpectedChecksums(stat *Stat) (sha256Hex string, sha512Hex string) {
+	sha256Hex = stat.Metadata[MetadataSHA256]
+	if sha256Hex == "" {
+		sha256Hex = stat.SHA256
+	}
+
+	return sha256Hex, stat.Metadata[MetadataSHA512]
+}
+
+// OpenVerified opens an object for Get and Download, with the given options.
+// With WithVerify, reading the last byte returns a *ChecksumMismatchError if the
+// contents don't match the expected digests of the object.
+// Objects without any known digest are read without verification.
+func OpenVerified(ctx context.Context, st Storage, object string, opts ...GetOption) (io.ReadCloser, *Stat, error) {
+	o := NewGetOptions(opts...)
+
+	r, stat, err := st.Open(ctx, object)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !o.Verify {
+		return r, stat, nil
+	}
+
+	checksums, err := newChecksums(ExpectedChecksums(stat))
+	if err != nil {
+		_ = r.Close()
+		return nil, nil, err
+	}
+	if len(checksums) == 0 {
+		return r, stat, nil
+	}
+
+	return &verifyingReadCloser{
+		checksumReader: newChecksumReader(r, object, checksums),
+		closer:         r,
+	}, stat, nil
+}
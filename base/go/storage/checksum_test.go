@@ -0,0 +1,159 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	storage_fs "go.resf.org/peridot/base/go/storage/fs"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sha512Hex(data []byte) string {
+	sum := sha512.Sum512(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPut_Checksums(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New())
+	data := []byte("foo")
+
+	_, err := st.PutBytes("foo", data, storage.WithSHA256(sha256Hex(data)), storage.WithSHA512(sha512Hex(data)))
+	require.Nil(t, err)
+
+	stat, err := st.Stat(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, sha256Hex(data), stat.Metadata[storage.MetadataSHA256])
+	require.Equal(t, sha512Hex(data), stat.Metadata[storage.MetadataSHA512])
+
+	// Nothing is stored if the contents don't match.
+	_, err = st.PutBytes("bar", data, storage.WithSHA512(sha512Hex([]byte("bar"))))
+	require.ErrorIs(t, err, storage.ErrChecksumMismatch)
+	var mismatch *storage.ChecksumMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, storage.MetadataSHA512, mismatch.Algorithm)
+	require.Equal(t, sha512Hex(data), mismatch.Actual)
+	exists, err := st.Exists("bar")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	_, err = st.PutBytes("bar", data, storage.WithSHA256("not-hex"))
+	require.NotNil(t, err)
+	require.NotErrorIs(t, err, storage.ErrChecksumMismatch)
+}
+
+func TestGet_Verify(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New())
+	data := []byte("foo")
+
+	_, err := st.PutBytes("foo", data, storage.WithSHA256(sha256Hex(data)))
+	require.Nil(t, err)
+	got, err := st.Get("foo", storage.WithVerify())
+	require.Nil(t, err)
+	require.Equal(t, data, got)
+
+	// Writers record the expected digest without checking it,
+	// so this stores an object that doesn't match its digest.
+	w, err := st.Create(ctx, "corrupt", storage.WithSHA256(sha256Hex([]byte("bar"))))
+	require.Nil(t, err)
+	_, err = w.Write(data)
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+
+	_, err = st.Get("corrupt")
+	require.Nil(t, err)
+	_, err = st.Get("corrupt", storage.WithVerify())
+	require.ErrorIs(t, err, storage.ErrChecksumMismatch)
+
+	require.Nil(t, st.Download("corrupt", "/corrupt"))
+	require.ErrorIs(t, st.Download("corrupt", "/corrupt", storage.WithVerify()), storage.ErrChecksumMismatch)
+}
+
+// putCorrupt stores an object whose contents don't match its recorded digest.
+func putCorrupt(t *testing.T, st storage.Storage, object string) {
+	w, err := st.Create(context.Background(), object, storage.WithSHA256(sha256Hex([]byte("foo"))))
+	require.Nil(t, err)
+	_, err = w.Write([]byte("bar"))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+}
+
+func TestDownload_VerifyKeepsFile(t *testing.T) {
+	st, err := storage_fs.New(t.TempDir())
+	require.Nil(t, err)
+	putCorrupt(t, st, "corrupt")
+
+	dir := t.TempDir()
+	toPath := filepath.Join(dir, "out")
+	require.Nil(t, os.WriteFile(toPath, []byte("old"), 0644))
+
+	// A mismatch leaves the existing file and no temporary file behind.
+	require.ErrorIs(t, st.Download("corrupt", toPath, storage.WithVerify()), storage.ErrChecksumMismatch)
+	data, err := os.ReadFile(toPath)
+	require.Nil(t, err)
+	require.Equal(t, []byte("old"), data)
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+
+	require.Nil(t, st.Download("corrupt", toPath))
+	data, err = os.ReadFile(toPath)
+	require.Nil(t, err)
+	require.Equal(t, []byte("bar"), data)
+	info, err := os.Stat(toPath)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+func TestDownload_VerifyKeepsFile_Memory(t *testing.T) {
+	fs := memfs.New()
+	st := storage_memory.New(fs)
+	putCorrupt(t, st, "corrupt")
+
+	f, err := fs.Create("/out/file")
+	require.Nil(t, err)
+	_, err = f.Write([]byte("old"))
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	require.ErrorIs(t, st.Download("corrupt", "/out/file", storage.WithVerify()), storage.ErrChecksumMismatch)
+	data, err := util.ReadFile(fs, "/out/file")
+	require.Nil(t, err)
+	require.Equal(t, []byte("old"), data)
+	entries, err := fs.ReadDir("/out")
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+
+	require.Nil(t, st.Download("corrupt", "/out/file"))
+	data, err = util.ReadFile(fs, "/out/file")
+	require.Nil(t, err)
+	require.Equal(t, []byte("bar"), data)
+}
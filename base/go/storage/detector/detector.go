@@ -19,23 +19,178 @@ import (
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 	"go.resf.org/peridot/base/go/storage"
+	storage_cache "go.resf.org/peridot/base/go/storage/cache"
+	storage_fs "go.resf.org/peridot/base/go/storage/fs"
 	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	storage_mirror "go.resf.org/peridot/base/go/storage/mirror"
 	storage_s3 "go.resf.org/peridot/base/go/storage/s3"
 	"net/url"
+	"strings"
 )
 
-func FromFlags(ctx *cli.Context) (storage.Storage, error) {
-	parsedURI, err := url.Parse(ctx.String("storage-connection-string"))
+// SignerFromFlags returns the signer for file and memory storage URLs,
+// or nil if storage-signing-url is not set.
+func SignerFromFlags(ctx *cli.Context) (*storage.HMACSigner, error) {
+	signingURL := ctx.String("storage-signing-url")
+	if signingURL == "" {
+		return nil, nil
+	}
+
+	return storage.NewHMACSigner(signingURL, []byte(ctx.String("storage-signing-key")))
+}
+
+// FromFlags returns the storage backend configured by the storage flags.
+// If mirrors are configured, writes are mirrored to them, and if a cache
+// directory is configured, reads are cached on disk.
+//
+// The returned function must be called before exiting, it waits for background
+// mirror copies and removes the cached files.
+func FromFlags(ctx *cli.Context) (storage.Storage, func() error, error) {
+	st, err := FromConnectionString(ctx, ctx.String("storage-connection-string"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Closed in reverse order, so the cache is closed before the mirror below it.
+	var closers []func() error
+	closeAll := func() error {
+		var firstErr error
+		for i := len(closers) - 1; i >= 0; i-- {
+			err := closers[i]()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	mirrorConnectionStrings := ctx.StringSlice("storage-mirror-connection-strings")
+	if len(mirrorConnectionStrings) > 0 {
+		var consistency storage_mirror.Consistency
+		switch ctx.String("storage-mirror-consistency") {
+		case "all":
+			consistency = storage_mirror.ConsistencyAll
+		case "primary":
+			consistency = storage_mirror.ConsistencyPrimary
+		default:
+			return nil, nil, errors.Errorf("unknown storage mirror consistency: %s", ctx.String("storage-mirror-consistency"))
+		}
+
+		var secondaries []storage.Storage
+		for _, connectionString := range mirrorConnectionStrings {
+			secondary, err := FromConnectionString(ctx, connectionString)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to create storage mirror")
+			}
+			secondaries = append(secondaries, secondary)
+		}
+		mirror := storage_mirror.New(st, secondaries, storage_mirror.WithConsistency(consistency))
+		closers = append(closers, func() error {
+			mirror.Close()
+			return nil
+		})
+		st = mirror
+	}
+
+	if cacheDir := ctx.String("storage-cache-dir"); cacheDir != "" {
+		cache, err := storage_cache.New(st, cacheDir, ctx.Int64("storage-cache-size-mb")*1024*1024)
+		if err != nil {
+			_ = closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, cache.Close)
+		st = cache
+	}
+
+	return st, closeAll, nil
+}
+
+// DefaultBackend is the name the backend configured by FromFlags is registered under.
+const DefaultBackend = "default"
+
+// RegistryFromFlags returns a registry with the backend configured by FromFlags
+// registered as DefaultBackend, followed by the backends in storage-backends.
+// URIs are resolved by the first backend that can read them.
+// The returned function must be called before exiting, see FromFlags.
+func RegistryFromFlags(ctx *cli.Context) (*storage.Registry, func() error, error) {
+	registry := storage.NewRegistry()
+
+	st, closer, err := FromFlags(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = registry.Register(DefaultBackend, st)
+	if err != nil {
+		_ = closer()
+		return nil, nil, err
+	}
+
+	for _, backend := range ctx.StringSlice("storage-backends") {
+		name, connectionString, ok := strings.Cut(backend, "=")
+		if !ok || name == "" {
+			_ = closer()
+			return nil, nil, errors.Errorf("invalid storage backend %s, expected name=connection-string", backend)
+		}
+
+		st, err := FromConnectionString(ctx, connectionString)
+		if err != nil {
+			_ = closer()
+			return nil, nil, errors.Wrapf(err, "failed to create storage backend %s", name)
+		}
+		err = registry.Register(name, st)
+		if err != nil {
+			_ = closer()
+			return nil, nil, err
+		}
+	}
+
+	return registry, closer, nil
+}
+
+// FromConnectionString returns a single storage backend, using the other storage flags
+// for its configuration.
+func FromConnectionString(ctx *cli.Context, connectionString string) (storage.Storage, error) {
+	parsedURI, err := url.Parse(connectionString)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse storage connection string")
 	}
 
+	var st storage.Storage
 	switch parsedURI.Scheme {
 	case "s3":
-		return storage_s3.FromFlags(ctx)
+		// S3 presigns URLs itself.
+		return storage_s3.FromConnectionString(ctx, connectionString)
+	case "file":
+		// file:///var/lib/storage, or file:///var/lib/storage?versioning=true to keep old versions
+		if parsedURI.Path == "" {
+			return nil, errors.New("file connection string is missing the path")
+		}
+		var opts []storage_fs.Option
+		if parsedURI.Query().Get("versioning") == "true" {
+			opts = append(opts, storage_fs.WithVersioning())
+		}
+		st, err = storage_fs.New(parsedURI.Path, opts...)
+		if err != nil {
+			return nil, err
+		}
 	case "memory":
-		return storage_memory.New(osfs.New("/")), nil
+		// memory://, or memory://?versioning=true to keep old versions
+		var opts []storage_memory.Option
+		if parsedURI.Query().Get("versioning") == "true" {
+			opts = append(opts, storage_memory.WithVersioning())
+		}
+		st = storage_memory.New(osfs.New("/"), opts...)
 	default:
 		return nil, errors.Errorf("unknown storage scheme: %s", parsedURI.Scheme)
 	}
+
+	signer, err := SignerFromFlags(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create URL signer")
+	}
+	if signer != nil {
+		st = storage.Signed(st, signer)
+	}
+
+	return st, nil
 }
@@ -0,0 +1,470 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage_fake is a storage.Storage for tests, that records every call
+// and can be scripted to fail.
+//
+//	st := storage_fake.New()
+//	st.Inject("Put", storage_fake.WithError(errors.New("unavailable")), storage_fake.WithTimes(2))
+//
+// makes the first two calls to Put fail, after which Put works as usual.
+// Calls that don't fail are passed to a real backend, in memory by default.
+package storage_fake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/go-git/go-billy/v5/memfs"
+	"go.resf.org/peridot/base/go/fault"
+	"go.resf.org/peridot/base/go/storage"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"io"
+	"os"
+	"time"
+)
+
+// Call is a recorded call to the fake.
+type Call struct {
+	Method string
+	Object string
+	// Err is the error the call returned.
+	// For Create, it is the error of creating the writer, not of writing to it.
+	Err error
+}
+
+// Fault is a scripted failure, see Fake.Inject.
+type Fault struct {
+	rule         fault.Rule
+	partialWrite int64
+}
+
+type FaultOption func(*Fault)
+
+// WithError makes matching calls return err.
+func WithError(err error) FaultOption {
+	return func(f *Fault) {
+		f.rule.Err = err
+	}
+}
+
+// WithNotFound makes matching calls return storage.ErrNotFound.
+func WithNotFound() FaultOption {
+	return WithError(storage.ErrNotFound)
+}
+
+// WithLatency delays matching calls, or until the context of the call is cancelled.
+// Without an error, delayed calls succeed.
+func WithLatency(latency time.Duration) FaultOption {
+	return func(f *Fault) {
+		f.rule.Latency = latency
+	}
+}
+
+// WithAfter lets the first n matching calls through, the fault triggers from the next one.
+func WithAfter(n int) FaultOption {
+	return func(f *Fault) {
+		f.rule.After = n
+	}
+}
+
+// WithTimes stops the fault after it triggered n times.
+// By default it keeps triggering.
+func WithTimes(n int) FaultOption {
+	return func(f *Fault) {
+		f.rule.Times = n
+	}
+}
+
+// WithObjectPrefix only matches calls for objects starting with prefix.
+func WithObjectPrefix(prefix string) FaultOption {
+	return func(f *Fault) {
+		f.rule.Prefix = prefix
+	}
+}
+
+// WithPartialWrite makes writes (Create, Put and PutBytes) of more than n bytes store
+// only the first n bytes, and then fail with the error of the fault, or io.ErrUnexpectedEOF if none is set.
+// This simulates a backend that keeps a truncated object when an upload breaks.
+// The truncated object is stored even if the writer is then aborted, as storage.Upload does.
+func WithPartialWrite(n int64) FaultOption {
+	return func(f *Fault) {
+		f.partialWrite = n
+	}
+}
+
+// Fake is a storage.Storage that records every call and fails as scripted.
+// Fake is safe for concurrent use.
+type Fake struct {
+	st storage.Storage
+
+	script *fault.Script[*Fault, *Call]
+}
+
+// New returns a fake backed by an in-memory backend.
+func New() *Fake {
+	return Wrap(storage_memory.New(memfs.New()))
+}
+
+// Wrap returns a fake that passes calls to st.
+func Wrap(st storage.Storage) *Fake {
+	return &Fake{
+		st: st,
+		script: fault.NewScript[*Fault, *Call](func(f *Fault) *fault.Rule {
+			return &f.rule
+		}),
+	}
+}
+
+// Inject adds a fault for calls to method, which is the name of a storage.Storage
+// method ("Get", "Put" etc.), or empty to match every method.
+// If several faults match a call, the one injected first is used.
+func (f *Fake) Inject(method string, opts ...FaultOption) *Fault {
+	fault := &Fault{
+		partialWrite: -1,
+	}
+	fault.rule.Method = method
+	for _, opt := range opts {
+		opt(fault)
+	}
+	f.script.Inject(fault)
+
+	return fault
+}
+
+// Triggered returns how many times the fault triggered.
+func (f *Fake) Triggered(fault *Fault) int {
+	return f.script.Triggered(fault)
+}
+
+// ClearFaults removes all faults, recorded calls are kept.
+func (f *Fake) ClearFaults() {
+	f.script.ClearFaults()
+}
+
+// Calls returns the recorded calls, in the order they returned.
+func (f *Fake) Calls() []*Call {
+	return f.script.Calls()
+}
+
+// CallsTo returns the recorded calls to method.
+func (f *Fake) CallsTo(method string) []*Call {
+	return f.script.CallsTo(method)
+}
+
+// CallCount returns the number of recorded calls to method.
+func (f *Fake) CallCount(method string) int {
+	return len(f.CallsTo(method))
+}
+
+// ResetCalls forgets the recorded calls.
+func (f *Fake) ResetCalls() {
+	f.script.ResetCalls()
+}
+
+// before applies the fault for a call, if any.
+// Returns the fault, and the error the call should fail with.
+func (f *Fake) before(ctx context.Context, method string, object string) (*Fault, error) {
+	fault, ok := f.script.Match(method, object)
+	if !ok {
+		return nil, nil
+	}
+
+	err := fault.rule.Wait(ctx)
+	if err != nil {
+		return fault, err
+	}
+	// Partial writes fail after writing.
+	if fault.partialWrite >= 0 {
+		return fault, nil
+	}
+
+	return fault, fault.rule.Err
+}
+
+func (f *Fake) record(method string, object string, err error) {
+	f.script.Record(method, &Call{
+		Method: method,
+		Object: object,
+		Err:    err,
+	})
+}
+
+// partialErr is the error a partial write fails with.
+func (fault *Fault) partialErr() error {
+	if fault.rule.Err != nil {
+		return fault.rule.Err
+	}
+
+	return io.ErrUnexpectedEOF
+}
+
+func (f *Fake) Open(ctx context.Context, object string, opts ...storage.OpenOption) (r io.ReadCloser, stat *storage.Stat, err error) {
+	defer func() { f.record("Open", object, err) }()
+
+	_, err = f.before(ctx, "Open", object)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f.st.Open(ctx, object, opts...)
+}
+
+func (f *Fake) Create(ctx context.Context, object string, opts ...storage.PutOption) (w storage.Writer, err error) {
+	defer func() { f.record("Create", object, err) }()
+
+	fault, err := f.before(ctx, "Create", object)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err = f.st.Create(ctx, object, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil && fault.partialWrite >= 0 {
+		return &partialWriter{
+			Writer:    w,
+			remaining: fault.partialWrite,
+			err:       fault.partialErr(),
+		}, nil
+	}
+
+	return w, nil
+}
+
+// partialWriter stores the first bytes written, then fails.
+type partialWriter struct {
+	storage.Writer
+
+	remaining int64
+	err       error
+	failed    bool
+	closeErr  error
+}
+
+func (w *partialWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return 0, w.err
+	}
+	if int64(len(p)) <= w.remaining {
+		n, err := w.Writer.Write(p)
+		w.remaining -= int64(n)
+		return n, err
+	}
+
+	n, err := w.Writer.Write(p[:w.remaining])
+	w.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	// Store what was written right away, callers abort the writer after a failed
+	// write, which would otherwise discard it.
+	w.failed = true
+	w.closeErr = w.Writer.Close()
+	return n, w.err
+}
+
+// Close stores what was written before the failure, and returns the error of the fault.
+func (w *partialWriter) Close() error {
+	if w.failed {
+		if w.closeErr != nil {
+			return w.closeErr
+		}
+		return w.err
+	}
+
+	return w.Writer.Close()
+}
+
+func (f *Fake) Stat(ctx context.Context, object string) (stat *storage.Stat, err error) {
+	defer func() { f.record("Stat", object, err) }()
+
+	_, err = f.before(ctx, "Stat", object)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.st.Stat(ctx, object)
+}
+
+func (f *Fake) List(ctx context.Context, prefix string, pageToken string, opts ...storage.ListOption) (result *storage.ListResult, err error) {
+	defer func() { f.record("List", prefix, err) }()
+
+	_, err = f.before(ctx, "List", prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.st.List(ctx, prefix, pageToken, opts...)
+}
+
+func (f *Fake) Download(object string, toPath string, opts ...storage.GetOption) (err error) {
+	defer func() { f.record("Download", object, err) }()
+
+	_, err = f.before(context.Background(), "Download", object)
+	if err != nil {
+		return err
+	}
+
+	return f.st.Download(object, toPath, opts...)
+}
+
+func (f *Fake) Get(object string, opts ...storage.GetOption) (data []byte, err error) {
+	defer func() { f.record("Get", object, err) }()
+
+	_, err = f.before(context.Background(), "Get", object)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.st.Get(object, opts...)
+}
+
+func (f *Fake) Put(object string, fromPath string, opts ...storage.PutOption) (info *storage.UploadInfo, err error) {
+	defer func() { f.record("Put", object, err) }()
+
+	fault, err := f.before(context.Background(), "Put", object)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil && fault.partialWrite >= 0 {
+		data, err := os.ReadFile(fromPath)
+		if err != nil {
+			return nil, err
+		}
+		return f.putPartial(object, data, fault, opts...)
+	}
+
+	return f.st.Put(object, fromPath, opts...)
+}
+
+func (f *Fake) PutBytes(object string, data []byte, opts ...storage.PutOption) (info *storage.UploadInfo, err error) {
+	defer func() { f.record("PutBytes", object, err) }()
+
+	fault, err := f.before(context.Background(), "PutBytes", object)
+	if err != nil {
+		return nil, err
+	}
+	if fault != nil && fault.partialWrite >= 0 {
+		return f.putPartial(object, data, fault, opts...)
+	}
+
+	return f.st.PutBytes(object, data, opts...)
+}
+
+// putPartial stores the start of data, and returns the error of the fault.
+// Expected digests are not checked, like a backend that doesn't verify uploads.
+func (f *Fake) putPartial(object string, data []byte, fault *Fault, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	if int64(len(data)) <= fault.partialWrite {
+		return f.st.PutBytes(object, data, opts...)
+	}
+
+	w, err := f.st.Create(context.Background(), object, opts...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, bytes.NewReader(data[:fault.partialWrite]))
+	if err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, fault.partialErr()
+}
+
+func (f *Fake) Delete(object string) (err error) {
+	defer func() { f.record("Delete", object, err) }()
+
+	_, err = f.before(context.Background(), "Delete", object)
+	if err != nil {
+		return err
+	}
+
+	return f.st.Delete(object)
+}
+
+func (f *Fake) Exists(object string) (exists bool, err error) {
+	defer func() { f.record("Exists", object, err) }()
+
+	_, err = f.before(context.Background(), "Exists", object)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Exists reports missing objects without an error.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return f.st.Exists(object)
+}
+
+func (f *Fake) ListVersions(ctx context.Context, prefix string, pageToken string, opts ...storage.ListOption) (result *storage.VersionListResult, err error) {
+	defer func() { f.record("ListVersions", prefix, err) }()
+
+	_, err = f.before(ctx, "ListVersions", prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.st.ListVersions(ctx, prefix, pageToken, opts...)
+}
+
+func (f *Fake) OpenVersion(ctx context.Context, object string, versionID string, opts ...storage.OpenOption) (r io.ReadCloser, stat *storage.Stat, err error) {
+	defer func() { f.record("OpenVersion", object, err) }()
+
+	_, err = f.before(ctx, "OpenVersion", object)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f.st.OpenVersion(ctx, object, versionID, opts...)
+}
+
+func (f *Fake) DeleteVersion(ctx context.Context, object string, versionID string) (err error) {
+	defer func() { f.record("DeleteVersion", object, err) }()
+
+	_, err = f.before(ctx, "DeleteVersion", object)
+	if err != nil {
+		return err
+	}
+
+	return f.st.DeleteVersion(ctx, object, versionID)
+}
+
+func (f *Fake) CanReadURI(uri string) (ok bool, err error) {
+	defer func() { f.record("CanReadURI", uri, err) }()
+
+	_, err = f.before(context.Background(), "CanReadURI", uri)
+	if err != nil {
+		return false, err
+	}
+
+	return f.st.CanReadURI(uri)
+}
+
+func (f *Fake) ObjectFromURI(uri string) (object string, err error) {
+	defer func() { f.record("ObjectFromURI", uri, err) }()
+
+	_, err = f.before(context.Background(), "ObjectFromURI", uri)
+	if err != nil {
+		return "", err
+	}
+
+	return f.st.ObjectFromURI(uri)
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_fake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFake_RecordsCalls(t *testing.T) {
+	f := New()
+
+	_, err := f.PutBytes("foo", []byte("foo"))
+	require.Nil(t, err)
+	_, err = f.Get("foo")
+	require.Nil(t, err)
+	_, err = f.Get("missing")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+
+	calls := f.Calls()
+	require.Len(t, calls, 3)
+	require.Equal(t, &Call{Method: "PutBytes", Object: "foo"}, calls[0])
+	require.Equal(t, &Call{Method: "Get", Object: "missing", Err: storage.ErrNotFound}, calls[2])
+	require.Equal(t, 2, f.CallCount("Get"))
+
+	f.ResetCalls()
+	require.Empty(t, f.Calls())
+}
+
+func TestFake_ErrorAfterCalls(t *testing.T) {
+	f := New()
+	unavailable := errors.New("unavailable")
+	fault := f.Inject("PutBytes", WithError(unavailable), WithAfter(1), WithTimes(2))
+
+	for i, expected := range []error{nil, unavailable, unavailable, nil} {
+		_, err := f.PutBytes(fmt.Sprintf("foo-%d", i), []byte("foo"))
+		require.Equal(t, expected, err, i)
+	}
+	require.Equal(t, 2, f.Triggered(fault))
+
+	// Failed writes don't store anything.
+	exists, err := f.Exists("foo-1")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestFake_NotFound(t *testing.T) {
+	f := New()
+	_, err := f.PutBytes("kernels/foo", []byte("foo"))
+	require.Nil(t, err)
+	_, err = f.PutBytes("other/foo", []byte("foo"))
+	require.Nil(t, err)
+
+	f.Inject("", WithNotFound(), WithObjectPrefix("kernels/"))
+
+	_, err = f.Get("kernels/foo")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+	_, _, err = f.Open(context.Background(), "kernels/foo")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+	exists, err := f.Exists("kernels/foo")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	_, err = f.Get("other/foo")
+	require.Nil(t, err)
+
+	f.ClearFaults()
+	_, err = f.Get("kernels/foo")
+	require.Nil(t, err)
+}
+
+func TestFake_Latency(t *testing.T) {
+	f := New()
+	f.Inject("Stat", WithLatency(50*time.Millisecond))
+	_, err := f.PutBytes("foo", []byte("foo"))
+	require.Nil(t, err)
+
+	start := time.Now()
+	_, err = f.Stat(context.Background(), "foo")
+	require.Nil(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// Delays end when the context is cancelled.
+	f.ClearFaults()
+	f.Inject("Stat", WithLatency(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = f.Stat(ctx, "foo")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestFake_PartialWrite(t *testing.T) {
+	ctx := context.Background()
+	f := New()
+	f.Inject("PutBytes", WithPartialWrite(3))
+
+	_, err := f.PutBytes("foo", []byte("foobar"))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	data, err := f.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("foo"), data)
+
+	// Small enough writes succeed.
+	_, err = f.PutBytes("bar", []byte("bar"))
+	require.Nil(t, err)
+
+	broken := errors.New("connection reset")
+	f.Inject("Create", WithPartialWrite(2), WithError(broken))
+	w, err := f.Create(ctx, "baz")
+	require.Nil(t, err)
+	n, err := w.Write([]byte("bazbaz"))
+	require.Equal(t, 2, n)
+	require.ErrorIs(t, err, broken)
+	require.ErrorIs(t, w.Close(), broken)
+	data, err = f.Get("baz")
+	require.Nil(t, err)
+	require.Equal(t, []byte("ba"), data)
+
+	// The truncated object is kept even though Upload aborts the writer.
+	f.ClearFaults()
+	f.Inject("Create", WithPartialWrite(3))
+	_, err = storage.Upload(ctx, f, "upload", bytes.NewReader([]byte("uploaded")))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	data, err = f.Get("upload")
+	require.Nil(t, err)
+	require.Equal(t, []byte("upl"), data)
+}
+
+func TestFake_Concurrent(t *testing.T) {
+	f := New()
+	f.Inject("PutBytes", WithError(errors.New("unavailable")), WithTimes(10))
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var failed int
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := f.PutBytes(fmt.Sprintf("foo-%d", i), []byte("foo"))
+			if err != nil {
+				lock.Lock()
+				failed++
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, 10, failed)
+	require.Equal(t, 50, f.CallCount("PutBytes"))
+}
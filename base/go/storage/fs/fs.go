@@ -0,0 +1,634 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.resf.org/peridot/base/go/storage"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var ErrInvalidName = errors.New("invalid object name")
+
+// FS is an implementation of the Storage interface for a local directory.
+//
+// The root directory contains:
+//   - objects/ with the contents of every object, at its name
+//   - metadata/ with a JSON sidecar for every object, containing its metadata
+//   - tmp/ with uploads in progress
+//   - versions/ with the noncurrent versions of every object, if versioning is enabled
+//
+// Writes go to a temporary file that is renamed into place once complete,
+// so readers never see a partially written object, even after a crash.
+//
+// Object names are paths below objects/, so an object can't be named like the
+// "directory" of other objects: with an object "a", writing "a/b" fails with
+// ErrInvalidName, and the other way around.
+type FS struct {
+	storage.Storage
+
+	root       string
+	versioning bool
+	// lock makes sure the object and its sidecar are replaced together,
+	// and that readers see them together.
+	lock sync.RWMutex
+}
+
+// sidecar is the metadata stored next to an object.
+type sidecar struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	SHA256      string            `json:"sha256"`
+	ETag        string            `json:"etag"`
+	VersionID   string            `json:"version_id"`
+	// DeleteMarker is only set on noncurrent versions, for deletes.
+	DeleteMarker bool `json:"delete_marker,omitempty"`
+}
+
+type Option func(*FS)
+
+// WithVersioning keeps the previous version of an object when it is overwritten or deleted,
+// like a versioned S3 bucket. Old versions are kept until deleted with DeleteVersion,
+// or by storage.ApplyRetention.
+func WithVersioning() Option {
+	return func(f *FS) {
+		f.versioning = true
+	}
+}
+
+// New creates a new local filesystem storage backend, storing objects under root.
+// The root directory is created if it doesn't exist.
+func New(root string, opts ...Option) (*FS, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range []string{"objects", "metadata", "tmp", "versions"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create storage directory")
+		}
+	}
+
+	f := &FS{
+		root: root,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f, nil
+}
+
+// paths returns the path of an object and of its sidecar.
+// Object names are slash separated, and may not escape the root directory.
+func (f *FS) paths(object string) (string, string, error) {
+	if object == "" || object == "." || strings.HasPrefix(object, "/") || path.Clean(object) != object || object == ".." || strings.HasPrefix(object, "../") {
+		return "", "", ErrInvalidName
+	}
+
+	return filepath.Join(f.root, "objects", filepath.FromSlash(object)),
+		filepath.Join(f.root, "metadata", filepath.FromSlash(object)+".json"), nil
+}
+
+// checkClash returns ErrInvalidName if an object would be stored below another object,
+// or at the directory of other objects. The lock must be held.
+// Deleted objects leave their empty directories behind, these are removed.
+func (f *FS) checkClash(object string, objectPath string) error {
+	info, err := os.Stat(objectPath)
+	if err == nil && info.IsDir() {
+		entries, err := os.ReadDir(objectPath)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return errors.Wrapf(ErrInvalidName, "%s: objects with names starting with %s/ exist", object, object)
+		}
+		err = os.Remove(objectPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	objectsRoot := filepath.Join(f.root, "objects")
+	for dir := filepath.Dir(objectPath); dir != objectsRoot; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			// An object further up makes the path "not a directory", it is found next.
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				continue
+			}
+			return err
+		}
+		if !info.IsDir() {
+			rel, err := filepath.Rel(objectsRoot, dir)
+			if err != nil {
+				return err
+			}
+			return errors.Wrapf(ErrInvalidName, "%s: object %s exists", object, filepath.ToSlash(rel))
+		}
+	}
+
+	return nil
+}
+
+func (f *FS) readSidecar(metaPath string) (*sidecar, error) {
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Objects copied into the directory by hand have no sidecar.
+			return &sidecar{}, nil
+		}
+		return nil, err
+	}
+
+	var sc sidecar
+	err = json.Unmarshal(data, &sc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse metadata")
+	}
+
+	return &sc, nil
+}
+
+func (f *FS) stat(objectPath string, metaPath string) (*storage.Stat, error) {
+	info, err := os.Stat(objectPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, storage.ErrNotFound
+	}
+
+	sc, err := f.readSidecar(metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.Stat{
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ETag:         sc.ETag,
+		SHA256:       sc.SHA256,
+		ContentType:  sc.ContentType,
+		VersionID:    sc.VersionID,
+		Metadata:     sc.Metadata,
+	}, nil
+}
+
+// readCloser reads a range of a file, and closes the file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (f *FS) Open(ctx context.Context, object string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	objectPath, metaPath, err := f.paths(object)
+	if err != nil {
+		return nil, nil, err
+	}
+	o := storage.NewOpenOptions(opts...)
+
+	// The open file keeps its contents if the object is replaced, so the lock
+	// is only needed until the file matching the sidecar is open.
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	stat, err := f.stat(objectPath, metaPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return openFile(objectPath, stat, o)
+}
+
+// openFile opens a file for reading, only reading the range in o.
+func openFile(p string, stat *storage.Stat, o *storage.OpenOptions) (io.ReadCloser, *storage.Stat, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, storage.ErrNotFound
+		}
+		return nil, nil, err
+	}
+	if !o.IsRange() {
+		return file, stat, nil
+	}
+
+	// Match S3, which rejects ranges starting at or after the end.
+	if o.Offset >= stat.Size {
+		_ = file.Close()
+		return nil, nil, storage.ErrInvalidRange
+	}
+	_, err = file.Seek(o.Offset, io.SeekStart)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+
+	var r io.Reader = file
+	if o.Length > 0 {
+		r = io.LimitReader(file, o.Length)
+	}
+	return &readCloser{Reader: r, Closer: file}, stat, nil
+}
+
+// fsWriter writes to a temporary file, which is renamed into place on Close.
+type fsWriter struct {
+	ctx      context.Context
+	f        *FS
+	object   string
+	opts     *storage.PutOptions
+	tmp      *os.File
+	w        io.Writer
+	md5Sum   hash.Hash
+	sha256   hash.Hash
+	info     *storage.UploadInfo
+	closed   bool
+	closeErr error
+}
+
+func (f *FS) Create(ctx context.Context, object string, opts ...storage.PutOption) (storage.Writer, error) {
+	_, _, err := f.paths(object)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(f.root, "tmp"), "upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	md5Sum := md5.New()
+	sha256Sum := sha256.New()
+	return &fsWriter{
+		ctx:    ctx,
+		f:      f,
+		object: object,
+		opts:   storage.NewPutOptions(opts...),
+		tmp:    tmp,
+		w:      io.MultiWriter(tmp, md5Sum, sha256Sum),
+		md5Sum: md5Sum,
+		sha256: sha256Sum,
+	}, nil
+}
+
+func (w *fsWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+func (w *fsWriter) Close() error {
+	if w.closed {
+		return w.closeErr
+	}
+	w.closed = true
+	w.closeErr = w.commit()
+
+	return w.closeErr
+}
+
+func (w *fsWriter) commit() error {
+	// The temporary file is renamed on success, so this only cleans up after failures.
+	defer os.Remove(w.tmp.Name())
+
+	// A cancelled context aborts the upload.
+	if err := w.ctx.Err(); err != nil {
+		_ = w.tmp.Close()
+		return err
+	}
+
+	// Make sure the contents are on disk before the object becomes visible.
+	err := w.tmp.Sync()
+	if err != nil {
+		_ = w.tmp.Close()
+		return err
+	}
+	err = w.tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	versionID, err := storage.NewVersionID()
+	if err != nil {
+		return err
+	}
+	sc := &sidecar{
+		ContentType: w.opts.ContentType,
+		Metadata:    storage.LowerMetadata(w.opts.Metadata),
+		SHA256:      hex.EncodeToString(w.sha256.Sum(nil)),
+		ETag:        fmt.Sprintf("\"%s\"", hex.EncodeToString(w.md5Sum.Sum(nil))),
+		VersionID:   versionID,
+	}
+
+	objectPath, metaPath, err := w.f.paths(w.object)
+	if err != nil {
+		return err
+	}
+
+	w.f.lock.Lock()
+	defer w.f.lock.Unlock()
+
+	err = w.f.checkClash(w.object, objectPath)
+	if err != nil {
+		return err
+	}
+
+	if w.f.versioning {
+		_, err = w.f.archive(w.object, objectPath, metaPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Replace the object first, so a failure in between never leaves
+	// metadata describing contents that were never written.
+	err = os.MkdirAll(filepath.Dir(objectPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(w.tmp.Name(), objectPath)
+	if err != nil {
+		return err
+	}
+	err = w.f.writeSidecar(metaPath, sc)
+	if err != nil {
+		return err
+	}
+
+	w.info = &storage.UploadInfo{
+		Location:  "file://" + objectPath,
+		VersionID: &versionID,
+	}
+	return nil
+}
+
+func (w *fsWriter) Info() *storage.UploadInfo {
+	return w.info
+}
+
+// writeSidecar atomically replaces the sidecar of an object.
+func (f *FS) writeSidecar(metaPath string, sc *sidecar) error {
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(f.root, "tmp"), "metadata-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(metaPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), metaPath)
+}
+
+// Download downloads a file from the storage backend to the given path.
+func (f *FS) Download(object string, toPath string, opts ...storage.GetOption) error {
+	return storage.DownloadTo(context.Background(), f, object, toPath, opts...)
+}
+
+// Get returns the contents of a file from the storage backend.
+func (f *FS) Get(object string, opts ...storage.GetOption) ([]byte, error) {
+	return storage.ReadAll(context.Background(), f, object, opts...)
+}
+
+// Put uploads a file to the storage backend.
+func (f *FS) Put(object string, fromPath string, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	file, err := os.Open(fromPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return storage.Upload(context.Background(), f, object, file, opts...)
+}
+
+// PutBytes uploads a file to the storage backend.
+func (f *FS) PutBytes(object string, data []byte, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	return storage.Upload(context.Background(), f, object, bytes.NewReader(data), opts...)
+}
+
+// Stat returns information about a file.
+func (f *FS) Stat(ctx context.Context, object string) (*storage.Stat, error) {
+	objectPath, metaPath, err := f.paths(object)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.stat(objectPath, metaPath)
+}
+
+// List returns a page of files starting with prefix.
+// Page tokens are the last name of the previous page.
+func (f *FS) List(ctx context.Context, prefix string, pageToken string, opts ...storage.ListOption) (*storage.ListResult, error) {
+	o := storage.NewListOptions(opts...)
+
+	var after string
+	if pageToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, errors.New("invalid page token")
+		}
+		after = string(decoded)
+	}
+
+	// Only walk the directory the prefix is in.
+	objectsDir := filepath.Join(f.root, "objects")
+	walkDir := objectsDir
+	if idx := strings.LastIndex(prefix, "/"); idx != -1 {
+		walkDir = filepath.Join(objectsDir, filepath.FromSlash(prefix[:idx]))
+	}
+
+	var objects []*storage.Object
+	err := filepath.WalkDir(walkDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(objectsDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) || name <= after {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, &storage.Object{
+			Name:         name,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// WalkDir sorts by path element, which isn't the same as sorting by name.
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	result := &storage.ListResult{
+		Objects: objects,
+	}
+	if len(objects) > o.PageSize {
+		result.Objects = objects[:o.PageSize]
+		result.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(result.Objects[o.PageSize-1].Name))
+	}
+
+	// The ETag is in the sidecar, only read it for the returned objects.
+	for _, object := range result.Objects {
+		_, metaPath, err := f.paths(object.Name)
+		if err != nil {
+			return nil, err
+		}
+		sc, err := f.readSidecar(metaPath)
+		if err != nil {
+			return nil, err
+		}
+		object.ETag = sc.ETag
+	}
+
+	return result, nil
+}
+
+// Delete deletes a file from the storage backend.
+func (f *FS) Delete(object string) error {
+	objectPath, metaPath, err := f.paths(object)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.versioning {
+		archived, err := f.archive(object, objectPath, metaPath)
+		if err != nil {
+			return err
+		}
+		if !archived {
+			return storage.ErrNotFound
+		}
+		return f.writeDeleteMarker(object)
+	}
+
+	err = os.Remove(objectPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storage.ErrNotFound
+		}
+		return err
+	}
+
+	err = os.Remove(metaPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Exists checks if a file exists in the storage backend.
+func (f *FS) Exists(object string) (bool, error) {
+	_, err := f.Stat(context.Background(), object)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CanReadURI checks if a URI can be read by the storage backend.
+// Only URIs pointing into the objects directory can be read.
+func (f *FS) CanReadURI(uri string) (bool, error) {
+	return strings.HasPrefix(uri, f.uriPrefix()), nil
+}
+
+// ObjectFromURI returns the object a file:// URI in the objects directory points to.
+func (f *FS) ObjectFromURI(uri string) (string, error) {
+	if !strings.HasPrefix(uri, f.uriPrefix()) {
+		return "", storage.ErrUnsupportedURI
+	}
+
+	object := strings.TrimPrefix(uri, f.uriPrefix())
+	_, _, err := f.paths(object)
+	if err != nil {
+		return "", storage.ErrUnsupportedURI
+	}
+
+	return object, nil
+}
+
+func (f *FS) uriPrefix() string {
+	return "file://" + filepath.ToSlash(filepath.Join(f.root, "objects")) + "/"
+}
@@ -0,0 +1,390 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_fs
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newFS(t *testing.T) *FS {
+	f, err := New(t.TempDir())
+	require.Nil(t, err)
+	return f
+}
+
+func TestFS_PutGet(t *testing.T) {
+	f := newFS(t)
+
+	info, err := f.PutBytes("kernels/lt/kernel.tar.xz", []byte("bar"))
+	require.Nil(t, err)
+	require.NotNil(t, info.VersionID)
+
+	blob, err := f.Get("kernels/lt/kernel.tar.xz")
+	require.Nil(t, err)
+	require.Equal(t, []byte("bar"), blob)
+
+	ok, err := f.CanReadURI(info.Location)
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	// Persisted, so a new instance sees the object.
+	reopened, err := New(f.root)
+	require.Nil(t, err)
+	blob, err = reopened.Get("kernels/lt/kernel.tar.xz")
+	require.Nil(t, err)
+	require.Equal(t, []byte("bar"), blob)
+
+	_, err = f.Get("missing")
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestFS_PutDownload(t *testing.T) {
+	f := newFS(t)
+	dir := t.TempDir()
+
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "in"), []byte("bar"), 0644))
+	_, err := f.Put("foo", filepath.Join(dir, "in"))
+	require.Nil(t, err)
+
+	require.Nil(t, f.Download("foo", filepath.Join(dir, "out")))
+	blob, err := os.ReadFile(filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("bar"), blob)
+
+	// A missing object doesn't create the file.
+	require.Equal(t, storage.ErrNotFound, f.Download("missing", filepath.Join(dir, "missing")))
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFS_OpenRange(t *testing.T) {
+	f := newFS(t)
+	_, err := f.PutBytes("foo", []byte("0123456789"))
+	require.Nil(t, err)
+
+	r, stat, err := f.Open(context.Background(), "foo", storage.WithRange(2, 3))
+	require.Nil(t, err)
+	require.Equal(t, int64(10), stat.Size)
+	blob, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Nil(t, r.Close())
+	require.Equal(t, []byte("234"), blob)
+
+	r, _, err = f.Open(context.Background(), "foo", storage.WithRange(8, 0))
+	require.Nil(t, err)
+	blob, err = io.ReadAll(r)
+	require.Nil(t, err)
+	require.Nil(t, r.Close())
+	require.Equal(t, []byte("89"), blob)
+
+	_, _, err = f.Open(context.Background(), "foo", storage.WithRange(10, 0))
+	require.Equal(t, storage.ErrInvalidRange, err)
+}
+
+func TestFS_Stat(t *testing.T) {
+	f := newFS(t)
+	_, err := f.PutBytes("foo", []byte("bar"), storage.WithContentType("text/plain"), storage.WithMetadata(map[string]string{"Kernel": "lt"}))
+	require.Nil(t, err)
+
+	stat, err := f.Stat(context.Background(), "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), stat.Size)
+	require.Equal(t, "text/plain", stat.ContentType)
+	require.Equal(t, map[string]string{"kernel": "lt"}, stat.Metadata)
+	require.Equal(t, "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9", stat.SHA256)
+	require.Equal(t, "\"37b51d194a7513e45b56f6524f2d51f2\"", stat.ETag)
+	require.NotEmpty(t, stat.VersionID)
+	require.False(t, stat.LastModified.IsZero())
+
+	// Overwriting creates a new version.
+	_, err = f.PutBytes("foo", []byte("baz"))
+	require.Nil(t, err)
+	next, err := f.Stat(context.Background(), "foo")
+	require.Nil(t, err)
+	require.Greater(t, next.VersionID, stat.VersionID)
+	require.Empty(t, next.ContentType)
+
+	_, err = f.Stat(context.Background(), "missing")
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestFS_VerifyCorrupted(t *testing.T) {
+	f := newFS(t)
+
+	_, err := f.PutBytes("foo", []byte("foo"))
+	require.Nil(t, err)
+
+	// The checksum is recorded on write, so changes on disk are detected.
+	objectPath, _, err := f.paths("foo")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(objectPath, []byte("bar"), 0644))
+
+	_, err = f.Get("foo", storage.WithVerify())
+	require.ErrorIs(t, err, storage.ErrChecksumMismatch)
+	err = f.Download("foo", filepath.Join(t.TempDir(), "foo"), storage.WithVerify())
+	require.ErrorIs(t, err, storage.ErrChecksumMismatch)
+}
+
+func TestFS_CreateCancelled(t *testing.T) {
+	f := newFS(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := f.Create(ctx, "foo")
+	require.Nil(t, err)
+	_, err = w.Write([]byte("partial"))
+	require.Nil(t, err)
+	cancel()
+	require.Equal(t, context.Canceled, w.Close())
+
+	ok, err := f.Exists("foo")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Join(f.root, "tmp"))
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
+
+func TestFS_ConcurrentWrites(t *testing.T) {
+	f := newFS(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := f.PutBytes("foo", []byte(fmt.Sprintf("value-%02d", i)))
+			require.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	// The object is one of the complete writes.
+	blob, err := f.Get("foo")
+	require.Nil(t, err)
+	require.Len(t, blob, len("value-00"))
+}
+
+func TestFS_ConcurrentReadsAndWrites(t *testing.T) {
+	f := newFS(t)
+
+	_, err := f.PutBytes("foo", []byte("value-00"))
+	require.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, err := f.PutBytes("foo", []byte(fmt.Sprintf("value-%02d", i)))
+			require.Nil(t, err)
+		}(i)
+		go func() {
+			defer wg.Done()
+			// Readers never see the metadata of one write with the contents of another.
+			_, err := f.Get("foo", storage.WithVerify())
+			require.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFS_List(t *testing.T) {
+	f := newFS(t)
+	for _, name := range []string{"a/3", "a/1", "a-b", "a/2/x", "b/1"} {
+		_, err := f.PutBytes(name, []byte(name))
+		require.Nil(t, err)
+	}
+
+	res, err := f.List(context.Background(), "a", "", storage.WithPageSize(2))
+	require.Nil(t, err)
+	require.Len(t, res.Objects, 2)
+	require.Equal(t, "a-b", res.Objects[0].Name)
+	require.Equal(t, "a/1", res.Objects[1].Name)
+	require.NotEmpty(t, res.Objects[0].ETag)
+	require.NotEmpty(t, res.NextPageToken)
+
+	res, err = f.List(context.Background(), "a", res.NextPageToken, storage.WithPageSize(2))
+	require.Nil(t, err)
+	require.Len(t, res.Objects, 2)
+	require.Equal(t, "a/2/x", res.Objects[0].Name)
+	require.Equal(t, "a/3", res.Objects[1].Name)
+	require.Empty(t, res.NextPageToken)
+
+	res, err = f.List(context.Background(), "a/2/", "")
+	require.Nil(t, err)
+	require.Len(t, res.Objects, 1)
+
+	res, err = f.List(context.Background(), "missing/", "")
+	require.Nil(t, err)
+	require.Empty(t, res.Objects)
+}
+
+func TestFS_Delete(t *testing.T) {
+	f := newFS(t)
+	_, err := f.PutBytes("foo", []byte("bar"))
+	require.Nil(t, err)
+
+	require.Nil(t, f.Delete("foo"))
+	require.Equal(t, storage.ErrNotFound, f.Delete("foo"))
+	_, err = f.Stat(context.Background(), "foo")
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestFS_InvalidNames(t *testing.T) {
+	f := newFS(t)
+
+	for _, name := range []string{"", ".", "/foo", "../foo", "foo/../../bar", "foo/", "foo//bar"} {
+		_, err := f.PutBytes(name, []byte("bar"))
+		require.Equal(t, ErrInvalidName, err, name)
+	}
+}
+
+func TestFS_NameClash(t *testing.T) {
+	f := newFS(t)
+
+	_, err := f.PutBytes("a", []byte("a"))
+	require.Nil(t, err)
+	_, err = f.PutBytes("a/b", []byte("b"))
+	require.ErrorIs(t, err, ErrInvalidName)
+	_, err = f.PutBytes("a/b/c", []byte("c"))
+	require.ErrorIs(t, err, ErrInvalidName)
+
+	_, err = f.PutBytes("x/y", []byte("y"))
+	require.Nil(t, err)
+	_, err = f.PutBytes("x", []byte("x"))
+	require.ErrorIs(t, err, ErrInvalidName)
+
+	// The objects that were there are kept.
+	data, err := f.Get("a")
+	require.Nil(t, err)
+	require.Equal(t, []byte("a"), data)
+	data, err = f.Get("x/y")
+	require.Nil(t, err)
+	require.Equal(t, []byte("y"), data)
+
+	// Once the other objects are deleted, the name can be used.
+	require.Nil(t, f.Delete("x/y"))
+	_, err = f.PutBytes("x", []byte("x"))
+	require.Nil(t, err)
+	require.Nil(t, f.Delete("a"))
+	_, err = f.PutBytes("a/b", []byte("b"))
+	require.Nil(t, err)
+}
+
+func TestFS_Versions(t *testing.T) {
+	ctx := context.Background()
+	f, err := New(t.TempDir(), WithVersioning())
+	require.Nil(t, err)
+
+	v1, err := f.PutBytes("kernels/foo", []byte("1"), storage.WithContentType("text/plain"))
+	require.Nil(t, err)
+	v2, err := f.PutBytes("kernels/foo", []byte("22"))
+	require.Nil(t, err)
+	_, err = f.PutBytes("kernels/other", []byte("other"))
+	require.Nil(t, err)
+
+	versions, err := storage.ObjectVersions(ctx, f, "kernels/foo")
+	require.Nil(t, err)
+	require.Len(t, versions, 2)
+	require.Equal(t, *v2.VersionID, versions[0].VersionID)
+	require.True(t, versions[0].IsLatest)
+	require.Equal(t, int64(2), versions[0].Size)
+	require.Equal(t, *v1.VersionID, versions[1].VersionID)
+	require.False(t, versions[1].IsLatest)
+
+	r, stat, err := f.OpenVersion(ctx, "kernels/foo", *v1.VersionID, storage.WithRange(0, 1))
+	require.Nil(t, err)
+	data, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Nil(t, r.Close())
+	require.Equal(t, []byte("1"), data)
+	require.Equal(t, "text/plain", stat.ContentType)
+	require.Equal(t, *v1.VersionID, stat.VersionID)
+
+	// Deletes leave a delete marker.
+	require.Nil(t, f.Delete("kernels/foo"))
+	require.ErrorIs(t, f.Delete("kernels/foo"), storage.ErrNotFound)
+	_, err = f.Get("kernels/foo")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+
+	list, err := f.ListVersions(ctx, "kernels/", "", storage.WithPageSize(2))
+	require.Nil(t, err)
+	require.Len(t, list.Versions, 2)
+	require.True(t, list.Versions[0].IsDeleteMarker)
+	require.True(t, list.Versions[0].IsLatest)
+	marker := list.Versions[0].VersionID
+	_, _, err = f.OpenVersion(ctx, "kernels/foo", marker)
+	require.ErrorIs(t, err, storage.ErrNotFound)
+
+	list, err = f.ListVersions(ctx, "kernels/", list.NextPageToken, storage.WithPageSize(2))
+	require.Nil(t, err)
+	require.Len(t, list.Versions, 2)
+	require.Equal(t, *v1.VersionID, list.Versions[0].VersionID)
+	require.Equal(t, "kernels/other", list.Versions[1].Name)
+	require.Empty(t, list.NextPageToken)
+
+	// Restoring a version writes it again.
+	_, err = storage.RestoreVersion(ctx, f, "kernels/foo", *v1.VersionID)
+	require.Nil(t, err)
+	data, err = f.Get("kernels/foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("1"), data)
+	versions, err = storage.ObjectVersions(ctx, f, "kernels/foo")
+	require.Nil(t, err)
+	require.Len(t, versions, 4)
+
+	// Deleting the current version makes the previous one current, unless it's a delete marker.
+	require.Nil(t, f.DeleteVersion(ctx, "kernels/foo", versions[0].VersionID))
+	_, err = f.Get("kernels/foo")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+	require.Nil(t, f.DeleteVersion(ctx, "kernels/foo", marker))
+	data, err = f.Get("kernels/foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("22"), data)
+
+	require.ErrorIs(t, f.DeleteVersion(ctx, "kernels/foo", marker), storage.ErrNotFound)
+	require.ErrorIs(t, f.DeleteVersion(ctx, "kernels/foo", "../other"), storage.ErrNotFound)
+}
+
+func TestFS_Unversioned(t *testing.T) {
+	ctx := context.Background()
+	f := newFS(t)
+
+	_, err := f.PutBytes("foo", []byte("1"))
+	require.Nil(t, err)
+	v2, err := f.PutBytes("foo", []byte("2"))
+	require.Nil(t, err)
+
+	// Only the current version is kept.
+	versions, err := storage.ObjectVersions(ctx, f, "foo")
+	require.Nil(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, *v2.VersionID, versions[0].VersionID)
+
+	require.Nil(t, f.DeleteVersion(ctx, "foo", *v2.VersionID))
+	exists, err := f.Exists("foo")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
@@ -0,0 +1,411 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_fs
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"go.resf.org/peridot/base/go/storage"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// versionPaths returns the path of a noncurrent version of an object and of its sidecar.
+func (f *FS) versionPaths(object string, versionID string) (string, string, error) {
+	if versionID == "" || versionID == "." || versionID == ".." || strings.ContainsAny(versionID, "/\\") {
+		return "", "", storage.ErrNotFound
+	}
+	_, _, err := f.paths(object)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Join(f.root, "versions", filepath.FromSlash(object))
+	return filepath.Join(dir, versionID), filepath.Join(dir, versionID+".json"), nil
+}
+
+// currentVersionID returns the version ID of the current version of an object.
+func currentVersionID(sc *sidecar) string {
+	if sc.VersionID == "" {
+		// Objects copied into the directory by hand, like objects written before S3 versioning was enabled.
+		return storage.NullVersionID
+	}
+
+	return sc.VersionID
+}
+
+// archive moves the current version of an object to the versions directory, the lock must be held.
+// Returns false if there is no current version.
+func (f *FS) archive(object string, objectPath string, metaPath string) (bool, error) {
+	_, err := os.Stat(objectPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	sc, err := f.readSidecar(metaPath)
+	if err != nil {
+		return false, err
+	}
+	sc.VersionID = currentVersionID(sc)
+
+	versionPath, versionMetaPath, err := f.versionPaths(object, sc.VersionID)
+	if err != nil {
+		return false, err
+	}
+	err = f.writeSidecar(versionMetaPath, sc)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(objectPath, versionPath)
+	if err != nil {
+		return false, err
+	}
+	err = os.Remove(metaPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// writeDeleteMarker records a delete in the versions directory, the lock must be held.
+func (f *FS) writeDeleteMarker(object string) error {
+	versionID, err := storage.NewVersionID()
+	if err != nil {
+		return err
+	}
+	_, versionMetaPath, err := f.versionPaths(object, versionID)
+	if err != nil {
+		return err
+	}
+
+	return f.writeSidecar(versionMetaPath, &sidecar{
+		VersionID:    versionID,
+		DeleteMarker: true,
+	})
+}
+
+// noncurrentVersions returns the noncurrent versions of an object, newest first, the lock must be held.
+func (f *FS) noncurrentVersions(object string) ([]*storage.ObjectVersion, error) {
+	dir := filepath.Join(f.root, "versions", filepath.FromSlash(object))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var versions []*storage.ObjectVersion
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		version, err := f.noncurrentVersion(object, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	sortVersions(versions)
+
+	return versions, nil
+}
+
+func (f *FS) noncurrentVersion(object string, versionID string) (*storage.ObjectVersion, error) {
+	versionPath, versionMetaPath, err := f.versionPaths(object, versionID)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := f.readSidecar(versionMetaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	version := &storage.ObjectVersion{
+		Name:           object,
+		VersionID:      versionID,
+		ETag:           sc.ETag,
+		IsDeleteMarker: sc.DeleteMarker,
+	}
+	infoPath := versionPath
+	if sc.DeleteMarker {
+		infoPath = versionMetaPath
+	}
+	info, err := os.Stat(infoPath)
+	if err != nil {
+		return nil, err
+	}
+	version.LastModified = info.ModTime()
+	if !sc.DeleteMarker {
+		version.Size = info.Size()
+	}
+
+	return version, nil
+}
+
+// sortVersions sorts versions newest first, the null version is always the oldest.
+func sortVersions(versions []*storage.ObjectVersion) {
+	key := func(v *storage.ObjectVersion) string {
+		if v.VersionID == storage.NullVersionID {
+			return ""
+		}
+		return v.VersionID
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return key(versions[i]) > key(versions[j])
+	})
+}
+
+// versions returns every version of an object, newest first, the lock must be held.
+func (f *FS) versions(object string) ([]*storage.ObjectVersion, error) {
+	objectPath, metaPath, err := f.paths(object)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := f.noncurrentVersions(object)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.stat(objectPath, metaPath)
+	if err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+	if stat != nil {
+		current := &storage.ObjectVersion{
+			Name:         object,
+			VersionID:    stat.VersionID,
+			Size:         stat.Size,
+			LastModified: stat.LastModified,
+			ETag:         stat.ETag,
+		}
+		if current.VersionID == "" {
+			current.VersionID = storage.NullVersionID
+		}
+		versions = append([]*storage.ObjectVersion{current}, versions...)
+	}
+	if len(versions) > 0 {
+		versions[0].IsLatest = true
+	}
+
+	return versions, nil
+}
+
+// ListVersions returns a page of object versions starting with prefix.
+// Page tokens are the name and version ID of the last version of the previous page.
+func (f *FS) ListVersions(ctx context.Context, prefix string, pageToken string, opts ...storage.ListOption) (*storage.VersionListResult, error) {
+	o := storage.NewListOptions(opts...)
+
+	var afterName, afterVersion string
+	if pageToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, errors.New("invalid page token")
+		}
+		afterName, afterVersion, _ = strings.Cut(string(decoded), "\x00")
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	// Objects with versions either have a current version in objects/, or noncurrent versions in versions/.
+	names := map[string]bool{}
+	objectsDir := filepath.Join(f.root, "objects")
+	versionsDir := filepath.Join(f.root, "versions")
+	for _, dir := range []string{objectsDir, versionsDir} {
+		walkDir := dir
+		if idx := strings.LastIndex(prefix, "/"); idx != -1 {
+			walkDir = filepath.Join(dir, filepath.FromSlash(prefix[:idx]))
+		}
+
+		err := filepath.WalkDir(walkDir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			if dir == versionsDir {
+				// Versions are stored at versions/<object>/<version ID>.json.
+				if !strings.HasSuffix(name, ".json") {
+					return nil
+				}
+				name = name[:strings.LastIndex(name, "/")]
+			}
+			if strings.HasPrefix(name, prefix) && name >= afterName {
+				names[name] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	result := &storage.VersionListResult{}
+	for _, name := range sorted {
+		versions, err := f.versions(name)
+		if err != nil {
+			return nil, err
+		}
+
+		skipping := name == afterName
+		for _, version := range versions {
+			if skipping {
+				if version.VersionID == afterVersion {
+					skipping = false
+				}
+				continue
+			}
+
+			if len(result.Versions) == o.PageSize {
+				last := result.Versions[len(result.Versions)-1]
+				result.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(last.Name + "\x00" + last.VersionID))
+				return result, nil
+			}
+			result.Versions = append(result.Versions, version)
+		}
+	}
+
+	return result, nil
+}
+
+func (f *FS) OpenVersion(ctx context.Context, object string, versionID string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	objectPath, metaPath, err := f.paths(object)
+	if err != nil {
+		return nil, nil, err
+	}
+	o := storage.NewOpenOptions(opts...)
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	stat, err := f.stat(objectPath, metaPath)
+	if err != nil && err != storage.ErrNotFound {
+		return nil, nil, err
+	}
+	if stat != nil && currentVersionID(&sidecar{VersionID: stat.VersionID}) == versionID {
+		return openFile(objectPath, stat, o)
+	}
+
+	versionPath, versionMetaPath, err := f.versionPaths(object, versionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err = f.stat(versionPath, versionMetaPath)
+	if err != nil {
+		// Delete markers have no contents, so they are not found either.
+		return nil, nil, err
+	}
+	stat.VersionID = versionID
+
+	return openFile(versionPath, stat, o)
+}
+
+func (f *FS) DeleteVersion(ctx context.Context, object string, versionID string) error {
+	objectPath, metaPath, err := f.paths(object)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	stat, err := f.stat(objectPath, metaPath)
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	if stat == nil || currentVersionID(&sidecar{VersionID: stat.VersionID}) != versionID {
+		versionPath, versionMetaPath, err := f.versionPaths(object, versionID)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(versionMetaPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return storage.ErrNotFound
+			}
+			return err
+		}
+		err = os.Remove(versionPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// Deleting the delete marker of a deleted object brings it back.
+		if stat == nil {
+			return f.promote(object, objectPath, metaPath)
+		}
+		return nil
+	}
+
+	err = os.Remove(objectPath)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(metaPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return f.promote(object, objectPath, metaPath)
+}
+
+// promote makes the newest noncurrent version current, unless it is a delete marker.
+// The lock must be held.
+func (f *FS) promote(object string, objectPath string, metaPath string) error {
+	versions, err := f.noncurrentVersions(object)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 || versions[0].IsDeleteMarker {
+		return nil
+	}
+	versionPath, versionMetaPath, err := f.versionPaths(object, versions[0].VersionID)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(versionPath, objectPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(versionMetaPath, metaPath)
+}
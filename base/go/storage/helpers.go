@@ -0,0 +1,148 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadAll returns the contents of a file.
+// Backends use this to implement Get on top of Open.
+func ReadAll(ctx context.Context, st Storage, object string, opts ...GetOption) ([]byte, error) {
+	var buf bytes.Buffer
+	err := ReadTo(ctx, st, object, &buf, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ReadTo copies the contents of a file to w, without holding it in memory.
+// Use DownloadTo to write to a file.
+func ReadTo(ctx context.Context, st Storage, object string, w io.Writer, opts ...GetOption) error {
+	r, _, err := OpenVerified(ctx, st, object, opts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// DownloadTo copies the contents of a file to toPath, without holding it in memory.
+// The contents are written to a temporary file next to toPath, which is only renamed
+// to toPath once complete and verified. On error toPath is left untouched.
+// Backends use this to implement Download on top of Open.
+func DownloadTo(ctx context.Context, st Storage, object string, toPath string, opts ...GetOption) error {
+	// Open before creating the file, so nothing is created if the object doesn't exist.
+	r, _, err := OpenVerified(ctx, st, object, opts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeFile(toPath, r)
+}
+
+// writeFile writes the contents of r to a temporary file next to path, and renames it to path.
+func writeFile(path string, r io.Reader) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	// CreateTemp creates the file with 0600, use the same mode as os.Create.
+	err = f.Chmod(0644)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Upload uploads the contents of r, without holding it in memory.
+// If reading from r fails, the upload is aborted and nothing is stored.
+// If expected digests are set and the contents don't match, the upload is aborted
+// and a *ChecksumMismatchError is returned.
+// Backends use this to implement Put and PutBytes on top of Create.
+func Upload(ctx context.Context, st Storage, object string, r io.Reader, opts ...PutOption) (*UploadInfo, error) {
+	o := NewPutOptions(opts...)
+	checksums, err := newChecksums(o.SHA256, o.SHA512)
+	if err != nil {
+		return nil, err
+	}
+	cr := newChecksumReader(r, object, checksums)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := st.Create(ctx, object, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(w, cr)
+	if err == nil {
+		err = cr.verify()
+	}
+	if err != nil {
+		// Abort before closing, so the partial file isn't stored.
+		cancel()
+		_ = w.Close()
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return w.Info(), nil
+}
+
+// LowerMetadata returns a copy of metadata with lower case keys.
+func LowerMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	lower := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		lower[strings.ToLower(k)] = v
+	}
+
+	return lower
+}
@@ -15,13 +15,23 @@
 package storage_memory
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
 	"github.com/pkg/errors"
 	"go.resf.org/peridot/base/go/storage"
 	"io"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type InMemory struct {
@@ -29,29 +39,77 @@ type InMemory struct {
 
 	rootPath string
 	fs       billy.Filesystem
+	lock     sync.Mutex
 	blobs    map[string][]byte
+	// meta contains the metadata of blobs written through the storage, blobs read from disk have none.
+	meta map[string]*blobMeta
+	// deleted contains the blobs deleted through the storage, which stay deleted even if they are on disk.
+	deleted map[string]bool
+	// versioning keeps every version of blobs written through the storage in versions, oldest first.
+	versioning bool
+	versions   map[string][]*blobVersion
 }
 
-// New creates a new InMemory storage.
-// rootPath is a spread operator because it's optional and it looks nicer.
-func New(fs billy.Filesystem, rootPath ...string) *InMemory {
-	if len(rootPath) > 1 {
-		panic("too many arguments")
+type Option func(*InMemory)
+
+// WithRootPath reads blobs that aren't in memory from below rootPath on the filesystem,
+// instead of its root.
+func WithRootPath(rootPath string) Option {
+	return func(im *InMemory) {
+		im.rootPath = rootPath
+	}
+}
+
+// WithVersioning keeps the previous versions of a blob when it is overwritten or deleted,
+// like a versioned S3 bucket. Old versions are kept until deleted with DeleteVersion,
+// or by storage.ApplyRetention.
+func WithVersioning() Option {
+	return func(im *InMemory) {
+		im.versioning = true
 	}
+}
 
+type blobMeta struct {
+	contentType  string
+	metadata     map[string]string
+	lastModified time.Time
+	versionID    string
+}
+
+// blobVersion is a version of a blob, or a delete marker.
+type blobVersion struct {
+	blob         []byte
+	meta         *blobMeta
+	deleteMarker bool
+}
+
+// New creates a new InMemory storage.
+// Blobs that aren't in memory are read from fs.
+func New(fs billy.Filesystem, opts ...Option) *InMemory {
 	inm := &InMemory{
-		fs:    fs,
-		blobs: make(map[string][]byte),
+		fs:       fs,
+		blobs:    make(map[string][]byte),
+		meta:     make(map[string]*blobMeta),
+		deleted:  make(map[string]bool),
+		versions: make(map[string][]*blobVersion),
 	}
-	if len(rootPath) == 1 {
-		inm.rootPath = rootPath[0]
+	for _, opt := range opts {
+		opt(inm)
 	}
 	return inm
 }
 
 func (im *InMemory) getBlob(object string) ([]byte, error) {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
 	blob, ok := im.blobs[object]
 	if !ok {
+		// Deleted through the storage, even if it's on disk
+		if im.deleted[object] {
+			return nil, storage.ErrNotFound
+		}
+
 		// If not in memory, check if it's on disk
 		path := object
 		if im.rootPath != "" {
@@ -61,6 +119,7 @@ func (im *InMemory) getBlob(object string) ([]byte, error) {
 		if err != nil {
 			return nil, storage.ErrNotFound
 		}
+		defer f.Close()
 
 		// Read file into blob
 		blob, err := io.ReadAll(f)
@@ -76,69 +135,269 @@ func (im *InMemory) getBlob(object string) ([]byte, error) {
 	return blob, nil
 }
 
-func (im *InMemory) Download(object string, toPath string) error {
+func (im *InMemory) Open(ctx context.Context, object string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
 	blob, err := im.getBlob(object)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// Open file
-	f, err := im.fs.OpenFile(toPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return errors.Wrap(err, "failed to open file")
+	return openBlob(blob, im.stat(object, blob), opts...)
+}
+
+func openBlob(blob []byte, stat *storage.Stat, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	o := storage.NewOpenOptions(opts...)
+	size := int64(len(blob))
+	content := blob
+	if o.IsRange() {
+		// Match S3, which rejects ranges starting at or after the end.
+		if o.Offset >= size {
+			return nil, nil, storage.ErrInvalidRange
+		}
+		end := size
+		if o.Length > 0 && o.Offset+o.Length < size {
+			end = o.Offset + o.Length
+		}
+		content = blob[o.Offset:end]
 	}
 
-	// Write blob to file
-	_, err = f.Write(blob)
-	if err != nil {
-		return errors.Wrap(err, "failed to write blob to file")
+	return io.NopCloser(bytes.NewReader(content)), stat, nil
+}
+
+func (im *InMemory) stat(object string, blob []byte) *storage.Stat {
+	im.lock.Lock()
+	meta := im.meta[object]
+	im.lock.Unlock()
+
+	return statBlob(blob, meta)
+}
+
+func statBlob(blob []byte, meta *blobMeta) *storage.Stat {
+	sha256Sum := sha256.Sum256(blob)
+	stat := &storage.Stat{
+		Size:   int64(len(blob)),
+		ETag:   etag(blob),
+		SHA256: hex.EncodeToString(sha256Sum[:]),
+	}
+	if meta != nil {
+		stat.ContentType = meta.contentType
+		stat.Metadata = meta.metadata
+		stat.LastModified = meta.lastModified
+		stat.VersionID = meta.versionID
 	}
 
-	return nil
+	return stat
 }
 
-func (im *InMemory) Get(object string) ([]byte, error) {
+// etag returns the ETag of a blob, in the same format as S3 for single part uploads.
+func etag(blob []byte) string {
+	md5Sum := md5.Sum(blob)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(md5Sum[:]))
+}
+
+func (im *InMemory) Stat(ctx context.Context, object string) (*storage.Stat, error) {
 	blob, err := im.getBlob(object)
 	if err != nil {
 		return nil, err
 	}
-	return blob, nil
+
+	return im.stat(object, blob), nil
 }
 
-func (im *InMemory) Put(object string, fromPath string) (*storage.UploadInfo, error) {
-	// Open file
-	f, err := im.fs.Open(fromPath)
+// List returns a page of blobs starting with prefix.
+// Files on disk are only listed once they have been read.
+func (im *InMemory) List(ctx context.Context, prefix string, pageToken string, opts ...storage.ListOption) (*storage.ListResult, error) {
+	o := storage.NewListOptions(opts...)
+
+	// The page token is the last name of the previous page
+	var after string
+	if pageToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, errors.New("invalid page token")
+		}
+		after = string(decoded)
+	}
+
+	im.lock.Lock()
+	var names []string
+	for name := range im.blobs {
+		if strings.HasPrefix(name, prefix) && name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := &storage.ListResult{}
+	for _, name := range names {
+		if len(result.Objects) == o.PageSize {
+			result.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(result.Objects[len(result.Objects)-1].Name))
+			break
+		}
+
+		object := &storage.Object{
+			Name: name,
+			Size: int64(len(im.blobs[name])),
+		}
+		if meta := im.meta[name]; meta != nil {
+			object.LastModified = meta.lastModified
+		}
+		result.Objects = append(result.Objects, object)
+	}
+	im.lock.Unlock()
+
+	return result, nil
+}
+
+// memoryWriter buffers a blob until it is closed.
+type memoryWriter struct {
+	ctx    context.Context
+	im     *InMemory
+	object string
+	opts   *storage.PutOptions
+	buf    bytes.Buffer
+	info   *storage.UploadInfo
+}
+
+func (im *InMemory) Create(ctx context.Context, object string, opts ...storage.PutOption) (storage.Writer, error) {
+	return &memoryWriter{
+		ctx:    ctx,
+		im:     im,
+		object: object,
+		opts:   storage.NewPutOptions(opts...),
+	}, nil
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	// A cancelled context aborts the upload.
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	versionID, err := storage.NewVersionID()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open file")
+		return err
+	}
+	meta := &blobMeta{
+		contentType:  w.opts.ContentType,
+		metadata:     storage.LowerMetadata(w.opts.Metadata),
+		lastModified: time.Now(),
+		versionID:    versionID,
 	}
 
-	// Read file into blob
-	blob, err := io.ReadAll(f)
+	w.im.lock.Lock()
+	if w.im.versioning {
+		w.im.addVersion(w.object, &blobVersion{blob: w.buf.Bytes(), meta: meta})
+	}
+	w.im.blobs[w.object] = w.buf.Bytes()
+	w.im.meta[w.object] = meta
+	delete(w.im.deleted, w.object)
+	w.im.lock.Unlock()
+
+	w.info = &storage.UploadInfo{
+		Location:  "memory://" + w.object,
+		VersionID: &versionID,
+	}
+	return nil
+}
+
+func (w *memoryWriter) Info() *storage.UploadInfo {
+	return w.info
+}
+
+func (im *InMemory) Download(object string, toPath string, opts ...storage.GetOption) error {
+	// Open the blob first, the file may be the fallback on disk
+	r, _, err := storage.OpenVerified(context.Background(), im, object, opts...)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read file")
+		return err
 	}
+	defer r.Close()
 
-	// Store blob
-	im.blobs[object] = blob
+	// Write to a temporary file next to toPath, so toPath is only replaced
+	// once the blob is complete and verified
+	f, err := util.TempFile(im.fs, filepath.Dir(toPath), "."+filepath.Base(toPath)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
 
-	return &storage.UploadInfo{
-		Location:  "memory://" + object,
-		VersionID: nil,
-	}, nil
+	// Write blob to file
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = im.fs.Remove(f.Name())
+		return errors.Wrap(err, "failed to write blob to file")
+	}
+
+	err = im.fs.Rename(f.Name(), toPath)
+	if err != nil {
+		_ = im.fs.Remove(f.Name())
+		return errors.Wrap(err, "failed to rename file")
+	}
+
+	return nil
 }
 
-func (im *InMemory) PutBytes(object string, blob []byte) (*storage.UploadInfo, error) {
-	// Store blob
-	im.blobs[object] = blob
+func (im *InMemory) Get(object string, opts ...storage.GetOption) ([]byte, error) {
+	return storage.ReadAll(context.Background(), im, object, opts...)
+}
 
-	return &storage.UploadInfo{
-		Location:  "memory://" + object,
-		VersionID: nil,
-	}, nil
+func (im *InMemory) Put(object string, fromPath string, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	// Open file
+	f, err := im.fs.Open(fromPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+
+	return storage.Upload(context.Background(), im, object, f, opts...)
+}
+
+func (im *InMemory) PutBytes(object string, blob []byte, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	return storage.Upload(context.Background(), im, object, bytes.NewReader(blob), opts...)
 }
 
 func (im *InMemory) Delete(object string) error {
+	// Read blobs on disk first, so they are deleted like blobs in memory
+	_, err := im.getBlob(object)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	if _, ok := im.blobs[object]; !ok {
+		return nil
+	}
+	if im.versioning {
+		versionID, err := storage.NewVersionID()
+		if err != nil {
+			return err
+		}
+		im.addVersion(object, &blobVersion{
+			deleteMarker: true,
+			meta: &blobMeta{
+				lastModified: time.Now(),
+				versionID:    versionID,
+			},
+		})
+	}
+
 	delete(im.blobs, object)
+	delete(im.meta, object)
+	im.deleted[object] = true
 	return nil
 }
 
@@ -156,3 +415,171 @@ func (im *InMemory) Exists(object string) (bool, error) {
 func (im *InMemory) CanReadURI(uri string) (bool, error) {
 	return strings.HasPrefix(uri, "memory://"), nil
 }
+
+func (im *InMemory) ObjectFromURI(uri string) (string, error) {
+	if !strings.HasPrefix(uri, "memory://") || uri == "memory://" {
+		return "", storage.ErrUnsupportedURI
+	}
+
+	return strings.TrimPrefix(uri, "memory://"), nil
+}
+
+// addVersion adds a version to the history of a blob, the lock must be held.
+// Blobs read from disk get their contents recorded as the null version first.
+func (im *InMemory) addVersion(object string, version *blobVersion) {
+	history := im.versions[object]
+	if len(history) == 0 {
+		if blob, ok := im.blobs[object]; ok {
+			history = append(history, &blobVersion{
+				blob: blob,
+				meta: &blobMeta{versionID: storage.NullVersionID},
+			})
+		}
+	}
+
+	im.versions[object] = append(history, version)
+}
+
+// history returns the versions of a blob, oldest first, the lock must be held.
+// Without versioning, only the current version is returned.
+func (im *InMemory) history(object string) []*blobVersion {
+	if history := im.versions[object]; len(history) > 0 {
+		return history
+	}
+	if blob, ok := im.blobs[object]; ok {
+		meta := &blobMeta{versionID: storage.NullVersionID}
+		if m := im.meta[object]; m != nil {
+			meta = m
+		}
+		return []*blobVersion{{blob: blob, meta: meta}}
+	}
+
+	return nil
+}
+
+// ListVersions returns a page of blob versions starting with prefix.
+// Page tokens are the name and version ID of the last version of the previous page.
+func (im *InMemory) ListVersions(ctx context.Context, prefix string, pageToken string, opts ...storage.ListOption) (*storage.VersionListResult, error) {
+	o := storage.NewListOptions(opts...)
+
+	var afterName, afterVersion string
+	if pageToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, errors.New("invalid page token")
+		}
+		afterName, afterVersion, _ = strings.Cut(string(decoded), "\x00")
+	}
+
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	nameSet := map[string]bool{}
+	for name := range im.blobs {
+		nameSet[name] = true
+	}
+	for name := range im.versions {
+		nameSet[name] = true
+	}
+	var names []string
+	for name := range nameSet {
+		if strings.HasPrefix(name, prefix) && name >= afterName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := &storage.VersionListResult{}
+	for _, name := range names {
+		history := im.history(name)
+		skipping := name == afterName
+		for i := len(history) - 1; i >= 0; i-- {
+			version := history[i]
+			if skipping {
+				if version.meta.versionID == afterVersion {
+					skipping = false
+				}
+				continue
+			}
+
+			if len(result.Versions) == o.PageSize {
+				last := result.Versions[len(result.Versions)-1]
+				result.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(last.Name + "\x00" + last.VersionID))
+				return result, nil
+			}
+
+			objectVersion := &storage.ObjectVersion{
+				Name:           name,
+				VersionID:      version.meta.versionID,
+				LastModified:   version.meta.lastModified,
+				IsLatest:       i == len(history)-1,
+				IsDeleteMarker: version.deleteMarker,
+			}
+			if !version.deleteMarker {
+				objectVersion.Size = int64(len(version.blob))
+				objectVersion.ETag = etag(version.blob)
+			}
+			result.Versions = append(result.Versions, objectVersion)
+		}
+	}
+
+	return result, nil
+}
+
+// findVersion returns the index of a version in the history of a blob, or -1, the lock must be held.
+func findVersion(history []*blobVersion, versionID string) int {
+	for i, version := range history {
+		if version.meta.versionID == versionID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (im *InMemory) OpenVersion(ctx context.Context, object string, versionID string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	im.lock.Lock()
+	history := im.history(object)
+	i := findVersion(history, versionID)
+	im.lock.Unlock()
+	if i == -1 || history[i].deleteMarker {
+		return nil, nil, storage.ErrNotFound
+	}
+
+	return openBlob(history[i].blob, statBlob(history[i].blob, history[i].meta), opts...)
+}
+
+func (im *InMemory) DeleteVersion(ctx context.Context, object string, versionID string) error {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+
+	history := im.history(object)
+	i := findVersion(history, versionID)
+	if i == -1 {
+		return storage.ErrNotFound
+	}
+	history = append(history[:i:i], history[i+1:]...)
+	im.versions[object] = history
+
+	// The previous version becomes current.
+	// Without one, the blob stays deleted, even if it was read from disk.
+	if len(history) == 0 {
+		delete(im.versions, object)
+		delete(im.blobs, object)
+		delete(im.meta, object)
+		im.deleted[object] = true
+		return nil
+	}
+	latest := history[len(history)-1]
+	if latest.deleteMarker {
+		delete(im.blobs, object)
+		delete(im.meta, object)
+		im.deleted[object] = true
+	} else {
+		im.blobs[object] = latest.blob
+		im.meta[object] = latest.meta
+		delete(im.deleted, object)
+	}
+
+	return nil
+}
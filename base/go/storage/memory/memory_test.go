@@ -15,9 +15,11 @@
 package storage_memory
 
 import (
+	"context"
 	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/stretchr/testify/require"
 	"go.resf.org/peridot/base/go/storage"
+	"io"
 	"os"
 	"testing"
 )
@@ -197,3 +199,252 @@ func TestInMemory_CanReadURI_No(t *testing.T) {
 	require.Nil(t, err)
 	require.False(t, ok)
 }
+
+func TestInMemory_Open(t *testing.T) {
+	fs := memfs.New()
+	im := New(fs)
+	im.blobs["foo"] = []byte("0123456789")
+
+	r, stat, err := im.Open(context.Background(), "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(10), stat.Size)
+	blob, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, []byte("0123456789"), blob)
+
+	r, stat, err = im.Open(context.Background(), "foo", storage.WithRange(2, 3))
+	require.Nil(t, err)
+	require.Equal(t, int64(10), stat.Size)
+	blob, err = io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, []byte("234"), blob)
+
+	r, _, err = im.Open(context.Background(), "foo", storage.WithRange(8, 0))
+	require.Nil(t, err)
+	blob, err = io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, []byte("89"), blob)
+
+	_, _, err = im.Open(context.Background(), "foo", storage.WithRange(10, 1))
+	require.Equal(t, storage.ErrInvalidRange, err)
+
+	_, _, err = im.Open(context.Background(), "bar")
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestInMemory_Create(t *testing.T) {
+	fs := memfs.New()
+	im := New(fs)
+
+	w, err := im.Create(context.Background(), "foo")
+	require.Nil(t, err)
+	_, err = w.Write([]byte("b"))
+	require.Nil(t, err)
+	_, err = w.Write([]byte("ar"))
+	require.Nil(t, err)
+
+	// Nothing is stored until the writer is closed.
+	_, ok := im.blobs["foo"]
+	require.False(t, ok)
+
+	require.Nil(t, w.Close())
+	require.Equal(t, []byte("bar"), im.blobs["foo"])
+	require.Equal(t, "memory://foo", w.Info().Location)
+}
+
+func TestInMemory_Create_Cancelled(t *testing.T) {
+	fs := memfs.New()
+	im := New(fs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := im.Create(ctx, "foo")
+	require.Nil(t, err)
+	_, err = w.Write([]byte("bar"))
+	require.Nil(t, err)
+
+	cancel()
+	require.Equal(t, context.Canceled, w.Close())
+	_, ok := im.blobs["foo"]
+	require.False(t, ok)
+}
+
+func TestInMemory_Stat(t *testing.T) {
+	fs := memfs.New()
+	im := New(fs)
+	_, err := im.PutBytes("foo", []byte("bar"), storage.WithContentType("text/plain"), storage.WithMetadata(map[string]string{"Kernel": "lt"}))
+	require.Nil(t, err)
+
+	stat, err := im.Stat(context.Background(), "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), stat.Size)
+	require.Equal(t, "text/plain", stat.ContentType)
+	require.Equal(t, map[string]string{"kernel": "lt"}, stat.Metadata)
+	require.Equal(t, "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9", stat.SHA256)
+	require.Equal(t, "\"37b51d194a7513e45b56f6524f2d51f2\"", stat.ETag)
+	require.False(t, stat.LastModified.IsZero())
+
+	_, err = im.Stat(context.Background(), "bar")
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestInMemory_List(t *testing.T) {
+	fs := memfs.New()
+	im := New(fs)
+	for _, name := range []string{"a/3", "a/1", "a/2", "b/1"} {
+		_, err := im.PutBytes(name, []byte(name))
+		require.Nil(t, err)
+	}
+
+	res, err := im.List(context.Background(), "a/", "", storage.WithPageSize(2))
+	require.Nil(t, err)
+	require.Len(t, res.Objects, 2)
+	require.Equal(t, "a/1", res.Objects[0].Name)
+	require.Equal(t, "a/2", res.Objects[1].Name)
+	require.Equal(t, int64(3), res.Objects[0].Size)
+	require.NotEmpty(t, res.NextPageToken)
+
+	res, err = im.List(context.Background(), "a/", res.NextPageToken, storage.WithPageSize(2))
+	require.Nil(t, err)
+	require.Len(t, res.Objects, 1)
+	require.Equal(t, "a/3", res.Objects[0].Name)
+	require.Empty(t, res.NextPageToken)
+
+	res, err = im.List(context.Background(), "", "")
+	require.Nil(t, err)
+	require.Len(t, res.Objects, 4)
+}
+
+func TestInMemory_Versions(t *testing.T) {
+	ctx := context.Background()
+	im := New(memfs.New(), WithVersioning())
+
+	v1, err := im.PutBytes("foo", []byte("1"), storage.WithContentType("text/plain"))
+	require.Nil(t, err)
+	v2, err := im.PutBytes("foo", []byte("2"))
+	require.Nil(t, err)
+	require.NotEqual(t, *v1.VersionID, *v2.VersionID)
+
+	stat, err := im.Stat(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, *v2.VersionID, stat.VersionID)
+
+	r, stat, err := im.OpenVersion(ctx, "foo", *v1.VersionID)
+	require.Nil(t, err)
+	data, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, []byte("1"), data)
+	require.Equal(t, "text/plain", stat.ContentType)
+
+	// Deletes leave a delete marker, and the old versions.
+	require.Nil(t, im.Delete("foo"))
+	_, err = im.Get("foo")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+
+	list, err := im.ListVersions(ctx, "", "", storage.WithPageSize(2))
+	require.Nil(t, err)
+	require.Len(t, list.Versions, 2)
+	require.True(t, list.Versions[0].IsDeleteMarker)
+	require.True(t, list.Versions[0].IsLatest)
+	require.Equal(t, *v2.VersionID, list.Versions[1].VersionID)
+	require.NotEmpty(t, list.NextPageToken)
+
+	list, err = im.ListVersions(ctx, "", list.NextPageToken, storage.WithPageSize(2))
+	require.Nil(t, err)
+	require.Len(t, list.Versions, 1)
+	require.Equal(t, *v1.VersionID, list.Versions[0].VersionID)
+	require.Equal(t, int64(1), list.Versions[0].Size)
+	require.Empty(t, list.NextPageToken)
+
+	// Deleting the delete marker brings the object back.
+	markers, err := im.ListVersions(ctx, "foo", "", storage.WithPageSize(1))
+	require.Nil(t, err)
+	require.Nil(t, im.DeleteVersion(ctx, "foo", markers.Versions[0].VersionID))
+	data, err = im.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("2"), data)
+
+	// Deleting the current version makes the previous one current.
+	require.Nil(t, im.DeleteVersion(ctx, "foo", *v2.VersionID))
+	data, err = im.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("1"), data)
+
+	require.ErrorIs(t, im.DeleteVersion(ctx, "foo", *v2.VersionID), storage.ErrNotFound)
+	_, _, err = im.OpenVersion(ctx, "foo", *v2.VersionID)
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestInMemory_Versions_OnFS(t *testing.T) {
+	ctx := context.Background()
+	fs := memfs.New()
+	{
+		f, _ := fs.OpenFile("foo", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		_, err := f.Write([]byte("bar"))
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+	}
+	im := New(fs, WithVersioning())
+
+	// Blobs on disk are the null version once read.
+	_, err := im.Get("foo")
+	require.Nil(t, err)
+	_, err = im.PutBytes("foo", []byte("baz"))
+	require.Nil(t, err)
+
+	data, err := storage.GetVersion(ctx, im, "foo", storage.NullVersionID)
+	require.Nil(t, err)
+	require.Equal(t, []byte("bar"), data)
+}
+
+func TestInMemory_Versions_Disabled(t *testing.T) {
+	ctx := context.Background()
+	im := New(memfs.New())
+
+	_, err := im.PutBytes("foo", []byte("1"))
+	require.Nil(t, err)
+	v2, err := im.PutBytes("foo", []byte("2"))
+	require.Nil(t, err)
+
+	// Only the current blob is kept.
+	list, err := im.ListVersions(ctx, "", "")
+	require.Nil(t, err)
+	require.Len(t, list.Versions, 1)
+	require.Equal(t, *v2.VersionID, list.Versions[0].VersionID)
+	require.True(t, list.Versions[0].IsLatest)
+
+	require.Nil(t, im.Delete("foo"))
+	list, err = im.ListVersions(ctx, "", "")
+	require.Nil(t, err)
+	require.Empty(t, list.Versions)
+}
+
+func TestInMemory_Delete_OnFS(t *testing.T) {
+	ctx := context.Background()
+
+	for _, opts := range [][]Option{nil, {WithVersioning()}} {
+		fs := memfs.New()
+		for _, name := range []string{"foo", "bar"} {
+			f, _ := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			_, err := f.Write([]byte("baz"))
+			require.Nil(t, err)
+			require.Nil(t, f.Close())
+		}
+		im := New(fs, opts...)
+
+		// Blobs on disk stay deleted, even if they were never read.
+		require.Nil(t, im.Delete("foo"))
+		exists, err := im.Exists("foo")
+		require.Nil(t, err)
+		require.False(t, exists)
+
+		// Deleting the last version of a blob on disk keeps it deleted too.
+		_, err = im.Get("bar")
+		require.Nil(t, err)
+		require.Nil(t, im.DeleteVersion(ctx, "bar", storage.NullVersionID))
+		_, err = im.Get("bar")
+		require.ErrorIs(t, err, storage.ErrNotFound)
+		list, err := im.ListVersions(ctx, "bar", "")
+		require.Nil(t, err)
+		require.Empty(t, list.Versions)
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mirror replicates writes to a storage.Storage to other backends,
+// for example to keep a disaster recovery copy in a second bucket.
+//
+// Reads are always served by the primary. Objects that didn't make it to a secondary,
+// because a write failed or was made before the mirror was set up, are copied by Repair.
+// Every backend has its own version IDs, so the version APIs only use the primary.
+package storage_mirror
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/storage"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Consistency decides when a write to the mirror returns.
+type Consistency int
+
+const (
+	// ConsistencyAll writes to every backend before returning.
+	// A write fails if any backend fails, even though the backends that succeeded keep the object.
+	ConsistencyAll Consistency = iota
+	// ConsistencyPrimary only waits for the primary, and copies the object
+	// to the secondaries in the background.
+	// Failed copies are logged, and left for Repair.
+	ConsistencyPrimary
+)
+
+const (
+	defaultQueueSize = 1000
+	defaultWorkers   = 4
+)
+
+// Mirror is a storage.Storage that writes to a primary and a set of secondaries.
+type Mirror struct {
+	storage.Storage
+
+	secondaries []storage.Storage
+	consistency Consistency
+	queueSize   int
+	workers     int
+
+	// queues has a queue per worker. Jobs for an object always go to the same
+	// worker, so a copy and a later delete of the object can't be reordered.
+	queues  []chan *job
+	pending sync.WaitGroup
+	done    sync.WaitGroup
+	lock    sync.Mutex
+	closed  bool
+	// dropped is the number of background copies dropped because the queue was full.
+	dropped int
+}
+
+// job copies or deletes an object on a secondary in the background.
+type job struct {
+	object    string
+	secondary storage.Storage
+	delete    bool
+}
+
+type Option func(*Mirror)
+
+// WithConsistency sets when writes return, defaults to ConsistencyAll.
+func WithConsistency(consistency Consistency) Option {
+	return func(m *Mirror) {
+		m.consistency = consistency
+	}
+}
+
+// WithQueueSize sets how many background copies can be pending with ConsistencyPrimary.
+// Copies are dropped (and left for Repair) when the queue is full, so writes never block on the secondaries.
+func WithQueueSize(size int) Option {
+	return func(m *Mirror) {
+		m.queueSize = size
+	}
+}
+
+// WithWorkers sets how many background copies run at the same time with ConsistencyPrimary.
+// Copies of the same object are never run at the same time.
+func WithWorkers(workers int) Option {
+	return func(m *Mirror) {
+		m.workers = workers
+	}
+}
+
+// New creates a mirror writing to primary and every secondary.
+// Call Close to wait for background copies before exiting.
+func New(primary storage.Storage, secondaries []storage.Storage, opts ...Option) *Mirror {
+	m := &Mirror{
+		Storage:     primary,
+		secondaries: secondaries,
+		consistency: ConsistencyAll,
+		queueSize:   defaultQueueSize,
+		workers:     defaultWorkers,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.consistency == ConsistencyPrimary {
+		// Without workers there is still a queue, nothing is taken off it.
+		shards := m.workers
+		if shards < 1 {
+			shards = 1
+		}
+		// The queue size is split between the workers, rounded up.
+		queueSize := (m.queueSize + shards - 1) / shards
+		for i := 0; i < shards; i++ {
+			queue := make(chan *job, queueSize)
+			m.queues = append(m.queues, queue)
+			if i < m.workers {
+				m.done.Add(1)
+				go m.worker(queue)
+			}
+		}
+	}
+
+	return m
+}
+
+func (m *Mirror) worker(queue <-chan *job) {
+	defer m.done.Done()
+
+	for j := range queue {
+		var err error
+		if j.delete {
+			err = j.secondary.Delete(j.object)
+			if err == storage.ErrNotFound {
+				err = nil
+			}
+		} else {
+			err = Copy(context.Background(), m.Storage, j.secondary, j.object)
+			if err == storage.ErrNotFound {
+				// Deleted from the primary since, the delete is queued as well.
+				err = nil
+			}
+		}
+		if err != nil {
+			base.LogErrorf("failed to mirror %s, run a repair to fix it: %v", j.object, err)
+		}
+		m.pending.Done()
+	}
+}
+
+// enqueue queues a background job for every secondary.
+func (m *Mirror) enqueue(object string, delete bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		base.LogErrorf("mirror is closed, not mirroring %s", object)
+		return
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(object))
+	queue := m.queues[h.Sum32()%uint32(len(m.queues))]
+
+	for _, secondary := range m.secondaries {
+		m.pending.Add(1)
+		select {
+		case queue <- &job{object: object, secondary: secondary, delete: delete}:
+		default:
+			m.pending.Done()
+			m.dropped++
+			base.LogErrorf("mirror queue is full, not mirroring %s, run a repair to fix it", object)
+		}
+	}
+}
+
+// Wait waits until the queued background copies are done.
+func (m *Mirror) Wait() {
+	m.pending.Wait()
+}
+
+// Dropped returns how many background copies were dropped because the queue was full.
+func (m *Mirror) Dropped() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.dropped
+}
+
+// Close waits for the queued background copies and stops the workers.
+// Writes after Close are not mirrored.
+func (m *Mirror) Close() {
+	m.lock.Lock()
+	if m.closed || m.queues == nil {
+		m.closed = true
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	for _, queue := range m.queues {
+		close(queue)
+	}
+	m.lock.Unlock()
+
+	m.done.Wait()
+}
+
+// backends returns the backends a write goes to before it returns.
+func (m *Mirror) backends() []storage.Storage {
+	if m.consistency == ConsistencyPrimary {
+		return []storage.Storage{m.Storage}
+	}
+
+	return append([]storage.Storage{m.Storage}, m.secondaries...)
+}
+
+func (m *Mirror) Create(ctx context.Context, object string, opts ...storage.PutOption) (storage.Writer, error) {
+	// Cancelling aborts the writers that were already created if a backend fails.
+	ctx, cancel := context.WithCancel(ctx)
+
+	backends := m.backends()
+	writers := make([]storage.Writer, 0, len(backends))
+	for _, backend := range backends {
+		w, err := backend.Create(ctx, object, opts...)
+		if err != nil {
+			cancel()
+			for _, created := range writers {
+				_ = created.Close()
+			}
+			return nil, err
+		}
+		writers = append(writers, w)
+	}
+
+	return &mirrorWriter{
+		m:       m,
+		object:  object,
+		writers: writers,
+		cancel:  cancel,
+	}, nil
+}
+
+func (m *Mirror) Put(object string, fromPath string, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	var info *storage.UploadInfo
+	for i, backend := range m.backends() {
+		backendInfo, err := backend.Put(object, fromPath, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			info = backendInfo
+		}
+	}
+	m.replicate(object)
+
+	return info, nil
+}
+
+func (m *Mirror) PutBytes(object string, data []byte, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	var info *storage.UploadInfo
+	for i, backend := range m.backends() {
+		backendInfo, err := backend.PutBytes(object, data, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			info = backendInfo
+		}
+	}
+	m.replicate(object)
+
+	return info, nil
+}
+
+// Delete deletes the object from every backend.
+// Only the primary decides whether the object existed, missing copies on the secondaries are ignored.
+func (m *Mirror) Delete(object string) error {
+	err := m.Storage.Delete(object)
+	if err != nil {
+		return err
+	}
+
+	if m.consistency == ConsistencyPrimary {
+		m.enqueue(object, true)
+		return nil
+	}
+	for _, secondary := range m.secondaries {
+		err := secondary.Delete(object)
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SignURL signs URLs with the primary.
+func (m *Mirror) SignURL(ctx context.Context, object string, method string, expires time.Duration) (string, error) {
+	return storage.SignURL(ctx, m.Storage, object, method, expires)
+}
+
+// replicate queues background copies of an object written to the primary.
+func (m *Mirror) replicate(object string) {
+	if m.consistency == ConsistencyPrimary {
+		m.enqueue(object, false)
+	}
+}
+
+// mirrorWriter writes to a writer per backend, the first one is the primary.
+type mirrorWriter struct {
+	m       *Mirror
+	object  string
+	writers []storage.Writer
+	cancel  context.CancelFunc
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	for _, writer := range w.writers {
+		_, err := writer.Write(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *mirrorWriter) Close() error {
+	defer w.cancel()
+
+	var firstErr error
+	for _, writer := range w.writers {
+		err := writer.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	w.m.replicate(w.object)
+
+	return nil
+}
+
+func (w *mirrorWriter) Info() *storage.UploadInfo {
+	return w.writers[0].Info()
+}
+
+// Copy copies an object from src to dst, keeping its content type and metadata.
+func Copy(ctx context.Context, src storage.Storage, dst storage.Storage, object string) error {
+	r, stat, err := src.Open(ctx, object)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = storage.Upload(
+		ctx,
+		dst,
+		object,
+		r,
+		storage.WithContentType(stat.ContentType),
+		storage.WithMetadata(stat.Metadata),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy %s", object)
+	}
+
+	return nil
+}
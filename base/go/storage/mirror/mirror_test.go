@@ -0,0 +1,289 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"testing"
+)
+
+func newBackends(count int) []storage.Storage {
+	var backends []storage.Storage
+	for i := 0; i < count; i++ {
+		backends = append(backends, storage_memory.New(memfs.New()))
+	}
+
+	return backends
+}
+
+func requireObject(t *testing.T, st storage.Storage, object string, expected string) {
+	t.Helper()
+
+	data, err := st.Get(object)
+	require.Nil(t, err, object)
+	require.Equal(t, expected, string(data), object)
+}
+
+func TestMirror_All(t *testing.T) {
+	ctx := context.Background()
+	backends := newBackends(3)
+	m := New(backends[0], backends[1:])
+
+	_, err := m.PutBytes("put-bytes", []byte("1"), storage.WithContentType("text/plain"))
+	require.Nil(t, err)
+	_, err = storage.Upload(ctx, m, "create", bytes.NewReader([]byte("2")))
+	require.Nil(t, err)
+
+	for _, backend := range backends {
+		requireObject(t, backend, "put-bytes", "1")
+		requireObject(t, backend, "create", "2")
+
+		stat, err := backend.Stat(ctx, "put-bytes")
+		require.Nil(t, err)
+		require.Equal(t, "text/plain", stat.ContentType)
+	}
+
+	require.Nil(t, m.Delete("create"))
+	for _, backend := range backends {
+		_, err := backend.Get("create")
+		require.ErrorIs(t, err, storage.ErrNotFound)
+	}
+}
+
+func TestMirror_AbortedCreate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backends := newBackends(2)
+	m := New(backends[0], backends[1:])
+
+	w, err := m.Create(ctx, "foo")
+	require.Nil(t, err)
+	_, err = w.Write([]byte("partial"))
+	require.Nil(t, err)
+	cancel()
+	require.NotNil(t, w.Close())
+
+	for _, backend := range backends {
+		exists, err := backend.Exists("foo")
+		require.Nil(t, err)
+		require.False(t, exists)
+	}
+}
+
+func TestMirror_Primary(t *testing.T) {
+	ctx := context.Background()
+	backends := newBackends(3)
+	m := New(backends[0], backends[1:], WithConsistency(ConsistencyPrimary), WithWorkers(2))
+	defer m.Close()
+
+	_, err := m.PutBytes("put-bytes", []byte("1"), storage.WithMetadata(map[string]string{"Origin": "test"}))
+	require.Nil(t, err)
+	_, err = storage.Upload(ctx, m, "create", bytes.NewReader([]byte("2")))
+	require.Nil(t, err)
+	requireObject(t, backends[0], "put-bytes", "1")
+
+	m.Wait()
+	for _, backend := range backends {
+		requireObject(t, backend, "put-bytes", "1")
+		requireObject(t, backend, "create", "2")
+
+		stat, err := backend.Stat(ctx, "put-bytes")
+		require.Nil(t, err)
+		require.Equal(t, map[string]string{"origin": "test"}, stat.Metadata)
+	}
+
+	require.Nil(t, m.Delete("create"))
+	m.Wait()
+	for _, backend := range backends {
+		_, err := backend.Get("create")
+		require.ErrorIs(t, err, storage.ErrNotFound)
+	}
+}
+
+func TestMirror_PrimaryOrdering(t *testing.T) {
+	backends := newBackends(2)
+	m := New(backends[0], backends[1:], WithConsistency(ConsistencyPrimary), WithWorkers(8))
+	defer m.Close()
+
+	// Copies and deletes of an object are applied in order, so the secondary ends up like the primary.
+	for i := 0; i < 50; i++ {
+		object := fmt.Sprintf("object-%02d", i)
+		_, err := m.PutBytes(object, []byte("1"))
+		require.Nil(t, err)
+		_, err = m.PutBytes(object, []byte("2"))
+		require.Nil(t, err)
+		if i%2 == 0 {
+			require.Nil(t, m.Delete(object))
+		}
+	}
+	m.Wait()
+
+	for i := 0; i < 50; i++ {
+		object := fmt.Sprintf("object-%02d", i)
+		if i%2 == 0 {
+			_, err := backends[1].Get(object)
+			require.ErrorIs(t, err, storage.ErrNotFound)
+			continue
+		}
+		requireObject(t, backends[1], object, "2")
+	}
+}
+
+func TestMirror_QueueFull(t *testing.T) {
+	backends := newBackends(2)
+	// No workers, so nothing is taken off the queue.
+	m := New(backends[0], backends[1:], WithConsistency(ConsistencyPrimary), WithWorkers(0), WithQueueSize(1))
+
+	_, err := m.PutBytes("a", []byte("1"))
+	require.Nil(t, err)
+	_, err = m.PutBytes("b", []byte("2"))
+	require.Nil(t, err)
+	require.Equal(t, 1, m.Dropped())
+
+	// The dropped copy is left for a repair.
+	stats, err := Repair(context.Background(), backends[0], backends[1], "")
+	require.Nil(t, err)
+	require.Equal(t, 2, stats.Copied)
+	requireObject(t, backends[1], "b", "2")
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	backends := newBackends(2)
+	src, dst := backends[0], backends[1]
+
+	for _, object := range []string{"kernels/a", "kernels/b", "kernels/c", "other/d"} {
+		_, err := src.PutBytes(object, []byte(object))
+		require.Nil(t, err)
+	}
+	_, err := dst.PutBytes("kernels/b", []byte("kernels/b"))
+	require.Nil(t, err)
+	_, err = dst.PutBytes("kernels/c", []byte("kernels/x"))
+	require.Nil(t, err)
+	_, err = dst.PutBytes("kernels/deleted", []byte("deleted"))
+	require.Nil(t, err)
+
+	stats, err := Repair(ctx, src, dst, "kernels/", WithDryRun(), WithPrune())
+	require.Nil(t, err)
+	require.Equal(t, &RepairStats{Checked: 3, Copied: 2, Pruned: 1}, stats)
+	requireObject(t, dst, "kernels/c", "kernels/x")
+
+	stats, err = Repair(ctx, src, dst, "kernels/")
+	require.Nil(t, err)
+	require.Equal(t, &RepairStats{Checked: 3, Copied: 2}, stats)
+	requireObject(t, dst, "kernels/a", "kernels/a")
+	requireObject(t, dst, "kernels/c", "kernels/c")
+	requireObject(t, dst, "kernels/deleted", "deleted")
+	_, err = dst.Get("other/d")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+
+	m := New(src, []storage.Storage{dst})
+	stats, err = m.Repair(ctx, "kernels/", WithPrune())
+	require.Nil(t, err)
+	require.Equal(t, &RepairStats{Checked: 3, Pruned: 1}, stats)
+	_, err = dst.Get("kernels/deleted")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+// statStorage changes the stats of the wrapped backend, to simulate backends that know less about objects.
+type statStorage struct {
+	storage.Storage
+	fn func(stat *storage.Stat)
+}
+
+func (s *statStorage) Stat(ctx context.Context, object string) (*storage.Stat, error) {
+	stat, err := s.Storage.Stat(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	s.fn(stat)
+	return stat, nil
+}
+
+func TestIsInSync(t *testing.T) {
+	withoutSHA256 := func(stat *storage.Stat) {
+		stat.SHA256 = ""
+	}
+	withoutChecksums := func(stat *storage.Stat) {
+		stat.SHA256 = ""
+		stat.ETag = ""
+	}
+
+	tests := []struct {
+		name   string
+		dst    string
+		opts   []storage.PutOption
+		fn     func(stat *storage.Stat)
+		inSync bool
+	}{
+		{
+			name:   "same sha256",
+			dst:    "foo",
+			fn:     func(stat *storage.Stat) {},
+			inSync: true,
+		},
+		{
+			name: "different sha256",
+			dst:  "bar",
+			fn:   func(stat *storage.Stat) {},
+		},
+		{
+			name:   "same sha256 in metadata",
+			dst:    "foo",
+			opts:   []storage.PutOption{storage.WithSHA256("2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")},
+			fn:     withoutChecksums,
+			inSync: true,
+		},
+		{
+			name:   "same etag",
+			dst:    "foo",
+			fn:     withoutSHA256,
+			inSync: true,
+		},
+		{
+			name: "different etag",
+			dst:  "bar",
+			fn:   withoutSHA256,
+		},
+		{
+			name: "nothing to compare",
+			dst:  "foo",
+			fn:   withoutChecksums,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backends := newBackends(2)
+			_, err := backends[0].PutBytes("object", []byte("foo"), test.opts...)
+			require.Nil(t, err)
+			_, err = backends[1].PutBytes("object", []byte(test.dst), test.opts...)
+			require.Nil(t, err)
+
+			src := &statStorage{Storage: backends[0], fn: test.fn}
+			dst := &statStorage{Storage: backends[1], fn: test.fn}
+			inSync, err := isInSync(ctx, src, dst, &storage.Object{Name: "object", Size: 3})
+			require.Nil(t, err)
+			require.Equal(t, test.inSync, inSync)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_mirror
+
+import (
+	"context"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/storage"
+)
+
+type RepairOptions struct {
+	DryRun bool
+	Prune  bool
+}
+
+type RepairOption func(*RepairOptions)
+
+// WithDryRun only reports what would be copied or deleted.
+func WithDryRun() RepairOption {
+	return func(o *RepairOptions) {
+		o.DryRun = true
+	}
+}
+
+// WithPrune also deletes objects from the destination that don't exist in the source,
+// for example objects whose delete wasn't mirrored.
+func WithPrune() RepairOption {
+	return func(o *RepairOptions) {
+		o.Prune = true
+	}
+}
+
+// RepairStats is the result of a repair.
+type RepairStats struct {
+	// Checked is the number of objects in the source.
+	Checked int
+	// Copied is the number of objects that were missing or different in the destination.
+	Copied int
+	// Pruned is the number of objects deleted from the destination.
+	Pruned int
+	// Failed is the number of objects that couldn't be copied or deleted, see the logs for why.
+	Failed int
+}
+
+func (s *RepairStats) add(other *RepairStats) {
+	s.Checked += other.Checked
+	s.Copied += other.Copied
+	s.Pruned += other.Pruned
+	s.Failed += other.Failed
+}
+
+// Repair copies every object under prefix that is missing or different in dst from src.
+// Also used to backfill a new secondary.
+// Objects are compared by size, and by SHA-256 checksum if both backends know it.
+// Failures to copy an object are counted and logged, so one bad object doesn't stop the repair.
+func Repair(ctx context.Context, src storage.Storage, dst storage.Storage, prefix string, opts ...RepairOption) (*RepairStats, error) {
+	o := &RepairOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	stats := &RepairStats{}
+	err := forEach(ctx, src, prefix, func(object *storage.Object) error {
+		stats.Checked++
+
+		inSync, err := isInSync(ctx, src, dst, object)
+		if err != nil {
+			return err
+		}
+		if inSync {
+			return nil
+		}
+
+		stats.Copied++
+		if o.DryRun {
+			base.LogInfof("would copy %s", object.Name)
+			return nil
+		}
+		err = Copy(ctx, src, dst, object.Name)
+		if err != nil {
+			stats.Copied--
+			stats.Failed++
+			base.LogErrorf("failed to repair %s: %v", object.Name, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !o.Prune {
+		return stats, nil
+	}
+
+	err = forEach(ctx, dst, prefix, func(object *storage.Object) error {
+		_, err := src.Stat(ctx, object.Name)
+		if err == nil {
+			return nil
+		}
+		if err != storage.ErrNotFound {
+			return err
+		}
+
+		stats.Pruned++
+		if o.DryRun {
+			base.LogInfof("would delete %s", object.Name)
+			return nil
+		}
+		err = dst.Delete(object.Name)
+		if err != nil && err != storage.ErrNotFound {
+			stats.Pruned--
+			stats.Failed++
+			base.LogErrorf("failed to prune %s: %v", object.Name, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// Repair repairs every secondary from the primary, see Repair.
+func (m *Mirror) Repair(ctx context.Context, prefix string, opts ...RepairOption) (*RepairStats, error) {
+	total := &RepairStats{}
+	for _, secondary := range m.secondaries {
+		stats, err := Repair(ctx, m.Storage, secondary, prefix, opts...)
+		if err != nil {
+			return nil, err
+		}
+		total.add(stats)
+	}
+
+	return total, nil
+}
+
+// isInSync returns whether dst has the same object as src.
+// Objects are compared by their SHA-256 checksum, or by their ETag if a checksum is missing.
+// If neither can be compared, the object is copied again to be safe.
+func isInSync(ctx context.Context, src storage.Storage, dst storage.Storage, object *storage.Object) (bool, error) {
+	dstStat, err := dst.Stat(ctx, object.Name)
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if dstStat.Size != object.Size {
+		return false, nil
+	}
+
+	srcStat, err := src.Stat(ctx, object.Name)
+	if err == storage.ErrNotFound {
+		// Deleted since it was listed.
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	srcSHA256, dstSHA256 := statSHA256(srcStat), statSHA256(dstStat)
+	if srcSHA256 != "" && dstSHA256 != "" {
+		return srcSHA256 == dstSHA256, nil
+	}
+	// ETags of different backends, or of multipart uploads, may differ for the same
+	// contents. That only causes an unneeded copy.
+	if srcStat.ETag != "" && dstStat.ETag != "" {
+		return srcStat.ETag == dstStat.ETag, nil
+	}
+
+	return false, nil
+}
+
+// statSHA256 returns the SHA-256 checksum of an object, from the metadata if the backend doesn't know it.
+func statSHA256(stat *storage.Stat) string {
+	if stat.SHA256 != "" {
+		return stat.SHA256
+	}
+
+	return stat.Metadata[storage.MetadataSHA256]
+}
+
+func forEach(ctx context.Context, st storage.Storage, prefix string, fn func(object *storage.Object) error) error {
+	var token string
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		page, err := st.List(ctx, prefix, token)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Objects {
+			err := fn(object)
+			if err != nil {
+				return err
+			}
+		}
+
+		token = page.NextPageToken
+		if token == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// prefixedStorage is a view of a backend that only contains the objects under a prefix.
+// It doesn't embed the backend, so objects outside the prefix can't be reached by accident.
+type prefixedStorage struct {
+	st     Storage
+	prefix string
+}
+
+// WithPrefix returns a view of st that only contains the objects under prefix,
+// for example to give each product its own directory in a shared bucket.
+// Object names passed to and returned by the view are relative to the prefix.
+func WithPrefix(st Storage, prefix string) Storage {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return st
+	}
+
+	return &prefixedStorage{
+		st:     st,
+		prefix: prefix + "/",
+	}
+}
+
+func (p *prefixedStorage) object(object string) string {
+	return p.prefix + object
+}
+
+func (p *prefixedStorage) Open(ctx context.Context, object string, opts ...OpenOption) (io.ReadCloser, *Stat, error) {
+	return p.st.Open(ctx, p.object(object), opts...)
+}
+
+func (p *prefixedStorage) Create(ctx context.Context, object string, opts ...PutOption) (Writer, error) {
+	return p.st.Create(ctx, p.object(object), opts...)
+}
+
+func (p *prefixedStorage) Stat(ctx context.Context, object string) (*Stat, error) {
+	return p.st.Stat(ctx, p.object(object))
+}
+
+func (p *prefixedStorage) List(ctx context.Context, prefix string, pageToken string, opts ...ListOption) (*ListResult, error) {
+	result, err := p.st.List(ctx, p.object(prefix), pageToken, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range result.Objects {
+		object.Name = strings.TrimPrefix(object.Name, p.prefix)
+	}
+	return result, nil
+}
+
+func (p *prefixedStorage) Download(object string, toPath string, opts ...GetOption) error {
+	return p.st.Download(p.object(object), toPath, opts...)
+}
+
+func (p *prefixedStorage) Get(object string, opts ...GetOption) ([]byte, error) {
+	return p.st.Get(p.object(object), opts...)
+}
+
+func (p *prefixedStorage) Put(object string, fromPath string, opts ...PutOption) (*UploadInfo, error) {
+	return p.st.Put(p.object(object), fromPath, opts...)
+}
+
+func (p *prefixedStorage) PutBytes(object string, data []byte, opts ...PutOption) (*UploadInfo, error) {
+	return p.st.PutBytes(p.object(object), data, opts...)
+}
+
+func (p *prefixedStorage) Delete(object string) error {
+	return p.st.Delete(p.object(object))
+}
+
+func (p *prefixedStorage) Exists(object string) (bool, error) {
+	return p.st.Exists(p.object(object))
+}
+
+func (p *prefixedStorage) ListVersions(ctx context.Context, prefix string, pageToken string, opts ...ListOption) (*VersionListResult, error) {
+	result, err := p.st.ListVersions(ctx, p.object(prefix), pageToken, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range result.Versions {
+		version.Name = strings.TrimPrefix(version.Name, p.prefix)
+	}
+	return result, nil
+}
+
+func (p *prefixedStorage) OpenVersion(ctx context.Context, object string, versionID string, opts ...OpenOption) (io.ReadCloser, *Stat, error) {
+	return p.st.OpenVersion(ctx, p.object(object), versionID, opts...)
+}
+
+func (p *prefixedStorage) DeleteVersion(ctx context.Context, object string, versionID string) error {
+	return p.st.DeleteVersion(ctx, p.object(object), versionID)
+}
+
+// CanReadURI only accepts URIs pointing to objects under the prefix.
+func (p *prefixedStorage) CanReadURI(uri string) (bool, error) {
+	ok, err := p.st.CanReadURI(uri)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	object, err := p.st.ObjectFromURI(uri)
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(object, p.prefix), nil
+}
+
+func (p *prefixedStorage) ObjectFromURI(uri string) (string, error) {
+	object, err := p.st.ObjectFromURI(uri)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(object, p.prefix) {
+		return "", ErrUnsupportedURI
+	}
+
+	return strings.TrimPrefix(object, p.prefix), nil
+}
+
+func (p *prefixedStorage) SignURL(ctx context.Context, object string, method string, expires time.Duration) (string, error) {
+	return SignURL(ctx, p.st, p.object(object), method, expires)
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_test
+
+import (
+	"context"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"testing"
+)
+
+func TestWithPrefix(t *testing.T) {
+	ctx := context.Background()
+	memory := storage_memory.New(memfs.New())
+	view := storage.WithPrefix(memory, "/kernels/")
+
+	info, err := view.PutBytes("foo", []byte("foo"))
+	require.Nil(t, err)
+	require.Equal(t, "memory://kernels/foo", info.Location)
+	_, err = memory.PutBytes("other", []byte("other"))
+	require.Nil(t, err)
+
+	data, err := memory.Get("kernels/foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("foo"), data)
+	data, err = view.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("foo"), data)
+
+	// Objects outside the prefix can't be reached.
+	exists, err := view.Exists("other")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	result, err := view.List(ctx, "", "")
+	require.Nil(t, err)
+	require.Len(t, result.Objects, 1)
+	require.Equal(t, "foo", result.Objects[0].Name)
+
+	versions, err := storage.ObjectVersions(ctx, view, "foo")
+	require.Nil(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, "foo", versions[0].Name)
+
+	ok, err := view.CanReadURI(info.Location)
+	require.Nil(t, err)
+	require.True(t, ok)
+	ok, err = view.CanReadURI("memory://other")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// Views can be nested.
+	nested := storage.WithPrefix(view, "nested")
+	_, err = nested.PutBytes("bar", []byte("bar"))
+	require.Nil(t, err)
+	exists, err = memory.Exists("kernels/nested/bar")
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	require.Nil(t, view.Delete("foo"))
+	exists, err = memory.Exists("kernels/foo")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrUnsupportedURI is returned when no backend can read a URI.
+var ErrUnsupportedURI = errors.New("unsupported storage URI")
+
+// Registry holds named storage backends, and resolves URIs to the backend that can read them.
+// For example the buckets of different products, next to a local directory.
+type Registry struct {
+	lock     sync.RWMutex
+	backends map[string]Storage
+	// names is in registration order, which is the order backends are tried in.
+	names []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		backends: make(map[string]Storage),
+	}
+}
+
+// Register adds a backend under name.
+// When resolving URIs, backends are tried in the order they were registered.
+func (r *Registry) Register(name string, st Storage) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.backends[name]; ok {
+		return fmt.Errorf("storage backend %s is already registered", name)
+	}
+	r.backends[name] = st
+	r.names = append(r.names, name)
+
+	return nil
+}
+
+// Get returns the backend registered under name.
+func (r *Registry) Get(name string) (Storage, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	st, ok := r.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("storage backend %s is not registered", name)
+	}
+
+	return st, nil
+}
+
+// Names returns the names of the registered backends, in registration order.
+func (r *Registry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]string(nil), r.names...)
+}
+
+// Resolve returns the first backend that can read uri, and the object uri points to.
+// A backend that fails to check uri is skipped, so one misconfigured backend
+// doesn't hide the others.
+// Returns ErrUnsupportedURI if no backend can read it, wrapping the first check error if any.
+func (r *Registry) Resolve(uri string) (Storage, string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var checkErr error
+	for _, name := range r.names {
+		st := r.backends[name]
+		ok, err := st.CanReadURI(uri)
+		if err != nil {
+			if checkErr == nil {
+				checkErr = fmt.Errorf("%s: %w", name, err)
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		object, err := st.ObjectFromURI(uri)
+		if err != nil {
+			return nil, "", err
+		}
+		return st, object, nil
+	}
+
+	if checkErr != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupportedURI, checkErr)
+	}
+	return nil, "", ErrUnsupportedURI
+}
+
+// OpenURI opens the object a URI points to, with the backend that can read it.
+func (r *Registry) OpenURI(ctx context.Context, uri string, opts ...OpenOption) (io.ReadCloser, *Stat, error) {
+	st, object, err := r.Resolve(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return st.Open(ctx, object, opts...)
+}
+
+// GetURI returns the contents of the object a URI points to.
+func (r *Registry) GetURI(ctx context.Context, uri string) ([]byte, error) {
+	st, object, err := r.Resolve(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadAll(ctx, st, object)
+}
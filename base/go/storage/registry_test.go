@@ -0,0 +1,128 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	storage_fs "go.resf.org/peridot/base/go/storage/fs"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"testing"
+)
+
+func newRegistry(t *testing.T) (*storage.Registry, storage.Storage, storage.Storage) {
+	fs, err := storage_fs.New(t.TempDir())
+	require.Nil(t, err)
+	memory := storage_memory.New(memfs.New())
+
+	registry := storage.NewRegistry()
+	require.Nil(t, registry.Register("fs", fs))
+	require.Nil(t, registry.Register("memory", memory))
+
+	return registry, fs, memory
+}
+
+func TestRegistry_Register(t *testing.T) {
+	registry, fs, _ := newRegistry(t)
+
+	require.NotNil(t, registry.Register("fs", storage_memory.New(memfs.New())))
+	require.Equal(t, []string{"fs", "memory"}, registry.Names())
+
+	st, err := registry.Get("fs")
+	require.Nil(t, err)
+	require.Equal(t, fs, st)
+
+	_, err = registry.Get("missing")
+	require.NotNil(t, err)
+}
+
+func TestRegistry_Resolve(t *testing.T) {
+	ctx := context.Background()
+	registry, fs, memory := newRegistry(t)
+
+	fsInfo, err := fs.PutBytes("dir/foo", []byte("from fs"))
+	require.Nil(t, err)
+	memoryInfo, err := memory.PutBytes("dir/foo", []byte("from memory"))
+	require.Nil(t, err)
+
+	st, object, err := registry.Resolve(fsInfo.Location)
+	require.Nil(t, err)
+	require.Equal(t, fs, st)
+	require.Equal(t, "dir/foo", object)
+
+	st, object, err = registry.Resolve(memoryInfo.Location)
+	require.Nil(t, err)
+	require.Equal(t, memory, st)
+	require.Equal(t, "dir/foo", object)
+
+	data, err := registry.GetURI(ctx, memoryInfo.Location)
+	require.Nil(t, err)
+	require.Equal(t, []byte("from memory"), data)
+
+	for _, uri := range []string{"s3://bucket/dir/foo", "file:///elsewhere/objects/foo", "memory://"} {
+		_, _, err = registry.Resolve(uri)
+		require.ErrorIs(t, err, storage.ErrUnsupportedURI, uri)
+	}
+}
+
+// brokenStorage fails every URI check.
+type brokenStorage struct {
+	storage.Storage
+}
+
+func (brokenStorage) CanReadURI(string) (bool, error) {
+	return false, errors.New("broken")
+}
+
+func TestRegistry_ResolveSkipsBrokenBackend(t *testing.T) {
+	memory := storage_memory.New(memfs.New())
+	info, err := memory.PutBytes("foo", []byte("foo"))
+	require.Nil(t, err)
+
+	registry := storage.NewRegistry()
+	require.Nil(t, registry.Register("broken", brokenStorage{memory}))
+	require.Nil(t, registry.Register("memory", memory))
+
+	st, object, err := registry.Resolve(info.Location)
+	require.Nil(t, err)
+	require.Equal(t, memory, st)
+	require.Equal(t, "foo", object)
+
+	_, _, err = registry.Resolve("s3://bucket/foo")
+	require.ErrorIs(t, err, storage.ErrUnsupportedURI)
+	require.ErrorContains(t, err, "broken")
+}
+
+func TestRegistry_ResolvePrefixed(t *testing.T) {
+	memory := storage_memory.New(memfs.New())
+
+	registry := storage.NewRegistry()
+	require.Nil(t, registry.Register("kernels", storage.WithPrefix(memory, "kernels")))
+	require.Nil(t, registry.Register("images", storage.WithPrefix(memory, "images")))
+
+	st, object, err := registry.Resolve("memory://images/foo")
+	require.Nil(t, err)
+	require.Equal(t, "foo", object)
+
+	images, err := registry.Get("images")
+	require.Nil(t, err)
+	require.Equal(t, images, st)
+
+	_, _, err = registry.Resolve("memory://other/foo")
+	require.ErrorIs(t, err, storage.ErrUnsupportedURI)
+}
@@ -23,8 +23,14 @@ import (
 )
 
 func FromFlags(ctx *cli.Context) (*S3, error) {
+	return FromConnectionString(ctx, ctx.String("storage-connection-string"))
+}
+
+// FromConnectionString creates an S3 backend for the bucket in connectionString,
+// using the endpoint and credentials from the storage flags.
+func FromConnectionString(ctx *cli.Context, connectionString string) (*S3, error) {
 	// Parse the connection string
-	parsedURI, err := url.Parse(ctx.String("storage-connection-string"))
+	parsedURI, err := url.Parse(connectionString)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse storage connection string")
 	}
@@ -16,25 +16,34 @@ package storage_s3
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
 	"go.resf.org/peridot/base/go/awsutils"
 	"go.resf.org/peridot/base/go/storage"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // S3 is an implementation of the Storage interface for S3.
 type S3 struct {
 	storage.Storage
 
-	bucket     string
-	uploader   *s3manager.Uploader
-	downloader *s3manager.Downloader
+	bucket   string
+	uploader *s3manager.Uploader
 }
 
 // New creates a new S3 storage backend.
@@ -49,89 +58,362 @@ func New(bucket string) (*S3, error) {
 	}
 
 	uploader := s3manager.NewUploader(sess)
-	downloader := s3manager.NewDownloader(sess)
 
 	return &S3{
-		bucket:     bucket,
-		uploader:   uploader,
-		downloader: downloader,
+		bucket:   bucket,
+		uploader: uploader,
 	}, nil
 }
 
-// Download downloads a file from the storage backend to the given path.
-func (s *S3) Download(object string, toPath string) error {
-	f, err := os.OpenFile(toPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+// Open returns a reader for the contents of a file.
+// The file is streamed from S3 as it is read.
+func (s *S3) Open(ctx context.Context, object string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	return s.open(ctx, object, "", opts...)
+}
+
+// OpenVersion returns a reader for the contents of a version of a file.
+func (s *S3) OpenVersion(ctx context.Context, object string, versionID string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	return s.open(ctx, object, versionID, opts...)
+}
+
+func (s *S3) open(ctx context.Context, object string, versionID string, opts ...storage.OpenOption) (io.ReadCloser, *storage.Stat, error) {
+	o := storage.NewOpenOptions(opts...)
+
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(object),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	if o.IsRange() {
+		input.Range = aws.String(o.HTTPRange())
 	}
-	defer f.Close()
 
-	_, err = s.downloader.Download(f, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(object),
-	})
+	result, err := s.uploader.S3.GetObjectWithContext(ctx, input)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == s3.ErrCodeNoSuchKey {
-				return storage.ErrNotFound
+			switch awsErr.Code() {
+			// Reading a delete marker is not allowed.
+			case s3.ErrCodeNoSuchKey, "NoSuchVersion", "MethodNotAllowed":
+				return nil, nil, storage.ErrNotFound
+			case "InvalidRange":
+				return nil, nil, storage.ErrInvalidRange
 			}
 		}
+		return nil, nil, err
 	}
 
-	return err
+	stat := &storage.Stat{
+		Size:         aws.Int64Value(result.ContentLength),
+		LastModified: aws.TimeValue(result.LastModified),
+		ETag:         aws.StringValue(result.ETag),
+		SHA256:       checksumToHex(result.ChecksumSHA256),
+		ContentType:  aws.StringValue(result.ContentType),
+		VersionID:    aws.StringValue(result.VersionId),
+		Metadata:     convertMetadata(result.Metadata),
+	}
+	// For range reads, the size of the whole object is after the slash ("bytes 0-99/1234").
+	if result.ContentRange != nil {
+		if idx := strings.LastIndex(*result.ContentRange, "/"); idx != -1 {
+			size, err := strconv.ParseInt((*result.ContentRange)[idx+1:], 10, 64)
+			if err == nil {
+				stat.Size = size
+			}
+		}
+	}
+
+	return result.Body, stat, nil
+}
+
+// s3Writer streams writes to an upload running in the background.
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	info *storage.UploadInfo
+	err  error
+}
+
+// Create returns a writer that uploads a file to S3.
+// Large files are uploaded in parts as they are written, so they are never held in memory.
+func (s *S3) Create(ctx context.Context, object string, opts ...storage.PutOption) (storage.Writer, error) {
+	o := storage.NewPutOptions(opts...)
+
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(object),
+		Metadata: aws.StringMap(storage.LowerMetadata(o.Metadata)),
+	}
+	if o.ContentType != "" {
+		input.ContentType = aws.String(o.ContentType)
+	}
+	// The size isn't known up front, so the upload may use several parts, and S3 only
+	// accepts a whole object checksum for single part uploads. Expected checksums are
+	// verified by Upload as the object is written, and recorded in the metadata instead.
+
+	pr, pw := io.Pipe()
+	input.Body = pr
+	w := &s3Writer{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+
+		result, err := s.uploader.UploadWithContext(ctx, input)
+		// Unblock any pending write if the upload failed.
+		_ = pr.CloseWithError(err)
+		if err != nil {
+			w.err = err
+			return
+		}
+
+		w.info = &storage.UploadInfo{
+			Location:  result.Location,
+			VersionID: result.VersionID,
+		}
+	}()
+
+	return w, nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close finishes the upload, and waits for it to complete.
+func (w *s3Writer) Close() error {
+	_ = w.pw.Close()
+	<-w.done
+
+	return w.err
+}
+
+func (w *s3Writer) Info() *storage.UploadInfo {
+	return w.info
+}
+
+// Download downloads a file from the storage backend to the given path.
+func (s *S3) Download(object string, toPath string, opts ...storage.GetOption) error {
+	return storage.DownloadTo(context.Background(), s, object, toPath, opts...)
 }
 
 // Get returns the contents of a file from the storage backend.
-func (s *S3) Get(object string) ([]byte, error) {
-	buf := aws.NewWriteAtBuffer([]byte{})
+func (s *S3) Get(object string, opts ...storage.GetOption) ([]byte, error) {
+	return storage.ReadAll(context.Background(), s, object, opts...)
+}
 
-	_, err := s.downloader.Download(buf, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(object),
+// Put uploads a file to the storage backend.
+func (s *S3) Put(object string, fromPath string, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	f, err := os.Open(fromPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return storage.Upload(context.Background(), s, object, f, opts...)
+}
+
+// PutBytes uploads a file to the storage backend.
+func (s *S3) PutBytes(object string, data []byte, opts ...storage.PutOption) (*storage.UploadInfo, error) {
+	return storage.Upload(context.Background(), s, object, bytes.NewReader(data), opts...)
+}
+
+// Stat returns information about a file.
+func (s *S3) Stat(ctx context.Context, object string) (*storage.Stat, error) {
+	result, err := s.uploader.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(object),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
 	})
 	if err != nil {
+		// HEAD responses have no body, so a missing object is only reported as NotFound.
 		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == s3.ErrCodeNoSuchKey {
+			if awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound" {
 				return nil, storage.ErrNotFound
 			}
 		}
+		return nil, err
 	}
 
-	return buf.Bytes(), err
+	return &storage.Stat{
+		Size:         aws.Int64Value(result.ContentLength),
+		LastModified: aws.TimeValue(result.LastModified),
+		ETag:         aws.StringValue(result.ETag),
+		SHA256:       checksumToHex(result.ChecksumSHA256),
+		ContentType:  aws.StringValue(result.ContentType),
+		VersionID:    aws.StringValue(result.VersionId),
+		Metadata:     convertMetadata(result.Metadata),
+	}, nil
 }
 
-// Put uploads a file to the storage backend.
-func (s *S3) Put(object string, fromPath string) (*storage.UploadInfo, error) {
-	f, err := os.Open(fromPath)
+// List returns a page of files starting with prefix.
+// Page tokens are S3 continuation tokens.
+func (s *S3) List(ctx context.Context, prefix string, pageToken string, opts ...storage.ListOption) (*storage.ListResult, error) {
+	o := storage.NewListOptions(opts...)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(o.PageSize)),
+	}
+	if pageToken != "" {
+		input.ContinuationToken = aws.String(pageToken)
+	}
+
+	result, err := s.uploader.S3.ListObjectsV2WithContext(ctx, input)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	result, err := s.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(object),
-		Body:   f,
+	list := &storage.ListResult{}
+	for _, object := range result.Contents {
+		list.Objects = append(list.Objects, &storage.Object{
+			Name:         aws.StringValue(object.Key),
+			Size:         aws.Int64Value(object.Size),
+			LastModified: aws.TimeValue(object.LastModified),
+			ETag:         aws.StringValue(object.ETag),
+		})
+	}
+	if aws.BoolValue(result.IsTruncated) {
+		list.NextPageToken = aws.StringValue(result.NextContinuationToken)
+	}
+
+	return list, nil
+}
+
+// ListVersions returns a page of file versions starting with prefix.
+// Versions are only kept if versioning is enabled on the bucket.
+// Page tokens are the key and version ID markers of S3, base64 encoded.
+func (s *S3) ListVersions(ctx context.Context, prefix string, pageToken string, opts ...storage.ListOption) (*storage.VersionListResult, error) {
+	o := storage.NewListOptions(opts...)
+
+	input := &s3.ListObjectVersionsInput{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(o.PageSize)),
+	}
+	if pageToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, errors.New("invalid page token")
+		}
+		keyMarker, versionIDMarker, _ := strings.Cut(string(decoded), "\x00")
+		input.KeyMarker = aws.String(keyMarker)
+		input.VersionIdMarker = aws.String(versionIDMarker)
+	}
+
+	result, err := s.uploader.S3.ListObjectVersionsWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &storage.VersionListResult{}
+	for _, version := range result.Versions {
+		list.Versions = append(list.Versions, &storage.ObjectVersion{
+			Name:         aws.StringValue(version.Key),
+			VersionID:    aws.StringValue(version.VersionId),
+			Size:         aws.Int64Value(version.Size),
+			LastModified: aws.TimeValue(version.LastModified),
+			ETag:         aws.StringValue(version.ETag),
+			IsLatest:     aws.BoolValue(version.IsLatest),
+		})
+	}
+	for _, marker := range result.DeleteMarkers {
+		list.Versions = append(list.Versions, &storage.ObjectVersion{
+			Name:           aws.StringValue(marker.Key),
+			VersionID:      aws.StringValue(marker.VersionId),
+			LastModified:   aws.TimeValue(marker.LastModified),
+			IsLatest:       aws.BoolValue(marker.IsLatest),
+			IsDeleteMarker: true,
+		})
+	}
+	// S3 returns versions and delete markers separately, both ordered by key and newest first.
+	sort.SliceStable(list.Versions, func(i, j int) bool {
+		a, b := list.Versions[i], list.Versions[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.IsLatest != b.IsLatest {
+			return a.IsLatest
+		}
+		return a.LastModified.After(b.LastModified)
 	})
+	if aws.BoolValue(result.IsTruncated) {
+		token := aws.StringValue(result.NextKeyMarker) + "\x00" + aws.StringValue(result.NextVersionIdMarker)
+		list.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(token))
+	}
 
-	return &storage.UploadInfo{
-		Location:  result.Location,
-		VersionID: result.VersionID,
-	}, err
+	return list, nil
 }
 
-// PutBytes uploads a file to the storage backend.
-func (s *S3) PutBytes(object string, data []byte) (*storage.UploadInfo, error) {
-	result, err := s.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(object),
-		Body:   aws.ReadSeekCloser(bytes.NewBuffer(data)),
+// DeleteVersion permanently deletes a version of a file.
+func (s *S3) DeleteVersion(ctx context.Context, object string, versionID string) error {
+	_, err := s.uploader.S3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket:    aws.String(s.bucket),
+		Key:       aws.String(object),
+		VersionId: aws.String(versionID),
 	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case s3.ErrCodeNoSuchKey, "NoSuchVersion":
+				return storage.ErrNotFound
+			}
+		}
+		return err
+	}
+
+	return nil
+}
 
-	return &storage.UploadInfo{
-		Location:  result.Location,
-		VersionID: result.VersionID,
-	}, err
+// SignURL returns a presigned S3 URL.
+// Presigned URLs can be valid for at most 7 days.
+func (s *S3) SignURL(ctx context.Context, object string, method string, expires time.Duration) (string, error) {
+	var req *request.Request
+	switch method {
+	case http.MethodGet:
+		req, _ = s.uploader.S3.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(object),
+		})
+	case http.MethodPut:
+		req, _ = s.uploader.S3.PutObjectRequest(&s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(object),
+		})
+	default:
+		return "", errors.Errorf("can't sign %s URLs", method)
+	}
+	req.SetContext(ctx)
+
+	return req.Presign(expires)
+}
+
+// checksumToHex converts a base64 encoded S3 checksum to hex.
+func checksumToHex(checksum *string) string {
+	if checksum == nil {
+		return ""
+	}
+
+	// Checksums of multipart uploads are a checksum of checksums, suffixed with the part count.
+	if strings.Contains(*checksum, "-") {
+		return ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(*checksum)
+	if err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(decoded)
+}
+
+// convertMetadata converts S3 metadata, which the SDK returns with canonicalized keys ("Foo-Bar").
+func convertMetadata(metadata map[string]*string) map[string]string {
+	return storage.LowerMetadata(aws.StringValueMap(metadata))
 }
 
 // Delete deletes a file from the storage backend.
@@ -188,3 +470,18 @@ func (s *S3) CanReadURI(uri string) (bool, error) {
 
 	return true, nil
 }
+
+// ObjectFromURI returns the key of an s3://bucket/key URI.
+// Everything after the bucket is the key, like the AWS CLI, so keys may contain # and ?.
+func (s *S3) ObjectFromURI(uri string) (string, error) {
+	ok, err := s.CanReadURI(uri)
+	if err != nil {
+		return "", err
+	}
+	prefix := "s3://" + s.bucket + "/"
+	if !ok || !strings.HasPrefix(uri, prefix) || uri == prefix {
+		return "", storage.ErrUnsupportedURI
+	}
+
+	return strings.TrimPrefix(uri, prefix), nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestObjectFromURI(t *testing.T) {
+	s := &S3{bucket: "bucket"}
+
+	tests := []struct {
+		uri    string
+		object string
+		err    error
+	}{
+		{uri: "s3://bucket/kernels/lt.tar.xz", object: "kernels/lt.tar.xz"},
+		{uri: "s3://bucket/kernels/lt#1.tar.xz", object: "kernels/lt#1.tar.xz"},
+		{uri: "s3://bucket/kernels/lt?version=1", object: "kernels/lt?version=1"},
+		{uri: "s3://bucket/kernels/lt%20x", object: "kernels/lt%20x"},
+		{uri: "s3://bucket/", err: storage.ErrUnsupportedURI},
+		{uri: "s3://bucket", err: storage.ErrUnsupportedURI},
+		{uri: "s3://other/kernels/lt.tar.xz", err: storage.ErrUnsupportedURI},
+		{uri: "file:///bucket/kernels/lt.tar.xz", err: storage.ErrUnsupportedURI},
+	}
+
+	for _, test := range tests {
+		object, err := s.ObjectFromURI(test.uri)
+		if test.err != nil {
+			require.ErrorIs(t, err, test.err, test.uri)
+			continue
+		}
+		require.Nil(t, err, test.uri)
+		require.Equal(t, test.object, object, test.uri)
+	}
+}
+
+// multipartServer is a minimal S3 API accepting single and multipart uploads.
+// Like S3, it rejects parts without a checksum if their multipart upload was
+// created with a checksum algorithm.
+type multipartServer struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	parts   map[string]map[int][]byte
+	// checksummed contains the multipart uploads created with a checksum algorithm.
+	checksummed map[string]bool
+	uploads     int
+}
+
+func (s *multipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.uploads++
+		uploadID := strconv.Itoa(s.uploads)
+		s.parts[uploadID] = map[int][]byte{}
+		s.checksummed[uploadID] = r.Header.Get("x-amz-checksum-algorithm") != ""
+		_, _ = fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, uploadID)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		if s.checksummed[query.Get("uploadId")] && r.Header.Get("x-amz-checksum-sha256") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprint(w, `<Error><Code>InvalidRequest</Code><Message>Checksum Type mismatch occurred</Message></Error>`)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		s.parts[query.Get("uploadId")][number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := s.parts[query.Get("uploadId")]
+		var object []byte
+		for number := 1; number <= len(parts); number++ {
+			object = append(object, parts[number]...)
+		}
+		s.objects[key] = object
+		_, _ = fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"multipart"</ETag></CompleteMultipartUploadResult>`, key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.parts, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+		w.Header().Set("ETag", `"single"`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestUpload_LargerThanPart(t *testing.T) {
+	server := &multipartServer{
+		objects:     map[string][]byte{},
+		parts:       map[string]map[int][]byte{},
+		checksummed: map[string]bool{},
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(httpServer.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	require.Nil(t, err)
+	s := &S3{
+		bucket:   "bucket",
+		uploader: s3manager.NewUploader(sess),
+	}
+
+	for _, size := range []int64{1024, 2*s3manager.DefaultUploadPartSize + 1} {
+		data := make([]byte, size)
+		_, err = rand.Read(data)
+		require.Nil(t, err)
+		digest := sha256.Sum256(data)
+
+		object := fmt.Sprintf("objects/%d", size)
+		_, err = storage.Upload(context.Background(), s, object, bytes.NewReader(data), storage.WithSHA256(hex.EncodeToString(digest[:])))
+		require.Nil(t, err)
+		require.Equal(t, data, server.objects[object])
+
+		// A body not matching the checksum is still rejected.
+		data[0]++
+		_, err = storage.Upload(context.Background(), s, object+"-corrupt", bytes.NewReader(data), storage.WithSHA256(hex.EncodeToString(digest[:])))
+		require.ErrorIs(t, err, storage.ErrChecksumMismatch)
+		require.NotContains(t, server.objects, object+"-corrupt")
+	}
+	require.Equal(t, 2, server.uploads)
+}
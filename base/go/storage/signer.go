@@ -0,0 +1,143 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrSigningUnsupported is returned when the backend can't issue signed URLs.
+	ErrSigningUnsupported = errors.New("storage backend does not support signed URLs")
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrSignatureExpired   = errors.New("signature expired")
+)
+
+const (
+	hmacExpiresParam   = "X-Peridot-Expires"
+	hmacSignatureParam = "X-Peridot-Signature"
+)
+
+// URLSigner is implemented by backends that can issue time-limited URLs, so
+// clients can read or write objects directly instead of through our services.
+type URLSigner interface {
+	// SignURL returns a URL that allows method (http.MethodGet or http.MethodPut)
+	// on object until expires has passed.
+	SignURL(ctx context.Context, object string, method string, expires time.Duration) (string, error)
+}
+
+// SignURL returns a signed URL for an object.
+// Returns ErrSigningUnsupported if the backend doesn't implement URLSigner.
+func SignURL(ctx context.Context, st Storage, object string, method string, expires time.Duration) (string, error) {
+	signer, ok := st.(URLSigner)
+	if !ok {
+		return "", ErrSigningUnsupported
+	}
+	if method != http.MethodGet && method != http.MethodPut {
+		return "", fmt.Errorf("can't sign %s URLs", method)
+	}
+
+	return signer.SignURL(ctx, object, method, expires)
+}
+
+// signedStorage adds a URLSigner to a backend.
+type signedStorage struct {
+	Storage
+	signer URLSigner
+}
+
+func (s *signedStorage) SignURL(ctx context.Context, object string, method string, expires time.Duration) (string, error) {
+	return s.signer.SignURL(ctx, object, method, expires)
+}
+
+// Signed returns st with signed URLs issued by signer.
+// Used to add an HMACSigner to backends that can't sign URLs themselves.
+func Signed(st Storage, signer URLSigner) Storage {
+	return &signedStorage{
+		Storage: st,
+		signer:  signer,
+	}
+}
+
+// HMACSigner signs URLs pointing to a handler that serves objects after
+// verifying the signature, see base.NewStorageHandler.
+type HMACSigner struct {
+	baseURL string
+	key     []byte
+}
+
+// NewHMACSigner creates a signer for URLs under baseURL, where the handler is served.
+// Objects are appended to baseURL, for example https://example.com/_storage/kernels/lt.tar.xz.
+// The key must be shared by every replica signing or verifying URLs.
+func NewHMACSigner(baseURL string, key []byte) (*HMACSigner, error) {
+	if len(key) == 0 {
+		return nil, errors.New("signing key is required")
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, err
+	}
+
+	return &HMACSigner{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		key:     key,
+	}, nil
+}
+
+func (s *HMACSigner) signature(object string, method string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = fmt.Fprintf(mac, "%s\n%s\n%d", method, object, expiresAt)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *HMACSigner) SignURL(ctx context.Context, object string, method string, expires time.Duration) (string, error) {
+	expiresAt := time.Now().Add(expires).Unix()
+
+	query := url.Values{}
+	query.Set(hmacExpiresParam, strconv.FormatInt(expiresAt, 10))
+	query.Set(hmacSignatureParam, s.signature(object, method, expiresAt))
+
+	escaped := (&url.URL{Path: object}).EscapedPath()
+	return fmt.Sprintf("%s/%s?%s", s.baseURL, escaped, query.Encode()), nil
+}
+
+// Verify checks the signature of a request for object.
+// Returns ErrInvalidSignature if the signature doesn't match, and ErrSignatureExpired if it has expired.
+func (s *HMACSigner) Verify(object string, method string, query url.Values) error {
+	expiresAt, err := strconv.ParseInt(query.Get(hmacExpiresParam), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	expected := s.signature(object, method, expiresAt)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(hmacSignatureParam))) {
+		return ErrInvalidSignature
+	}
+	if time.Now().Unix() > expiresAt {
+		return ErrSignatureExpired
+	}
+
+	return nil
+}
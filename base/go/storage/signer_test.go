@@ -0,0 +1,91 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseSigned(t *testing.T, signed string) (string, url.Values) {
+	u, err := url.Parse(signed)
+	require.Nil(t, err)
+
+	return strings.TrimPrefix(u.Path, "/_storage/"), u.Query()
+}
+
+func TestHMACSigner(t *testing.T) {
+	signer, err := NewHMACSigner("https://example.com/_storage/", []byte("key"))
+	require.Nil(t, err)
+
+	signed, err := signer.SignURL(context.Background(), "kernels/lt 6.1.tar.xz", http.MethodGet, time.Minute)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(signed, "https://example.com/_storage/kernels/lt%206.1.tar.xz?"), signed)
+
+	object, query := parseSigned(t, signed)
+	require.Equal(t, "kernels/lt 6.1.tar.xz", object)
+	require.Nil(t, signer.Verify(object, http.MethodGet, query))
+
+	// The signature is bound to the object, the method and the key.
+	require.ErrorIs(t, signer.Verify("kernels/other", http.MethodGet, query), ErrInvalidSignature)
+	require.ErrorIs(t, signer.Verify(object, http.MethodPut, query), ErrInvalidSignature)
+	other, err := NewHMACSigner("https://example.com/_storage/", []byte("other"))
+	require.Nil(t, err)
+	require.ErrorIs(t, other.Verify(object, http.MethodGet, query), ErrInvalidSignature)
+
+	// Extending the expiry invalidates the signature.
+	query.Set(hmacExpiresParam, "99999999999")
+	require.ErrorIs(t, signer.Verify(object, http.MethodGet, query), ErrInvalidSignature)
+	require.ErrorIs(t, signer.Verify(object, http.MethodGet, url.Values{}), ErrInvalidSignature)
+}
+
+func TestHMACSigner_Expired(t *testing.T) {
+	signer, err := NewHMACSigner("https://example.com/_storage", []byte("key"))
+	require.Nil(t, err)
+
+	signed, err := signer.SignURL(context.Background(), "foo", http.MethodPut, -time.Minute)
+	require.Nil(t, err)
+
+	object, query := parseSigned(t, signed)
+	require.ErrorIs(t, signer.Verify(object, http.MethodPut, query), ErrSignatureExpired)
+}
+
+func TestNewHMACSigner_NoKey(t *testing.T) {
+	_, err := NewHMACSigner("https://example.com/_storage", nil)
+	require.NotNil(t, err)
+}
+
+func TestSignURL(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := SignURL(ctx, nil, "foo", http.MethodGet, time.Minute)
+	require.ErrorIs(t, err, ErrSigningUnsupported)
+
+	signer, err := NewHMACSigner("https://example.com/_storage", []byte("key"))
+	require.Nil(t, err)
+	st := Signed(nil, signer)
+
+	signed, err := SignURL(ctx, st, "foo", http.MethodGet, time.Minute)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(signed, "https://example.com/_storage/foo?"))
+
+	_, err = SignURL(ctx, st, "foo", http.MethodDelete, time.Minute)
+	require.NotNil(t, err)
+}
@@ -14,9 +14,19 @@
 
 package storage
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
 
-var ErrNotFound = errors.New("not found")
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidRange is returned when a range read starts beyond the end of the object.
+	ErrInvalidRange = errors.New("invalid range")
+)
 
 // UploadInfo is the information about an upload.
 type UploadInfo struct {
@@ -27,21 +37,257 @@ type UploadInfo struct {
 	VersionID *string
 }
 
+// Stat is the information about a stored object.
+type Stat struct {
+	// Size is the size of the whole object, also for range reads.
+	Size int64
+
+	// LastModified is when the object was last written, zero if the backend doesn't track it.
+	LastModified time.Time
+
+	// ETag identifies the contents of the object, empty if the backend doesn't support it.
+	ETag string
+
+	// SHA256 is the hex encoded SHA-256 checksum of the object, empty if unknown.
+	// S3 only knows the checksum of objects uploaded with one.
+	SHA256 string
+
+	// ContentType is the content type set when the object was uploaded.
+	ContentType string
+
+	// VersionID is the version of the object, empty if the backend doesn't support versioning.
+	VersionID string
+
+	// Metadata is the user metadata set when the object was uploaded.
+	// Keys are always lower case.
+	Metadata map[string]string
+}
+
+// Object is an entry returned by List.
+type Object struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+// ListResult is a page of objects.
+type ListResult struct {
+	Objects []*Object
+
+	// NextPageToken continues the listing, empty on the last page.
+	NextPageToken string
+}
+
+// DefaultListPageSize is the page size of List, the maximum S3 supports.
+const DefaultListPageSize = 1000
+
+type ListOptions struct {
+	PageSize int
+}
+
+type ListOption func(*ListOptions)
+
+// WithPageSize sets the maximum number of objects in a page.
+func WithPageSize(pageSize int) ListOption {
+	return func(o *ListOptions) {
+		o.PageSize = pageSize
+	}
+}
+
+// NewListOptions applies the given options, backends use this to read the options passed to List.
+// The page size is clamped to DefaultListPageSize.
+func NewListOptions(opts ...ListOption) *ListOptions {
+	o := &ListOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.PageSize <= 0 || o.PageSize > DefaultListPageSize {
+		o.PageSize = DefaultListPageSize
+	}
+
+	return o
+}
+
+type PutOptions struct {
+	ContentType string
+	Metadata    map[string]string
+
+	// SHA256 is the expected hex encoded SHA-256 digest of the contents.
+	SHA256 string
+
+	// SHA512 is the expected hex encoded SHA-512 digest of the contents.
+	SHA512 string
+}
+
+type PutOption func(*PutOptions)
+
+// WithContentType sets the content type of the object.
+func WithContentType(contentType string) PutOption {
+	return func(o *PutOptions) {
+		o.ContentType = contentType
+	}
+}
+
+// WithMetadata sets user metadata on the object.
+// Keys are stored in lower case.
+func WithMetadata(metadata map[string]string) PutOption {
+	return func(o *PutOptions) {
+		o.Metadata = metadata
+	}
+}
+
+// WithSHA256 sets the expected hex encoded SHA-256 digest of the contents.
+// Put, PutBytes and Upload fail with ErrChecksumMismatch if the contents don't match,
+// and nothing is stored. The digest is recorded in the metadata of the object.
+func WithSHA256(digest string) PutOption {
+	return func(o *PutOptions) {
+		o.SHA256 = digest
+	}
+}
+
+// WithSHA512 sets the expected hex encoded SHA-512 digest of the contents.
+// Like WithSHA256, it is checked on upload and recorded in the metadata of the object.
+func WithSHA512(digest string) PutOption {
+	return func(o *PutOptions) {
+		o.SHA512 = digest
+	}
+}
+
+// NewPutOptions applies the given options, backends use this to read the options passed to a write.
+// Expected digests are added to the metadata, under MetadataSHA256 and MetadataSHA512.
+func NewPutOptions(opts ...PutOption) *PutOptions {
+	o := &PutOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.SHA256 != "" || o.SHA512 != "" {
+		metadata := LowerMetadata(o.Metadata)
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		if o.SHA256 != "" {
+			metadata[MetadataSHA256] = o.SHA256
+		}
+		if o.SHA512 != "" {
+			metadata[MetadataSHA512] = o.SHA512
+		}
+		o.Metadata = metadata
+	}
+
+	return o
+}
+
+type GetOptions struct {
+	Verify bool
+}
+
+type GetOption func(*GetOptions)
+
+// WithVerify checks the contents against the expected digests of the object,
+// Get and Download return ErrChecksumMismatch if they don't match.
+func WithVerify() GetOption {
+	return func(o *GetOptions) {
+		o.Verify = true
+	}
+}
+
+// NewGetOptions applies the given options, backends use this to read the options passed to Get and Download.
+func NewGetOptions(opts ...GetOption) *GetOptions {
+	o := &GetOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// Writer uploads an object as it is written.
+// The object is only stored once Close returns without error.
+// Cancelling the context passed to Create aborts the upload, nothing is stored.
+type Writer interface {
+	io.WriteCloser
+
+	// Info returns the information about the upload, only set after a successful Close.
+	Info() *UploadInfo
+}
+
+type OpenOptions struct {
+	// Offset is the first byte to read.
+	Offset int64
+
+	// Length is the number of bytes to read, zero or less reads until the end.
+	Length int64
+}
+
+type OpenOption func(*OpenOptions)
+
+// WithRange only reads length bytes starting at offset.
+// A length of zero or less reads until the end of the object.
+func WithRange(offset int64, length int64) OpenOption {
+	return func(o *OpenOptions) {
+		o.Offset = offset
+		o.Length = length
+	}
+}
+
+// NewOpenOptions applies the given options, backends use this to read the options passed to Open.
+func NewOpenOptions(opts ...OpenOption) *OpenOptions {
+	o := &OpenOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// IsRange returns whether only part of the object should be read.
+func (o *OpenOptions) IsRange() bool {
+	return o.Offset > 0 || o.Length > 0
+}
+
+// HTTPRange returns the range as an HTTP Range header value.
+func (o *OpenOptions) HTTPRange() string {
+	if o.Length <= 0 {
+		return fmt.Sprintf("bytes=%d-", o.Offset)
+	}
+
+	return fmt.Sprintf("bytes=%d-%d", o.Offset, o.Offset+o.Length-1)
+}
+
 // Storage is an interface for storage backends.
 // Usually S3, but can be anything.
 type Storage interface {
+	// Open returns a reader for the contents of a file, and information about the file.
+	// Returns ErrNotFound if the file does not exist, and ErrInvalidRange if a
+	// range starts beyond the end of the file.
+	Open(ctx context.Context, object string, opts ...OpenOption) (io.ReadCloser, *Stat, error)
+
+	// Create returns a writer that uploads a file to the storage backend.
+	// The file is only stored once the writer is closed.
+	Create(ctx context.Context, object string, opts ...PutOption) (Writer, error)
+
+	// Stat returns information about a file.
+	// Returns ErrNotFound if the file does not exist.
+	Stat(ctx context.Context, object string) (*Stat, error)
+
+	// List returns a page of files starting with prefix, ordered by name.
+	// Pass the NextPageToken of the result to get the next page.
+	List(ctx context.Context, prefix string, pageToken string, opts ...ListOption) (*ListResult, error)
+
 	// Download downloads a file from the storage backend to the given path.
-	Download(object string, toPath string) error
+	Download(object string, toPath string, opts ...GetOption) error
 
 	// Get returns the contents of a file from the storage backend.
 	// Returns ErrNotFound if the file does not exist.
-	Get(object string) ([]byte, error)
+	Get(object string, opts ...GetOption) ([]byte, error)
 
 	// Put uploads a file to the storage backend.
-	Put(object string, fromPath string) (*UploadInfo, error)
+	Put(object string, fromPath string, opts ...PutOption) (*UploadInfo, error)
 
 	// PutBytes uploads a file to the storage backend.
-	PutBytes(object string, data []byte) (*UploadInfo, error)
+	PutBytes(object string, data []byte, opts ...PutOption) (*UploadInfo, error)
 
 	// Delete deletes a file from the storage backend.
 	// Returns ErrNotFound if the file does not exist.
@@ -51,7 +297,25 @@ type Storage interface {
 	// Returns false if the file does not exist.
 	Exists(object string) (bool, error)
 
+	// ListVersions returns a page of object versions starting with prefix,
+	// ordered by name and newest first.
+	// Backends without versioning return the current version of every object.
+	ListVersions(ctx context.Context, prefix string, pageToken string, opts ...ListOption) (*VersionListResult, error)
+
+	// OpenVersion is like Open, but for a specific version of a file.
+	// Returns ErrNotFound if the version does not exist or is a delete marker.
+	OpenVersion(ctx context.Context, object string, versionID string, opts ...OpenOption) (io.ReadCloser, *Stat, error)
+
+	// DeleteVersion permanently deletes a version of a file.
+	// If it was the current version, the previous version becomes current.
+	// Returns ErrNotFound if the version does not exist.
+	DeleteVersion(ctx context.Context, object string, versionID string) error
+
 	// CanReadURI checks if a URI can be read by the storage backend.
 	// Returns false if the URI cannot be read.
 	CanReadURI(uri string) (bool, error)
+
+	// ObjectFromURI returns the object a URI accepted by CanReadURI points to.
+	// Returns ErrUnsupportedURI if the URI cannot be read by the storage backend.
+	ObjectFromURI(uri string) (string, error)
 }
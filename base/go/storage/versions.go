@@ -0,0 +1,235 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+// NullVersionID is the version ID of objects written before versioning was enabled, like in S3.
+const NullVersionID = "null"
+
+// NewVersionID returns a new version ID for backends that emulate versioning.
+// Version IDs of later writes sort after earlier ones.
+func NewVersionID() (string, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+// ObjectVersion is an entry returned by ListVersions.
+type ObjectVersion struct {
+	Name      string
+	VersionID string
+	Size      int64
+	// LastModified is when this version was written.
+	LastModified time.Time
+	ETag         string
+	// IsLatest is true for the current version of the object.
+	IsLatest bool
+	// IsDeleteMarker is true if this version records a delete, it has no contents.
+	IsDeleteMarker bool
+}
+
+// VersionListResult is a page of object versions.
+type VersionListResult struct {
+	Versions []*ObjectVersion
+
+	// NextPageToken continues the listing, empty on the last page.
+	NextPageToken string
+}
+
+// ObjectVersions returns every version of an object, newest first.
+func ObjectVersions(ctx context.Context, st Storage, object string) ([]*ObjectVersion, error) {
+	var versions []*ObjectVersion
+	var token string
+	for {
+		page, err := st.ListVersions(ctx, object, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range page.Versions {
+			// Other objects can start with the same name.
+			if version.Name == object {
+				versions = append(versions, version)
+			}
+		}
+
+		token = page.NextPageToken
+		if token == "" || (len(page.Versions) > 0 && page.Versions[len(page.Versions)-1].Name > object) {
+			return versions, nil
+		}
+	}
+}
+
+// GetVersion returns the contents of a version of an object.
+func GetVersion(ctx context.Context, st Storage, object string, versionID string) ([]byte, error) {
+	r, _, err := st.OpenVersion(ctx, object, versionID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// DownloadVersion downloads a version of an object to the given path.
+func DownloadVersion(ctx context.Context, st Storage, object string, versionID string, toPath string) error {
+	r, _, err := st.OpenVersion(ctx, object, versionID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeFile(toPath, r)
+}
+
+// RestoreVersion makes a previous version of an object the current one, by writing it again.
+// The content type and metadata of the version are kept, and the versions in between are not touched.
+func RestoreVersion(ctx context.Context, st Storage, object string, versionID string) (*UploadInfo, error) {
+	r, stat, err := st.OpenVersion(ctx, object, versionID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return Upload(ctx, st, object, r, WithContentType(stat.ContentType), WithMetadata(stat.Metadata))
+}
+
+// RetentionPolicy decides which noncurrent versions are deleted by ApplyRetention.
+// The current version of an object is never deleted.
+type RetentionPolicy struct {
+	// KeepLast is the number of versions to keep, including the current one.
+	// Zero keeps every version.
+	KeepLast int
+
+	// MaxAge deletes versions that have been noncurrent for longer than this.
+	// Zero keeps versions regardless of their age.
+	MaxAge time.Duration
+
+	// DryRun only counts what would be deleted.
+	DryRun bool
+}
+
+// RetentionStats is the result of ApplyRetention.
+type RetentionStats struct {
+	// Objects is the number of objects checked.
+	Objects int
+	// Deleted is the number of versions (and delete markers) deleted.
+	Deleted int
+}
+
+// ApplyRetention deletes the noncurrent versions of every object under prefix that fall outside policy.
+// Delete markers are removed once no noncurrent versions are left behind them.
+func ApplyRetention(ctx context.Context, st Storage, prefix string, policy *RetentionPolicy) (*RetentionStats, error) {
+	stats := &RetentionStats{}
+
+	var token string
+	var versions []*ObjectVersion
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := st.ListVersions(ctx, prefix, token)
+		if err != nil {
+			return nil, err
+		}
+
+		// Versions of an object can span pages, so an object is only handled
+		// once a version of the next object (or the last page) is seen.
+		for _, version := range page.Versions {
+			if len(versions) > 0 && versions[0].Name != version.Name {
+				err := applyRetention(ctx, st, versions, policy, stats)
+				if err != nil {
+					return nil, err
+				}
+				versions = nil
+			}
+			versions = append(versions, version)
+		}
+
+		token = page.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	if len(versions) > 0 {
+		err := applyRetention(ctx, st, versions, policy, stats)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// applyRetention applies the policy to the versions of a single object, ordered newest first.
+func applyRetention(ctx context.Context, st Storage, versions []*ObjectVersion, policy *RetentionPolicy, stats *RetentionStats) error {
+	stats.Objects++
+
+	var remove []*ObjectVersion
+	kept := 0
+	for i, version := range versions {
+		if i == 0 {
+			if !version.IsDeleteMarker {
+				kept++
+			}
+			continue
+		}
+		if version.IsDeleteMarker {
+			// Delete markers that aren't current don't hide anything.
+			remove = append(remove, version)
+			continue
+		}
+
+		// A version becomes noncurrent when the next one is written.
+		noncurrentSince := versions[i-1].LastModified
+		expired := policy.MaxAge > 0 && time.Since(noncurrentSince) > policy.MaxAge
+		if expired || (policy.KeepLast > 0 && kept >= policy.KeepLast) {
+			remove = append(remove, version)
+			continue
+		}
+		kept++
+	}
+
+	// A current delete marker with nothing behind it only hides a deleted object.
+	if versions[0].IsDeleteMarker && kept == 0 {
+		remove = append(remove, versions[0])
+	}
+
+	stats.Deleted += len(remove)
+	if policy.DryRun {
+		return nil
+	}
+	for _, version := range remove {
+		err := st.DeleteVersion(ctx, version.Name, version.VersionID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"testing"
+	"time"
+)
+
+func putVersions(t *testing.T, st storage.Storage, object string, count int) {
+	for i := 0; i < count; i++ {
+		_, err := st.PutBytes(object, []byte(fmt.Sprintf("%s-%d", object, i)))
+		require.Nil(t, err)
+	}
+}
+
+func requireVersions(t *testing.T, st storage.Storage, object string, expected int) {
+	t.Helper()
+
+	versions, err := storage.ObjectVersions(context.Background(), st, object)
+	require.Nil(t, err)
+	require.Len(t, versions, expected, object)
+}
+
+func TestObjectVersions(t *testing.T) {
+	st := storage_memory.New(memfs.New(), storage_memory.WithVersioning())
+	putVersions(t, st, "foo", 3)
+	putVersions(t, st, "foobar", 2)
+
+	requireVersions(t, st, "foo", 3)
+	requireVersions(t, st, "foobar", 2)
+	requireVersions(t, st, "missing", 0)
+}
+
+func TestApplyRetention_KeepLast(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New(), storage_memory.WithVersioning())
+	putVersions(t, st, "kernels/a", 5)
+	putVersions(t, st, "kernels/b", 1)
+	putVersions(t, st, "other", 5)
+
+	stats, err := storage.ApplyRetention(ctx, st, "kernels/", &storage.RetentionPolicy{KeepLast: 2, DryRun: true})
+	require.Nil(t, err)
+	require.Equal(t, &storage.RetentionStats{Objects: 2, Deleted: 3}, stats)
+	requireVersions(t, st, "kernels/a", 5)
+
+	stats, err = storage.ApplyRetention(ctx, st, "kernels/", &storage.RetentionPolicy{KeepLast: 2})
+	require.Nil(t, err)
+	require.Equal(t, &storage.RetentionStats{Objects: 2, Deleted: 3}, stats)
+	requireVersions(t, st, "kernels/a", 2)
+	requireVersions(t, st, "kernels/b", 1)
+	requireVersions(t, st, "other", 5)
+
+	// The newest versions are kept.
+	data, err := st.Get("kernels/a")
+	require.Nil(t, err)
+	require.Equal(t, []byte("kernels/a-4"), data)
+	versions, err := storage.ObjectVersions(ctx, st, "kernels/a")
+	require.Nil(t, err)
+	data, err = storage.GetVersion(ctx, st, "kernels/a", versions[1].VersionID)
+	require.Nil(t, err)
+	require.Equal(t, []byte("kernels/a-3"), data)
+}
+
+func TestApplyRetention_MaxAge(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New(), storage_memory.WithVersioning())
+	putVersions(t, st, "foo", 2)
+	time.Sleep(100 * time.Millisecond)
+	putVersions(t, st, "foo", 1)
+
+	// The first version has been noncurrent since the second was written, the second only just now.
+	stats, err := storage.ApplyRetention(ctx, st, "", &storage.RetentionPolicy{MaxAge: 50 * time.Millisecond})
+	require.Nil(t, err)
+	require.Equal(t, 1, stats.Deleted)
+	requireVersions(t, st, "foo", 2)
+}
+
+func TestApplyRetention_DeleteMarkers(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New(), storage_memory.WithVersioning())
+	putVersions(t, st, "foo", 2)
+	require.Nil(t, st.Delete("foo"))
+
+	stats, err := storage.ApplyRetention(ctx, st, "", &storage.RetentionPolicy{KeepLast: 1})
+	require.Nil(t, err)
+	require.Equal(t, 1, stats.Deleted)
+	requireVersions(t, st, "foo", 2)
+
+	// Once nothing is left behind it, the delete marker is removed too.
+	stats, err = storage.ApplyRetention(ctx, st, "", &storage.RetentionPolicy{MaxAge: time.Nanosecond})
+	require.Nil(t, err)
+	require.Equal(t, 2, stats.Deleted)
+	requireVersions(t, st, "foo", 0)
+}
+
+func TestRestoreVersion(t *testing.T) {
+	ctx := context.Background()
+	st := storage_memory.New(memfs.New(), storage_memory.WithVersioning())
+
+	v1, err := st.PutBytes("foo", []byte("1"), storage.WithMetadata(map[string]string{"kernel": "lt"}))
+	require.Nil(t, err)
+	_, err = st.PutBytes("foo", []byte("2"))
+	require.Nil(t, err)
+
+	_, err = storage.RestoreVersion(ctx, st, "foo", *v1.VersionID)
+	require.Nil(t, err)
+
+	stat, err := st.Stat(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"kernel": "lt"}, stat.Metadata)
+	data, err := st.Get("foo")
+	require.Nil(t, err)
+	require.Equal(t, []byte("1"), data)
+	requireVersions(t, st, "foo", 3)
+
+	_, err = storage.RestoreVersion(ctx, st, "foo", "missing")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+}
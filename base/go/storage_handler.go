@@ -0,0 +1,151 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"context"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.resf.org/peridot/base/go/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redirectHeader is the gRPC header RedirectToSignedURL uses to tell the gateway to redirect.
+const redirectHeader = "x-peridot-redirect"
+
+// NewStorageHandler serves objects from st to clients with a URL signed by signer.
+// Mount it at the path of the signer base URL, for example:
+//
+//	base.WithHTTPHandler("/_storage/", base.NewStorageHandler("/_storage/", st, signer))
+//
+// GET requests download the object, PUT requests upload the request body.
+func NewStorageHandler(prefix string, st storage.Storage, signer *storage.HMACSigner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		object := strings.TrimPrefix(r.URL.Path, prefix)
+		if object == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		err := signer.Verify(object, r.Method, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			reader, stat, err := st.Open(r.Context(), object)
+			if err != nil {
+				if err == storage.ErrNotFound {
+					http.NotFound(w, r)
+					return
+				}
+				LogErrorf("failed to open %s: %v", object, err)
+				http.Error(w, "failed to open object", http.StatusInternalServerError)
+				return
+			}
+			defer reader.Close()
+
+			if stat.ContentType != "" {
+				w.Header().Set("Content-Type", stat.ContentType)
+			} else {
+				w.Header().Set("Content-Type", "application/octet-stream")
+			}
+			if stat.ETag != "" {
+				w.Header().Set("ETag", stat.ETag)
+			}
+			w.Header().Set("Content-Length", strconv.FormatInt(stat.Size, 10))
+			_, err = io.Copy(w, reader)
+			if err != nil {
+				LogErrorf("failed to serve %s: %v", object, err)
+			}
+		case http.MethodPut:
+			var opts []storage.PutOption
+			if contentType := r.Header.Get("Content-Type"); contentType != "" {
+				opts = append(opts, storage.WithContentType(contentType))
+			}
+
+			_, err := storage.Upload(r.Context(), st, object, r.Body, opts...)
+			if err != nil {
+				LogErrorf("failed to upload %s: %v", object, err)
+				http.Error(w, "failed to upload object", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// SignURL returns a signed URL for an object and when it expires, ready to be returned by an API.
+// Errors are gRPC status errors.
+func SignURL(ctx context.Context, st storage.Storage, object string, method string, expires time.Duration) (string, *timestamppb.Timestamp, error) {
+	expiresAt := time.Now().Add(expires)
+
+	signed, err := storage.SignURL(ctx, st, object, method, expires)
+	if err != nil {
+		if err == storage.ErrSigningUnsupported {
+			return "", nil, status.Error(codes.Unimplemented, "direct access to objects is not supported")
+		}
+		LogErrorf("failed to sign URL for %s: %v", object, err)
+		return "", nil, status.Error(codes.Internal, "failed to sign URL")
+	}
+
+	return signed, timestamppb.New(expiresAt), nil
+}
+
+// RedirectToSignedURL makes the gRPC-gateway respond with a redirect to a signed GET URL
+// for object, so HTTP clients download it directly from storage.
+// gRPC clients get the URL in the x-peridot-redirect header.
+func RedirectToSignedURL(ctx context.Context, st storage.Storage, object string, expires time.Duration) error {
+	signed, _, err := SignURL(ctx, st, object, http.MethodGet, expires)
+	if err != nil {
+		return err
+	}
+
+	return grpc.SetHeader(ctx, metadata.Pairs(redirectHeader, signed))
+}
+
+// redirectResponseOption turns the header set by RedirectToSignedURL into an HTTP redirect.
+func redirectResponseOption(ctx context.Context, w http.ResponseWriter, _ proto.Message) error {
+	md, ok := runtime.ServerMetadataFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	values := md.HeaderMD.Get(redirectHeader)
+	if len(values) == 0 {
+		return nil
+	}
+
+	// Don't forward the header to HTTP clients as well.
+	w.Header().Del(runtime.MetadataHeaderPrefix + redirectHeader)
+	w.Header().Set("Location", values[0])
+	w.WriteHeader(http.StatusFound)
+
+	return nil
+}
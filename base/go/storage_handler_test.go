@@ -0,0 +1,151 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"context"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/storage"
+	storage_memory "go.resf.org/peridot/base/go/storage/memory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newSignedStorage(t *testing.T) (storage.Storage, string) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	signer, err := storage.NewHMACSigner(server.URL+"/_storage/", []byte("key"))
+	require.Nil(t, err)
+
+	st := storage.Signed(storage_memory.New(memfs.New()), signer)
+	mux.Handle("/_storage/", NewStorageHandler("/_storage/", st, signer))
+
+	return st, server.URL
+}
+
+func TestStorageHandler(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newSignedStorage(t)
+
+	putURL, expiresAt, err := SignURL(ctx, st, "kernels/lt.tar.xz", http.MethodPut, time.Minute)
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Minute), expiresAt.AsTime(), time.Second*5)
+
+	req, err := http.NewRequest(http.MethodPut, putURL, bytes.NewReader([]byte("kernel")))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/x-xz")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Nil(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	stat, err := st.Stat(ctx, "kernels/lt.tar.xz")
+	require.Nil(t, err)
+	require.Equal(t, "application/x-xz", stat.ContentType)
+
+	// A PUT URL can't be used to download.
+	resp, err = http.Get(putURL)
+	require.Nil(t, err)
+	require.Nil(t, resp.Body.Close())
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	getURL, _, err := SignURL(ctx, st, "kernels/lt.tar.xz", http.MethodGet, time.Minute)
+	require.Nil(t, err)
+	resp, err = http.Get(getURL)
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Nil(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []byte("kernel"), body)
+	require.Equal(t, "application/x-xz", resp.Header.Get("Content-Type"))
+}
+
+func TestStorageHandler_Rejected(t *testing.T) {
+	ctx := context.Background()
+	st, serverURL := newSignedStorage(t)
+
+	resp, err := http.Get(serverURL + "/_storage/foo")
+	require.Nil(t, err)
+	require.Nil(t, resp.Body.Close())
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	expiredURL, _, err := SignURL(ctx, st, "foo", http.MethodGet, -time.Minute)
+	require.Nil(t, err)
+	resp, err = http.Get(expiredURL)
+	require.Nil(t, err)
+	require.Nil(t, resp.Body.Close())
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	missingURL, _, err := SignURL(ctx, st, "foo", http.MethodGet, time.Minute)
+	require.Nil(t, err)
+	resp, err = http.Get(missingURL)
+	require.Nil(t, err)
+	require.Nil(t, resp.Body.Close())
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSignURL_Unsupported(t *testing.T) {
+	_, _, err := SignURL(context.Background(), storage_memory.New(memfs.New()), "foo", http.MethodGet, time.Minute)
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestRedirectResponseOption(t *testing.T) {
+	ctx := context.Background()
+	st, _ := newSignedStorage(t)
+
+	_, err := storage.Upload(ctx, st, "kernels/lt.tar.xz", bytes.NewReader([]byte("kernel")))
+	require.Nil(t, err)
+	signed, _, err := SignURL(ctx, st, "kernels/lt.tar.xz", http.MethodGet, time.Minute)
+	require.Nil(t, err)
+
+	// Serve a gateway response with the header RedirectToSignedURL sets.
+	mux := runtime.NewServeMux(DefaultServeMuxOptions()...)
+	err = mux.HandlePath(http.MethodGet, "/v1/kernels/{name}:download", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		md := runtime.ServerMetadata{
+			HeaderMD: metadata.Pairs(redirectHeader, signed),
+		}
+		ctx := runtime.NewServerMetadataContext(r.Context(), md)
+		runtime.ForwardResponseMessage(ctx, mux, &runtime.JSONPb{}, w, r, &emptypb.Empty{}, mux.GetForwardResponseOptions()...)
+	})
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/kernels/lt:download", nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+	require.Equal(t, signed, rec.Header().Get("Location"))
+	require.Empty(t, rec.Header().Values(runtime.MetadataHeaderPrefix+redirectHeader))
+
+	// Following the redirect downloads the object.
+	resp, err := http.Get(rec.Header().Get("Location"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, []byte("kernel"), body)
+}
@@ -484,8 +484,8 @@ def go_dependencies():
     go_repository(
         name = "com_github_fergusstrange_embedded_postgres",
         importpath = "github.com/fergusstrange/embedded-postgres",
-        sum = "h1:ZYRD89nammxQDWDi6taJE2CYjDuAoVc1TpEqRIYQryc=",
-        version = "v1.23.0",
+        sum = "h1:sa+k2Ycrtz40eCRPOzI7Ry7TtkWXXJ+YRsxpKMDhxK0=",
+        version = "v1.25.0",
     )
     go_repository(
         name = "com_github_fogleman_gg",
@@ -2795,6 +2795,12 @@ def go_dependencies():
         version = "v0.12.3",
     )
 
+    go_repository(
+        name = "io_etcd_go_bbolt",
+        importpath = "go.etcd.io/bbolt",
+        sum = "h1:j+zJOnnEjF/kyHlDDgGnVL/AIqIJPq8UoB2GSNfkUfQ=",
+        version = "v1.3.7",
+    )
     go_repository(
         name = "io_etcd_go_etcd_api_v3",
         importpath = "go.etcd.io/etcd/api/v3",
@@ -24,7 +24,7 @@ import (
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/urfave/cli/v2"
 	base "go.resf.org/peridot/base/go"
-	"go.resf.org/peridot/base/go/kv/dynamodb"
+	kv_detector "go.resf.org/peridot/base/go/kv/detector"
 	kernelmanager_rpc "go.resf.org/peridot/tools/kernelmanager/rpc"
 	kernelmanager_ui "go.resf.org/peridot/tools/kernelmanager/ui"
 	"go.temporal.io/sdk/client"
@@ -62,7 +62,7 @@ func setupApi(ctx *cli.Context) (*runtime.ServeMux, error) {
 		return nil, err
 	}
 
-	kv, err := dynamodb.New("http://localhost:4566", "kernelmanager")
+	kv, err := kv_detector.FromFlags(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -119,9 +119,13 @@ func main() {
 			base.WithDatabaseFlags("kernelmanager"),
 			base.WithTemporalFlags("", "kernelmanager_queue"),
 			base.WithFrontendAuthFlags(""),
+			base.WithKVFlags(),
 		),
 	}
 
+	// Default to LocalStack, like the rest of the dev setup.
+	base.RareUseChangeDefault(string(base.EnvVarKVConnectionString), "dynamodb://kernelmanager?endpoint=http://localhost:4566")
+
 	if err := app.Run(os.Args); err != nil {
 		base.LogFatalf("failed to start kernelmanager_dev: %v", err)
 	}
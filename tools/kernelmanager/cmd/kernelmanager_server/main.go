@@ -3,7 +3,7 @@ package main
 import (
 	"github.com/urfave/cli/v2"
 	base "go.resf.org/peridot/base/go"
-	"go.resf.org/peridot/base/go/kv/dynamodb"
+	kv_detector "go.resf.org/peridot/base/go/kv/detector"
 	kernelmanager_rpc "go.resf.org/peridot/tools/kernelmanager/rpc"
 	"go.temporal.io/sdk/client"
 	"os"
@@ -21,7 +21,7 @@ func run(ctx *cli.Context) error {
 		return err
 	}
 
-	kv, err := dynamodb.New(ctx.String("dynamodb-table"))
+	kv, err := kv_detector.FromFlags(ctx)
 	if err != nil {
 		return err
 	}
@@ -48,17 +48,16 @@ func main() {
 			base.WithGrpcFlags(6677),
 			base.WithGatewayFlags(6678),
 			base.WithOidcFlags("", "releng"),
-			[]cli.Flag{
-				&cli.StringFlag{
-					Name:    "dynamodb-table",
-					Usage:   "DynamoDB table name",
-					EnvVars: []string{"DYNAMODB_TABLE"},
-					Value:   "kernelmanager",
-				},
-			},
+			base.WithKVFlags(),
 		),
 	}
 
+	// DYNAMODB_TABLE and DYNAMODB_ENDPOINT were used before kv connection strings.
+	if err := kv_detector.ApplyLegacyEnv("kernelmanager"); err != nil {
+		base.LogFatalf("failed to apply legacy kv environment: %v", err)
+	}
+	base.RareUseChangeDefault(string(base.EnvVarKVConnectionString), "dynamodb://kernelmanager")
+
 	if err := app.Run(os.Args); err != nil {
 		base.LogFatalf("failed to start mship_api: %v", err)
 	}
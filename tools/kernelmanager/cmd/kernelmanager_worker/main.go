@@ -19,7 +19,7 @@ import (
 	"github.com/urfave/cli/v2"
 	base "go.resf.org/peridot/base/go"
 	"go.resf.org/peridot/base/go/forge/gitlab"
-	"go.resf.org/peridot/base/go/kv/dynamodb"
+	kv_detector "go.resf.org/peridot/base/go/kv/detector"
 	storage_detector "go.resf.org/peridot/base/go/storage/detector"
 	kernelmanager_worker "go.resf.org/peridot/tools/kernelmanager/worker"
 	"go.temporal.io/sdk/client"
@@ -33,7 +33,7 @@ func run(ctx *cli.Context) error {
 		return err
 	}
 
-	kv, err := dynamodb.New(ctx.String("dynamodb-endpoint"), ctx.String("dynamodb-table"))
+	kv, err := kv_detector.FromFlags(ctx)
 	if err != nil {
 		return err
 	}
@@ -48,17 +48,26 @@ func run(ctx *cli.Context) error {
 		true,
 	)
 
-	st, err := storage_detector.FromFlags(ctx)
+	st, closeStorage, err := storage_detector.FromFlags(ctx)
 	if err != nil {
 		return err
 	}
+	// Wait for background mirror copies when the worker is interrupted.
+	defer func() {
+		if err := closeStorage(); err != nil {
+			base.LogErrorf("failed to close storage: %v", err)
+		}
+	}()
 
 	w := worker.New(temporalClient, ctx.String("temporal-task-queue"), worker.Options{})
-	workerServer := kernelmanager_worker.New(
+	workerServer, err := kernelmanager_worker.New(
 		kv,
 		gitlabForge,
 		st,
 	)
+	if err != nil {
+		return err
+	}
 
 	// Register workflows
 	w.RegisterWorkflow(kernelmanager_worker.TriggerKernelUpdateWorkflow)
@@ -74,18 +83,8 @@ func main() {
 	flags := base.WithFlags(
 		base.WithTemporalFlags("", "kernelmanager_queue"),
 		base.WithStorageFlags(),
+		base.WithKVFlags(),
 		[]cli.Flag{
-			&cli.StringFlag{
-				Name:    "dynamodb-endpoint",
-				Usage:   "DynamoDB endpoint",
-				EnvVars: []string{"DYNAMODB_ENDPOINT"},
-			},
-			&cli.StringFlag{
-				Name:    "dynamodb-table",
-				Usage:   "DynamoDB table name",
-				EnvVars: []string{"DYNAMODB_TABLE"},
-				Value:   "kernelmanager",
-			},
 			&cli.StringFlag{
 				Name:    "gitlab-host",
 				Usage:   "GitLab host",
@@ -105,6 +104,12 @@ func main() {
 		},
 	)
 
+	// DYNAMODB_TABLE and DYNAMODB_ENDPOINT were used before kv connection strings.
+	if err := kv_detector.ApplyLegacyEnv("kernelmanager"); err != nil {
+		base.LogFatalf("failed to apply legacy kv environment: %v", err)
+	}
+	base.RareUseChangeDefault(string(base.EnvVarKVConnectionString), "dynamodb://kernelmanager")
+
 	app := &cli.App{
 		Name:   "kernelmanager_worker",
 		Action: run,
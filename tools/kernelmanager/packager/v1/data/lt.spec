@@ -1472,7 +1472,7 @@ fi
 %kernel_lt_variant_files %{_use_vdso} %{with_std}
 
 %changelog
-{{range $val := .Changelog}}
-* {{$val.Date}} {{$val.Name}} - {{$val.Version}}-{{$val.BuildID}}
-- {{$val.Text}}
+{{range $val := .Changelog}}* {{if $val.Subject}}{{$val.Subject}}{{else}}{{$val.Date}} {{$val.Name}} - {{$val.Version}}-{{$val.BuildID}}{{end}}
+{{range $text := $val.Messages}}- {{$text}}
+{{end}}
 {{end}}
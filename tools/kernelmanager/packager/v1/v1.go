@@ -183,7 +183,7 @@ func kernel(kernelType string, in *Input) (*packager.Output, error) {
 		suffix = "gz"
 	}
 	tarballName := fmt.Sprintf("linux-%s.tar.%s", in.Version, suffix)
-	metadata := fmt.Sprintf("%s SOURCES/%s", tarballName)
+	metadata := fmt.Sprintf("%s SOURCES/%s", sum, tarballName)
 
 	// Create .[kernelpackage].metadata
 	metadataName := fmt.Sprintf(".%s.metadata", in.KernelPackage)
@@ -272,3 +272,9 @@ func WriteConfigFile(config map[string]string, comments []string) []byte {
 func ML(in *Input) (*packager.Output, error) {
 	return kernel("ml", in)
 }
+
+// LT creates a new kernel package for the LT kernel
+// Returns spec and SOURCE files
+func LT(in *Input) (*packager.Output, error) {
+	return kernel("lt", in)
+}
@@ -7,9 +7,9 @@ import (
 	base "go.resf.org/peridot/base/go"
 	"go.resf.org/peridot/base/go/kv"
 	kernelmanagerpb "go.resf.org/peridot/tools/kernelmanager/pb"
+	kernelmanager_store "go.resf.org/peridot/tools/kernelmanager/store"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/proto"
 	"strings"
 )
 
@@ -22,27 +22,27 @@ func (s *Server) ListKernels(ctx context.Context, req *kernelmanagerpb.ListKerne
 		req.PageSize = 100
 	}
 
-	prefix := fmt.Sprintf("/kernels/entries/")
-	query, err := s.kv.RangePrefix(ctx, prefix, req.PageSize, req.PageToken)
-	if err != nil {
-		base.LogErrorf("failed to get kernels: %v", err)
-		return nil, status.Error(codes.Internal, "failed to get kernels")
-	}
-
 	var kernels []*kernelmanagerpb.Kernel
-	for _, pair := range query.Pairs {
-		kernel := &kernelmanagerpb.Kernel{}
-		err := proto.Unmarshal(pair.Value, kernel)
-		if err != nil {
-			base.LogErrorf("failed to unmarshal kernel: %v", err)
-			return nil, status.Error(codes.Internal, "failed to unmarshal kernel")
-		}
-		kernels = append(kernels, kernel)
+	var nextToken string
+	var err error
+	if req.ScmNamespace != "" {
+		kernels, nextToken, err = s.kernels.Query(
+			ctx,
+			kernelmanager_store.IndexScmNamespace,
+			kernelmanager_store.ScmNamespaceQuery(req.ScmNamespace),
+			req.PageSize,
+			req.PageToken,
+		)
+	} else {
+		kernels, nextToken, err = s.kernels.List(ctx, req.PageSize, req.PageToken)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	return &kernelmanagerpb.ListKernelsResponse{
 		Kernels:       kernels,
-		NextPageToken: query.NextToken,
+		NextPageToken: nextToken,
 	}, nil
 }
 
@@ -51,23 +51,7 @@ func (s *Server) GetKernel(ctx context.Context, req *kernelmanagerpb.GetKernelRe
 		return nil, status.Error(codes.InvalidArgument, "name must be provided")
 	}
 
-	kernelBytes, err := s.kv.Get(ctx, fmt.Sprintf("/kernels/entries/%s", strings.TrimPrefix(req.Name, "kernels/")))
-	if err != nil {
-		if errors.Is(err, kv.ErrNotFound) {
-			return nil, status.Error(codes.NotFound, "kernel not found")
-		}
-		base.LogErrorf("failed to get kernel: %v", err)
-		return nil, status.Error(codes.Internal, "failed to get kernel")
-	}
-
-	kernel := &kernelmanagerpb.Kernel{}
-	err = proto.Unmarshal(kernelBytes.Value, kernel)
-	if err != nil {
-		base.LogErrorf("failed to unmarshal kernel: %v", err)
-		return nil, status.Error(codes.Internal, "failed to unmarshal kernel")
-	}
-
-	return kernel, nil
+	return s.kernels.Get(ctx, strings.TrimPrefix(req.Name, "kernels/"))
 }
 
 func (s *Server) CreateKernel(ctx context.Context, req *kernelmanagerpb.CreateKernelRequest) (*kernelmanagerpb.Kernel, error) {
@@ -81,6 +65,7 @@ func (s *Server) CreateKernel(ctx context.Context, req *kernelmanagerpb.CreateKe
 	}
 
 	// Verify first that the custom name is not already taken
+	// Kernels created before names were reserved only have entries, so check those too
 	prefix := fmt.Sprintf("/kernels/entries/%s/", req.Kernel.Name)
 	query, err := s.kv.RangePrefix(ctx, prefix, 1, "")
 	if err != nil {
@@ -91,20 +76,29 @@ func (s *Server) CreateKernel(ctx context.Context, req *kernelmanagerpb.CreateKe
 		return nil, status.Error(codes.InvalidArgument, "kernel name already taken")
 	}
 
-	name := fmt.Sprintf("%s/%s", req.Kernel.Name, base.NameGen("kernels"))
+	customName := req.Kernel.Name
+	name := fmt.Sprintf("%s/%s", customName, base.NameGen("kernels"))
 	req.Kernel.Name = name
 
-	kernelBytes, err := proto.Marshal(req.Kernel)
+	createOps, err := s.kernels.CreateOps(req.Kernel)
 	if err != nil {
-		base.LogErrorf("failed to marshal kernel: %v", err)
-		return nil, status.Error(codes.Internal, "failed to marshal kernel")
+		return nil, err
 	}
 
-	err = s.kv.Set(ctx, fmt.Sprintf("/kernels/entries/%s", name), kernelBytes)
+	// Reserve the custom name and create the kernel in one transaction,
+	// so concurrent creates with the same name can't both succeed
+	revision, err := s.kv.Txn(
+		ctx,
+		append([]*kv.Op{kv.CreateOp(fmt.Sprintf("/kernels/names/%s", customName), []byte(name))}, createOps...)...,
+	)
 	if err != nil {
+		if errors.Is(err, kv.ErrConflict) {
+			return nil, status.Error(codes.InvalidArgument, "kernel name already taken")
+		}
 		base.LogErrorf("failed to set kernel: %v", err)
 		return nil, status.Error(codes.Internal, "failed to set kernel")
 	}
+	s.kernels.SetEtag(req.Kernel, revision)
 
 	return req.Kernel, nil
 }
@@ -119,27 +113,48 @@ func (s *Server) UpdateKernel(ctx context.Context, req *kernelmanagerpb.UpdateKe
 		return nil, status.Error(codes.InvalidArgument, "kernel must be provided")
 	}
 
-	// Check existing kernel
-	_, err := s.kv.Get(ctx, fmt.Sprintf("/kernels/entries/%s", req.Kernel.Name))
-	if err != nil {
-		if errors.Is(err, kv.ErrNotFound) {
-			return nil, status.Error(codes.NotFound, "kernel not found")
-		}
-		base.LogErrorf("failed to get kernel: %v", err)
-		return nil, status.Error(codes.Internal, "failed to get kernel")
+	// Fails if the kernel doesn't exist, or has been modified in the meantime,
+	// or since the etag was read if the kernel has one
+	return s.kernels.Update(ctx, req.Kernel)
+}
+
+func (s *Server) ListUpdates(ctx context.Context, req *kernelmanagerpb.ListUpdatesRequest) (*kernelmanagerpb.ListUpdatesResponse, error) {
+	// Min page size is 1, max page size is 100.
+	if req.PageSize < 1 {
+		req.PageSize = 20
+	}
+	if req.PageSize > 100 {
+		req.PageSize = 100
 	}
 
-	kernelBytes, err := proto.Marshal(req.Kernel)
+	var updates []*kernelmanagerpb.Update
+	var nextToken string
+	var err error
+	if req.Kernel != "" {
+		updates, nextToken, err = s.updates.Query(
+			ctx,
+			kernelmanager_store.IndexKernelFinished,
+			kernelmanager_store.KernelFinishedQuery(strings.TrimPrefix(req.Kernel, "kernels/")),
+			req.PageSize,
+			req.PageToken,
+		)
+	} else {
+		updates, nextToken, err = s.updates.List(ctx, req.PageSize, req.PageToken)
+	}
 	if err != nil {
-		base.LogErrorf("failed to marshal kernel: %v", err)
-		return nil, status.Error(codes.Internal, "failed to marshal kernel")
+		return nil, err
 	}
 
-	err = s.kv.Set(ctx, fmt.Sprintf("/kernels/entries/%s", req.Kernel.Name), kernelBytes)
-	if err != nil {
-		base.LogErrorf("failed to set kernel: %v", err)
-		return nil, status.Error(codes.Internal, "failed to set kernel")
+	return &kernelmanagerpb.ListUpdatesResponse{
+		Updates:       updates,
+		NextPageToken: nextToken,
+	}, nil
+}
+
+func (s *Server) GetUpdate(ctx context.Context, req *kernelmanagerpb.GetUpdateRequest) (*kernelmanagerpb.Update, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name must be provided")
 	}
 
-	return req.Kernel, nil
+	return s.updates.Get(ctx, req.Name)
 }
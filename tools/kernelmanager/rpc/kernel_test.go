@@ -0,0 +1,161 @@
+package kernelmanager_rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	kv_memory "go.resf.org/peridot/base/go/kv/memory"
+	kernelmanagerpb "go.resf.org/peridot/tools/kernelmanager/pb"
+	kernelmanager_store "go.resf.org/peridot/tools/kernelmanager/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *Server {
+	store, err := kv_memory.New()
+	require.Nil(t, err)
+
+	kernels, err := kernelmanager_store.Kernels(store)
+	require.Nil(t, err)
+	updates, err := kernelmanager_store.Updates(store)
+	require.Nil(t, err)
+
+	return &Server{
+		kv:      store,
+		kernels: kernels,
+		updates: updates,
+	}
+}
+
+func TestUpdateKernel_Etag(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+
+	created, err := s.CreateKernel(ctx, &kernelmanagerpb.CreateKernelRequest{
+		Kernel: &kernelmanagerpb.Kernel{Name: "kernel-lt", Pkg: "kernel-lt"},
+	})
+	require.Nil(t, err)
+	require.NotEmpty(t, created.Etag)
+
+	// Two clients read the same kernel, and both try to update it.
+	first := proto.Clone(created).(*kernelmanagerpb.Kernel)
+	first.Pkg = "kernel-lt-first"
+	second := proto.Clone(created).(*kernelmanagerpb.Kernel)
+	second.Pkg = "kernel-lt-second"
+
+	updated, err := s.UpdateKernel(ctx, &kernelmanagerpb.UpdateKernelRequest{Kernel: first})
+	require.Nil(t, err)
+	require.NotEqual(t, created.Etag, updated.Etag)
+
+	// Both stale updates are rejected, and don't overwrite the first update.
+	_, err = s.UpdateKernel(ctx, &kernelmanagerpb.UpdateKernelRequest{Kernel: second})
+	require.Equal(t, codes.Aborted, status.Code(err), "%v", err)
+	stale := proto.Clone(created).(*kernelmanagerpb.Kernel)
+	stale.Pkg = "kernel-lt-stale"
+	_, err = s.UpdateKernel(ctx, &kernelmanagerpb.UpdateKernelRequest{Kernel: stale})
+	require.Equal(t, codes.Aborted, status.Code(err), "%v", err)
+
+	kernel, err := s.kernels.Get(ctx, created.Name)
+	require.Nil(t, err)
+	require.Equal(t, "kernel-lt-first", kernel.Pkg)
+	require.Equal(t, updated.Etag, kernel.Etag)
+
+	// Updating with the current etag succeeds.
+	second.Etag = kernel.Etag
+	_, err = s.UpdateKernel(ctx, &kernelmanagerpb.UpdateKernelRequest{Kernel: second})
+	require.Nil(t, err)
+
+	// Updates without an etag don't check it.
+	kernel.Etag = ""
+	kernel.Pkg = "kernel-lt"
+	_, err = s.UpdateKernel(ctx, &kernelmanagerpb.UpdateKernelRequest{Kernel: kernel})
+	require.Nil(t, err)
+
+	_, err = s.UpdateKernel(ctx, &kernelmanagerpb.UpdateKernelRequest{Kernel: &kernelmanagerpb.Kernel{Name: created.Name, Etag: "invalid"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "%v", err)
+}
+
+func TestListKernels_ScmNamespace(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+
+	for name, namespace := range map[string]string{
+		"kernel-lt":  "rocky",
+		"kernel-ml":  "rocky",
+		"kernel-sig": "rocky/sig",
+		"kernel-alt": "other",
+	} {
+		_, err := s.CreateKernel(ctx, &kernelmanagerpb.CreateKernelRequest{
+			Kernel: &kernelmanagerpb.Kernel{
+				Name:   name,
+				Pkg:    name,
+				Config: &kernelmanagerpb.Config{ScmNamespace: namespace},
+			},
+		})
+		require.Nil(t, err)
+	}
+
+	// Kernels in nested namespaces are not part of the parent namespace.
+	res, err := s.ListKernels(ctx, &kernelmanagerpb.ListKernelsRequest{ScmNamespace: "rocky", PageSize: 1})
+	require.Nil(t, err)
+	require.Len(t, res.Kernels, 1)
+	require.NotEmpty(t, res.NextPageToken)
+	pkgs := []string{res.Kernels[0].Pkg}
+
+	res, err = s.ListKernels(ctx, &kernelmanagerpb.ListKernelsRequest{ScmNamespace: "rocky", PageSize: 1, PageToken: res.NextPageToken})
+	require.Nil(t, err)
+	require.Len(t, res.Kernels, 1)
+	require.Empty(t, res.NextPageToken)
+	pkgs = append(pkgs, res.Kernels[0].Pkg)
+	require.ElementsMatch(t, []string{"kernel-lt", "kernel-ml"}, pkgs)
+
+	res, err = s.ListKernels(ctx, &kernelmanagerpb.ListKernelsRequest{ScmNamespace: "rocky/sig"})
+	require.Nil(t, err)
+	require.Len(t, res.Kernels, 1)
+	require.Equal(t, "kernel-sig", res.Kernels[0].Pkg)
+
+	res, err = s.ListKernels(ctx, &kernelmanagerpb.ListKernelsRequest{})
+	require.Nil(t, err)
+	require.Len(t, res.Kernels, 4)
+}
+
+func TestListUpdates_Kernel(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+
+	finished := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	for i, kernel := range []string{"lt/kernels/1", "lt/kernels/12", "lt/kernels/1", "lt/kernels/1"} {
+		_, err := s.updates.Create(ctx, &kernelmanagerpb.Update{
+			Name:             fmt.Sprintf("updates/%d", i),
+			Kernel:           &kernelmanagerpb.Kernel{Name: kernel},
+			KernelOrgVersion: fmt.Sprintf("6.1.%d", i),
+			FinishedTime:     timestamppb.New(finished.Add(time.Duration(i) * time.Hour)),
+		})
+		require.Nil(t, err)
+	}
+
+	// Updates of a kernel are listed most recently finished first,
+	// without the updates of kernels whose name starts with the same prefix.
+	res, err := s.ListUpdates(ctx, &kernelmanagerpb.ListUpdatesRequest{Kernel: "kernels/lt/kernels/1"})
+	require.Nil(t, err)
+	var versions []string
+	for _, update := range res.Updates {
+		versions = append(versions, update.KernelOrgVersion)
+	}
+	require.Equal(t, []string{"6.1.3", "6.1.2", "6.1.0"}, versions)
+
+	res, err = s.ListUpdates(ctx, &kernelmanagerpb.ListUpdatesRequest{})
+	require.Nil(t, err)
+	require.Len(t, res.Updates, 4)
+
+	update, err := s.GetUpdate(ctx, &kernelmanagerpb.GetUpdateRequest{Name: "updates/1"})
+	require.Nil(t, err)
+	require.Equal(t, "lt/kernels/12", update.Kernel.Name)
+
+	_, err = s.GetUpdate(ctx, &kernelmanagerpb.GetUpdateRequest{Name: "updates/4"})
+	require.Equal(t, codes.NotFound, status.Code(err), "%v", err)
+}
@@ -1,9 +1,11 @@
 package kernelmanager_rpc
 
 import (
+	"context"
 	base "go.resf.org/peridot/base/go"
 	"go.resf.org/peridot/base/go/kv"
 	kernelmanagerpb "go.resf.org/peridot/tools/kernelmanager/pb"
+	kernelmanager_store "go.resf.org/peridot/tools/kernelmanager/store"
 	"go.temporal.io/sdk/client"
 	"google.golang.org/genproto/googleapis/longrunning"
 	"google.golang.org/grpc"
@@ -17,10 +19,12 @@ type Server struct {
 	kernelmanagerpb.UnimplementedKernelManagerServer
 
 	kv       kv.KV
+	kernels  *kv.Collection[*kernelmanagerpb.Kernel]
+	updates  *kv.Collection[*kernelmanagerpb.Update]
 	temporal client.Client
 }
 
-func NewServer(kv kv.KV, temporalClient client.Client, oidcInterceptorDetails *base.OidcInterceptorDetails, opts ...base.GRPCServerOption) (*Server, error) {
+func NewServer(store kv.KV, temporalClient client.Client, oidcInterceptorDetails *base.OidcInterceptorDetails, opts ...base.GRPCServerOption) (*Server, error) {
 	oidcInterceptor, err := base.OidcGrpcInterceptor(oidcInterceptorDetails)
 	if err != nil {
 		return nil, err
@@ -33,14 +37,31 @@ func NewServer(kv kv.KV, temporalClient client.Client, oidcInterceptorDetails *b
 		return nil, err
 	}
 
+	kernels, err := kernelmanager_store.Kernels(store)
+	if err != nil {
+		return nil, err
+	}
+
+	updates, err := kernelmanager_store.Updates(store)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Server{
 		GRPCServer: *grpcServer,
-		kv:         kv,
+		kv:         store,
+		kernels:    kernels,
+		updates:    updates,
 		temporal:   temporalClient,
 	}, nil
 }
 
 func (s *Server) Start() error {
+	// Index kernels created before the SCM namespace index was added
+	if err := s.kernels.Reindex(context.Background(), kernelmanager_store.IndexScmNamespace); err != nil {
+		return err
+	}
+
 	s.RegisterService(func(server *grpc.Server) {
 		reflection.Register(server)
 		longrunning.RegisterOperationsServer(server, s)
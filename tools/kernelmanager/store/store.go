@@ -0,0 +1,78 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kernelmanager_store declares the kernel manager collections, so the
+// server and the worker maintain the same indexes.
+package kernelmanager_store
+
+import (
+	"fmt"
+	"go.resf.org/peridot/base/go/kv"
+	kernelmanagerpb "go.resf.org/peridot/tools/kernelmanager/pb"
+	"math"
+	"net/url"
+)
+
+const (
+	// IndexScmNamespace indexes kernels by the SCM namespace they are stored in.
+	IndexScmNamespace = "scm_namespace"
+
+	// IndexKernelFinished indexes updates by kernel, most recently finished first.
+	IndexKernelFinished = "kernel_finished"
+)
+
+// Kernels returns the kernel collection.
+func Kernels(store kv.KV) (*kv.Collection[*kernelmanagerpb.Kernel], error) {
+	return kv.NewCollection[*kernelmanagerpb.Kernel](
+		store,
+		"/kernels/entries/",
+		kv.WithIndex(IndexScmNamespace, func(kernel *kernelmanagerpb.Kernel) []string {
+			return []string{escape(kernel.GetConfig().GetScmNamespace())}
+		}),
+	)
+}
+
+// Updates returns the update collection.
+func Updates(store kv.KV) (*kv.Collection[*kernelmanagerpb.Update], error) {
+	return kv.NewCollection[*kernelmanagerpb.Update](
+		store,
+		"/kernels/updates/",
+		kv.WithIndex(IndexKernelFinished, func(update *kernelmanagerpb.Update) []string {
+			kernel := update.GetKernel().GetName()
+			if kernel == "" {
+				return nil
+			}
+
+			// Invert the finish time, so the most recent update is listed first
+			finished := update.GetFinishedTime().AsTime().UnixNano()
+			return []string{fmt.Sprintf("%s/%019d", escape(kernel), math.MaxInt64-finished)}
+		}),
+	)
+}
+
+// ScmNamespaceQuery returns the IndexScmNamespace prefix matching kernels in a namespace.
+func ScmNamespaceQuery(namespace string) string {
+	return escape(namespace) + "/"
+}
+
+// KernelFinishedQuery returns the IndexKernelFinished prefix matching updates of a kernel.
+func KernelFinishedQuery(kernel string) string {
+	return escape(kernel) + "/"
+}
+
+// escape escapes slashes in index values, so a prefix query for "a" doesn't
+// match the value "a/b".
+func escape(value string) string {
+	return url.PathEscape(value)
+}
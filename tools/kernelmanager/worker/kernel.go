@@ -1,6 +1,7 @@
 package kernelmanager_worker
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/go-git/go-billy/v5/memfs"
@@ -10,35 +11,32 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/pkg/errors"
-	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/storage"
 	"go.resf.org/peridot/tools/kernelmanager/packager"
-	"go.resf.org/peridot/tools/kernelmanager/packager/kernelorg"
 	repack_v1 "go.resf.org/peridot/tools/kernelmanager/packager/v1"
 	kernelmanagerpb "go.resf.org/peridot/tools/kernelmanager/pb"
 	"golang.org/x/crypto/openpgp"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"os"
 	"strings"
 	"time"
 )
 
 func (w *Worker) GetKernel(ctx context.Context, name string) (*kernelmanagerpb.Kernel, error) {
-	kernelBytes, err := w.kv.Get(ctx, fmt.Sprintf("/kernels/entries/%s", name))
-	if err != nil {
-		base.LogErrorf("failed to get kernel: %v", err)
-		return nil, status.Error(codes.Internal, "failed to get kernel")
-	}
+	return w.kernels.Get(ctx, name)
+}
 
-	kernel := &kernelmanagerpb.Kernel{}
-	err = proto.Unmarshal(kernelBytes.Value, kernel)
-	if err != nil {
-		base.LogErrorf("failed to unmarshal kernel: %v", err)
-		return nil, status.Error(codes.Internal, "failed to unmarshal kernel")
+// CreateUpdate stores a finished update.
+// Retries of the activity store the same update, so an existing update is not an error.
+func (w *Worker) CreateUpdate(ctx context.Context, update *kernelmanagerpb.Update) error {
+	_, err := w.updates.Create(ctx, update)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
 	}
 
-	return kernel, nil
+	return err
 }
 
 func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kernel) (*kernelmanagerpb.Update, error) {
@@ -106,7 +104,7 @@ func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kerne
 	//     })
 	// }
 
-	var output *kernel_repack.Output
+	var output *packager.Output
 	var entity *openpgp.Entity
 	var version string
 
@@ -117,18 +115,23 @@ func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kerne
 		msg := fmt.Sprintf("Rebase to %s", version)
 		return []*repack_v1.ChangelogEntry{
 			{
-				Date:    time.Now().Format("Mon Jan 02 2006"),
-				Name:    "Mustafa Gezen",
-				Version: version,
-				BuildID: buildID,
-				Text:    msg,
+				Date:     time.Now().Format("Mon Jan 02 2006"),
+				Name:     "Mustafa Gezen",
+				Version:  version,
+				BuildID:  buildID,
+				Messages: []string{msg},
 			},
 		}
 	}
 
+	additionalConfig, err := additionalKernelConfig(kernel.Config.RepackOptions.AdditionalKernelConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	switch kernel.Config.RepackOptions.KernelOrgVariant {
 	case kernelmanagerpb.RepackOptions_MAINLINE:
-		mlVersion, mlTarball, _, err := kernelorg.GetLatestStable()
+		mlVersion, mlTarball, _, err := w.kernelOrg.GetLatestStable()
 		if err != nil {
 			return nil, err
 		}
@@ -140,7 +143,7 @@ func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kerne
 			KernelPackage:          kernel.Pkg,
 			Tarball:                mlTarball,
 			Changelog:              changelog(mlVersion),
-			AdditionalKernelConfig: kernel.Config.RepackOptions.AdditionalKernelConfig,
+			AdditionalKernelConfig: additionalConfig,
 		})
 		if err != nil {
 			return nil, err
@@ -152,7 +155,7 @@ func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kerne
 		if !strings.HasSuffix(repackVersion, ".") {
 			repackVersion = repackVersion + "."
 		}
-		ltVersion, ltTarball, ltEntity, err := kernelorg.GetLatestLT(repackVersion)
+		ltVersion, ltTarball, ltEntity, err := w.kernelOrg.GetLatestLT(repackVersion)
 		if err != nil {
 			return nil, err
 		}
@@ -164,7 +167,7 @@ func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kerne
 			KernelPackage:          kernel.Pkg,
 			Tarball:                ltTarball,
 			Changelog:              changelog(ltVersion),
-			AdditionalKernelConfig: kernel.Config.RepackOptions.AdditionalKernelConfig,
+			AdditionalKernelConfig: additionalConfig,
 		})
 		if err != nil {
 			return nil, err
@@ -172,9 +175,17 @@ func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kerne
 
 		output = out
 		entity = ltEntity
+	default:
+		return nil, errors.Errorf("unsupported kernel.org variant %s", kernel.Config.RepackOptions.KernelOrgVariant)
 	}
 
-	// Upload tarball to S3
+	// Upload the tarball before pushing the metadata referencing it.
+	// A failed upload can leave a truncated tarball behind, so it is always uploaded
+	// again instead of skipping existing objects.
+	_, err = storage.Upload(ctx, w.storage, output.TarballSha256, bytes.NewReader(output.Tarball), storage.WithSHA256(output.TarballSha256))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to upload tarball")
+	}
 
 	// Check out each branch, delete all files in SOURCES, then extract to FS.
 	for _, branch := range kernel.Config.ScmBranches {
@@ -190,9 +201,9 @@ func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kerne
 			}
 		}
 
-		// Delete all files in SOURCES
+		// Delete all files in SOURCES, new repositories have none
 		files, err := fs.ReadDir("SOURCES")
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			return nil, errors.Wrap(err, "failed to read SOURCES directory")
 		}
 
@@ -253,3 +264,22 @@ func (w *Worker) KernelRepack(ctx context.Context, kernel *kernelmanagerpb.Kerne
 
 	return update, nil
 }
+
+// additionalKernelConfig converts "CONFIG_X=y" lines to config entries for all architectures.
+func additionalKernelConfig(lines []string) ([]*repack_v1.KernelConfig, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	config, _, err := repack_v1.ParseConfigFile([]byte(strings.Join(lines, "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	return []*repack_v1.KernelConfig{
+		{
+			Arch: "all",
+			Map:  config,
+		},
+	}, nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kernelmanager_worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/require"
+	"go.resf.org/peridot/base/go/forge"
+	kv_fake "go.resf.org/peridot/base/go/kv/fake"
+	storage_fake "go.resf.org/peridot/base/go/storage/fake"
+	kernelmanagerpb "go.resf.org/peridot/tools/kernelmanager/pb"
+	kernelmanager_store "go.resf.org/peridot/tools/kernelmanager/store"
+	"golang.org/x/crypto/openpgp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// testForge is a forge whose repositories can't be created until ensureErr is cleared.
+// Repositories are pushed to remote, a local bare repository, if set.
+type testForge struct {
+	forge.Forge
+
+	remote      string
+	ensureErr   error
+	ensureCalls int
+}
+
+func (t *testForge) WithNamespace(string) forge.Forge {
+	return t
+}
+
+func (t *testForge) GetRemote(repo string) string {
+	if t.remote != "" {
+		return t.remote
+	}
+	return "https://git.example.com/" + repo
+}
+
+func (t *testForge) GetAuthenticator() (*forge.Authenticator, error) {
+	return &forge.Authenticator{
+		AuthorName:  "test",
+		AuthorEmail: "test@resf.org",
+	}, nil
+}
+
+func (t *testForge) EnsureRepositoryExists(*forge.Authenticator, string) error {
+	t.ensureCalls++
+	return t.ensureErr
+}
+
+func newWorker(t *testing.T, f forge.Forge) (*Worker, *kv_fake.Fake, *storage_fake.Fake) {
+	store, err := kv_fake.New()
+	require.Nil(t, err)
+	st := storage_fake.New()
+
+	w, err := New(store, f, st)
+	require.Nil(t, err)
+	w.kernelOrg = &testKernelOrg{tarball: testTarball}
+
+	return w, store, st
+}
+
+var testTarball = []byte("linux-6.1.50 tarball")
+
+// testKernelOrg serves a single tarball as the latest release, so repacks run offline.
+type testKernelOrg struct {
+	tarball []byte
+}
+
+func (k *testKernelOrg) GetLatestStable() (string, []byte, *openpgp.Entity, error) {
+	return "6.5.1", k.tarball, nil, nil
+}
+
+func (k *testKernelOrg) GetLatestLT(prefix string) (string, []byte, *openpgp.Entity, error) {
+	return prefix + "50", k.tarball, nil, nil
+}
+
+// newRemote returns the path of a bare repository repacks can be pushed to.
+func newRemote(t *testing.T) string {
+	dir := t.TempDir()
+	_, err := git.PlainInit(dir, true)
+	require.Nil(t, err)
+
+	return dir
+}
+
+// remoteCommits returns the number of commits on a branch of the remote, 0 if it doesn't exist.
+func remoteCommits(t *testing.T, remote string, branch string) int {
+	repo, err := git.PlainOpen(remote)
+	require.Nil(t, err)
+
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return 0
+	}
+	require.Nil(t, err)
+
+	commits, err := repo.Log(&git.LogOptions{From: ref.Hash()})
+	require.Nil(t, err)
+	count := 0
+	require.Nil(t, commits.ForEach(func(*object.Commit) error {
+		count++
+		return nil
+	}))
+
+	return count
+}
+
+func tarballObject() string {
+	sum := sha256.Sum256(testTarball)
+	return hex.EncodeToString(sum[:])
+}
+
+func testKernel() *kernelmanagerpb.Kernel {
+	return &kernelmanagerpb.Kernel{
+		Name: "lt",
+		Pkg:  "kernel-lt",
+		Config: &kernelmanagerpb.Config{
+			RepackOptions: &kernelmanagerpb.RepackOptions{
+				KernelOrgVariant: kernelmanagerpb.RepackOptions_LONGTERM,
+				KernelOrgVersion: "6.1",
+			},
+			ScmNamespace: "kernels",
+			ScmBranches:  []string{"r9"},
+		},
+	}
+}
+
+// A repack that can't reach the forge aborts before writing anything,
+// so a retried activity starts from a clean state.
+func TestKernelRepack_AbortsOnForgeError(t *testing.T) {
+	ctx := context.Background()
+	unavailable := errors.New("forge unavailable")
+	f := &testForge{ensureErr: unavailable}
+	w, store, st := newWorker(t, f)
+
+	_, err := w.KernelRepack(ctx, testKernel())
+	require.ErrorIs(t, err, unavailable)
+	require.Equal(t, 1, f.ensureCalls)
+	require.Empty(t, store.Calls())
+	require.Empty(t, st.Calls())
+}
+
+// GetKernel runs before KernelRepack in TriggerKernelUpdateWorkflow.
+// Transient kv errors fail the attempt so the activity is retried,
+// while a missing kernel is reported as NotFound, which aborts the workflow.
+func TestGetKernel_RetryAndAbort(t *testing.T) {
+	ctx := context.Background()
+	w, store, _ := newWorker(t, &testForge{})
+
+	_, err := w.kernels.Create(ctx, testKernel())
+	require.Nil(t, err)
+
+	store.Inject("Get", kv_fake.WithError(errors.New("connection reset")), kv_fake.WithTimes(1))
+	_, err = w.GetKernel(ctx, "lt")
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	kernel, err := w.GetKernel(ctx, "lt")
+	require.Nil(t, err)
+	require.Equal(t, "kernel-lt", kernel.Pkg)
+	require.Equal(t, 2, store.CallCount("Get"))
+
+	store.Inject("Get", kv_fake.WithNotFound())
+	_, err = w.GetKernel(ctx, "lt")
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// A tarball upload that breaks midway fails the repack before anything is pushed,
+// and the retried activity replaces the truncated tarball.
+func TestKernelRepack_PartialUpload(t *testing.T) {
+	ctx := context.Background()
+	f := &testForge{remote: newRemote(t)}
+	w, _, st := newWorker(t, f)
+
+	fault := st.Inject("Create", storage_fake.WithPartialWrite(5), storage_fake.WithTimes(1))
+	_, err := w.KernelRepack(ctx, testKernel())
+	require.NotNil(t, err)
+	require.Equal(t, 1, st.Triggered(fault))
+	require.Equal(t, 0, remoteCommits(t, f.remote, "r9"))
+
+	truncated, err := st.Get(tarballObject())
+	require.Nil(t, err)
+	require.Equal(t, testTarball[:5], truncated)
+
+	update, err := w.KernelRepack(ctx, testKernel())
+	require.Nil(t, err)
+	require.Equal(t, "6.1.50", update.KernelOrgVersion)
+	require.Equal(t, tarballObject(), update.KernelOrgTarballSha256)
+	require.Equal(t, 1, remoteCommits(t, f.remote, "r9"))
+
+	tarball, err := st.Get(tarballObject())
+	require.Nil(t, err)
+	require.Equal(t, testTarball, tarball)
+}
+
+// Once storage starts failing, repacks abort without pushing, and keep the tarball
+// uploaded by earlier repacks.
+func TestKernelRepack_StorageErrorsAfterCalls(t *testing.T) {
+	ctx := context.Background()
+	f := &testForge{remote: newRemote(t)}
+	w, _, st := newWorker(t, f)
+
+	unavailable := errors.New("storage unavailable")
+	st.Inject("Create", storage_fake.WithAfter(1), storage_fake.WithError(unavailable))
+
+	_, err := w.KernelRepack(ctx, testKernel())
+	require.Nil(t, err)
+	require.Equal(t, 1, remoteCommits(t, f.remote, "r9"))
+
+	_, err = w.KernelRepack(ctx, testKernel())
+	require.ErrorIs(t, err, unavailable)
+	require.Equal(t, 1, remoteCommits(t, f.remote, "r9"))
+	require.Equal(t, 2, st.CallCount("Create"))
+
+	tarball, err := st.Get(tarballObject())
+	require.Nil(t, err)
+	require.Equal(t, testTarball, tarball)
+}
+
+// CreateUpdate runs as its own activity, so a write that succeeded but reported
+// an error is retried with the same update, which must not fail the workflow.
+func TestCreateUpdate_RetryAfterApplied(t *testing.T) {
+	ctx := context.Background()
+	w, store, _ := newWorker(t, &testForge{})
+
+	kernel := testKernel()
+	kernel.Name = "lt/kernels/1"
+	update := &kernelmanagerpb.Update{Name: "updates/run", Kernel: kernel, KernelOrgVersion: "6.1.50"}
+
+	store.Inject("Txn", kv_fake.WithError(errors.New("connection reset")), kv_fake.WithApplied(), kv_fake.WithTimes(1))
+	require.NotNil(t, w.CreateUpdate(ctx, update))
+	require.Nil(t, w.CreateUpdate(ctx, update))
+
+	updates, _, err := w.updates.Query(ctx, kernelmanager_store.IndexKernelFinished, kernelmanager_store.KernelFinishedQuery(kernel.Name), 10, "")
+	require.Nil(t, err)
+	require.Len(t, updates, 1)
+	require.Equal(t, "6.1.50", updates[0].KernelOrgVersion)
+}
@@ -18,18 +18,56 @@ import (
 	"go.resf.org/peridot/base/go/forge"
 	"go.resf.org/peridot/base/go/kv"
 	"go.resf.org/peridot/base/go/storage"
+	"go.resf.org/peridot/tools/kernelmanager/packager/kernelorg"
+	kernelmanagerpb "go.resf.org/peridot/tools/kernelmanager/pb"
+	kernelmanager_store "go.resf.org/peridot/tools/kernelmanager/store"
+	"golang.org/x/crypto/openpgp"
 )
 
 type Worker struct {
 	kv      kv.KV
+	kernels *kv.Collection[*kernelmanagerpb.Kernel]
+	updates *kv.Collection[*kernelmanagerpb.Update]
 	forge   forge.Forge
 	storage storage.Storage
+	// kernelOrg fetches releases from kernel.org, tests replace it to run offline.
+	kernelOrg kernelOrg
 }
 
-func New(kv kv.KV, forge forge.Forge, st storage.Storage) *Worker {
-	return &Worker{
-		kv:      kv,
-		forge:   forge,
-		storage: st,
+// kernelOrg fetches the latest releases and their signing keys from kernel.org.
+type kernelOrg interface {
+	GetLatestStable() (string, []byte, *openpgp.Entity, error)
+	GetLatestLT(prefix string) (string, []byte, *openpgp.Entity, error)
+}
+
+// kernelOrgReleases fetches releases with the kernelorg package.
+type kernelOrgReleases struct{}
+
+func (kernelOrgReleases) GetLatestStable() (string, []byte, *openpgp.Entity, error) {
+	return kernelorg.GetLatestStable()
+}
+
+func (kernelOrgReleases) GetLatestLT(prefix string) (string, []byte, *openpgp.Entity, error) {
+	return kernelorg.GetLatestLT(prefix)
+}
+
+func New(store kv.KV, forge forge.Forge, st storage.Storage) (*Worker, error) {
+	kernels, err := kernelmanager_store.Kernels(store)
+	if err != nil {
+		return nil, err
+	}
+
+	updates, err := kernelmanager_store.Updates(store)
+	if err != nil {
+		return nil, err
 	}
+
+	return &Worker{
+		kv:        store,
+		kernels:   kernels,
+		updates:   updates,
+		forge:     forge,
+		storage:   st,
+		kernelOrg: kernelOrgReleases{},
+	}, nil
 }
@@ -51,6 +51,16 @@ func TriggerKernelUpdateWorkflow(ctx workflow.Context, req *kernelmanagerpb.Trig
 	// Set the start time
 	update.StartedTime = timestamppb.New(startTime)
 
+	// Store the update, named after the run so retries don't store it twice
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: 25 * time.Second,
+	})
+	update.Name = "updates/" + workflow.GetInfo(ctx).WorkflowExecution.RunID
+	err = workflow.ExecuteActivity(ctx, w.CreateUpdate, &update).Get(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	return &kernelmanagerpb.TriggerKernelUpdateResponse{
 		Update: &update,
 	}, nil
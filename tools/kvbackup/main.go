@@ -0,0 +1,164 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main implements kvbackup, which exports kv data to storage and imports it back.
+// The kv backend and storage are configured with the same flags as the services, so
+// to copy data between backends, export with one kv connection string and import with another.
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli/v2"
+	base "go.resf.org/peridot/base/go"
+	"go.resf.org/peridot/base/go/kv/backup"
+	kv_detector "go.resf.org/peridot/base/go/kv/detector"
+	storage_detector "go.resf.org/peridot/base/go/storage/detector"
+	"os"
+)
+
+func export(ctx *cli.Context) error {
+	store, err := kv_detector.FromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	st, closeStorage, err := storage_detector.FromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := closeStorage(); err != nil {
+			base.LogErrorf("failed to close storage: %v", err)
+		}
+	}()
+
+	m, err := backup.Export(
+		ctx.Context,
+		store,
+		st,
+		ctx.String("prefix"),
+		ctx.String("name"),
+		backup.WithFormat(backup.Format(ctx.String("format"))),
+		backup.WithPartSize(ctx.Int("part-size")),
+	)
+	if err != nil {
+		return err
+	}
+
+	base.LogInfof("exported %d pairs in %d parts to %s", m.Pairs(), len(m.Parts), ctx.String("name"))
+	return nil
+}
+
+func restore(ctx *cli.Context) error {
+	var mode backup.ImportMode
+	switch ctx.String("mode") {
+	case "overwrite":
+		mode = backup.ImportOverwrite
+	case "skip-existing":
+		mode = backup.ImportSkipExisting
+	default:
+		return fmt.Errorf("unknown import mode: %s", ctx.String("mode"))
+	}
+
+	store, err := kv_detector.FromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	st, closeStorage, err := storage_detector.FromFlags(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := closeStorage(); err != nil {
+			base.LogErrorf("failed to close storage: %v", err)
+		}
+	}()
+
+	stats, err := backup.Import(
+		ctx.Context,
+		store,
+		st,
+		ctx.String("name"),
+		backup.WithMode(mode),
+		backup.WithFromPart(ctx.Int("from-part")),
+	)
+	if err != nil {
+		return err
+	}
+
+	base.LogInfof("imported %d parts: %d written, %d skipped, %d expired", stats.Parts, stats.Written, stats.Skipped, stats.Expired)
+	return nil
+}
+
+func main() {
+	nameFlag := &cli.StringFlag{
+		Name:     "name",
+		Usage:    "name of the backup, all objects are stored under this prefix",
+		Required: true,
+	}
+
+	app := &cli.App{
+		Name:  "kvbackup",
+		Usage: "export and import kv data",
+		Flags: base.WithFlags(
+			base.WithKVFlags(),
+			base.WithStorageFlags(),
+		),
+		Commands: []*cli.Command{
+			{
+				Name:   "export",
+				Usage:  "export every pair under a prefix, resumes an interrupted export with the same name",
+				Action: export,
+				Flags: []cli.Flag{
+					nameFlag,
+					&cli.StringFlag{
+						Name:     "prefix",
+						Usage:    "prefix to export, for example /kernels/",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "backup format (jsonl or proto)",
+						Value: string(backup.FormatJSONL),
+					},
+					&cli.IntFlag{
+						Name:  "part-size",
+						Usage: "number of pairs per part",
+						Value: 10000,
+					},
+				},
+			},
+			{
+				Name:   "import",
+				Usage:  "import a backup",
+				Action: restore,
+				Flags: []cli.Flag{
+					nameFlag,
+					&cli.StringFlag{
+						Name:  "mode",
+						Usage: "what to do with existing keys (overwrite or skip-existing)",
+						Value: "overwrite",
+					},
+					&cli.IntFlag{
+						Name:  "from-part",
+						Usage: "index of the first part to import, to resume an interrupted import",
+					},
+				},
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		base.LogFatalf("failed to run kvbackup: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Peridot Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main implements storagerepair, which copies objects that are missing or different
+// in a mirror of the storage. Also used to backfill a new mirror.
+// The source is configured with the storage flags, and the destination with --to.
+package main
+
+import (
+	"github.com/urfave/cli/v2"
+	base "go.resf.org/peridot/base/go"
+	storage_detector "go.resf.org/peridot/base/go/storage/detector"
+	storage_mirror "go.resf.org/peridot/base/go/storage/mirror"
+	"os"
+)
+
+func repair(ctx *cli.Context) error {
+	src, err := storage_detector.FromConnectionString(ctx, ctx.String("storage-connection-string"))
+	if err != nil {
+		return err
+	}
+	dst, err := storage_detector.FromConnectionString(ctx, ctx.String("to"))
+	if err != nil {
+		return err
+	}
+
+	var opts []storage_mirror.RepairOption
+	if ctx.Bool("dry-run") {
+		opts = append(opts, storage_mirror.WithDryRun())
+	}
+	if ctx.Bool("prune") {
+		opts = append(opts, storage_mirror.WithPrune())
+	}
+
+	stats, err := storage_mirror.Repair(ctx.Context, src, dst, ctx.String("prefix"), opts...)
+	if err != nil {
+		return err
+	}
+
+	base.LogInfof("checked %d objects: %d copied, %d pruned, %d failed", stats.Checked, stats.Copied, stats.Pruned, stats.Failed)
+	if stats.Failed > 0 {
+		return cli.Exit("some objects could not be repaired", 1)
+	}
+	return nil
+}
+
+func main() {
+	app := &cli.App{
+		Name:   "storagerepair",
+		Usage:  "copy objects that are missing or different in a storage mirror",
+		Action: repair,
+		Flags: base.WithFlags(
+			base.WithStorageFlags(),
+			[]cli.Flag{
+				&cli.StringFlag{
+					Name:     "to",
+					Usage:    "connection string of the mirror to repair",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "prefix",
+					Usage: "only repair objects starting with this prefix",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only log what would be copied or deleted",
+				},
+				&cli.BoolFlag{
+					Name:  "prune",
+					Usage: "also delete objects from the mirror that don't exist in the source",
+				},
+			},
+		),
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		base.LogFatalf("failed to run storagerepair: %v", err)
+	}
+}